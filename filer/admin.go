@@ -0,0 +1,186 @@
+/*
+ * Admin API
+ * Served on a separate listener (adminListenPort) and protected by a bearer
+ * token (adminToken) and/or an OpenID Connect login, see oidc.go. Never
+ * expose it to the public internet.
+ */
+
+package filer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThomasLeister/prosody-filer/internal/httpserver"
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Builds the handler for all admin API endpoints
+ */
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quarantine", s.handleAdminQuarantine)
+	mux.HandleFunc("/quarantine/", s.handleAdminQuarantine)
+	mux.HandleFunc("/metrics", handleAdminMetrics)
+	mux.HandleFunc("/slot", s.handleAdminSlot)
+	mux.HandleFunc("/events", s.handleAdminEvents)
+	mux.HandleFunc("/readonly", s.handleAdminReadOnly)
+	mux.HandleFunc("/maintenance", s.handleAdminMaintenance)
+	mux.HandleFunc("/short", s.handleAdminShortURL)
+	mux.HandleFunc("/journal", s.handleAdminJournal)
+	mux.HandleFunc("/usage", s.handleAdminUsage)
+	mux.HandleFunc("/uploads", s.handleAdminUploads)
+	mux.HandleFunc("/status", s.handleAdminStatus)
+	mux.HandleFunc("/bans", s.handleAdminBans)
+
+	login := http.NewServeMux()
+	if s.conf.OidcIssuer != "" {
+		login.HandleFunc("/oidc/login", s.handleOIDCLogin)
+		login.HandleFunc("/oidc/callback", s.handleOIDCCallback)
+		login.HandleFunc("/oidc/logout", s.handleOIDCLogout)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.conf.OidcIssuer != "" && strings.HasPrefix(r.URL.Path, "/oidc/") {
+			login.ServeHTTP(w, r)
+			return
+		}
+
+		// slotToken only grants access to slot requests
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !tokenMatches(token, s.conf.AdminToken) && !(r.URL.Path == "/slot" && tokenMatches(token, s.conf.SlotToken)) && s.adminSessionUser(r) == "" {
+			// Send browsers to the login page
+			if s.conf.OidcIssuer != "" && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/oidc/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			log.Warn("Admin API request with invalid token from ", r.RemoteAddr)
+			httpError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func tokenMatches(token string, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+/*
+ * Starts the admin API listener
+ */
+func (s *Server) serveAdmin() error {
+	listener, err := httpserver.Listen(s.conf.AdminListenPort, s.conf.AdminUnixSocket)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Admin API listening on %s\n", s.conf.AdminListenPort)
+	return http.Serve(listener, s.adminHandler())
+}
+
+/*
+ * Writes v as JSON response
+ */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("Failed to write JSON response: ", err)
+	}
+}
+
+/*
+ * Quarantine endpoints:
+ *   GET    /quarantine              List quarantined files
+ *   GET    /quarantine/<id>         Show metadata of a quarantined file
+ *   GET    /quarantine/<id>/file    Download a quarantined file for review
+ *   POST   /quarantine/<id>/release Make a quarantined file downloadable
+ *   DELETE /quarantine/<id>         Delete a quarantined file
+ */
+func (s *Server) handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/quarantine"), "/")
+
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+
+		items, err := s.listQuarantine()
+		if err != nil {
+			log.Error("Failed to list quarantine: ", err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		}
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	parts := strings.SplitN(rest, "/", 2)
+	id := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	if !isQuarantineID(id) {
+		httpError(w, http.StatusNotFound, "")
+		return
+	}
+
+	item, err := s.getQuarantineItem(id)
+	if os.IsNotExist(err) {
+		httpError(w, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		log.Error("Failed to read quarantine entry ", id, ": ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, item)
+	case action == "" && r.Method == http.MethodDelete:
+		if err := s.purgeQuarantined(id); err != nil {
+			log.Error("Failed to purge quarantined file ", id, ": ", err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "file" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", item.displayName()))
+		storedFile, err := s.openStoredFile(filepath.Join(s.quarantineDir(id), "file"))
+		if err != nil {
+			log.Error("Failed to open quarantined file ", id, ": ", err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		}
+		defer storedFile.Close()
+		http.ServeContent(w, r, "", storedFile.modTime, storedFile)
+	case action == "release" && r.Method == http.MethodPost:
+		err := s.releaseQuarantined(id)
+		if err == storage.ErrExists {
+			httpError(w, http.StatusConflict, "")
+			return
+		} else if err != nil {
+			log.Error("Failed to release quarantined file ", id, ": ", err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" || action == "file" || action == "release":
+		httpError(w, http.StatusMethodNotAllowed, "")
+	default:
+		httpError(w, http.StatusNotFound, "")
+	}
+}
@@ -0,0 +1,414 @@
+/*
+ * "export" and "import" commands: backups and server moves as tar archives
+ *
+ *   prosody-filer export -since 2024-01-01 -out backup.tar.zst
+ *   prosody-filer import backup.tar.zst
+ *
+ * Archives start with manifest.json, the metadata of all exported files,
+ * followed by the files as "files/<path>". Files are exported as uploaded,
+ * i.e. decompressed and decrypted, and stored as configured on import, so
+ * archives can move files between servers with other keys. Archives are
+ * compressed with zstd or gzip if the name ends in ".zst" or ".gz".
+ * Imports skip files which exist already, short URLs are not exported.
+ */
+
+package filer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+const archiveManifestName = "manifest.json"
+
+/*
+ * First entry of an archive
+ */
+type archiveManifest struct {
+	Version  int            `json:"version"`
+	Exported time.Time      `json:"exported"`
+	Files    []fileMetadata `json:"files"`
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	since := flags.String("since", "", "Only export files uploaded since this date, e.g. \"2024-01-01\" or \"2024-01-01T12:00:00Z\".")
+	out := flags.String("out", "", "Archive to write, e.g. \"backup.tar.zst\", or \"-\" for standard output.")
+	flags.Parse(args)
+
+	if *out == "" {
+		return errors.New("-out is required")
+	} else if *out == "-" {
+		// Keep log messages out of the archive
+		log.Out = os.Stderr
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		var err error
+		if sinceTime, err = parseSince(*since); err != nil {
+			return err
+		}
+	}
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+
+	var dst io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dst = file
+	}
+
+	var compressor io.WriteCloser = nopWriteCloser{dst}
+	switch {
+	case strings.HasSuffix(*out, ".zst") || strings.HasSuffix(*out, ".tzst"):
+		if compressor, err = zstd.NewWriter(dst); err != nil {
+			return err
+		}
+	case strings.HasSuffix(*out, ".gz") || strings.HasSuffix(*out, ".tgz"):
+		compressor = gzip.NewWriter(dst)
+	}
+
+	result, err := s.exportArchive(compressor, sinceTime)
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	if file, ok := dst.(*os.File); ok && file != os.Stdout && err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		if *out != "-" {
+			os.Remove(*out)
+		}
+		return fmt.Errorf("export failed: %s", err)
+	}
+	log.Infof("Exported %d files (%s), %d failed", result.Copied, formatSize(result.Bytes), result.Failed)
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: prosody-filer import [options] <archive>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the archive to import is required, or \"-\" for standard input")
+	}
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if s.conf.ReadOnly {
+		return errors.New("cannot import files in read-only mode")
+	}
+
+	var src io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		src = file
+	}
+
+	result, err := s.importArchive(src)
+	log.Infof("Imported %d files (%s), %d existed already, %d failed", result.Copied, formatSize(result.Bytes), result.Skipped, result.Failed)
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("failed to import %d files, run the command again to retry them", result.Failed)
+	}
+	return err
+}
+
+/*
+ * Parses a date, or a time in RFC 3339 format
+ */
+func parseSince(value string) (time.Time, error) {
+	if since, err := time.Parse("2006-01-02", value); err == nil {
+		return since, nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return since, fmt.Errorf("invalid date %q: must be like \"2024-01-01\" or \"2024-01-01T12:00:00Z\"", value)
+	}
+	return since, nil
+}
+
+/*
+ * Writes a tar archive of the files uploaded since the given time which
+ * have not expired, with their metadata
+ */
+func (s *Server) exportArchive(dst io.Writer, since time.Time) (migrationResult, error) {
+	var result migrationResult
+
+	manifest := archiveManifest{Version: 1, Exported: time.Now().UTC(), Files: []fileMetadata{}}
+	err := filepath.Walk(s.sharedPath("meta"), func(metaFilename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(metaFilename, ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(metaFilename)
+		if err != nil {
+			return err
+		}
+		var meta fileMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Errorf("Invalid metadata %s: %s", metaFilename, err)
+			result.Failed++
+			return nil
+		}
+		if meta.UploadedAt.Before(since) || meta.expired() {
+			return nil
+		}
+		// Aliases are not carried over, the index is not exported
+		meta.ShortURL = ""
+		meta.Deduplicated = false
+		manifest.Files = append(manifest.Files, meta)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+
+	archive := tar.NewWriter(dst)
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return result, err
+	}
+	err = archive.WriteHeader(&tar.Header{
+		Name:    archiveManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.Exported,
+	})
+	if err != nil {
+		return result, err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return result, err
+	}
+
+	for _, meta := range manifest.Files {
+		stored, err := s.openBackendFile(meta.Path)
+		if err != nil {
+			log.Errorf("Failed to export %s: %s", meta.Path, err)
+			result.Failed++
+			continue
+		}
+		err = archive.WriteHeader(&tar.Header{
+			Name:    "files/" + meta.Path,
+			Mode:    0644,
+			Size:    stored.size,
+			ModTime: meta.UploadedAt,
+		})
+		if err == nil {
+			_, err = copyBuffered(archive, stored)
+		}
+		stored.Close()
+		if err != nil {
+			return result, fmt.Errorf("failed to export %s: %s", meta.Path, err)
+		}
+		result.Copied++
+		result.Bytes += stored.size
+	}
+	return result, archive.Close()
+}
+
+/*
+ * Stores the files of an archive written by exportArchive, which may be
+ * compressed
+ */
+func (s *Server) importArchive(src io.Reader) (migrationResult, error) {
+	var result migrationResult
+
+	reader := bufio.NewReader(src)
+	magic, _ := reader.Peek(4)
+	var decompressed io.Reader = reader
+	switch {
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return result, err
+		}
+		defer decoder.Close()
+		decompressed = decoder
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		decoder, err := gzip.NewReader(reader)
+		if err != nil {
+			return result, err
+		}
+		decompressed = decoder
+	}
+
+	archive := tar.NewReader(decompressed)
+	header, err := archive.Next()
+	if err != nil || header.Name != archiveManifestName {
+		return result, errors.New("invalid archive: manifest.json is missing")
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return result, fmt.Errorf("invalid manifest: %s", err)
+	}
+	if manifest.Version != 1 {
+		return result, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	files := make(map[string]fileMetadata, len(manifest.Files))
+	for _, meta := range manifest.Files {
+		files[meta.Path] = meta
+	}
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("invalid archive: %s", err)
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(header.Name, "files/") {
+			continue
+		}
+
+		fileStorePath := strings.TrimPrefix(header.Name, "files/")
+		meta, ok := files[fileStorePath]
+		if !ok {
+			log.Errorf("Cannot import %s: missing from manifest", fileStorePath)
+			result.Failed++
+			continue
+		}
+		if err := checkStorePath(fileStorePath, windowsPaths); err != nil {
+			log.Errorf("Cannot import %s: %s", fileStorePath, err)
+			result.Failed++
+			continue
+		}
+		exists, err := s.backend.Exists(fileStorePath)
+		if err != nil {
+			log.Errorf("Failed to check %s: %s", fileStorePath, err)
+			result.Failed++
+			continue
+		} else if exists {
+			result.Skipped++
+			continue
+		}
+
+		size, err := s.importFile(fileStorePath, archive, meta)
+		if err == storage.ErrExists {
+			result.Skipped++
+			continue
+		} else if err != nil {
+			log.Error(err)
+			result.Failed++
+			continue
+		}
+		result.Copied++
+		result.Bytes += size
+		if result.Copied%1000 == 0 {
+			log.Infof("Imported %d files (%s)", result.Copied, formatSize(result.Bytes))
+		}
+	}
+	return result, nil
+}
+
+/*
+ * Stores the content read from src like an upload, i.e. compressed and
+ * encrypted if configured, and writes its metadata, based on meta. If meta
+ * has a SHA-256 hash, the content has to match it. Returns the size of the
+ * content.
+ */
+func (s *Server) importFile(fileStorePath string, src io.Reader, meta fileMetadata) (int64, error) {
+	reader := bufio.NewReader(src)
+	head, err := peekHead(reader)
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read %s: %s", fileStorePath, err)
+	}
+
+	tmpFile, err := s.createTempFile()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	compress := s.conf.CompressFiles && shouldCompress(fileStorePath, head)
+	storedWriter, err := s.newStoredFileWriter(tmpFile, head, compress)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write %s: %s", tmpFile.Name(), err)
+	}
+	hasher, md5Hasher := sha256.New(), md5.New()
+	size, err := copyBuffered(storedWriter, io.TeeReader(reader, io.MultiWriter(hasher, md5Hasher)))
+	if err == nil {
+		err = storedWriter.Close()
+	}
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if err == nil {
+		err = tmpFile.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s: %s", fileStorePath, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if meta.SHA256 != "" && meta.SHA256 != hash {
+		return 0, fmt.Errorf("failed to import %s: content does not match SHA-256 hash %s", fileStorePath, meta.SHA256)
+	}
+
+	deduplicated, err := s.backend.Commit(tmpFile.Name(), fileStorePath, hash)
+	if err == storage.ErrExists {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to store %s: %s", fileStorePath, err)
+	}
+
+	meta.Path = fileStorePath
+	meta.Size = size
+	meta.SHA256 = hash
+	meta.MD5 = hex.EncodeToString(md5Hasher.Sum(nil))
+	meta.Deduplicated = deduplicated
+	if meta.ContentType == "" {
+		meta.ContentType = extensionContentType(fileStorePath)
+	}
+	if meta.UploadedAt.IsZero() {
+		meta.UploadedAt = time.Now().UTC()
+	}
+	if err := s.writeMetadata(meta); err != nil {
+		log.Error(err)
+	}
+	return size, nil
+}
@@ -0,0 +1,65 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+ * Export files of an encrypted store and import them into another one
+ */
+func TestExportImport(t *testing.T) {
+	source := newTestServer(t)
+	source.conf.StoreDir = t.TempDir()
+	source.conf.CompressFiles = true
+	source.conf.EncryptionKey = testEncryptionKey
+	if err := source.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"abc/one.txt": "one", "abc/two.txt": "two two", "def/old.txt": "old"}
+	for fileStorePath, content := range files {
+		source.uploadFile(t, fileStorePath, []byte(content))
+	}
+	meta, _ := source.readMetadata("def/old.txt")
+	meta.UploadedAt = time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	source.writeMetadata(meta)
+
+	var archive bytes.Buffer
+	compressor, _ := zstd.NewWriter(&archive)
+	result, err := source.exportArchive(compressor, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	compressor.Close()
+	if err != nil || result.Copied != 2 || result.Bytes != 10 {
+		t.Fatalf("export: got %+v, %v", result, err)
+	}
+
+	target := newTestServer(t)
+	target.conf.StoreDir = t.TempDir()
+	result, err = target.importArchive(bytes.NewReader(archive.Bytes()))
+	if err != nil || result.Copied != 2 || result.Failed != 0 {
+		t.Fatalf("import: got %+v, %v", result, err)
+	}
+	for _, fileStorePath := range []string{"abc/one.txt", "abc/two.txt"} {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		if rr := target.serveUpload(req); rr.Code != http.StatusOK || rr.Body.String() != files[fileStorePath] {
+			t.Errorf("download of %s: got %v %q", fileStorePath, rr.Code, rr.Body.String())
+		}
+	}
+	if exists, _ := target.backend.Exists("def/old.txt"); exists {
+		t.Errorf("file uploaded before -since has been exported")
+	}
+
+	// Existing files are skipped
+	result, err = target.importArchive(bytes.NewReader(archive.Bytes()))
+	if err != nil || result.Skipped != 2 || result.Copied != 0 {
+		t.Errorf("repeated import: got %+v, %v", result, err)
+	}
+
+	if _, err := target.importArchive(bytes.NewReader([]byte("not an archive"))); err == nil {
+		t.Errorf("invalid archive accepted")
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Audit log
+ * Every upload and deletion is appended to auditLog with its size, SHA-256
+ * and the address of the client, and kept after the file itself is gone.
+ * With auditLogChain, each entry also holds the hash of the one before it,
+ * so entries removed or changed afterwards are found by
+ * "prosody-filer audit-verify".
+ */
+
+package filer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	ClientIP string    `json:"clientIP,omitempty"`
+	Prev     string    `json:"prev,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+/*
+ * Hash of the entry chained to the one before, computed over the entry
+ * without its own hash
+ */
+func (entry auditEntry) chainHash() (string, error) {
+	entry.Hash = ""
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(line)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+/*
+ * Appends uploads and deletions to auditLog
+ */
+func (s *Server) startAuditLog() error {
+	if err := os.MkdirAll(filepath.Dir(s.conf.AuditLog), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %s", err)
+	}
+	prev := ""
+	if s.conf.AuditLogChain {
+		var err error
+		if prev, err = lastAuditHash(s.conf.AuditLog); err != nil {
+			return fmt.Errorf("failed to read audit log: %s", err)
+		}
+	}
+	file, err := os.OpenFile(s.conf.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+
+	s.subscribeEvents(func(event fileEvent) {
+		if event.Type != "upload" && event.Type != "delete" {
+			return
+		}
+		entry := auditEntry{
+			Time:     event.Time,
+			Op:       event.Type,
+			Path:     event.Path,
+			Size:     event.Size,
+			SHA256:   event.SHA256,
+			ClientIP: event.ClientIP,
+		}
+
+		// Events may be published concurrently, the chain must stay in order
+		s.auditMutex.Lock()
+		defer s.auditMutex.Unlock()
+		if s.conf.AuditLogChain {
+			entry.Prev = prev
+			hash, err := entry.chainHash()
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			entry.Hash = hash
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			log.Error("Writing audit log failed: ", err)
+			return
+		}
+		if err := file.Sync(); err != nil {
+			log.Error("Writing audit log failed: ", err)
+		}
+		prev = entry.Hash
+	})
+	return nil
+}
+
+/*
+ * Returns the hash of the last entry, to continue the chain with
+ */
+func lastAuditHash(filename string) (string, error) {
+	last := ""
+	err := readAuditLog(filename, func(line int, entry auditEntry) error {
+		last = entry.Hash
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return last, err
+}
+
+/*
+ * Calls fn with every entry of the audit log and its line number
+ */
+func readAuditLog(filename string, fn func(line int, entry auditEntry) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		var entry auditEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("invalid entry in line %d: %s", line, err)
+		}
+		if err := fn(line, entry); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Checks that every entry is chained to the one before. Returns the number
+ * of entries.
+ */
+func verifyAuditLog(filename string) (int, error) {
+	count, prev := 0, ""
+	err := readAuditLog(filename, func(line int, entry auditEntry) error {
+		if entry.Hash == "" {
+			return fmt.Errorf("line %d is not chained", line)
+		}
+		if entry.Prev != prev {
+			return fmt.Errorf("line %d doesn't follow the entry before, entries were removed or changed", line)
+		}
+		hash, err := entry.chainHash()
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("line %d was changed", line)
+		}
+		count++
+		prev = entry.Hash
+		return nil
+	})
+	return count, err
+}
+
+/*
+ * "audit-verify" command: checks the hash chain of the audit log
+ */
+func runAuditVerify(args []string) error {
+	flags := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	auditLog := flags.String("file", "", "Audit log to verify, default: auditLog of the configuration.")
+	flags.Parse(args)
+
+	if *auditLog == "" {
+		s, err := readConfig(*configFile)
+		if err != nil {
+			return fmt.Errorf("failed to read configuration file: %s", err)
+		}
+		if s.conf.AuditLog == "" {
+			return fmt.Errorf("auditLog is not set")
+		}
+		*auditLog = s.conf.AuditLog
+	}
+
+	count, err := verifyAuditLog(*auditLog)
+	if err != nil {
+		return fmt.Errorf("audit log %s is invalid: %s", *auditLog, err)
+	}
+	fmt.Printf("%s: %d entries, chain intact\n", *auditLog, count)
+	return nil
+}
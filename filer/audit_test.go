@@ -0,0 +1,87 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * Uploads and deletions are logged with client address and chained by hash
+ */
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AuditLog = filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	s.conf.AuditLogChain = true
+	if err := s.startAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := s.newUploadRequest(t, "abc/first.txt", []byte("first"))
+	req.RemoteAddr = "192.0.2.7:4711"
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Fatalf("upload: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if err := s.deleteFile("abc/first.txt", s.clientIP(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []auditEntry
+	err := readAuditLog(s.conf.AuditLog, func(line int, entry auditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Op != "upload" || entries[0].Size != 5 || entries[0].SHA256 == "" ||
+		entries[0].ClientIP != "192.0.2.7" || entries[1].Op != "delete" || entries[1].ClientIP != "192.0.2.7" ||
+		entries[0].Prev != "" || entries[1].Prev != entries[0].Hash {
+		t.Fatalf("unexpected audit log: %+v", entries)
+	}
+	if count, err := verifyAuditLog(s.conf.AuditLog); err != nil || count != 2 {
+		t.Fatalf("verifying: %d entries, %v", count, err)
+	}
+
+	// The chain continues after a restart
+	s.events.Lock()
+	s.events.subscribers = make(map[int]func(fileEvent))
+	s.events.Unlock()
+	if err := s.startAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	s.uploadFile(t, "abc/second.txt", []byte("second"))
+	if count, err := verifyAuditLog(s.conf.AuditLog); err != nil || count != 3 {
+		t.Fatalf("verifying after restart: %d entries, %v", count, err)
+	}
+
+	// Changed entries break the chain
+	content, err := os.ReadFile(s.conf.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := bytes.Replace(content, []byte("192.0.2.7"), []byte("192.0.2.8"), 1)
+	if err := os.WriteFile(s.conf.AuditLog, changed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(s.conf.AuditLog); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("changed entry: got %v", err)
+	}
+
+	// So do removed ones
+	lines := strings.SplitAfter(string(content), "\n")
+	if err := os.WriteFile(s.conf.AuditLog, []byte(lines[0]+lines[2]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(s.conf.AuditLog); err == nil {
+		t.Errorf("removed entry: chain still intact")
+	}
+}
@@ -0,0 +1,274 @@
+/*
+ * Authentication of requests
+ * An Authenticator decides whether a request may upload, download or delete
+ * a file. The default one checks the MACs of mod_http_upload_external and
+ * the upload tokens of mod_http_file_share. Programs embedding the filer can
+ * replace it, e.g. with per-tenant secrets or allowing everything behind
+ * mTLS.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+	"github.com/ThomasLeister/prosody-filer/internal/config"
+)
+
+var uploadMACsMetric = newCounter("prosody_filer_upload_macs_total", "Uploads signed with a MAC, by MAC parameter and result.")
+
+/*
+ * Checks requests before they are handled. Errors should be *AuthError,
+ * other errors are answered with 403 Forbidden.
+ */
+type Authenticator interface {
+	// Called before an upload is received. Uploads without Content-Length
+	// come with Size -1 and are checked again with the received size.
+	ValidatePut(r *http.Request, upload Upload) error
+
+	// Called for downloads, including HEAD requests and QR codes
+	ValidateGet(r *http.Request, fileStorePath string) error
+
+	ValidateDelete(r *http.Request, fileStorePath string) error
+}
+
+/*
+ * An upload to be authorized
+ */
+type Upload struct {
+	// Path below the upload directory, decoded and as sent by the client
+	Path        string
+	EscapedPath string
+
+	// Upload directory the request has been sent to, e.g. "upload/"
+	SubDir string
+
+	// Size of the whole file, -1 if unknown yet
+	Size int64
+}
+
+/*
+ * Rejection of a request, answered with Status and Message
+ */
+type AuthError struct {
+	Status  int
+	Message string
+
+	// Credentials have been sent, but are wrong. Counted for notifyMacFailures.
+	Invalid bool
+
+	// WWW-Authenticate header of 401 responses (optional)
+	Challenge string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+/*
+ * Replaces the default authenticator. Must be called before the server
+ * handles requests.
+ */
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+/*
+ * Answers a request rejected by the authenticator. Attempts with missing
+ * or wrong credentials are delayed by macFailureDelay.
+ */
+func (s *Server) rejectUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	authErr, ok := err.(*AuthError)
+	if !ok {
+		authErr = &AuthError{Status: http.StatusForbidden, Message: "Forbidden"}
+	}
+	log.Warn("Rejected ", r.Method, " request for ", r.URL.Path, ": ", err)
+
+	if authErr.Invalid {
+		s.recordMACFailure(s.clientIP(r))
+	}
+	if authErr.Challenge != "" {
+		w.Header().Set("WWW-Authenticate", authErr.Challenge)
+	}
+	switch authErr.Status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		s.tarpit(r)
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", ALLOWED_METHODS)
+	}
+	http.Error(w, authErr.Message, authErr.Status)
+}
+
+/*
+ * The default authenticator: uploads need a MAC, an upload token or a
+ * mod_http_file_share token, downloads are public unless downloadAuth
+ * requires Basic auth, and files can't be deleted.
+ */
+type macAuthenticator struct {
+	conf          *Config
+	jwtKeys       *jwtKeys
+	downloadUsers *downloadUsers
+}
+
+func (a macAuthenticator) ValidatePut(r *http.Request, upload Upload) error {
+	query := r.URL.Query()
+	accepted := macVersions(a.conf, upload.SubDir)
+	protocolVersion := uploadMACVersion(accepted, query)
+	expires, err := uploadExpiry(query)
+	if err != nil {
+		return &AuthError{Status: http.StatusBadRequest, Message: "Bad Request: " + err.Error()}
+	}
+	maxDownloads, err := uploadMaxDownloads(query)
+	if err != nil {
+		return &AuthError{Status: http.StatusBadRequest, Message: "Bad Request: " + err.Error()}
+	}
+
+	statusCodes := uploadStatusCodes(a.conf)
+	if protocolVersion == "" && hasMAC(query) {
+		sent := uploadMACVersion(hmacauth.Versions, query)
+		return &AuthError{Status: statusCodes.MissingMAC, Message: http.StatusText(statusCodes.MissingMAC) + ": MAC version " + sent + " not accepted, expecting " + strings.Join(accepted, " or ")}
+	} else if protocolVersion == "" && expires != 0 {
+		return &AuthError{Status: http.StatusForbidden, Message: "Forbidden: exp parameter must be signed by a MAC"}
+	} else if protocolVersion == "" && maxDownloads != 0 {
+		return &AuthError{Status: http.StatusForbidden, Message: "Forbidden: maxdl parameter must be signed by a MAC"}
+	} else if protocolVersion == "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		if isUploadToken, err := validateUploadToken(r, upload, a.jwtKeys); isUploadToken {
+			return err
+		}
+		// Slot issued by Prosody's mod_http_file_share
+		return validateFileShareToken(r, upload, a.conf.Secret)
+	} else if protocolVersion == "" {
+		return &AuthError{Status: statusCodes.MissingMAC, Message: http.StatusText(statusCodes.MissingMAC) + ": missing MAC, expecting \"v\", \"v2\" or \"token\" parameter"}
+	}
+
+	// Checked again once the size is known
+	if upload.Size < 0 {
+		return nil
+	}
+	if !a.macMatches(protocolVersion, upload, expires, maxDownloads, query.Get(protocolVersion)) {
+		return &AuthError{Status: statusCodes.InvalidMAC, Message: http.StatusText(statusCodes.InvalidMAC) + ": invalid MAC", Invalid: true}
+	}
+	return nil
+}
+
+func (a macAuthenticator) ValidateGet(r *http.Request, fileStorePath string) error {
+	return validateDownloadAuth(r, fileStorePath, a.conf.DownloadAuth, a.downloadUsers)
+}
+
+func (a macAuthenticator) ValidateDelete(r *http.Request, fileStorePath string) error {
+	return &AuthError{Status: http.StatusMethodNotAllowed, Message: "Method Not Allowed"}
+}
+
+/*
+ * Checks the MAC sent by the client. Depending on macPathEncoding, it is
+ * calculated over the decoded path, the percent-encoded path, or either.
+ */
+func (a macAuthenticator) macMatches(protocolVersion string, upload Upload, expires int64, maxDownloads int64, clientMAC string) bool {
+	var paths []string
+	switch a.conf.MacPathEncoding {
+	case "escaped":
+		paths = []string{upload.EscapedPath}
+	case "both":
+		paths = []string{upload.Path, upload.EscapedPath}
+	default:
+		paths = []string{upload.Path}
+	}
+
+	for _, macPath := range paths {
+		if hmacauth.Verify(a.conf.Secret, protocolVersion, macPath, upload.Size, extensionContentType(macPath), expires, maxDownloads, clientMAC) {
+			if a.conf.ServerType == "auto" {
+				encoding := "decoded"
+				if macPath != upload.Path {
+					encoding = "escaped"
+				}
+				log.Infof("Upload of %s signed with %q MAC over %s path", upload.Path, protocolVersion, encoding)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Check if MAC is attached to URL and return its protocol version, or "" if there is none.
+Ejabberd: 	supports "v" and probably "v2"		Doc: https://docs.ejabberd.im/archive/20_12/modules/#mod-http-upload
+Prosody: 	supports "v" and "v2"				Doc: https://modules.prosody.im/mod_http_upload_external.html
+Metronome: 	supports: "token" (meaning "v2")	Doc: https://archon.im/metronome-im/documentation/external-upload-protocol/)
+*/
+func uploadMACVersion(versions []string, a url.Values) string {
+	for _, version := range versions {
+		if a[version] != nil {
+			return version
+		}
+	}
+	return ""
+}
+
+/*
+ * Reports whether any MAC parameter is attached to the URL, accepted or not
+ */
+func hasMAC(a url.Values) bool {
+	return a["v2"] != nil || a["token"] != nil || a["v"] != nil
+}
+
+/*
+ * Returns the MAC parameters accepted for uploads to subDir, in order of
+ * preference: those pinned for subDir or the instance, else those of
+ * serverType, without "v" unless allowV1 is set
+ */
+func macVersions(conf *Config, subDir string) []string {
+	versions := hmacauth.Versions
+	if pinned, ok := conf.SubDirMacVersions[path.Join("/", subDir)]; ok {
+		versions = pinned
+	} else if len(conf.MacVersions) > 0 {
+		versions = conf.MacVersions
+	} else if preset, ok := config.Presets[conf.ServerType]; ok {
+		versions = preset.MacVersions
+	}
+	if conf.AllowV1 {
+		return versions
+	}
+
+	var accepted []string
+	for _, version := range versions {
+		if version != "v" {
+			accepted = append(accepted, version)
+		}
+	}
+	return accepted
+}
+
+/*
+ * Returns the status codes of rejected uploads: those of the serverType
+ * preset with protocolStatusCodes, else the ones expected by all XMPP servers
+ */
+func uploadStatusCodes(conf *Config) config.StatusCodes {
+	if preset, ok := config.Presets[conf.ServerType]; ok && conf.ProtocolStatusCodes {
+		return preset.StatusCodes
+	}
+	return config.DefaultStatusCodes
+}
+
+/*
+ * Counts an upload to subDir signed with a MAC by its parameter, so admins
+ * can tell which ones their clients still use. valid is false for invalid
+ * MACs.
+ */
+func (s *Server) countUploadMAC(r *http.Request, subDir string, valid bool) {
+	version := uploadMACVersion(macVersions(&s.conf, subDir), r.URL.Query())
+	if version == "" {
+		return
+	}
+	result := "valid"
+	if !valid {
+		result = "invalid"
+	} else {
+		atomic.AddInt64(s.stats.uploadsByMAC[version], 1)
+	}
+	uploadMACsMetric.add(`version="`+version+`",result="`+result+`"`, 1)
+}
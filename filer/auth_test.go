@@ -0,0 +1,145 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+)
+
+/*
+ * Allows uploads and deletes with a bearer token, downloads only with the
+ * "key" parameter
+ */
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) ValidatePut(r *http.Request, upload Upload) error {
+	if r.Header.Get("Authorization") != "Bearer letmein" {
+		return &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized"}
+	}
+	return nil
+}
+
+func (tokenAuthenticator) ValidateGet(r *http.Request, fileStorePath string) error {
+	if r.URL.Query().Get("key") != "secret" {
+		return &AuthError{Status: http.StatusNotFound, Message: "Not Found"}
+	}
+	return nil
+}
+
+func (a tokenAuthenticator) ValidateDelete(r *http.Request, fileStorePath string) error {
+	return a.ValidatePut(r, Upload{Path: fileStorePath, Size: -1})
+}
+
+/*
+ * The default authenticator does not allow deleting files
+ */
+func TestDefaultAuthenticatorDelete(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	if status := s.uploadFile(t, "abc/keep.txt", []byte("keep me")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/upload/abc/keep.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") == "" {
+		t.Errorf("delete: got %v, Allow %q", rr.Code, rr.Header().Get("Allow"))
+	}
+	if _, err := os.Stat(s.storagePath("abc/keep.txt")); err != nil {
+		t.Errorf("file has been deleted: %v", err)
+	}
+}
+
+/*
+ * Requests are checked by the configured authenticator
+ */
+func TestCustomAuthenticator(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	s.SetAuthenticator(tokenAuthenticator{})
+	var deleted []fileEvent
+	defer s.subscribeEvents(func(event fileEvent) {
+		if event.Type == "delete" {
+			deleted = append(deleted, event)
+		}
+	})()
+
+	request := func(method string, target string, token string, content []byte) int {
+		req, _ := http.NewRequest(method, target, bytes.NewReader(content))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return s.serveUpload(req).Code
+	}
+
+	// MACs are not needed anymore
+	if status := request("PUT", "/upload/abc/custom.txt", "letmein", []byte("custom")); status != http.StatusCreated {
+		t.Fatalf("upload with token: got %v want %v", status, http.StatusCreated)
+	}
+	if status := s.uploadFile(t, "abc/mac.txt", []byte("mac")).Code; status != http.StatusUnauthorized {
+		t.Errorf("upload with MAC: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	if status := request("GET", "/upload/abc/custom.txt", "", nil); status != http.StatusNotFound {
+		t.Errorf("download without key: got %v want %v", status, http.StatusNotFound)
+	}
+	if status := request("GET", "/upload/abc/custom.txt?key=secret", "", nil); status != http.StatusOK {
+		t.Errorf("download with key: got %v want %v", status, http.StatusOK)
+	}
+
+	if status := request("DELETE", "/upload/abc/custom.txt", "wrong", nil); status != http.StatusUnauthorized {
+		t.Errorf("delete with wrong token: got %v want %v", status, http.StatusUnauthorized)
+	}
+	if status := request("DELETE", "/upload/abc/custom.txt", "letmein", nil); status != http.StatusNoContent {
+		t.Fatalf("delete: got %v want %v", status, http.StatusNoContent)
+	}
+	if _, err := os.Stat(s.storagePath("abc/custom.txt")); !os.IsNotExist(err) {
+		t.Errorf("file has not been deleted: %v", err)
+	}
+	if _, err := os.Stat(s.metadataPath("abc/custom.txt")); !os.IsNotExist(err) {
+		t.Errorf("metadata has not been deleted: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Path != "abc/custom.txt" || deleted[0].Size != 6 {
+		t.Errorf("wrong delete events: %+v", deleted)
+	}
+	if status := request("DELETE", "/upload/abc/custom.txt", "letmein", nil); status != http.StatusNotFound {
+		t.Errorf("delete of missing file: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+/*
+ * Uploads are counted by MAC parameter
+ */
+func TestUploadMACCounts(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	validBefore := uploadMACsMetric.get(`version="v",result="valid"`)
+	invalidBefore := uploadMACsMetric.get(`version="v",result="invalid"`)
+	content := []byte("counted")
+	s.uploadFile(t, "abc/v.txt", content)
+	req, _ := http.NewRequest("PUT", "/upload/abc/v2.txt", bytes.NewReader(content))
+	req.URL.RawQuery = "v2=" + s.uploadMAC("v2", "abc/v2.txt", int64(len(content)), 0, 0)
+	s.serveUpload(req)
+	req = s.newUploadRequest(t, "abc/invalid.txt", content)
+	req.URL.RawQuery = "v=00"
+	s.serveUpload(req)
+
+	if *s.stats.uploadsByMAC["v"] != 1 || *s.stats.uploadsByMAC["v2"] != 1 || *s.stats.uploadsByMAC["token"] != 0 {
+		t.Errorf("unexpected counts: v %d, v2 %d, token %d", *s.stats.uploadsByMAC["v"], *s.stats.uploadsByMAC["v2"], *s.stats.uploadsByMAC["token"])
+	}
+	if valid := uploadMACsMetric.get(`version="v",result="valid"`) - validBefore; valid != 1 {
+		t.Errorf("got %v valid v MACs want 1", valid)
+	}
+	if invalid := uploadMACsMetric.get(`version="v",result="invalid"`) - invalidBefore; invalid != 1 {
+		t.Errorf("got %v invalid v MACs want 1", invalid)
+	}
+}
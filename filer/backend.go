@@ -0,0 +1,113 @@
+/*
+ * Storage backends
+ * Stored files are kept on the local filesystem (StoreDir) or in an S3
+ * compatible object store. Prosody Filer's own state (metadata, quarantine,
+ * temporary files unless tempDir is set) always stays in StoreDir.
+ */
+
+package filer
+
+import (
+	"os"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Sets up the configured storage backend
+ */
+func (s *Server) setupBackend() error {
+	s.backend = localBackend{s}
+	s.storageHealth.primary = s.backend
+
+	if s.conf.StorageBackend == "s3" {
+		s3, err := storage.NewS3(s.s3Config())
+		if err != nil {
+			return err
+		}
+		s.backend = s3
+		s.storageHealth.primary = s3
+
+		if s.conf.DiskCacheSize > 0 {
+			cache, err := newDiskCache(s.internalPath("cache"), s.conf.DiskCacheSize)
+			if err != nil {
+				return err
+			}
+			s.backend = &cachingBackend{Backend: s3, cache: cache, maxFileSize: s.conf.DiskCacheMaxFileSize}
+		}
+	}
+
+	if s.conf.FailoverStoreDir != "" {
+		s.storageHealth.secondary = dirBackend{s.conf.FailoverStoreDir}
+		s.backend = &failoverBackend{Backend: s.backend, server: s}
+	}
+
+	if len(s.conf.FallbackStoreDirs) > 0 {
+		fallback := &fallbackBackend{Backend: s.backend}
+		for _, dir := range s.conf.FallbackStoreDirs {
+			fallback.dirs = append(fallback.dirs, dirBackend{dir})
+		}
+		s.backend = fallback
+	}
+
+	if s.conf.MemoryCacheSize > 0 {
+		s.backend = &memoryCachingBackend{
+			Backend:     s.backend,
+			cache:       newMemoryCache(s.conf.MemoryCacheSize, s.conf.MemoryCacheWindow),
+			maxFileSize: s.conf.MemoryCacheMaxFileSize,
+		}
+	}
+	return nil
+}
+
+func (s *Server) s3Config() storage.S3Config {
+	return storage.S3Config{
+		Endpoint:  s.conf.S3Endpoint,
+		Region:    s.conf.S3Region,
+		Bucket:    s.conf.S3Bucket,
+		Prefix:    s.conf.S3Prefix,
+		AccessKey: s.conf.S3AccessKey,
+		SecretKey: s.conf.S3SecretKey,
+		PathStyle: s.conf.S3PathStyle,
+		Timeout:   s.conf.S3Timeout,
+	}
+}
+
+/*
+ * Files in StoreDir
+ */
+type localBackend struct {
+	server *Server
+}
+
+func (b localBackend) Commit(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	if b.server.conf.Deduplicate {
+		return b.server.commitDeduplicated(tmpFilename, b.server.storagePath(fileStorePath), hash)
+	}
+	return false, commitFile(tmpFilename, b.server.storagePath(fileStorePath))
+}
+
+func (b localBackend) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	// Files stored in the other layout are replaced where they are
+	absFilename := b.server.findStoredFile(fileStorePath)
+	if b.server.conf.Deduplicate {
+		return b.server.replaceDeduplicated(tmpFilename, absFilename, hash)
+	}
+	return false, commitReplacing(tmpFilename, absFilename)
+}
+
+func (b localBackend) Open(fileStorePath string) (storage.File, error) {
+	return storage.OpenLocalFile(b.server.findStoredFile(fileStorePath))
+}
+
+func (b localBackend) Delete(fileStorePath string) error {
+	return os.Remove(b.server.findStoredFile(fileStorePath))
+}
+
+func (b localBackend) Exists(fileStorePath string) (bool, error) {
+	_, err := os.Lstat(b.server.findStoredFile(fileStorePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
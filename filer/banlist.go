@@ -0,0 +1,210 @@
+/*
+ * Persistent bans
+ * Every ban is kept as a JSON file in banDir, named after the client, so
+ * bans survive restarts. By default, banDir is in clusterDir, so the nodes
+ * of a cluster share it: each node writes the bans it imposes and re-reads
+ * the directory every banSyncInterval, picking up the bans of the others.
+ * Files of expired bans are removed while re-reading.
+ */
+
+package filer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * A banned client, as stored in banDir and listed by the admin API
+ */
+type clientBan struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+var banFilenameReplacer = strings.NewReplacer(":", "_", "/", "_", "\\", "_")
+
+func (s *Server) banDir() string {
+	if s.conf.BanDir != "" {
+		return s.conf.BanDir
+	}
+	return s.sharedPath("bans")
+}
+
+func (s *Server) banPath(client string) string {
+	return filepath.Join(s.banDir(), banFilenameReplacer.Replace(client)+".json")
+}
+
+/*
+ * Writes ban to banDir, replacing a previous ban of the client
+ */
+func (s *Server) saveBan(ban clientBan) error {
+	if err := os.MkdirAll(s.banDir(), os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+
+	filename := s.banPath(ban.Client)
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+/*
+ * Replaces the bans in memory with those in banDir, removing files of
+ * expired bans
+ */
+func (s *Server) loadBans() error {
+	entries, err := os.ReadDir(s.banDir())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read banDir: %s", err)
+	}
+
+	until := make(map[string]time.Time)
+	reasons := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		filename := filepath.Join(s.banDir(), entry.Name())
+		data, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			// Lifted by another node meanwhile
+			continue
+		} else if err != nil {
+			return err
+		}
+		var ban clientBan
+		if err := json.Unmarshal(data, &ban); err != nil || ban.Client == "" {
+			log.Warn("Ignoring invalid ban ", filename)
+			continue
+		}
+		if time.Now().After(ban.Until) {
+			os.Remove(filename)
+			continue
+		}
+		until[ban.Client], reasons[ban.Client] = ban.Until, ban.Reason
+	}
+
+	s.bans.Lock()
+	s.bans.until, s.bans.reasons = until, reasons
+	bannedClientsMetric.set("", float64(len(until)))
+	s.bans.Unlock()
+	return nil
+}
+
+/*
+ * Re-reads banDir every banSyncInterval
+ */
+func (s *Server) startBanSync() {
+	go func() {
+		for {
+			time.Sleep(s.conf.BanSyncInterval)
+			if err := s.loadBans(); err != nil {
+				log.Error("Reading bans failed: ", err)
+			}
+		}
+	}()
+}
+
+/*
+ * Lifts the ban of client. Returns false if it isn't banned.
+ */
+func (s *Server) unban(client string) (bool, error) {
+	s.bans.Lock()
+	_, banned := s.bans.until[client]
+	delete(s.bans.until, client)
+	delete(s.bans.reasons, client)
+	bannedClientsMetric.set("", float64(len(s.bans.until)))
+	s.bans.Unlock()
+
+	err := os.Remove(s.banPath(client))
+	if os.IsNotExist(err) {
+		return banned, nil
+	}
+	return true, err
+}
+
+/*
+ * Bans endpoint:
+ *   GET    /bans                                  List banned clients
+ *   POST   /bans?client=<address>[&duration=<d>]  Ban a client for duration (default: banDuration)
+ *   DELETE /bans?client=<address>                 Lift the ban of a client
+ */
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	if !s.bansEnabled() {
+		httpError(w, http.StatusNotImplemented, "notFoundLimit and honeypotBan are not set")
+		return
+	}
+
+	var client string
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		ip := net.ParseIP(r.FormValue("client"))
+		if ip == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid client"})
+			return
+		}
+		client = ip.String()
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bans := []clientBan{}
+		now := time.Now()
+		s.bans.Lock()
+		for address, until := range s.bans.until {
+			if now.Before(until) {
+				bans = append(bans, clientBan{Client: address, Until: until.UTC(), Reason: s.bans.reasons[address]})
+			}
+		}
+		s.bans.Unlock()
+		sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"bans": bans})
+
+	case http.MethodPost:
+		duration := s.conf.BanDuration
+		if value := r.FormValue("duration"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+				return
+			}
+		}
+		ban := clientBan{Client: client, Until: time.Now().Add(duration).UTC(), Reason: "admin"}
+		log.Warnf("Banning %s for %s on request of an admin", client, duration)
+		s.bans.Lock()
+		s.banUntilLocked(ban.Client, ban.Until, ban.Reason)
+		s.bans.Unlock()
+		bansMetric.add(`reason="admin"`, 1)
+		writeJSON(w, http.StatusOK, ban)
+
+	case http.MethodDelete:
+		banned, err := s.unban(client)
+		if err != nil {
+			log.Error("Failed to remove ban: ", err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		} else if !banned {
+			httpError(w, http.StatusNotFound, "")
+			return
+		}
+		log.Info("Lifted ban of ", client)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "")
+	}
+}
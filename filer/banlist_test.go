@@ -0,0 +1,78 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ * Bans are kept in banDir and restored by other servers sharing it
+ */
+func TestPersistentBans(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+	s.conf.HoneypotPaths = []string{"/.env"}
+	s.conf.HoneypotBan = true
+	s.conf.BanDir = t.TempDir()
+
+	req, _ := http.NewRequest("GET", "/.env", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+	s.serveUpload(req)
+	if _, err := os.Stat(s.banPath("192.0.2.1")); err != nil {
+		t.Fatalf("ban not kept: %s", err)
+	}
+	if rr := s.adminRequest(t, "POST", "/bans?client=2001:db8::1&duration=10m"); rr.Code != http.StatusOK {
+		t.Fatalf("ban by admin: got %v want %v", rr.Code, http.StatusOK)
+	}
+	// Expired bans are removed when loading
+	if err := s.saveBan(clientBan{Client: "192.0.2.3", Until: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestServer(t)
+	other.conf = s.conf
+	if err := other.loadBans(); err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Bans []clientBan `json:"bans"`
+	}
+	rr := other.adminRequest(t, "GET", "/bans")
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Bans) != 2 || response.Bans[0].Client != "192.0.2.1" || response.Bans[0].Reason != "honeypot" ||
+		response.Bans[1].Client != "2001:db8::1" || response.Bans[1].Reason != "admin" {
+		t.Errorf("unexpected bans: %+v", response.Bans)
+	}
+	if _, err := os.Stat(other.banPath("192.0.2.3")); !os.IsNotExist(err) {
+		t.Errorf("expired ban not removed: %v", err)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/file.txt", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+	if rr := other.serveUpload(req); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("request of client banned by other server: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// Lifted bans are removed from banDir
+	if rr := other.adminRequest(t, "DELETE", "/bans?client=192.0.2.1"); rr.Code != http.StatusNoContent {
+		t.Errorf("lifting ban: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := other.adminRequest(t, "DELETE", "/bans?client=192.0.2.1"); rr.Code != http.StatusNotFound {
+		t.Errorf("lifting ban again: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if err := s.loadBans(); err != nil {
+		t.Fatal(err)
+	}
+	if _, banned := s.bans.until["192.0.2.1"]; banned {
+		t.Error("lifted ban still active after loading")
+	}
+	if rr := s.adminRequest(t, "POST", "/bans?client=example.com"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid client: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Banning clients guessing URLs
+ * Upload URLs contain random strings, so guessing them is impractical.
+ * Still, clients causing more than notFoundLimit 404 responses within
+ * notFoundWindow are banned for banDuration, and get 429 responses for all
+ * requests in the meantime. Bans are kept in banDir, so they survive
+ * restarts and are shared by all nodes of a cluster, see banlist.go.
+ *
+ * Clients requesting one of the honeypotPaths, which only generic web
+ * scanners do, are logged in a fixed format for fail2ban, reported to
+ * CrowdSec and, with honeypotBan, banned right away.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	bansMetric          = newCounter("prosody_filer_bans_total", "Clients banned, by reason.")
+	bannedClientsMetric = newGauge("prosody_filer_banned_clients", "Clients currently banned.")
+	honeypotMetric      = newCounter("prosody_filer_honeypot_requests_total", "Requests for honeypotPaths.")
+)
+
+type missCount struct {
+	count int
+	since time.Time
+}
+
+/*
+ * Refuses requests of banned clients
+ */
+func (s *Server) rejectBanned(w http.ResponseWriter, r *http.Request) bool {
+	if !s.bansEnabled() {
+		return false
+	}
+
+	client := s.clientIP(r)
+	s.bans.Lock()
+	until, banned := s.bans.until[client]
+	if banned && time.Now().After(until) {
+		delete(s.bans.until, client)
+		delete(s.bans.reasons, client)
+		bannedClientsMetric.set("", float64(len(s.bans.until)))
+		banned = false
+	}
+	s.bans.Unlock()
+
+	if !banned {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	httpError(w, http.StatusTooManyRequests, "")
+	return true
+}
+
+/*
+ * Counts a 404 response and bans the client once it exceeds notFoundLimit
+ */
+func (s *Server) recordNotFound(r *http.Request) {
+	if s.conf.NotFoundLimit <= 0 {
+		return
+	}
+
+	client := s.clientIP(r)
+	s.bans.Lock()
+	defer s.bans.Unlock()
+
+	// Forget about clients which haven't missed for a while
+	for address, misses := range s.bans.misses {
+		if time.Since(misses.since) > s.conf.NotFoundWindow {
+			delete(s.bans.misses, address)
+		}
+	}
+
+	misses := s.bans.misses[client]
+	if misses == nil {
+		misses = &missCount{since: time.Now()}
+		s.bans.misses[client] = misses
+	}
+	misses.count++
+
+	if misses.count > s.conf.NotFoundLimit {
+		log.Warnf("Banning %s for %s after %d requests for missing files", client, s.conf.BanDuration, misses.count)
+		s.reportCrowdsecFlood(client, misses.count, misses.since)
+		delete(s.bans.misses, client)
+		s.banLocked(client, "not_found")
+	}
+}
+
+func (s *Server) bansEnabled() bool {
+	return s.conf.NotFoundLimit > 0 || s.conf.HoneypotBan
+}
+
+/*
+ * Bans client for banDuration. The caller must hold s.bans.
+ */
+func (s *Server) banLocked(client string, reason string) {
+	s.banUntilLocked(client, time.Now().Add(s.conf.BanDuration), reason)
+	bansMetric.add(`reason="`+reason+`"`, 1)
+}
+
+/*
+ * Bans client until the given time and keeps the ban in banDir. The
+ * caller must hold s.bans.
+ */
+func (s *Server) banUntilLocked(client string, until time.Time, reason string) {
+	s.bans.until[client] = until
+	s.bans.reasons[client] = reason
+	bannedClientsMetric.set("", float64(len(s.bans.until)))
+	if err := s.saveBan(clientBan{Client: client, Until: until.UTC(), Reason: reason}); err != nil {
+		log.Error("Failed to keep ban: ", err)
+	}
+}
+
+/*
+ * Answers requests for honeypotPaths with 404 Not Found, flagging the
+ * client as scanner
+ */
+func (s *Server) rejectHoneypot(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.conf.HoneypotPaths) == 0 || !s.isHoneypot(r.URL.Path) {
+		return false
+	}
+
+	client := s.clientIP(r)
+	honeypotMetric.add("", 1)
+	// Matched by the fail2ban filter in the README, keep the format
+	log.Warnf("Honeypot %s requested by %s", r.URL.Path, client)
+	s.reportCrowdsecHoneypot(client, r.URL.Path)
+	if s.conf.HoneypotBan {
+		log.Warnf("Banning %s for %s after requesting a honeypot", client, s.conf.BanDuration)
+		s.bans.Lock()
+		s.banLocked(client, "honeypot")
+		s.bans.Unlock()
+	}
+
+	httpError(w, http.StatusNotFound, "")
+	return true
+}
+
+/*
+ * Reports whether urlPath matches one of honeypotPaths, ignoring case
+ */
+func (s *Server) isHoneypot(urlPath string) bool {
+	urlPath = strings.ToLower(path.Clean("/" + urlPath))
+	for _, pattern := range s.conf.HoneypotPaths {
+		if matched, _ := path.Match(strings.ToLower(pattern), urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Clients requesting too many missing files are banned
+ */
+func TestNotFoundBan(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.NotFoundLimit = 3
+
+	// Remove kept bans after test
+	defer s.cleanup()
+	get := func(remoteAddr string) *http.Response {
+		req, _ := http.NewRequest("GET", "/upload/abc/missing.jpg", nil)
+		req.RemoteAddr = remoteAddr
+		return s.serveUpload(req).Result()
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := get("192.0.2.1:4711"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("request %d: got %v want %v", i, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+	// The fourth miss exceeds the limit
+	get("192.0.2.1:4711")
+
+	resp := get("192.0.2.1:4712")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("request of banned client: got %v, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := get("192.0.2.2:4711"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request of other client: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Bans expire
+	s.bans.until["192.0.2.1"] = time.Now().Add(-time.Second)
+	if resp := get("192.0.2.1:4711"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request after ban expired: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+/*
+ * Clients requesting honeypots are logged and banned
+ */
+func TestHoneypot(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.HoneypotPaths = []string{"/.env", "/upload/*.php"}
+
+	// Remove kept bans after test
+	defer s.cleanup()
+	get := func(url string, remoteAddr string) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.RemoteAddr = remoteAddr
+		return s.serveUpload(req).Code
+	}
+
+	output := new(bytes.Buffer)
+	previousOut, previousLevel := log.Out, log.GetLevel()
+	log.Out = output
+	log.SetLevel(logrus.WarnLevel)
+	defer func() {
+		log.Out = previousOut
+		log.SetLevel(previousLevel)
+	}()
+
+	// Flagged, but not banned
+	if code := get("/upload/WP-Login.php", "192.0.2.1:4711"); code != http.StatusNotFound {
+		t.Errorf("honeypot: got %v want %v", code, http.StatusNotFound)
+	}
+	if !strings.Contains(output.String(), `msg="Honeypot /upload/WP-Login.php requested by 192.0.2.1"`) {
+		t.Errorf("honeypot request not logged: %s", output.String())
+	}
+	if code := get("/upload/abc/missing.jpg", "192.0.2.1:4711"); code != http.StatusNotFound {
+		t.Errorf("request after honeypot without honeypotBan: got %v want %v", code, http.StatusNotFound)
+	}
+
+	s.conf.HoneypotBan = true
+	get("/upload/../.env", "192.0.2.1:4711")
+	if code := get("/upload/abc/missing.jpg", "192.0.2.1:4711"); code != http.StatusTooManyRequests {
+		t.Errorf("request of banned client: got %v want %v", code, http.StatusTooManyRequests)
+	}
+	if code := get("/upload/abc/missing.jpg", "192.0.2.2:4711"); code != http.StatusNotFound {
+		t.Errorf("request of other client: got %v want %v", code, http.StatusNotFound)
+	}
+}
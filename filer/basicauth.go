@@ -0,0 +1,224 @@
+/*
+ * HTTP Basic auth for downloads
+ * Semi-private deployments can limit downloads below some or all prefixes
+ * to a known group of users. Users come from downloadUsers and the
+ * htpasswd file downloadHtpasswd, which is re-read on SIGHUP.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const downloadAuthChallenge = `Basic realm="Prosody Filer", charset="UTF-8"`
+
+/*
+ * Users allowed to download, with their password entries: "{SHA}" or
+ * "$apr1$" hashes as written by htpasswd -s and -m, or plain text
+ */
+type downloadUsers struct {
+	sync.RWMutex
+	passwords map[string]string
+}
+
+/*
+ * Loads the users of downloadUsers and downloadHtpasswd. Entries in the
+ * config take precedence.
+ */
+func (s *Server) loadDownloadUsers() error {
+	passwords := make(map[string]string)
+	if s.conf.DownloadHtpasswd != "" {
+		file, err := os.Open(s.conf.DownloadHtpasswd)
+		if err != nil {
+			return fmt.Errorf("failed to open htpasswd file: %s", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.SplitN(line, ":", 2)
+			if len(fields) != 2 || fields[0] == "" {
+				return fmt.Errorf("invalid entry in %s line %d", s.conf.DownloadHtpasswd, lineNumber)
+			}
+			if err := checkPasswordEntry(fields[1]); err != nil {
+				return fmt.Errorf("invalid entry in %s line %d: %s", s.conf.DownloadHtpasswd, lineNumber, err)
+			}
+			passwords[fields[0]] = fields[1]
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read htpasswd file: %s", err)
+		}
+	}
+	for user, password := range s.conf.DownloadUsers {
+		if err := checkPasswordEntry(password); err != nil {
+			return fmt.Errorf("invalid downloadUsers entry %q: %s", user, err)
+		}
+		passwords[user] = password
+	}
+
+	s.downloadUsers.Lock()
+	s.downloadUsers.passwords = passwords
+	s.downloadUsers.Unlock()
+
+	if len(s.conf.DownloadAuth) > 0 {
+		log.Info("Loaded ", len(passwords), " download users")
+	}
+	return nil
+}
+
+/*
+ * Rejects hashes which can't be checked, so their users don't silently
+ * fail to log in. bcrypt would need golang.org/x/crypto.
+ */
+func checkPasswordEntry(entry string) error {
+	if strings.HasPrefix(entry, "$") && !strings.HasPrefix(entry, "$apr1$") {
+		return fmt.Errorf("unsupported password hash, use htpasswd -m (MD5) or -s (SHA-1)")
+	}
+	return nil
+}
+
+/*
+ * Reports whether password matches the entry of user
+ */
+func (u *downloadUsers) verify(user, password string) bool {
+	u.RLock()
+	entry, ok := u.passwords[user]
+	u.RUnlock()
+	if !ok {
+		return false
+	}
+
+	expected := entry
+	switch {
+	case strings.HasPrefix(entry, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(entry, "$apr1$"):
+		salt := strings.SplitN(entry[len("$apr1$"):], "$", 2)[0]
+		password = apr1Crypt(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+/*
+ * Returns the users allowed to download fileStorePath, by the longest
+ * matching prefix of downloadAuth, or nil if the file is public
+ */
+func downloadAuthUsers(rules map[string][]string, fileStorePath string) []string {
+	var users []string
+	longest := -1
+	for prefix, allowed := range rules {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if strings.HasPrefix(fileStorePath, prefix) && len(prefix) > longest {
+			users, longest = allowed, len(prefix)
+		}
+	}
+	return users
+}
+
+/*
+ * Checks the Basic auth credentials of a download. Missing or wrong
+ * credentials are answered with 401 and a challenge, so browsers ask for
+ * them; users not allowed below the prefix get 403.
+ */
+func validateDownloadAuth(r *http.Request, fileStorePath string, rules map[string][]string, users *downloadUsers) error {
+	allowed := downloadAuthUsers(rules, fileStorePath)
+	if allowed == nil {
+		return nil
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized", Challenge: downloadAuthChallenge}
+	}
+	if !users.verify(user, password) {
+		return &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized", Challenge: downloadAuthChallenge, Invalid: true}
+	}
+	if !containsString(allowed, "*") && !containsString(allowed, user) {
+		log.Warnf("User %s is not allowed to download %s", user, fileStorePath)
+		return &AuthError{Status: http.StatusForbidden, Message: "Forbidden"}
+	}
+	return nil
+}
+
+/*
+ * Apache's MD5 based password hash, as written by htpasswd -m
+ */
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alternate[:])
+		} else {
+			ctx.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte(password[:1]))
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx := md5.New()
+		if i&1 != 0 {
+			ctx.Write([]byte(password))
+		} else {
+			ctx.Write(final)
+		}
+		if i%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			ctx.Write(final)
+		} else {
+			ctx.Write([]byte(password))
+		}
+		final = ctx.Sum(nil)
+	}
+
+	// Custom base64 encoding of the bytes in a shuffled order
+	var hash []byte
+	encode := func(value uint32, n int) {
+		for ; n > 0; n-- {
+			hash = append(hash, itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return magic + salt + "$" + string(hash)
+}
@@ -0,0 +1,69 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Downloads below downloadAuth prefixes need the credentials of an allowed user
+ */
+func TestDownloadAuth(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.uploadFile(t, "team/secret.txt", []byte("team only"))
+	s.uploadFile(t, "ops/secret.txt", []byte("ops only"))
+	s.uploadFile(t, "public/file.txt", []byte("for everyone"))
+
+	// Set config: htpasswd -b -m and -s, and a plain password in the config
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(htpasswd, []byte("# download users\nalice:$apr1$xyz$NU.niW1.aK5j0LYFfMca4/\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	s.conf.DownloadHtpasswd = htpasswd
+	s.conf.DownloadUsers = map[string]string{"carol": "carol's password"}
+	s.conf.DownloadAuth = map[string][]string{"/team": {"*"}, "ops/": {"bob"}}
+	if err := s.loadDownloadUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(fileStorePath, user, password string) *http.Response {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		return s.serveUpload(req).Result()
+	}
+
+	for _, test := range []struct {
+		path, user, password string
+		status               int
+	}{
+		{"team/secret.txt", "", "", http.StatusUnauthorized},
+		{"team/secret.txt", "alice", "password", http.StatusOK},
+		{"team/secret.txt", "bob", "password", http.StatusOK},
+		{"team/secret.txt", "carol", "carol's password", http.StatusOK},
+		{"team/secret.txt", "alice", "wrong", http.StatusUnauthorized},
+		{"team/secret.txt", "mallory", "password", http.StatusUnauthorized},
+		{"ops/secret.txt", "bob", "password", http.StatusOK},
+		{"ops/secret.txt", "alice", "password", http.StatusForbidden},
+		{"public/file.txt", "", "", http.StatusOK},
+	} {
+		resp := get(test.path, test.user, test.password)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s as %q: got %v want %v", test.path, test.user, resp.StatusCode, test.status)
+		}
+		if challenge := resp.Header.Get("WWW-Authenticate"); (resp.StatusCode == http.StatusUnauthorized) != (challenge != "") {
+			t.Errorf("%s as %q: WWW-Authenticate %q with status %v", test.path, test.user, challenge, resp.StatusCode)
+		}
+	}
+
+	// bcrypt hashes can't be checked
+	os.WriteFile(htpasswd, []byte("dave:$2y$05$abcdefghijklmnopqrstuuzmI0Ed4WmF2DpsUmaHZ4JFEptRxiuOy\n"), 0600)
+	if err := s.loadDownloadUsers(); err == nil {
+		t.Error("bcrypt hash accepted")
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * "bench" command: uploads (and downloads) files to a running instance and
+ * reports throughput and latency, for sizing hardware
+ */
+
+package filer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	baseURL := flags.String("url", "", "URL of the upload directory, e.g. \"https://upload.example.com/upload/\". Defaults to listenport and uploadSubDir.")
+	concurrency := flags.Int("concurrency", 4, "Number of concurrent requests.")
+	sizeString := flags.String("size", "1M", "Size of each file, e.g. \"512K\" or \"10M\".")
+	count := flags.Int("count", 100, "Number of files to upload.")
+	download := flags.Bool("download", true, "Download each file after uploading it.")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+
+	size, err := parseSize(*sizeString)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *count < 1 {
+		return errors.New("concurrency and count must be positive")
+	}
+
+	client := &http.Client{}
+	if *baseURL == "" {
+		*baseURL, client = s.localURL()
+	}
+
+	b := &benchmark{
+		server:  s,
+		client:  client,
+		baseURL: strings.TrimSuffix(*baseURL, "/") + "/",
+		dir:     "bench-" + randomHex(4),
+		size:    size,
+	}
+	fmt.Printf("Uploading %d files of %d bytes to %s%s/ with %d concurrent requests\n", *count, size, b.baseURL, b.dir, *concurrency)
+
+	files := make([]int, *count)
+	for n := range files {
+		files[n] = n
+	}
+
+	failed := 0
+	uploads := b.run(files, *concurrency, b.upload)
+	uploads.print(os.Stdout, "Uploads")
+	failed += uploads.failed
+	if *download {
+		downloads := b.run(uploads.ok, *concurrency, b.download)
+		downloads.print(os.Stdout, "Downloads")
+		failed += downloads.failed
+	}
+	fmt.Printf("Uploaded files have been left in %s/, remove them when done\n", b.dir)
+
+	if failed > 0 {
+		return fmt.Errorf("%d requests failed", failed)
+	}
+	return nil
+}
+
+/*
+ * Parses a size like "10M". Suffixes are powers of 1024.
+ */
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("invalid size \"\"")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size * multiplier, nil
+}
+
+/*
+ * Builds the URL of the local instance from the configuration. Clients for
+ * unix sockets connect to the socket regardless of the URL's host.
+ */
+func (s *Server) localURL() (string, *http.Client) {
+	subDir := strings.Trim(s.conf.UploadSubDir, "/")
+
+	if s.conf.UnixSocket {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", s.conf.ListenPort)
+			},
+		}
+		return "http://localhost/" + subDir, &http.Client{Transport: transport}
+	}
+
+	host, port, err := net.SplitHostPort(s.conf.ListenPort)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/" + subDir, &http.Client{}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+type benchmark struct {
+	server  *Server
+	client  *http.Client
+	baseURL string
+	dir     string
+	size    int64
+}
+
+/*
+ * Results of one kind of request
+ */
+type benchResult struct {
+	durations []time.Duration
+	ok        []int
+	failed    int
+	elapsed   time.Duration
+	size      int64
+}
+
+/*
+ * Runs request for all files with concurrent workers
+ */
+func (b *benchmark) run(files []int, concurrency int, request func(n int) (time.Duration, error)) *benchResult {
+	result := &benchResult{size: b.size}
+	var mutex sync.Mutex
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				duration, err := request(n)
+
+				mutex.Lock()
+				if err != nil {
+					log.Error(err)
+					result.failed++
+				} else {
+					result.durations = append(result.durations, duration)
+					result.ok = append(result.ok, n)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, n := range files {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+
+	result.elapsed = time.Since(start)
+	return result
+}
+
+func (b *benchmark) filePath(n int) string {
+	return path.Join(b.dir, strconv.Itoa(n)+".bin")
+}
+
+func (b *benchmark) upload(n int) (time.Duration, error) {
+	fileStorePath := b.filePath(n)
+
+	// Random contents, so compression and deduplication don't skew the results
+	content := make([]byte, b.size)
+	mathrand.New(mathrand.NewSource(time.Now().UnixNano())).Read(content)
+
+	protocolVersion := macVersions(&b.server.conf, b.server.conf.UploadSubDir)[0]
+	mac := b.server.uploadMAC(protocolVersion, fileStorePath, b.size, 0, 0)
+
+	req, err := http.NewRequest(http.MethodPut, b.baseURL+fileStorePath+"?"+protocolVersion+"="+mac, bytes.NewReader(content))
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("upload of %s failed: %s", fileStorePath, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("upload of %s failed: %s", fileStorePath, resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+func (b *benchmark) download(n int) (time.Duration, error) {
+	fileStorePath := b.filePath(n)
+	start := time.Now()
+	resp, err := b.client.Get(b.baseURL + fileStorePath)
+	if err != nil {
+		return 0, fmt.Errorf("download of %s failed: %s", fileStorePath, err)
+	}
+	defer resp.Body.Close()
+
+	received, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("download of %s failed: %s", fileStorePath, err)
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download of %s failed: %s", fileStorePath, resp.Status)
+	} else if received != b.size {
+		return 0, fmt.Errorf("download of %s failed: received %d of %d bytes", fileStorePath, received, b.size)
+	}
+	return time.Since(start), nil
+}
+
+/*
+ * Returns the p-th percentile of sorted durations
+ */
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func (r *benchResult) print(w io.Writer, name string) {
+	sort.Slice(r.durations, func(i, j int) bool { return r.durations[i] < r.durations[j] })
+
+	throughput := float64(int64(len(r.durations))*r.size) / r.elapsed.Seconds() / (1024 * 1024)
+	fmt.Fprintf(w, "%s: %d ok, %d failed, %.1f MiB/s, %.1f requests/s\n", name, len(r.durations), r.failed,
+		throughput, float64(len(r.durations))/r.elapsed.Seconds())
+	fmt.Fprintf(w, "  latency p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(r.durations, 0.5).Round(time.Millisecond),
+		percentile(r.durations, 0.9).Round(time.Millisecond),
+		percentile(r.durations, 0.99).Round(time.Millisecond),
+		percentile(r.durations, 1).Round(time.Millisecond))
+}
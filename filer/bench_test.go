@@ -0,0 +1,58 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ * Run the bench command against a test server
+ */
+func TestBench(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(s.handleRequest))
+	defer server.Close()
+
+	err := runBench([]string{"-config", writeTestConfig(t, ""), "-url", server.URL + "/upload/", "-count", "5", "-concurrency", "2", "-size", "4K"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.conf.StoreDir, "bench-*", "*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("wrong number of uploaded files: got %d want 5", len(files))
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"100": 100, "4K": 4096, "10M": 10 * 1024 * 1024, "1g": 1024 * 1024 * 1024} {
+		if size, err := parseSize(s); err != nil || size != expected {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", s, size, err, expected)
+		}
+	}
+	for _, s := range []string{"", "M", "-1K", "1.5M"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) did not fail", s)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := percentile(sorted, 0.5); p != 5 {
+		t.Errorf("wrong p50: got %d want 5", p)
+	}
+	if p := percentile(sorted, 1); p != 10 {
+		t.Errorf("wrong maximum: got %d want 10", p)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Event publishing to message brokers
+ * Events are published as JSON to a NATS subject or an MQTT topic, with the
+ * event type appended ("prosody-filer.upload", "prosody-filer/upload").
+ * Connections are opened on the first event and reopened after failures.
+ */
+
+package filer
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/url"
+	"time"
+)
+
+var brokerFailuresMetric = newCounter("prosody_filer_broker_failures_total", "Events which could not be published to a message broker, by broker.")
+
+const brokerTimeout = 10 * time.Second
+
+/*
+ * Connection to a message broker
+ */
+type brokerClient interface {
+	publish(topic string, payload []byte) error
+	close()
+}
+
+/*
+ * Publishes the configured events to a broker in the background
+ */
+func (s *Server) startBrokerPublisher(name string, client brokerClient, topic func(eventType string) string) {
+	queue := make(chan fileEvent, 100)
+
+	s.subscribeEvents(func(event fileEvent) {
+		if !eventSelected(s.conf.BrokerEvents, event.Type) {
+			return
+		}
+		select {
+		case queue <- event:
+		default:
+			log.Warn(name, " queue full, dropping ", event.Type, " event of ", event.Path)
+			brokerFailuresMetric.add(`broker="`+name+`"`, 1)
+		}
+	})
+
+	go func() {
+		for event := range queue {
+			payload, err := json.Marshal(event)
+			if err == nil {
+				err = client.publish(topic(event.Type), payload)
+			}
+			// Connections break now and then; retry once on a new one
+			if err != nil {
+				client.close()
+				err = client.publish(topic(event.Type), payload)
+			}
+			if err != nil {
+				client.close()
+				log.Errorf("Publishing %s event of %s to %s failed: %s", event.Type, event.Path, name, err)
+				brokerFailuresMetric.add(`broker="`+name+`"`, 1)
+			}
+		}
+	}()
+}
+
+/*
+ * Connects to the host of a broker URL, using TLS for the given schemes
+ */
+func brokerDial(u *url.URL, defaultPort string, tlsSchemes ...string) (net.Conn, error) {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	dialer := &net.Dialer{Timeout: brokerTimeout}
+	for _, scheme := range tlsSchemes {
+		if u.Scheme == scheme {
+			return tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: u.Hostname()})
+		}
+	}
+	return dialer.Dial("tcp", address)
+}
@@ -0,0 +1,89 @@
+/*
+ * Burn after reading
+ * Files below the prefixes in burnAfterReading are removed right after
+ * their first complete download. Range requests are answered with the
+ * whole file, so a file can't be read repeatedly in parts. While a file is
+ * being sent, other requests for it get 404 Not Found; if the download
+ * fails, the file stays available for another attempt. Downloads are never
+ * redirected, offloaded or sent precompressed, so Prosody Filer can tell
+ * whether they completed. Claims are kept per process, so in a cluster,
+ * concurrent downloads on different nodes may both receive the file.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Reports whether fileStorePath is removed after its first download
+ */
+func (s *Server) burnsAfterReading(fileStorePath string) bool {
+	for _, prefix := range s.conf.BurnAfterReading {
+		if strings.HasPrefix(fileStorePath, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * A download of a file which is burned once it has been sent completely
+ */
+type burnReader struct {
+	statusRecorder
+	s             *Server
+	r             *http.Request
+	fileStorePath string
+}
+
+/*
+ * Claims fileStorePath for a download, unless another one is in progress.
+ * Answers the request and returns false if the file can't be claimed or,
+ * in read-only mode, can't be removed afterwards.
+ */
+func (s *Server) claimBurn(w http.ResponseWriter, r *http.Request, fileStorePath string) (*burnReader, bool) {
+	if s.isReadOnly() {
+		w.Header().Set("Retry-After", s.retryAfter())
+		httpError(w, http.StatusServiceUnavailable, "file can't be downloaded during maintenance")
+		return nil, false
+	}
+
+	s.burning.Lock()
+	defer s.burning.Unlock()
+	if s.burning.paths[fileStorePath] {
+		log.Warn("Refused download of ", fileStorePath, ": being downloaded by another client")
+		httpError(w, http.StatusNotFound, "")
+		return nil, false
+	}
+	s.burning.paths[fileStorePath] = true
+	return &burnReader{statusRecorder: statusRecorder{ResponseWriter: w}, s: s, r: r, fileStorePath: fileStorePath}, true
+}
+
+/*
+ * Removes the file if it has been sent completely, and releases the claim
+ * afterwards
+ */
+func (b *burnReader) finish() {
+	defer func() {
+		b.s.burning.Lock()
+		delete(b.s.burning.paths, b.fileStorePath)
+		b.s.burning.Unlock()
+	}()
+
+	length, err := strconv.ParseInt(b.Header().Get("Content-Length"), 10, 64)
+	if b.status != http.StatusOK || err != nil || b.written != length || b.r.Context().Err() != nil {
+		if b.status == http.StatusOK {
+			log.Info("Download of ", b.fileStorePath, " incomplete, not burning it")
+		}
+		return
+	}
+	log.Info("Burning ", b.fileStorePath, " after reading")
+	if err := b.s.deleteFile(b.fileStorePath, b.s.clientIP(b.r)); err != nil && !os.IsNotExist(err) {
+		log.Error("Burning file failed: ", err)
+	}
+}
@@ -0,0 +1,73 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+/*
+ * Files below burnAfterReading are removed after their first complete
+ * download, range requests get the whole file
+ */
+func TestBurnAfterReading(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.BurnAfterReading = []string{"/once/"}
+
+	content := []byte("read me once")
+	s.uploadFile(t, "once/abc/secret.txt", content)
+	s.uploadFile(t, "abc/file.txt", content)
+	request := func(method string, fileStorePath string, header string, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/upload/"+fileStorePath, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return s.serveUpload(req)
+	}
+
+	if rr := request("HEAD", "once/abc/secret.txt", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("HEAD: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr := request("GET", "abc/file.txt", "", "")
+	if rr := request("GET", "once/abc/secret.txt", "If-None-Match", rr.Header().Get("ETag")); rr.Code != http.StatusNotModified {
+		t.Errorf("conditional download: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// A claimed file is not sent to others
+	if _, ok := s.claimBurn(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "once/abc/secret.txt"); !ok {
+		t.Fatal("claiming file failed")
+	}
+	if rr := request("GET", "once/abc/secret.txt", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("concurrent download: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	delete(s.burning.paths, "once/abc/secret.txt")
+	if _, err := os.Stat(s.storagePath("once/abc/secret.txt")); err != nil {
+		t.Fatalf("file removed before being downloaded: %v", err)
+	}
+
+	rr = request("GET", "once/abc/secret.txt", "Range", "bytes=5-")
+	if rr.Code != http.StatusOK || rr.Body.String() != string(content) {
+		t.Errorf("range request: got %v %q", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(s.storagePath("once/abc/secret.txt")); !os.IsNotExist(err) {
+		t.Errorf("file not removed after reading: %v", err)
+	}
+	if rr := request("GET", "once/abc/secret.txt", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("second download: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if len(s.burning.paths) != 0 {
+		t.Errorf("claims not released: %v", s.burning.paths)
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := request("GET", "abc/file.txt", "", ""); rr.Code != http.StatusOK {
+			t.Errorf("download outside prefix: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+}
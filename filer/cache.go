@@ -0,0 +1,311 @@
+/*
+ * Read-through disk cache for remote storage backends
+ * Files downloaded from a remote backend (S3) are kept in StoreDir, so
+ * popular files don't have to be fetched from the remote store again. The
+ * cache is limited to diskCacheSize bytes; the least recently used files
+ * are evicted first. Files are cached as stored, i.e. still encrypted.
+ * Video and audio files are cached in the background.
+ */
+
+package filer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+var (
+	cacheRequestsMetric = newCounter("prosody_filer_cache_requests_total", "Cache lookups, by cache and result.")
+	cacheSizeMetric     = newGauge("prosody_filer_cache_size_bytes", "Size of cached files, by cache.")
+)
+
+/*
+ * Storage backend serving files from the disk cache if possible
+ */
+type cachingBackend struct {
+	storage.Backend
+	cache       *diskCache
+	maxFileSize int64
+}
+
+func (c *cachingBackend) Open(fileStorePath string) (storage.File, error) {
+	if file, err := c.cache.open(fileStorePath); err == nil {
+		cacheRequestsMetric.add(`cache="disk",result="hit"`, 1)
+		return file, nil
+	}
+	cacheRequestsMetric.add(`cache="disk",result="miss"`, 1)
+
+	file, err := c.Backend.Open(fileStorePath)
+	if err != nil || file.Size() > c.maxFileSize {
+		return file, err
+	}
+
+	// Players seek right away, so media is served from the remote store
+	// while it is cached, instead of waiting for the whole file
+	if isMediaType(extensionContentType(fileStorePath)) {
+		go c.fillInBackground(fileStorePath)
+		return file, nil
+	}
+
+	cached, err := c.cache.fill(fileStorePath, file)
+	if err != nil {
+		// Serve from the remote store instead
+		log.Warn("Caching ", fileStorePath, " failed: ", err)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	file.Close()
+	return cached, nil
+}
+
+func (c *cachingBackend) fillInBackground(fileStorePath string) {
+	c.cache.mutex.Lock()
+	_, loading := c.cache.loading[cacheKey(fileStorePath)]
+	c.cache.mutex.Unlock()
+	if loading {
+		return
+	}
+
+	file, err := c.Backend.Open(fileStorePath)
+	if err != nil {
+		log.Warn("Caching ", fileStorePath, " failed: ", err)
+		return
+	}
+	defer file.Close()
+	cached, err := c.cache.fill(fileStorePath, file)
+	if err != nil {
+		log.Warn("Caching ", fileStorePath, " failed: ", err)
+		return
+	}
+	cached.Close()
+}
+
+func (c *cachingBackend) Delete(fileStorePath string) error {
+	c.cache.mutex.Lock()
+	c.cache.remove(cacheKey(fileStorePath))
+	c.cache.mutex.Unlock()
+	return c.Backend.Delete(fileStorePath)
+}
+
+func (c *cachingBackend) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	deduplicated, err := c.Backend.Replace(tmpFilename, fileStorePath, hash)
+	c.cache.mutex.Lock()
+	c.cache.remove(cacheKey(fileStorePath))
+	c.cache.mutex.Unlock()
+	return deduplicated, err
+}
+
+func (c *cachingBackend) Presign(fileStorePath string, expiry time.Duration) (string, error) {
+	signer, ok := c.Backend.(storage.Presigner)
+	if !ok {
+		return "", fmt.Errorf("storage backend does not support presigned URLs")
+	}
+	return signer.Presign(fileStorePath, expiry)
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+/*
+ * Size-bounded LRU cache of files in a directory
+ */
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Files being fetched, closed when done
+	loading map[string]chan struct{}
+}
+
+/*
+ * Opens the cache in dir, picking up files cached before
+ */
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %s", dir, err)
+	}
+
+	c := &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		loading: make(map[string]chan struct{}),
+	}
+
+	// Without access times, recently modified files are considered recently used
+	var cached []os.FileInfo
+	filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), "tmp-") {
+			os.Remove(filename)
+			return nil
+		}
+		cached = append(cached, info)
+		return nil
+	})
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+
+	c.mutex.Lock()
+	for _, info := range cached {
+		c.add(info.Name(), info.Size())
+	}
+	c.mutex.Unlock()
+
+	return c, nil
+}
+
+func cacheKey(fileStorePath string) string {
+	hash := sha256.Sum256([]byte(fileStorePath))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *diskCache) filename(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+/*
+ * Adds an entry and evicts the least recently used ones if the cache is
+ * full. Must be called with mutex held.
+ */
+func (c *diskCache) add(key string, size int64) {
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+	}
+	cacheSizeMetric.set(`cache="disk"`, float64(c.size))
+}
+
+/*
+ * Removes an entry. Must be called with mutex held.
+ */
+func (c *diskCache) remove(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.size -= element.Value.(*cacheEntry).size
+	os.Remove(c.filename(key))
+	cacheSizeMetric.set(`cache="disk"`, float64(c.size))
+}
+
+/*
+ * Opens a cached file
+ */
+func (c *diskCache) open(fileStorePath string) (storage.File, error) {
+	key := cacheKey(fileStorePath)
+
+	c.mutex.Lock()
+	element, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := storage.OpenLocalFile(c.filename(key))
+	if err != nil {
+		// Removed behind our back
+		c.mutex.Lock()
+		c.remove(key)
+		c.mutex.Unlock()
+		return nil, err
+	}
+	return file, nil
+}
+
+/*
+ * Copies a file from src into the cache and opens the cached copy.
+ * Concurrent requests for the same file wait for the first one to finish.
+ */
+func (c *diskCache) fill(fileStorePath string, src storage.File) (storage.File, error) {
+	key := cacheKey(fileStorePath)
+
+	c.mutex.Lock()
+	if done, ok := c.loading[key]; ok {
+		c.mutex.Unlock()
+		<-done
+		return c.open(fileStorePath)
+	}
+	done := make(chan struct{})
+	c.loading[key] = done
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.loading, key)
+		c.mutex.Unlock()
+		close(done)
+	}()
+
+	filename := c.filename(key)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	size, err := io.Copy(tmpFile, src)
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
+		tmpFile.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size != src.Size() {
+		return nil, fmt.Errorf("received %d of %d bytes", size, src.Size())
+	}
+
+	// Keep the modification time for Last-Modified and ETag headers
+	os.Chtimes(tmpFile.Name(), time.Now(), src.ModTime())
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.remove(key)
+	c.add(key, size)
+	c.mutex.Unlock()
+
+	return c.open(fileStorePath)
+}
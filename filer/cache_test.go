@@ -0,0 +1,74 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+ * Files from S3 must be served from the disk cache once they have been fetched
+ */
+func TestDiskCache(t *testing.T) {
+	s, fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	s.conf.DiskCacheSize = 2500
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[string][]byte{}
+	for _, name := range []string{"first", "second", "third"} {
+		contents[name] = []byte(strings.Repeat(name, 1000/len(name)+1)[:1000])
+		if status := s.uploadFile(t, "abc/"+name+".txt", contents[name]).Code; status != http.StatusCreated {
+			t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+	}
+
+	download := func(name string) {
+		req, _ := http.NewRequest("GET", "/upload/abc/"+name+".txt", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), contents[name]) {
+			t.Fatalf("download of %s failed. Status: %v", name, rr.Code)
+		}
+	}
+
+	// Fetched from S3 once, then served from the cache
+	download("first")
+	gets := fake.Gets
+	download("first")
+	if fake.Gets != gets {
+		t.Errorf("cached file has been fetched again")
+	}
+
+	// Cache holds two files: the least recently used one is evicted
+	download("second")
+	download("first")
+	download("third")
+	gets = fake.Gets
+	download("first")
+	if fake.Gets != gets {
+		t.Errorf("recently used file has been evicted")
+	}
+	download("second")
+	if fake.Gets == gets {
+		t.Errorf("least recently used file has not been evicted")
+	}
+
+	// Cached files are picked up after a restart
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+	gets = fake.Gets
+	download("second")
+	if fake.Gets != gets {
+		t.Errorf("cached file has not been picked up again")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Client supplied checksums
+ * Clients can send the SHA-256 hash of the upload (X-Content-SHA256 header
+ * or "sha256" URL parameter, hex or base64 encoded) and/or its MD5 hash
+ * (standard Content-MD5 header, base64 encoded). They are verified while
+ * the upload is received and uploads not matching them are rejected.
+ * Clients streaming an upload before knowing its hash can send
+ * X-Content-SHA256 as trailer instead, announced in the Trailer header.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	errInvalidChecksum = errors.New("invalid checksum")
+	errMissingTrailer  = errors.New("announced checksum trailer is missing")
+)
+
+/*
+ * Decodes a hex or base64 encoded checksum of the given length
+ */
+func decodeChecksum(encoded string, size int) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+
+	checksum, err := hex.DecodeString(encoded)
+	if err != nil || len(checksum) != size {
+		checksum, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(checksum) != size {
+		return nil, errInvalidChecksum
+	}
+	return checksum, nil
+}
+
+/*
+ * Returns the SHA-256 hash sent by the client or nil
+ */
+func clientSHA256(r *http.Request) ([]byte, error) {
+	encoded := r.Header.Get("X-Content-SHA256")
+	if encoded == "" {
+		encoded = r.URL.Query().Get("sha256")
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	return decodeChecksum(encoded, 32)
+}
+
+/*
+ * Returns the SHA-256 hash sent by the client as trailer or nil. Trailers
+ * are only known once the body has been read completely.
+ */
+func trailerSHA256(r *http.Request) ([]byte, error) {
+	values, announced := r.Trailer[http.CanonicalHeaderKey("X-Content-SHA256")]
+	if !announced {
+		return nil, nil
+	} else if len(values) == 0 {
+		return nil, errMissingTrailer
+	}
+	return decodeChecksum(values[0], 32)
+}
+
+/*
+ * Returns the MD5 hash from the Content-MD5 header or nil
+ */
+func clientMD5(r *http.Request) ([]byte, error) {
+	encoded := r.Header.Get("Content-MD5")
+	if encoded == "" {
+		return nil, nil
+	}
+
+	checksum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(checksum) != md5.Size {
+		return nil, errInvalidChecksum
+	}
+	return checksum, nil
+}
+
+/*
+ * Reports whether a received hash matches the expected one, if any
+ */
+func checksumMatches(expected []byte, received []byte) bool {
+	return expected == nil || bytes.Equal(expected, received)
+}
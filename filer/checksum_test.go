@@ -0,0 +1,147 @@
+package filer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Uploads must be rejected if they don't match the checksum sent by the client
+ */
+func TestUploadClientChecksum(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte("photo taken on a train with bad reception")
+	sum := sha256.Sum256(content)
+
+	tests := []struct {
+		fileStorePath string
+		header        string
+		param         string
+		want          int
+	}{
+		{"abc/hex.txt", hex.EncodeToString(sum[:]), "", http.StatusCreated},
+		{"abc/base64.txt", base64.StdEncoding.EncodeToString(sum[:]), "", http.StatusCreated},
+		{"abc/param.txt", "", hex.EncodeToString(sum[:]), http.StatusCreated},
+		{"abc/mismatch.txt", hex.EncodeToString(make([]byte, 32)), "", http.StatusUnprocessableEntity},
+		{"abc/malformed.txt", "not a checksum", "", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := s.newUploadRequest(t, test.fileStorePath, content)
+		if test.header != "" {
+			req.Header.Set("X-Content-SHA256", test.header)
+		}
+		if test.param != "" {
+			q := req.URL.Query()
+			q.Add("sha256", test.param)
+			req.URL.RawQuery = q.Encode()
+		}
+
+		if status := s.serveUpload(req).Code; status != test.want {
+			t.Errorf("upload of %s returned wrong status code: got %v want %v", test.fileStorePath, status, test.want)
+		}
+
+		_, err := os.Stat(filepath.Join(s.conf.StoreDir, test.fileStorePath))
+		if stored := err == nil; stored != (test.want == http.StatusCreated) {
+			t.Errorf("upload of %s: stored = %v", test.fileStorePath, stored)
+		}
+	}
+}
+
+/*
+ * Content-MD5 must be verified on uploads and sent on downloads if configured
+ */
+func TestContentMD5(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.SendContentMD5 = true
+
+	content := []byte("mirrored with generic HTTP tools")
+	sum := md5.Sum(content)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	req := s.newUploadRequest(t, "abc/wrong.txt", content)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)))
+	if status := s.serveUpload(req).Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("upload with wrong Content-MD5 returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+
+	req = s.newUploadRequest(t, "abc/right.txt", content)
+	req.Header.Set("Content-MD5", contentMD5)
+	if status := s.serveUpload(req).Code; status != http.StatusCreated {
+		t.Fatalf("upload with correct Content-MD5 returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, _ = http.NewRequest(method, "/upload/abc/right.txt", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-MD5"); got != contentMD5 {
+			t.Errorf("%s returned wrong Content-MD5: got %q want %q", method, got, contentMD5)
+		}
+	}
+}
+
+/*
+ * Streaming uploads can send their checksum as trailer
+ */
+func TestTrailerChecksum(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ChunkedUploads = "verify"
+	s.conf.MaxFileSize = 1024
+	server := httptest.NewServer(s.withMiddleware(http.HandlerFunc(s.handleRequest)))
+	defer server.Close()
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("streamed with trailer")
+	hash := sha256.Sum256(content)
+	upload := func(fileStorePath string, trailer http.Header) int {
+		signed := s.newUploadRequest(t, fileStorePath, content)
+		// Without Content-Length, so the body is sent chunked, followed by the trailer
+		req, err := http.NewRequest("PUT", server.URL+signed.URL.RequestURI(), io.MultiReader(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Trailer = trailer
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := upload("abc/ok.txt", http.Header{"X-Content-Sha256": {hex.EncodeToString(hash[:])}}); status != http.StatusCreated {
+		t.Errorf("upload with matching trailer: got %v want %v", status, http.StatusCreated)
+	}
+	if status := upload("abc/damaged.txt", http.Header{"X-Content-Sha256": {hex.EncodeToString(make([]byte, 32))}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("upload with wrong trailer: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+	if _, err := os.Stat(filepath.Join(s.conf.StoreDir, "abc/damaged.txt")); !os.IsNotExist(err) {
+		t.Errorf("upload not matching trailer has been stored")
+	}
+	if status := upload("abc/missing.txt", http.Header{"X-Content-Sha256": nil}); status != http.StatusBadRequest {
+		t.Errorf("upload with announced but missing trailer: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * ClamAV integration
+ * Uploads are streamed to clamd using the INSTREAM command while they are
+ * being received. Also see: https://linux.die.net/man/8/clamd
+ */
+
+package filer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+ * A running INSTREAM scan
+ */
+type clamdScan struct {
+	conn    net.Conn
+	timeout time.Duration
+	err     error
+}
+
+/*
+ * Connects to clamd. The address is either a unix socket path
+ * ("/run/clamav/clamd.ctl", "unix:/run/clamav/clamd.ctl") or a TCP
+ * address ("127.0.0.1:3310", "tcp:127.0.0.1:3310").
+ */
+func (s *Server) clamdDial() (net.Conn, error) {
+	network, address := "tcp", s.conf.ClamdAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	} else if strings.HasPrefix(address, "tcp:") {
+		address = strings.TrimPrefix(address, "tcp:")
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	return net.DialTimeout(network, address, s.conf.ClamdTimeout)
+}
+
+/*
+ * Opens a connection to clamd and starts a new INSTREAM scan
+ */
+func (s *Server) startClamdScan() (*clamdScan, error) {
+	conn, err := s.clamdDial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %s", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(s.conf.ClamdTimeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start clamd scan: %s", err)
+	}
+
+	return &clamdScan{conn: conn, timeout: s.conf.ClamdTimeout}, nil
+}
+
+/*
+ * Sends a chunk of the upload to clamd.
+ * Errors are remembered and reported by finish(), so a failing scanner
+ * never interrupts receiving the upload itself.
+ */
+func (s *clamdScan) Write(p []byte) (int, error) {
+	if s.err != nil || len(p) == 0 {
+		return len(p), nil
+	}
+
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	// Every chunk is prefixed with its length as 4 byte unsigned integer in network byte order
+	chunk := make([]byte, 4, 4+len(p))
+	binary.BigEndian.PutUint32(chunk, uint32(len(p)))
+	chunk = append(chunk, p...)
+
+	if _, err := s.conn.Write(chunk); err != nil {
+		s.err = err
+	}
+
+	return len(p), nil
+}
+
+/*
+ * Ends the stream and waits for the verdict. Returns the name of the
+ * detected signature or an empty string if the upload is clean.
+ */
+func (s *clamdScan) finish() (string, error) {
+	if s.err != nil {
+		return "", fmt.Errorf("failed to stream upload to clamd: %s", s.err)
+	}
+
+	// A zero length chunk marks the end of the stream
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", fmt.Errorf("failed to stream upload to clamd: %s", err)
+	}
+
+	reply, err := bufio.NewReader(s.conn).ReadString('\x00')
+	reply = strings.TrimRight(reply, "\x00\n")
+	if reply == "" && err != nil {
+		return "", fmt.Errorf("failed to read clamd reply: %s", err)
+	}
+
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	default:
+		return "", fmt.Errorf("clamd scan failed: %s", reply)
+	}
+}
+
+/*
+ * Closes the connection to clamd
+ */
+func (s *clamdScan) close() {
+	s.conn.Close()
+}
+
+/*
+ * Decides what happens to an upload which could not be scanned.
+ * Returns nil if the upload may be accepted anyway.
+ */
+func (s *Server) handleScannerFailure(err error) error {
+	if s.conf.ClamdFailureMode == "accept" {
+		log.Warn("Accepting upload without virus scan: ", err)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,129 @@
+package filer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Starts a fake clamd which answers every INSTREAM scan with reply.
+ * Returns the address to be used as clamdAddress.
+ */
+func fakeClamd(t *testing.T, reply string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil {
+					return
+				}
+
+				// Read chunks until the terminating zero length chunk
+				for {
+					var size uint32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(io.Discard, conn, int64(size)); err != nil {
+						return
+					}
+				}
+
+				conn.Write([]byte(reply + "\x00"))
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+/*
+ * Upload a clean file with virus scanning enabled
+ */
+func TestUploadClamdClean(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ClamdAddress = fakeClamd(t, "stream: OK")
+
+	// Check status code
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Upload an infected file. It must be rejected and not be stored.
+ */
+func TestUploadClamdInfected(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ClamdAddress = fakeClamd(t, "stream: Eicar-Signature FOUND")
+
+	// Check status code
+	if status := s.uploadCatmetal(t).Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Check that the file was not stored
+	if _, err := os.Stat(filepath.Join(s.conf.StoreDir, "thomas/abc/catmetal.jpg")); err == nil {
+		t.Errorf("infected file has been stored")
+	}
+}
+
+/*
+ * Upload while clamd is unreachable, using both failure modes
+ */
+func TestUploadClamdUnavailable(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Reserve an address nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conf.ClamdAddress = listener.Addr().String()
+	listener.Close()
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+
+	s.conf.ClamdFailureMode = "accept"
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
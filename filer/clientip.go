@@ -0,0 +1,144 @@
+/*
+ * Client addresses
+ * Behind a reverse proxy, the address of the client is taken from the
+ * X-Forwarded-For header, if the request comes from one of trustedProxies
+ * or through the unix socket. X-Forwarded-Proto and X-Forwarded-Host of
+ * these requests name the scheme and host clients used, for absolute URLs
+ * and logs. With forwardedPrefix, X-Forwarded-Prefix names the path prefix
+ * the proxy stripped.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/*
+ * Parses trustedProxies, which are addresses or networks in CIDR notation
+ */
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trustedProxies entry %q: %s", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Reports whether r comes from one of trustedProxies or through the unix
+ * socket
+ */
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return (ip == nil && s.conf.UnixSocket) || (ip != nil && s.isTrustedProxy(ip))
+}
+
+/*
+ * Returns the path prefix a trusted proxy stripped from r, e.g. "/chat",
+ * or "" if there is none or forwardedPrefix is not set
+ */
+func (s *Server) forwardedPrefix(r *http.Request) string {
+	prefix := r.Header.Get("X-Forwarded-Prefix")
+	if !s.conf.ForwardedPrefix || prefix == "" || !s.fromTrustedProxy(r) {
+		return ""
+	}
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+/*
+ * Returns the scheme the client used for r, "http" or "https"
+ */
+func (s *Server) requestScheme(r *http.Request) string {
+	if s.fromTrustedProxy(r) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+/*
+ * Returns the host the client sent r to
+ */
+func (s *Server) requestHost(r *http.Request) string {
+	if s.fromTrustedProxy(r) {
+		if host := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+/*
+ * Returns the address of the client which sent r. X-Forwarded-For is
+ * followed from the right, as long as the addresses belong to trusted
+ * proxies.
+ */
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if !s.fromTrustedProxy(r) {
+		if ip == nil {
+			return host
+		}
+		return ip.String()
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
@@ -0,0 +1,117 @@
+package filer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.trustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+
+	for _, test := range []struct {
+		remoteAddr    string
+		forwardedFor  string
+		expectedIP    string
+		unixSocketReq bool
+	}{
+		{"192.0.2.1:4711", "", "192.0.2.1", false},
+		{"192.0.2.1:4711", "198.51.100.1", "192.0.2.1", false},
+		{"127.0.0.1:4711", "", "127.0.0.1", false},
+		{"127.0.0.1:4711", "198.51.100.1", "198.51.100.1", false},
+		{"127.0.0.1:4711", "198.51.100.1, 10.1.2.3", "198.51.100.1", false},
+		{"127.0.0.1:4711", "203.0.113.1, 198.51.100.1", "198.51.100.1", false},
+		{"127.0.0.1:4711", "garbage", "127.0.0.1", false},
+		{"[2001:db8::1]:4711", "", "2001:db8::1", false},
+		{"@", "198.51.100.1", "198.51.100.1", true},
+		{"@", "198.51.100.1", "@", false},
+	} {
+		s.conf.UnixSocket = test.unixSocketReq
+		req, _ := http.NewRequest("GET", "/upload/abc/cat.jpg", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if ip := s.clientIP(req); ip != test.expectedIP {
+			t.Errorf("clientIP(%s, X-Forwarded-For %q) = %s, want %s", test.remoteAddr, test.forwardedFor, ip, test.expectedIP)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"localhost"}); err == nil {
+		t.Error("invalid proxy address has been accepted")
+	}
+}
+
+/*
+ * MACs signed for the path in front of a proxy stripping a prefix
+ */
+func TestForwardedPrefix(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ForwardedPrefix = true
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("behind a proxy")
+	for _, test := range []struct {
+		remoteAddr string
+		prefix     string
+		want       int
+	}{
+		{"127.0.0.1:1234", "", http.StatusForbidden},
+		{"192.0.2.1:1234", "/chat", http.StatusForbidden},
+		{"127.0.0.1:1234", "/chat/", http.StatusCreated},
+	} {
+		req := s.newUploadRequest(t, "chat/abc/file.txt", content)
+		req.URL.Path = "/upload/abc/file.txt"
+		req.RemoteAddr = test.remoteAddr
+		if test.prefix != "" {
+			req.Header.Set("X-Forwarded-Prefix", test.prefix)
+		}
+		if rr := s.serveUpload(req); rr.Code != test.want {
+			t.Errorf("%s with prefix %q: got %v want %v", test.remoteAddr, test.prefix, rr.Code, test.want)
+		}
+	}
+	if exists, _ := s.backend.Exists("abc/file.txt"); !exists {
+		t.Errorf("upload not stored below its internal path")
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/abc/file.txt", nil)
+	req.Host = "upload.example.com"
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Prefix", "/chat")
+	if base := s.requestBaseURL(req); base != "http://upload.example.com/chat" {
+		t.Errorf("got base URL %s", base)
+	}
+}
+
+func TestForwardedProtoAndHost(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, test := range []struct {
+		remoteAddr string
+		proto      string
+		host       string
+		want       string
+	}{
+		{"127.0.0.1:1234", "", "", "http://filer.internal:5050"},
+		{"127.0.0.1:1234", "https", "upload.example.com", "https://upload.example.com"},
+		{"127.0.0.1:1234", "HTTPS, http", "upload.example.com, other.example.com", "https://upload.example.com"},
+		{"127.0.0.1:1234", "gopher", "", "http://filer.internal:5050"},
+		{"192.0.2.1:1234", "https", "evil.example.com", "http://filer.internal:5050"},
+	} {
+		req, _ := http.NewRequest("GET", "/upload/abc/file.txt", nil)
+		req.Host = "filer.internal:5050"
+		req.RemoteAddr = test.remoteAddr
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if test.host != "" {
+			req.Header.Set("X-Forwarded-Host", test.host)
+		}
+		if base := s.requestBaseURL(req); base != test.want {
+			t.Errorf("%s with %q %q: got %s want %s", test.remoteAddr, test.proto, test.host, base, test.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Cluster mode
+ * Several filers behind a load balancer share an object storage backend
+ * and keep metadata, short URLs and quarantined files in clusterDir, a
+ * directory shared by all nodes (e.g. NFS). Periodic cleanups only run on
+ * the node holding the leader lease in clusterDir, which is taken over by
+ * another node once it hasn't been renewed for clusterLeaseDuration.
+ */
+
+package filer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const clusterLeaseDuration = time.Minute
+
+var clusterLeaderMetric = newGauge("prosody_filer_cluster_leader", "1 if this node runs the periodic cleanups of the cluster.")
+
+/*
+ * Lease of the leader node, stored in clusterDir
+ */
+type clusterLease struct {
+	Node    string    `json:"node"`
+	Expires time.Time `json:"expires"`
+}
+
+/*
+ * Returns the absolute path of an element in the directory shared by all
+ * nodes of a cluster, which is the internal directory without cluster mode
+ */
+func (s *Server) sharedPath(elem ...string) string {
+	if s.conf.ClusterDir == "" {
+		return s.internalPath(elem...)
+	}
+	return filepath.Join(append([]string{s.conf.ClusterDir}, elem...)...)
+}
+
+/*
+ * Determines the name of this node and creates the shared directory
+ */
+func (s *Server) setupCluster() error {
+	if s.conf.ClusterDir == "" {
+		return nil
+	}
+
+	s.cluster.node = s.conf.ClusterNode
+	if s.cluster.node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine clusterNode: %s", err)
+		}
+		s.cluster.node = hostname
+	}
+	if err := os.MkdirAll(s.conf.ClusterDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create clusterDir: %s", err)
+	}
+	return nil
+}
+
+/*
+ * Reports whether this node runs the periodic cleanups. Without cluster
+ * mode, it always does.
+ */
+func (s *Server) isClusterLeader() bool {
+	return s.conf.ClusterDir == "" || atomic.LoadInt32(&s.cluster.leader) == 1
+}
+
+/*
+ * Takes or renews the leader lease periodically
+ */
+func (s *Server) startClusterLease() {
+	go func() {
+		for {
+			s.renewClusterLease()
+			time.Sleep(clusterLeaseDuration / 3)
+		}
+	}()
+}
+
+func (s *Server) renewClusterLease() {
+	leader, err := s.acquireClusterLease()
+	if err != nil {
+		log.Error("Cluster lease: ", err)
+	}
+
+	value := int32(0)
+	if leader {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.cluster.leader, value) != value {
+		if leader {
+			log.Info("Node ", s.cluster.node, " is now the cluster leader")
+		} else {
+			log.Info("Node ", s.cluster.node, " is no longer the cluster leader")
+		}
+	}
+	clusterLeaderMetric.set("", float64(value))
+}
+
+/*
+ * Reads the current leader lease. Returns an empty lease if there is none.
+ */
+func readClusterLease(leasePath string) (clusterLease, error) {
+	var current clusterLease
+	data, err := os.ReadFile(leasePath)
+	if os.IsNotExist(err) {
+		return current, nil
+	} else if err != nil {
+		return current, err
+	}
+	return current, json.Unmarshal(data, &current)
+}
+
+/*
+ * Reports whether this node holds the leader lease, taking it if it is
+ * free or expired. The lease is only written while holding an exclusively
+ * created lock file and after reading it again, so nodes taking over an
+ * expired lease at the same time, or a node renewing a lease which has
+ * been taken over meanwhile, can't overwrite each other's lease.
+ */
+func (s *Server) acquireClusterLease() (bool, error) {
+	leasePath := filepath.Join(s.conf.ClusterDir, "leader.json")
+	current, err := readClusterLease(leasePath)
+	if err != nil {
+		return false, err
+	} else if current.Node != s.cluster.node && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	lockPath := filepath.Join(s.conf.ClusterDir, "leader.lock")
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// The lock is only held while writing the lease, so an old one has been left by a node
+		// which crashed meanwhile. Nodes removing it only try to lock again in their next round.
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > clusterLeaseDuration {
+			log.Warn("Removing stale cluster lock")
+			os.Remove(lockPath)
+		}
+		return current.Node == s.cluster.node && time.Now().Before(current.Expires), nil
+	} else if err != nil {
+		return false, err
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	// Another node may have taken the lease since it has been read
+	current, err = readClusterLease(leasePath)
+	if err != nil {
+		return false, err
+	} else if current.Node != s.cluster.node && time.Now().Before(current.Expires) {
+		return false, nil
+	}
+
+	lease := clusterLease{Node: s.cluster.node, Expires: time.Now().Add(clusterLeaseDuration).UTC()}
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	tmpFilename := leasePath + "." + s.cluster.node + ".tmp"
+	if err := os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFilename, leasePath); err != nil {
+		os.Remove(tmpFilename)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,129 @@
+package filer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * One node holds the leader lease, another one takes it over once it
+ * expires
+ */
+func TestClusterLease(t *testing.T) {
+	dir := t.TempDir()
+	node := func(name string) *Server {
+		s := newTestServer(t)
+		s.conf.ClusterDir = dir
+		s.conf.ClusterNode = name
+		if err := s.setupCluster(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a, b := node("a"), node("b")
+
+	a.renewClusterLease()
+	b.renewClusterLease()
+	if !a.isClusterLeader() || b.isClusterLeader() {
+		t.Fatalf("leaders after start: a %v, b %v", a.isClusterLeader(), b.isClusterLeader())
+	}
+
+	// Renewed by the leader
+	a.renewClusterLease()
+	b.renewClusterLease()
+	if !a.isClusterLeader() || b.isClusterLeader() {
+		t.Errorf("leaders after renewal: a %v, b %v", a.isClusterLeader(), b.isClusterLeader())
+	}
+
+	// Node a stops renewing
+	data, _ := json.Marshal(clusterLease{Node: "a", Expires: time.Now().Add(-time.Second)})
+	os.WriteFile(filepath.Join(dir, "leader.json"), data, 0644)
+	b.renewClusterLease()
+	a.renewClusterLease()
+	if a.isClusterLeader() || !b.isClusterLeader() {
+		t.Errorf("leaders after expiry: a %v, b %v", a.isClusterLeader(), b.isClusterLeader())
+	}
+}
+
+/*
+ * Only one of several nodes taking over an expired lease at the same time
+ * may become leader
+ */
+func TestClusterLeaseTakeover(t *testing.T) {
+	dir := t.TempDir()
+	var nodes []*Server
+	for _, name := range []string{"a", "b", "c", "d"} {
+		s := newTestServer(t)
+		s.conf.ClusterDir = dir
+		s.conf.ClusterNode = name
+		if err := s.setupCluster(); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, s)
+	}
+
+	for round := 0; round < 50; round++ {
+		data, _ := json.Marshal(clusterLease{Node: "gone", Expires: time.Now().Add(-time.Second)})
+		os.WriteFile(filepath.Join(dir, "leader.json"), data, 0644)
+
+		var wg sync.WaitGroup
+		var leaders int32
+		for _, s := range nodes {
+			wg.Add(1)
+			go func(s *Server) {
+				defer wg.Done()
+				if leader, err := s.acquireClusterLease(); err != nil {
+					t.Error(err)
+				} else if leader {
+					atomic.AddInt32(&leaders, 1)
+				}
+			}(s)
+		}
+		wg.Wait()
+		if leaders != 1 {
+			t.Fatalf("round %d: %d nodes took over the lease", round, leaders)
+		}
+	}
+
+	// A lock left by a crashed node is removed
+	lockPath := filepath.Join(dir, "leader.lock")
+	os.WriteFile(lockPath, nil, 0644)
+	old := time.Now().Add(-2 * clusterLeaseDuration)
+	os.Chtimes(lockPath, old, old)
+	data, _ := json.Marshal(clusterLease{Node: "gone", Expires: time.Now().Add(-time.Second)})
+	os.WriteFile(filepath.Join(dir, "leader.json"), data, 0644)
+	if leader, _ := nodes[0].acquireClusterLease(); leader {
+		t.Error("lease taken while locked")
+	}
+	if leader, err := nodes[0].acquireClusterLease(); !leader || err != nil {
+		t.Errorf("lease not taken after removing stale lock: %v", err)
+	}
+}
+
+/*
+ * Metadata written by one node is read by the others
+ */
+func TestClusterSharedMetadata(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ClusterDir = t.TempDir()
+	s.uploadFile(t, "abc/shared.txt", []byte("shared"))
+
+	if _, err := os.Stat(filepath.Join(s.conf.ClusterDir, "meta", "abc", "shared.txt.json")); err != nil {
+		t.Errorf("metadata not stored in clusterDir: %s", err)
+	}
+	other := newTestServer(t)
+	other.conf.ClusterDir = s.conf.ClusterDir
+	if meta, err := other.readMetadata("abc/shared.txt"); err != nil || meta.Size != 6 {
+		t.Errorf("metadata not shared: %+v, %v", meta, err)
+	}
+}
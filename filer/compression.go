@@ -0,0 +1,296 @@
+/*
+ * Compression at rest
+ * Files are compressed with zstd before they are stored (and encrypted, if
+ * configured) and decompressed on download. Formats which are compressed
+ * already are stored as they are.
+ *
+ * Content is compressed in independent frames of 1 MiB, so ranges can be
+ * read without decompressing everything before them. The frames are
+ * followed by a table of their compressed sizes (4 bytes each), the number
+ * of frames (4 bytes) and the uncompressed size (8 bytes).
+ */
+
+package filer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionFrameSize = 1024 * 1024
+
+	// Number of frames and uncompressed size
+	compressionTrailerLen = 12
+)
+
+/*
+ * Content types which don't get smaller by compressing them again
+ */
+var compressedContentTypes = map[string]bool{
+	"application/gzip":                        true,
+	"application/x-gzip":                      true,
+	"application/zip":                         true,
+	"application/x-zip-compressed":            true,
+	"application/x-7z-compressed":             true,
+	"application/x-rar-compressed":            true,
+	"application/vnd.rar":                     true,
+	"application/x-bzip2":                     true,
+	"application/x-xz":                        true,
+	"application/zstd":                        true,
+	"application/x-brotli":                    true,
+	"application/java-archive":                true,
+	"application/vnd.android.package-archive": true,
+	"application/epub+zip":                    true,
+	"application/wasm":                        true,
+}
+
+func isCompressedContentType(contentType string) bool {
+	family := strings.SplitN(contentType, "/", 2)[0]
+	switch {
+	case contentType == "image/svg+xml" || contentType == "image/bmp" || contentType == "image/x-ms-bmp" || contentType == "image/tiff":
+		return false
+	case family == "image" || family == "audio" || family == "video":
+		return true
+	case strings.HasPrefix(contentType, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(contentType, "application/vnd.oasis.opendocument."):
+		// Zip containers
+		return true
+	}
+	return compressedContentTypes[contentType]
+}
+
+/*
+ * Decides whether an upload is worth compressing, going by its file
+ * extension and its first bytes
+ */
+func shouldCompress(fileStorePath string, head []byte) bool {
+	if isCompressedContentType(extensionContentType(fileStorePath)) {
+		return false
+	}
+
+	sniffed := http.DetectContentType(head)
+	if i := strings.Index(sniffed, ";"); i >= 0 {
+		sniffed = sniffed[:i]
+	}
+	return !isCompressedContentType(sniffed)
+}
+
+/*
+ * Compresses everything written to it. Close() writes the frame table and
+ * closes dst.
+ */
+type compressingWriter struct {
+	dst        io.WriteCloser
+	encoder    *zstd.Encoder
+	buf        []byte
+	frameSizes []uint32
+	size       int64
+}
+
+func (s *Server) newCompressingWriter(dst io.WriteCloser) (*compressingWriter, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.conf.CompressionLevel)),
+		zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &compressingWriter{dst: dst, encoder: encoder, buf: make([]byte, 0, compressionFrameSize)}, nil
+}
+
+func (c *compressingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(c.buf[len(c.buf):cap(c.buf)], p)
+		c.buf = c.buf[:len(c.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(c.buf) == compressionFrameSize {
+			if err := c.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (c *compressingWriter) flush() error {
+	frame := c.encoder.EncodeAll(c.buf, nil)
+	c.frameSizes = append(c.frameSizes, uint32(len(frame)))
+	c.size += int64(len(c.buf))
+	c.buf = c.buf[:0]
+
+	_, err := c.dst.Write(frame)
+	return err
+}
+
+func (c *compressingWriter) Close() error {
+	if len(c.buf) > 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 4*len(c.frameSizes)+compressionTrailerLen)
+	for i, frameSize := range c.frameSizes {
+		binary.BigEndian.PutUint32(trailer[4*i:], frameSize)
+	}
+	binary.BigEndian.PutUint32(trailer[len(trailer)-12:], uint32(len(c.frameSizes)))
+	binary.BigEndian.PutUint64(trailer[len(trailer)-8:], uint64(c.size))
+	if _, err := c.dst.Write(trailer); err != nil {
+		return err
+	}
+	return c.dst.Close()
+}
+
+/*
+ * Decompresses a file, allowing random access
+ */
+type decompressingReader struct {
+	src     io.ReadSeeker
+	decoder *zstd.Decoder
+	size    int64
+	pos     int64
+
+	// Offsets of the frames in src, followed by the offset of the frame table
+	frameOffsets []int64
+
+	buf      []byte
+	bufFrame int
+}
+
+/*
+ * Sets up decompression of src, which contains srcSize bytes of compressed
+ * frames and frame table
+ */
+func newDecompressingReader(src io.ReadSeeker, srcSize int64) (*decompressingReader, error) {
+	if srcSize < compressionTrailerLen {
+		return nil, errors.New("truncated compressed file")
+	}
+
+	trailer := make([]byte, compressionTrailerLen)
+	if _, err := src.Seek(srcSize-compressionTrailerLen, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, trailer); err != nil {
+		return nil, err
+	}
+	frames := int64(binary.BigEndian.Uint32(trailer))
+	size := int64(binary.BigEndian.Uint64(trailer[4:]))
+
+	tableOffset := srcSize - compressionTrailerLen - 4*frames
+	if tableOffset < 0 || size > frames*compressionFrameSize || size <= (frames-1)*compressionFrameSize {
+		return nil, fmt.Errorf("invalid frame table")
+	}
+
+	table := make([]byte, 4*frames)
+	if _, err := src.Seek(tableOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, table); err != nil {
+		return nil, err
+	}
+
+	frameOffsets := make([]int64, frames+1)
+	for i := int64(0); i < frames; i++ {
+		frameOffsets[i+1] = frameOffsets[i] + int64(binary.BigEndian.Uint32(table[4*i:]))
+	}
+	if frameOffsets[frames] != tableOffset {
+		return nil, fmt.Errorf("invalid frame table")
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &decompressingReader{
+		src:          src,
+		decoder:      decoder,
+		size:         size,
+		frameOffsets: frameOffsets,
+		bufFrame:     -1,
+	}, nil
+}
+
+/*
+ * Size of the decompressed content
+ */
+func (d *decompressingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	frame := int(d.pos / compressionFrameSize)
+	if frame != d.bufFrame {
+		if err := d.loadFrame(frame); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf[d.pos%compressionFrameSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decompressingReader) loadFrame(frame int) error {
+	compressed := make([]byte, d.frameOffsets[frame+1]-d.frameOffsets[frame])
+	if _, err := d.src.Seek(d.frameOffsets[frame], io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(d.src, compressed); err != nil {
+		return err
+	}
+
+	buf, err := d.decoder.DecodeAll(compressed, d.buf[:0])
+	if err != nil {
+		return fmt.Errorf("failed to decompress frame %d: %s", frame, err)
+	}
+
+	// All frames but the last one are complete
+	want := int64(compressionFrameSize)
+	if frame == len(d.frameOffsets)-2 {
+		want = d.size - int64(frame)*compressionFrameSize
+	}
+	if int64(len(buf)) != want {
+		return fmt.Errorf("frame %d has wrong size", frame)
+	}
+
+	d.buf = buf
+	d.bufFrame = frame
+	return nil
+}
+
+func (d *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decompressingReader) Close() error {
+	d.decoder.Close()
+	return nil
+}
@@ -0,0 +1,188 @@
+package filer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+ * Compressed formats must be stored as they are
+ */
+func TestShouldCompress(t *testing.T) {
+	jpeg, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		head []byte
+		want bool
+	}{
+		{"abc/server.log", []byte("2024-01-01 something happened\n"), true},
+		{"abc/report.csv", []byte("a,b,c\n1,2,3\n"), true},
+		{"abc/cat.jpg", jpeg[:sniffLen], false},
+		{"abc/archive.zip", []byte("PK\x03\x04"), false},
+		{"abc/backup.bin", []byte("\x1f\x8b\x08\x00"), false},
+		{"abc/document.docx", []byte("PK\x03\x04"), false},
+		{"abc/drawing.svg", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), true},
+	}
+
+	for _, test := range tests {
+		if got := shouldCompress(test.path, test.head); got != test.want {
+			t.Errorf("shouldCompress(%s) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+/*
+ * Upload a compressible file and download it again, with and without encryption
+ */
+func TestUploadCompressed(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, key := range []string{"", testEncryptionKey} {
+		func() {
+			// Remove uploaded file after test
+			defer s.cleanup()
+
+			// Set config
+			s.conf.CompressFiles = true
+			s.conf.EncryptionKey = key
+			if err := s.loadEncryptionKey(); err != nil {
+				t.Fatal(err)
+			}
+
+			content := []byte(strings.Repeat("Jan 01 00:00:00 host daemon[123]: something happened\n", 5000))
+			if status := s.uploadFile(t, "thomas/abc/daemon.log", content).Code; status != http.StatusCreated {
+				t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+			}
+
+			stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/daemon.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) >= len(content)/10 {
+				t.Errorf("file has not been stored compressed: %d bytes", len(stored))
+			}
+
+			req, _ := http.NewRequest("GET", "/upload/thomas/abc/daemon.log", nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+				t.Errorf("download did not return original content. Status: %v", rr.Code)
+			}
+
+			// Range requests must work on decompressed content
+			req, _ = http.NewRequest("GET", "/upload/thomas/abc/daemon.log", nil)
+			req.Header.Set("Range", "bytes=100000-100099")
+			rr = httptest.NewRecorder()
+			http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+			if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), content[100000:100100]) {
+				t.Errorf("range request failed. Status: %v", rr.Code)
+			}
+		}()
+	}
+}
+
+/*
+ * Seeking backwards and forwards must return the right content
+ */
+func TestDecompressingReaderSeek(t *testing.T) {
+	s := newTestServer(t)
+
+	content := []byte(strings.Repeat("0123456789abcdef", 200000))
+	var compressed bytes.Buffer
+	writer, err := s.newCompressingWriter(nopWriteCloser{&compressed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(content)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := newDecompressingReader(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if reader.Size() != int64(len(content)) {
+		t.Fatalf("wrong size: got %d want %d", reader.Size(), len(content))
+	}
+
+	part := make([]byte, 10)
+	for _, offset := range []int64{2000000, 5, 1234567, 0, 3199990} {
+		reader.Seek(offset, io.SeekStart)
+		if _, err := io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+10]) {
+			t.Errorf("read at %d returned %q, %v", offset, part, err)
+		}
+	}
+}
+
+/*
+ * Range requests must work on files stored with any combination of encodings
+ */
+func TestRangeRequestsThroughLayers(t *testing.T) {
+	s := newTestServer(t)
+
+	content := make([]byte, 2*compressionFrameSize+12345)
+	for i := range content {
+		content[i] = byte(i * 7 / 1000)
+	}
+
+	for _, compress := range []bool{false, true} {
+		for _, key := range []string{"", testEncryptionKey} {
+			func() {
+				// Remove uploaded file after test
+				defer s.cleanup()
+
+				// Set config
+				s.conf.CompressFiles = compress
+				s.conf.EncryptionKey = key
+				if err := s.loadEncryptionKey(); err != nil {
+					t.Fatal(err)
+				}
+
+				if status := s.uploadFile(t, "thomas/abc/large.log", content).Code; status != http.StatusCreated {
+					t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+				}
+
+				request := func(method string, ranges string) *httptest.ResponseRecorder {
+					req, _ := http.NewRequest(method, "/upload/thomas/abc/large.log", nil)
+					req.Header.Set("Range", ranges)
+					rr := httptest.NewRecorder()
+					http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+					return rr
+				}
+
+				// Resume an interrupted download
+				offset := compressionFrameSize + 100
+				rr := request("GET", "bytes="+strconv.Itoa(offset)+"-")
+				if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), content[offset:]) {
+					t.Errorf("compress=%v, encrypted=%v: resuming failed. Status: %v", compress, key != "", rr.Code)
+				}
+
+				// Several ranges, in reverse order
+				rr = request("GET", "bytes=2000000-2000009,10-19")
+				body := rr.Body.String()
+				if rr.Code != http.StatusPartialContent || !strings.Contains(body, string(content[2000000:2000010])) || !strings.Contains(body, string(content[10:20])) {
+					t.Errorf("compress=%v, encrypted=%v: multiple ranges failed. Status: %v", compress, key != "", rr.Code)
+				}
+
+				rr = request("HEAD", "")
+				if rr.Header().Get("Accept-Ranges") != "bytes" || rr.Header().Get("Content-Length") != strconv.Itoa(len(content)) {
+					t.Errorf("compress=%v, encrypted=%v: wrong HEAD headers: %v", compress, key != "", rr.Header())
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Uploads to existing paths
+ * By default, stored files are never replaced (conflictPolicy "reject").
+ * Gateways which reuse upload slots can have stored files replaced by
+ * uploads with a valid MAC ("overwrite"), optionally keeping the replaced
+ * files ("version"): up to keepVersions of them per path are moved to the
+ * versions directory, next to a copy of their metadata, as stored (i.e.
+ * compressed and encrypted if configured).
+ */
+
+package filer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Returns the directory keeping replaced versions of fileStorePath
+ */
+func (s *Server) versionsDir(fileStorePath string) string {
+	return s.sharedPath("versions", filepath.FromSlash(fileStorePath))
+}
+
+/*
+ * Replaces the file stored at fileStorePath with a received upload. Returns
+ * true if the upload has been deduplicated, like Backend.Commit.
+ */
+func (s *Server) replaceFile(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	meta, _ := s.readMetadata(fileStorePath)
+	if s.conf.ConflictPolicy == "version" {
+		if err := s.keepVersion(fileStorePath); err != nil {
+			return false, err
+		}
+	}
+
+	deduplicated, err := s.backend.Replace(tmpFilename, fileStorePath, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace %s: %s", fileStorePath, err)
+	}
+	if meta.ShortURL != "" {
+		os.Remove(s.shortURLIndexPath(meta.ShortURL))
+	}
+	s.releaseBlob(meta.SHA256)
+	log.Info("Replaced ", fileStorePath)
+	return deduplicated, nil
+}
+
+/*
+ * Copies the file stored at fileStorePath and its metadata to the versions
+ * directory and removes the oldest versions beyond keepVersions
+ */
+func (s *Server) keepVersion(fileStorePath string) error {
+	src, err := s.backend.Open(fileStorePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for keeping a version: %s", fileStorePath, err)
+	}
+	defer src.Close()
+
+	dir := s.versionsDir(fileStorePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", dir, err)
+	}
+	version := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	dst, err := os.Create(version)
+	if err != nil {
+		return fmt.Errorf("failed to keep version of %s: %s", fileStorePath, err)
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(version)
+		return fmt.Errorf("failed to keep version of %s: %s", fileStorePath, err)
+	}
+	if data, err := os.ReadFile(s.metadataPath(fileStorePath)); err == nil {
+		if err := os.WriteFile(version+".json", data, 0644); err != nil {
+			log.Warn("Failed to keep metadata of ", fileStorePath, ": ", err)
+		}
+	}
+
+	versions, err := s.listVersions(fileStorePath)
+	if err != nil {
+		return err
+	}
+	if s.conf.KeepVersions > 0 && len(versions) > s.conf.KeepVersions {
+		for _, name := range versions[:len(versions)-s.conf.KeepVersions] {
+			os.Remove(filepath.Join(dir, name))
+			os.Remove(filepath.Join(dir, name+".json"))
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the names of the kept versions of fileStorePath, oldest first
+ */
+func (s *Server) listVersions(fileStorePath string) ([]string, error) {
+	entries, err := os.ReadDir(s.versionsDir(fileStorePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), ".json") {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
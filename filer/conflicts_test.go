@@ -0,0 +1,161 @@
+package filer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConflictPolicyOverwrite(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ConflictPolicy = "overwrite"
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.uploadFile(t, "abc/slot.txt", []byte("first"))
+	if rr := s.uploadFile(t, "abc/slot.txt", []byte("second upload")); rr.Code != http.StatusCreated {
+		t.Fatalf("upload to existing path: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/slot.txt", nil)
+	if rr := s.serveUpload(req); rr.Body.String() != "second upload" {
+		t.Errorf("file has not been replaced: %q", rr.Body.String())
+	}
+	if meta, err := s.readMetadata("abc/slot.txt"); err != nil || meta.Size != int64(len("second upload")) {
+		t.Errorf("metadata has not been replaced: %+v %v", meta, err)
+	}
+	if _, err := os.Stat(s.versionsDir("abc/slot.txt")); !os.IsNotExist(err) {
+		t.Errorf("version has been kept: %v", err)
+	}
+
+	// Still checked by MAC
+	req = s.newUploadRequest(t, "abc/slot.txt", []byte("third"))
+	req.URL.RawQuery = "v=" + "0000"
+	if rr := s.serveUpload(req); rr.Code != http.StatusForbidden {
+		t.Errorf("upload with invalid MAC: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+/*
+ * A file which can't be replaced must be kept, and stay readable while it
+ * is replaced
+ */
+func TestReplaceFailed(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ConflictPolicy = "overwrite"
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.uploadFile(t, "abc/slot.txt", []byte("first"))
+	file, err := s.backend.Open("abc/slot.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := s.replaceFile(filepath.Join(t.TempDir(), "missing"), "abc/slot.txt", ""); err == nil {
+		t.Fatal("replacing with a missing upload succeeded")
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/slot.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusOK || rr.Body.String() != "first" {
+		t.Errorf("file lost by failed replace: %v %q", rr.Code, rr.Body.String())
+	}
+
+	if rr := s.uploadFile(t, "abc/slot.txt", []byte("second")); rr.Code != http.StatusCreated {
+		t.Fatalf("upload to existing path: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if content, err := io.ReadAll(file); err != nil || string(content) != "first" {
+		t.Errorf("replaced file not readable by open download: %q %v", content, err)
+	}
+}
+
+/*
+ * Replacing a deduplicated file links to identical content and releases
+ * the blob of the replaced one
+ */
+func TestReplaceDeduplicated(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ConflictPolicy = "overwrite"
+	s.conf.Deduplicate = true
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.uploadFile(t, "abc/slot.txt", []byte("first"))
+	s.uploadFile(t, "def/other.txt", []byte("second"))
+	first, _ := s.readMetadata("abc/slot.txt")
+
+	if rr := s.uploadFile(t, "abc/slot.txt", []byte("second")); rr.Code != http.StatusCreated {
+		t.Fatalf("upload to existing path: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if meta, err := s.readMetadata("abc/slot.txt"); err != nil || !meta.Deduplicated {
+		t.Errorf("replacement must be deduplicated: %+v, %v", meta, err)
+	}
+	slot, err := os.Stat(s.storagePath("abc/slot.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := os.Stat(s.storagePath("def/other.txt")); err != nil || !os.SameFile(slot, other) {
+		t.Errorf("replacement not linked to identical file: %v", err)
+	}
+	if _, err := os.Stat(s.blobPath(first.SHA256)); !os.IsNotExist(err) {
+		t.Errorf("blob of replaced file not released: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(s.conf.StoreDir, "abc", ".replace-*")); len(matches) != 0 {
+		t.Errorf("temporary links left behind: %v", matches)
+	}
+}
+
+func TestConflictPolicyVersion(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ConflictPolicy = "version"
+	s.conf.KeepVersions = 2
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		if rr := s.uploadFile(t, "abc/versioned.txt", []byte(content)); rr.Code != http.StatusCreated {
+			t.Fatalf("upload of %s: got %v want %v", content, rr.Code, http.StatusCreated)
+		}
+	}
+
+	versions, err := s.listVersions("abc/versioned.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("unexpected versions %v: %v", versions, err)
+	}
+	for i, want := range []string{"v2", "v3"} {
+		version := filepath.Join(s.versionsDir("abc/versioned.txt"), versions[i])
+		if content, err := os.ReadFile(version); err != nil || !bytes.Equal(content, []byte(want)) {
+			t.Errorf("version %d: got %q want %q (%v)", i, content, want, err)
+		}
+		if _, err := os.Stat(version + ".json"); err != nil {
+			t.Errorf("metadata of version %d has not been kept: %s", i, err)
+		}
+	}
+}
+
+/*
+ * Quarantined paths are not replaced
+ */
+func TestConflictPolicyQuarantined(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ConflictPolicy = "overwrite"
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.conf.HashDenylistAction = "quarantine"
+	s.denyCatmetal(t)
+	s.uploadCatmetal(t)
+	if !s.isQuarantined("thomas/abc/catmetal.jpg") {
+		t.Fatalf("file has not been quarantined")
+	}
+	if rr := s.uploadFile(t, "thomas/abc/catmetal.jpg", []byte("other content")); rr.Code != http.StatusConflict {
+		t.Errorf("upload to quarantined path: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,371 @@
+/*
+ * CrowdSec integration
+ * As a bouncer (crowdsecAPIKey), the "crowdsec" middleware asks the local
+ * API at crowdsecURL for decisions about the client's address and refuses
+ * clients with one. Answers are cached for crowdsecCacheDuration; if the
+ * API can't be reached, requests are served.
+ * As a watcher (crowdsecMachineID, crowdsecPassword), alerts with a ban
+ * decision are sent for clients banned for causing too many 404 responses
+ * ("prosody-filer/404-flood") and clients sending crowdsecMacFailures
+ * uploads with invalid MAC within macFailureWindow
+ * ("prosody-filer/mac-bruteforce"), so they are blocked by all bouncers.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var crowdsecFailuresMetric = newCounter("prosody_filer_crowdsec_failures_total", "Failed requests to the CrowdSec local API, by request.")
+
+const (
+	crowdsecTimeout          = 2 * time.Second
+	crowdsecMaxCacheSize     = 10000
+	crowdsecScenarioFlood    = "prosody-filer/404-flood"
+	crowdsecScenarioMAC      = "prosody-filer/mac-bruteforce"
+	crowdsecScenarioHoneypot = "prosody-filer/honeypot"
+	crowdsecScenarioVersion  = "1.0"
+)
+
+type crowdsecState struct {
+	sync.Mutex
+	client      *http.Client
+	decisions   map[string]crowdsecCacheEntry
+	macFailures map[string]*macFailureCount
+	alerts      chan crowdsecAlert
+	token       string
+}
+
+type crowdsecCacheEntry struct {
+	decision string
+	expires  time.Time
+}
+
+type crowdsecDecision struct {
+	Duration string `json:"duration"`
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Origin   string `json:"origin,omitempty"`
+	Scenario string `json:"scenario,omitempty"`
+}
+
+type crowdsecAlert struct {
+	Scenario        string             `json:"scenario"`
+	ScenarioHash    string             `json:"scenario_hash"`
+	ScenarioVersion string             `json:"scenario_version"`
+	Message         string             `json:"message"`
+	EventsCount     int                `json:"events_count"`
+	StartAt         string             `json:"start_at"`
+	StopAt          string             `json:"stop_at"`
+	Capacity        int                `json:"capacity"`
+	Leakspeed       string             `json:"leakspeed"`
+	Simulated       bool               `json:"simulated"`
+	Remediation     bool               `json:"remediation"`
+	Events          []crowdsecEvent    `json:"events"`
+	Source          crowdsecSource     `json:"source"`
+	Decisions       []crowdsecDecision `json:"decisions"`
+}
+
+type crowdsecEvent struct {
+	Timestamp string         `json:"timestamp"`
+	Meta      []crowdsecMeta `json:"meta"`
+}
+
+type crowdsecMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type crowdsecSource struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	IP    string `json:"ip"`
+}
+
+/*
+ * Prepares the decision cache, and sends alerts if crowdsecMachineID is set
+ */
+func (s *Server) startCrowdsec() {
+	s.crowdsec.client = &http.Client{Timeout: crowdsecTimeout}
+	s.crowdsec.decisions = make(map[string]crowdsecCacheEntry)
+	s.crowdsec.macFailures = make(map[string]*macFailureCount)
+	if s.conf.CrowdsecMachineID == "" {
+		return
+	}
+
+	s.crowdsec.alerts = make(chan crowdsecAlert, 100)
+	go func() {
+		for alert := range s.crowdsec.alerts {
+			if err := s.sendCrowdsecAlert(alert); err != nil {
+				log.Error("Sending alert to CrowdSec failed: ", err)
+				crowdsecFailuresMetric.add(`request="alerts"`, 1)
+			}
+		}
+	}()
+}
+
+func (s *Server) crowdsecMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.rejectCrowdsecDecision(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+/*
+ * Refuses clients with a CrowdSec decision
+ */
+func (s *Server) rejectCrowdsecDecision(w http.ResponseWriter, r *http.Request) bool {
+	if s.conf.CrowdsecAPIKey == "" || s.crowdsec.decisions == nil {
+		return false
+	}
+
+	client := s.clientIP(r)
+	decision := s.crowdsecDecision(client)
+	if decision == "" {
+		return false
+	}
+	log.Warn("Refusing ", client, " because of CrowdSec decision ", decision)
+	httpError(w, http.StatusForbidden, "")
+	return true
+}
+
+/*
+ * Returns the type of the decision about ip ("ban", "captcha", ...), or ""
+ */
+func (s *Server) crowdsecDecision(ip string) string {
+	s.crowdsec.Lock()
+	entry, ok := s.crowdsec.decisions[ip]
+	s.crowdsec.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.decision
+	}
+
+	decision, err := s.queryCrowdsecDecision(ip)
+	if err != nil {
+		// Cached as well, so an unreachable API doesn't slow down every request
+		log.Warn("Querying CrowdSec decisions failed: ", err)
+		crowdsecFailuresMetric.add(`request="decisions"`, 1)
+	}
+
+	s.crowdsec.Lock()
+	defer s.crowdsec.Unlock()
+	if len(s.crowdsec.decisions) >= crowdsecMaxCacheSize {
+		for address, entry := range s.crowdsec.decisions {
+			if time.Now().After(entry.expires) {
+				delete(s.crowdsec.decisions, address)
+			}
+		}
+	}
+	if len(s.crowdsec.decisions) < crowdsecMaxCacheSize {
+		s.crowdsec.decisions[ip] = crowdsecCacheEntry{decision: decision, expires: time.Now().Add(s.conf.CrowdsecCacheDuration)}
+	}
+	return decision
+}
+
+func (s *Server) queryCrowdsecDecision(ip string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, s.crowdsecURL("/v1/decisions?ip="+url.QueryEscape(ip)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Api-Key", s.conf.CrowdsecAPIKey)
+	req.Header.Set("User-Agent", "prosody-filer/"+Version)
+
+	resp, err := s.crowdsec.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// null if there is no decision
+	var decisions []crowdsecDecision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&decisions); err != nil {
+		return "", err
+	}
+	if len(decisions) == 0 {
+		return "", nil
+	}
+	return decisions[0].Type, nil
+}
+
+func (s *Server) crowdsecURL(path string) string {
+	return strings.TrimRight(s.conf.CrowdsecURL, "/") + path
+}
+
+/*
+ * Counts an upload with invalid MAC and reports the client once it reaches
+ * crowdsecMacFailures within macFailureWindow
+ */
+func (s *Server) recordCrowdsecMACFailure(client string) {
+	if s.crowdsec.alerts == nil {
+		return
+	}
+
+	s.crowdsec.Lock()
+	defer s.crowdsec.Unlock()
+
+	// Forget about clients which haven't failed for a while
+	for address, failures := range s.crowdsec.macFailures {
+		if time.Since(failures.since) > macFailureWindow {
+			delete(s.crowdsec.macFailures, address)
+		}
+	}
+
+	failures := s.crowdsec.macFailures[client]
+	if failures == nil {
+		failures = &macFailureCount{since: time.Now()}
+		s.crowdsec.macFailures[client] = failures
+	}
+	failures.count++
+
+	if failures.count >= s.conf.CrowdsecMacFailures {
+		delete(s.crowdsec.macFailures, client)
+		s.queueCrowdsecAlert(crowdsecScenarioMAC, client, failures.count, failures.since, s.conf.CrowdsecMacFailures, macFailureWindow,
+			fmt.Sprintf("%s sent %d uploads with invalid MAC", client, failures.count))
+	}
+}
+
+/*
+ * Reports a client banned for causing too many 404 responses
+ */
+func (s *Server) reportCrowdsecFlood(client string, count int, since time.Time) {
+	if s.crowdsec.alerts == nil {
+		return
+	}
+	s.queueCrowdsecAlert(crowdsecScenarioFlood, client, count, since, s.conf.NotFoundLimit, s.conf.NotFoundWindow,
+		fmt.Sprintf("%s requested %d missing files", client, count))
+}
+
+/*
+ * Reports a client requesting one of honeypotPaths
+ */
+func (s *Server) reportCrowdsecHoneypot(client string, urlPath string) {
+	if s.crowdsec.alerts == nil {
+		return
+	}
+	s.queueCrowdsecAlert(crowdsecScenarioHoneypot, client, 1, time.Now(), 1, 0,
+		fmt.Sprintf("%s requested honeypot %s", client, urlPath))
+}
+
+func (s *Server) queueCrowdsecAlert(scenario string, client string, count int, since time.Time, capacity int, window time.Duration, message string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	alert := crowdsecAlert{
+		Scenario:        scenario,
+		ScenarioVersion: crowdsecScenarioVersion,
+		Message:         message,
+		EventsCount:     count,
+		StartAt:         since.UTC().Format(time.RFC3339),
+		StopAt:          now,
+		Capacity:        capacity,
+		Leakspeed:       window.String(),
+		Remediation:     true,
+		Events: []crowdsecEvent{{
+			Timestamp: now,
+			Meta:      []crowdsecMeta{{Key: "service", Value: "prosody-filer"}, {Key: "source_ip", Value: client}},
+		}},
+		Source: crowdsecSource{Scope: "Ip", Value: client, IP: client},
+		Decisions: []crowdsecDecision{{
+			Duration: s.conf.BanDuration.String(),
+			Type:     "ban",
+			Scope:    "Ip",
+			Value:    client,
+			Origin:   "prosody-filer",
+			Scenario: scenario,
+		}},
+	}
+
+	select {
+	case s.crowdsec.alerts <- alert:
+	default:
+		log.Warn("CrowdSec alert queue full, dropping ", scenario, " alert for ", client)
+		crowdsecFailuresMetric.add(`request="alerts"`, 1)
+	}
+}
+
+/*
+ * Sends an alert, logging in first if necessary
+ */
+func (s *Server) sendCrowdsecAlert(alert crowdsecAlert) error {
+	body, err := json.Marshal([]crowdsecAlert{alert})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if s.crowdsec.token == "" {
+			if err := s.crowdsecLogin(); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodPost, s.crowdsecURL("/v1/alerts"), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "prosody-filer/"+Version)
+		req.Header.Set("Authorization", "Bearer "+s.crowdsec.token)
+
+		resp, err := s.crowdsec.client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		// Token expired
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			s.crowdsec.token = ""
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		log.Info("Reported ", alert.Source.IP, " to CrowdSec: ", alert.Message)
+		return nil
+	}
+}
+
+func (s *Server) crowdsecLogin() error {
+	body, err := json.Marshal(map[string]interface{}{
+		"machine_id": s.conf.CrowdsecMachineID,
+		"password":   s.conf.CrowdsecPassword,
+		"scenarios":  []string{crowdsecScenarioFlood, crowdsecScenarioMAC, crowdsecScenarioHoneypot},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.crowdsec.client.Post(s.crowdsecURL("/v1/watchers/login"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login failed: %s", resp.Status)
+	}
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil || response.Token == "" {
+		return fmt.Errorf("login failed: invalid response")
+	}
+	s.crowdsec.token = response.Token
+	return nil
+}
@@ -0,0 +1,144 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Minimal CrowdSec local API: a decision about 192.0.2.66, and alerts
+ * collected in a channel
+ */
+type fakeCrowdsec struct {
+	mutex           sync.Mutex
+	decisionQueries int
+	alerts          chan crowdsecAlert
+}
+
+func (f *fakeCrowdsec) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/decisions":
+		if r.Header.Get("X-Api-Key") != "bouncerkey" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		f.mutex.Lock()
+		f.decisionQueries++
+		f.mutex.Unlock()
+		if r.FormValue("ip") == "192.0.2.66" {
+			w.Write([]byte(`[{"duration":"3h59m","scope":"Ip","type":"ban","value":"192.0.2.66","origin":"crowdsec"}]`))
+			return
+		}
+		w.Write([]byte("null"))
+	case "/v1/watchers/login":
+		var login map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["machine_id"] != "filer" || login["password"] != "machinepassword" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"code":200,"expire":"2099-01-01T00:00:00Z","token":"jwt"}`))
+	case "/v1/alerts":
+		if r.Header.Get("Authorization") != "Bearer jwt" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var alerts []crowdsecAlert
+		json.NewDecoder(r.Body).Decode(&alerts)
+		for _, alert := range alerts {
+			f.alerts <- alert
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/*
+ * Clients with a decision are refused, answers are cached
+ */
+func TestCrowdsecDecisions(t *testing.T) {
+	s := newTestServer(t)
+
+	fake := &fakeCrowdsec{}
+	lapi := httptest.NewServer(fake)
+	defer lapi.Close()
+
+	// Set config
+	s.conf.CrowdsecURL = lapi.URL
+	s.conf.CrowdsecAPIKey = "bouncerkey"
+	s.startCrowdsec()
+
+	req := httptest.NewRequest("GET", "/upload/abc/missing.txt", nil)
+	req.RemoteAddr = "192.0.2.66:1234"
+	if rr := s.serveUpload(req); rr.Code != http.StatusForbidden {
+		t.Errorf("client with decision: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/upload/abc/missing.txt", nil)
+		if rr := s.serveUpload(req); rr.Code != http.StatusNotFound {
+			t.Errorf("client without decision: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	}
+	if fake.decisionQueries != 2 {
+		t.Errorf("got %d queries want 2", fake.decisionQueries)
+	}
+
+	// Served if CrowdSec is unreachable
+	s.conf.CrowdsecURL = "http://127.0.0.1:1"
+	req = httptest.NewRequest("GET", "/upload/abc/missing.txt", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	if rr := s.serveUpload(req); rr.Code != http.StatusNotFound {
+		t.Errorf("unreachable CrowdSec: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+/*
+ * 404 floods and MAC brute force are reported with ban decisions
+ */
+func TestCrowdsecAlerts(t *testing.T) {
+	s := newTestServer(t)
+
+	fake := &fakeCrowdsec{alerts: make(chan crowdsecAlert, 10)}
+	lapi := httptest.NewServer(fake)
+	defer lapi.Close()
+
+	// Set config
+	s.conf.CrowdsecURL = lapi.URL
+	s.conf.CrowdsecMachineID = "filer"
+	s.conf.CrowdsecPassword = "machinepassword"
+	s.conf.CrowdsecMacFailures = 3
+	s.conf.NotFoundLimit = 2
+	s.startCrowdsec()
+
+	receive := func() crowdsecAlert {
+		select {
+		case alert := <-fake.alerts:
+			return alert
+		case <-time.After(5 * time.Second):
+			t.Fatal("no alert received")
+		}
+		return crowdsecAlert{}
+	}
+
+	for i := 0; i < 3; i++ {
+		s.serveUpload(httptest.NewRequest("GET", "/upload/abc/missing.txt", nil))
+	}
+	alert := receive()
+	if alert.Scenario != crowdsecScenarioFlood || alert.Source.IP != "192.0.2.1" || alert.EventsCount != 3 ||
+		len(alert.Decisions) != 1 || alert.Decisions[0].Type != "ban" || alert.Decisions[0].Value != "192.0.2.1" {
+		t.Errorf("unexpected alert: %+v", alert)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.recordMACFailure("192.0.2.3:1234")
+	}
+	if alert := receive(); alert.Scenario != crowdsecScenarioMAC || alert.Source.IP != "192.0.2.3" || alert.EventsCount != 3 {
+		t.Errorf("unexpected alert: %+v", alert)
+	}
+}
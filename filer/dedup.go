@@ -0,0 +1,141 @@
+/*
+ * Deduplication
+ * Stored files are indexed by the SHA-256 hash of their content: the index
+ * in ".prosody-filer/blobs/" holds a hard link to every stored file. When
+ * the same content is uploaded again, the new path is linked to the
+ * existing file instead of storing another copy. Once the index holds
+ * the only link left, the blob is released.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Returns the path of the index entry for content with the given hash
+ */
+func (s *Server) blobPath(hash string) string {
+	return s.internalPath("blobs", hash[:2], hash)
+}
+
+/*
+ * Moves a completely received upload to its final location like
+ * commitFile(), but links to an identical stored file if there is one.
+ * Returns true if the upload has been deduplicated.
+ */
+func (s *Server) commitDeduplicated(tmpFilename string, absFilename string, hash string) (bool, error) {
+	absDirectory := filepath.Dir(absFilename)
+	if err := os.MkdirAll(absDirectory, os.ModePerm); err != nil {
+		return false, fmt.Errorf("failed to create directory %s: %s", absDirectory, err)
+	}
+
+	blob := s.blobPath(hash)
+	err := os.Link(blob, absFilename)
+	if err == nil {
+		return true, nil
+	} else if os.IsExist(err) {
+		return false, storage.ErrExists
+	} else if !os.IsNotExist(err) {
+		// E.g. maximum number of links reached: store a copy
+		log.Warnf("Could not link %s to identical file: %s", absFilename, err)
+	}
+
+	if err := commitFile(tmpFilename, absFilename); err != nil {
+		return false, err
+	}
+	addToIndex(absFilename, blob)
+	return false, nil
+}
+
+/*
+ * Replaces a stored file with a received upload like commitReplacing(),
+ * but links to an identical stored file if there is one. Returns true if
+ * the upload has been deduplicated.
+ */
+func (s *Server) replaceDeduplicated(tmpFilename string, absFilename string, hash string) (bool, error) {
+	absDirectory := filepath.Dir(absFilename)
+	if err := os.MkdirAll(absDirectory, os.ModePerm); err != nil {
+		return false, fmt.Errorf("failed to create directory %s: %s", absDirectory, err)
+	}
+
+	// Links can't replace files, so the identical file is linked next to the
+	// stored one and renamed over it
+	blob := s.blobPath(hash)
+	linkFilename := filepath.Join(absDirectory, ".replace-"+filepath.Base(absFilename))
+	os.Remove(linkFilename)
+	err := os.Link(blob, linkFilename)
+	if err == nil {
+		err = os.Rename(linkFilename, absFilename)
+		// Renaming does nothing if the stored file is the identical one already
+		os.Remove(linkFilename)
+		if err != nil {
+			return false, fmt.Errorf("failed to replace %s: %s", absFilename, err)
+		}
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		log.Warnf("Could not link %s to identical file: %s", absFilename, err)
+	}
+
+	if err := commitReplacing(tmpFilename, absFilename); err != nil {
+		return false, err
+	}
+	addToIndex(absFilename, blob)
+	return false, nil
+}
+
+/*
+ * Adds a stored file to the index. Fails harmlessly if an identical upload
+ * has been stored concurrently.
+ */
+func addToIndex(absFilename string, blob string) {
+	if err := os.MkdirAll(filepath.Dir(blob), os.ModePerm); err != nil {
+		log.Warnf("Failed to create blob directory: %s", err)
+	} else if err := os.Link(absFilename, blob); err != nil && !os.IsExist(err) {
+		log.Warnf("Failed to add %s to deduplication index: %s", absFilename, err)
+	}
+}
+
+/*
+ * Removes the index entry for content with the given hash if no stored
+ * file links to it anymore
+ */
+func (s *Server) releaseBlob(hash string) {
+	if !s.conf.Deduplicate || len(hash) < 2 {
+		return
+	}
+	blob := s.blobPath(hash)
+	info, err := os.Stat(blob)
+	if err != nil {
+		return
+	}
+	if links, ok := linkCount(info); ok && links <= 1 {
+		if err := os.Remove(blob); err != nil {
+			log.Warnf("Failed to release blob %s: %s", hash, err)
+			return
+		}
+		log.Debug("Released blob ", hash)
+	}
+}
+
+/*
+ * Releases all blobs no stored file links to anymore, e.g. because the
+ * files have been removed from storeDir by hand
+ */
+func (s *Server) releaseOrphanedBlobs() {
+	if !s.conf.Deduplicate {
+		return
+	}
+	filepath.Walk(s.internalPath("blobs"), func(blob string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		s.releaseBlob(info.Name())
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ * Identical uploads must be stored only once
+ */
+func TestUploadDeduplicated(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.Deduplicate = true
+
+	content := []byte("the same meme, forwarded to ten MUCs")
+	for _, fileStorePath := range []string{"abc/meme.txt", "def/meme.txt", "ghi/other.txt"} {
+		if status := s.uploadFile(t, fileStorePath, content).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s returned wrong status code: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+	if status := s.uploadFile(t, "jkl/different.txt", []byte("something else")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	stat := func(fileStorePath string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(s.conf.StoreDir, fileStorePath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	first := stat("abc/meme.txt")
+	if !os.SameFile(first, stat("def/meme.txt")) || !os.SameFile(first, stat("ghi/other.txt")) {
+		t.Errorf("identical uploads have not been deduplicated")
+	}
+	if os.SameFile(first, stat("jkl/different.txt")) {
+		t.Errorf("different uploads have been deduplicated")
+	}
+
+	if meta, err := s.readMetadata("abc/meme.txt"); err != nil || meta.Deduplicated {
+		t.Errorf("first upload must not be marked as deduplicated: %+v, %v", meta, err)
+	}
+	if meta, err := s.readMetadata("def/meme.txt"); err != nil || !meta.Deduplicated {
+		t.Errorf("second upload must be marked as deduplicated: %+v, %v", meta, err)
+	}
+
+	// Uploading other content to an existing path must still fail
+	if status := s.uploadFile(t, "abc/meme.txt", []byte("other content")).Code; status != http.StatusConflict {
+		t.Errorf("upload to existing path returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+}
+
+/*
+ * Blobs must be released once no stored file links to them anymore
+ */
+func TestReleaseBlob(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.Deduplicate = true
+
+	content := []byte("a meme nobody wants to keep")
+	for _, fileStorePath := range []string{"abc/meme.txt", "def/meme.txt", "ghi/meme.txt"} {
+		if status := s.uploadFile(t, fileStorePath, content).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s returned wrong status code: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+	meta, err := s.readMetadata("abc/meme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := s.blobPath(meta.SHA256)
+	blobExists := func() bool {
+		_, err := os.Stat(blob)
+		return err == nil
+	}
+
+	if err := s.deleteFile("abc/meme.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists() {
+		t.Fatal("blob released while files still link to it")
+	}
+
+	// Expired by the periodic cleanup
+	expired := time.Now().Add(-time.Minute).UTC()
+	meta, _ = s.readMetadata("def/meme.txt")
+	meta.Expires = &expired
+	s.writeMetadata(meta)
+	s.removeExpiredFiles()
+	if !blobExists() {
+		t.Fatal("blob released while a file still links to it")
+	}
+
+	if err := s.deleteFile("ghi/meme.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists() {
+		t.Error("blob not released after the last file has been deleted")
+	}
+
+	// Removed from storeDir by hand
+	if status := s.uploadFile(t, "jkl/meme.txt", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	os.Remove(s.storagePath("jkl/meme.txt"))
+	s.removeExpiredFiles()
+	if blobExists() {
+		t.Error("orphaned blob not released by the cleanup")
+	}
+}
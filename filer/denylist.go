@@ -0,0 +1,65 @@
+/*
+ * SHA-256 hash denylist
+ * Uploads whose content hash is on the list are refused or quarantined.
+ * The list is re-read on SIGHUP.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * Reads the denylist file. Expects one hex encoded SHA-256 hash per line,
+ * optionally followed by a comment (so sha256sum output can be used as is).
+ * Lines starting with "#" are ignored.
+ */
+func (s *Server) loadHashDenylist() error {
+	file, err := os.Open(s.conf.HashDenylist)
+	if err != nil {
+		return fmt.Errorf("failed to open hash denylist: %s", err)
+	}
+	defer file.Close()
+
+	hashes := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		hash := strings.ToLower(fields[0])
+		if raw, err := hex.DecodeString(hash); err != nil || len(raw) != 32 {
+			return fmt.Errorf("invalid SHA-256 hash in %s line %d", s.conf.HashDenylist, lineNumber)
+		}
+		hashes[hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read hash denylist: %s", err)
+	}
+
+	s.hashDenylist.Lock()
+	s.hashDenylist.hashes = hashes
+	s.hashDenylist.Unlock()
+
+	log.Info("Loaded ", len(hashes), " hashes from ", s.conf.HashDenylist)
+	return nil
+}
+
+/*
+ * Reports whether the hex encoded SHA-256 hash is on the denylist
+ */
+func (s *Server) isHashDenied(hash string) bool {
+	s.hashDenylist.RLock()
+	defer s.hashDenylist.RUnlock()
+
+	return s.hashDenylist.hashes[hash]
+}
@@ -0,0 +1,87 @@
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Writes a denylist containing the hash of catmetal.jpg and enables it
+ */
+func (s *Server) denyCatmetal(t *testing.T) {
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(catMetalFile)
+
+	s.conf.HashDenylist = filepath.Join(t.TempDir(), "denylist.txt")
+	list := "# known bad files\n" + hex.EncodeToString(sum[:]) + "  catmetal.jpg\n"
+	if err := os.WriteFile(s.conf.HashDenylist, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loadHashDenylist(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+ * Upload a file whose hash is on the denylist
+ */
+func TestUploadHashDenied(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.denyCatmetal(t)
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+}
+
+/*
+ * Upload a file whose hash is on the denylist with quarantine enabled
+ */
+func TestUploadHashDeniedQuarantine(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.denyCatmetal(t)
+	s.conf.HashDenylistAction = "quarantine"
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	if !s.isQuarantined("thomas/abc/catmetal.jpg") {
+		t.Errorf("file has not been quarantined")
+	}
+}
+
+/*
+ * Loading a denylist with invalid entries must fail
+ */
+func TestLoadHashDenylistInvalid(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	s.conf.HashDenylist = filepath.Join(t.TempDir(), "denylist.txt")
+	if err := os.WriteFile(s.conf.HashDenylist, []byte("notahash\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loadHashDenylist(); err == nil {
+		t.Errorf("invalid denylist was accepted")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux || freebsd || darwin
+// +build linux freebsd darwin
+
+package filer
+
+import "syscall"
+
+/*
+ * Returns how much of the file system containing dir is used, in percent
+ */
+func diskUsage(dir string) (int, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	total := uint64(stat.Blocks) * uint64(stat.Bsize)
+	available := uint64(stat.Bavail) * uint64(stat.Bsize)
+	if total == 0 {
+		return 0, nil
+	}
+	return int(100 - available*100/total), nil
+}
+
+/*
+ * Returns the bytes available to unprivileged users on the file system
+ * containing dir
+ */
+func diskFree(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
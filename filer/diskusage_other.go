@@ -0,0 +1,12 @@
+//go:build !linux && !freebsd && !darwin
+// +build !linux,!freebsd,!darwin
+
+package filer
+
+func diskUsage(dir string) (int, error) {
+	return 0, errDiskUsageUnsupported
+}
+
+func diskFree(dir string) (uint64, error) {
+	return 0, errDiskUsageUnsupported
+}
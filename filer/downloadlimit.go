@@ -0,0 +1,128 @@
+/*
+ * Download limits
+ * Files can expire after a number of downloads, e.g. large files shared
+ * in public channels: maxDownloads applies to all uploads, and
+ * prefixMaxDownloads below prefixes of the stored path, unless the XMPP
+ * server signs a maxdl parameter of the upload URL. The limit is kept in
+ * the metadata of the upload.
+ *
+ * Every GET sending the file counts. Range requests are answered with the
+ * whole file, so the file can't be read repeatedly in parts. The count is
+ * taken before the file is sent and returned if the response turns out to
+ * be something else, e.g. 304 Not Modified. Downloads are never redirected
+ * or offloaded. After the last download, the file is removed.
+ * Counts are kept consistent within one process; nodes of a cluster may
+ * exceed the limit by the downloads running concurrently on other nodes.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Returns the download limit requested by the maxdl parameter of an upload
+ * URL, or 0 if there is none
+ */
+func uploadMaxDownloads(query url.Values) (int64, error) {
+	if query["maxdl"] == nil {
+		return 0, nil
+	}
+	maxDownloads, err := strconv.ParseInt(query.Get("maxdl"), 10, 64)
+	if err != nil || maxDownloads <= 0 {
+		return 0, fmt.Errorf("invalid maxdl parameter %q", query.Get("maxdl"))
+	}
+	return maxDownloads, nil
+}
+
+/*
+ * Returns the download limit of an upload to fileStorePath, 0 for none.
+ * The longest matching prefix of prefixMaxDownloads wins over
+ * maxDownloads, a signed maxdl parameter over both.
+ */
+func (s *Server) maxDownloads(r *http.Request, fileStorePath string) int64 {
+	if maxDownloads, _ := uploadMaxDownloads(r.URL.Query()); maxDownloads != 0 {
+		return maxDownloads
+	}
+	limit, longest := s.conf.MaxDownloads, -1
+	for prefix, prefixLimit := range s.conf.PrefixMaxDownloads {
+		prefix = strings.TrimPrefix(prefix, "/")
+		if strings.HasPrefix(fileStorePath, prefix) && len(prefix) > longest {
+			limit, longest = prefixLimit, len(prefix)
+		}
+	}
+	return limit
+}
+
+/*
+ * Counts a download of a file with a download limit until its response
+ * turns out not to contain the file, see finish()
+ */
+type downloadCounter struct {
+	statusRecorder
+	s             *Server
+	r             *http.Request
+	fileStorePath string
+	last          bool
+}
+
+/*
+ * Counts a download of fileStorePath before it is sent. Returns false if
+ * the limit has been reached by other downloads meanwhile.
+ */
+func (s *Server) countDownload(w http.ResponseWriter, r *http.Request, fileStorePath string) (*downloadCounter, bool) {
+	s.downloadCounts.Lock()
+	defer s.downloadCounts.Unlock()
+
+	meta, err := s.readMetadata(fileStorePath)
+	if err != nil || meta.expired() {
+		return nil, false
+	}
+	meta.Downloads++
+	if err := s.writeMetadata(meta); err != nil {
+		log.Error(err)
+	}
+	return &downloadCounter{
+		statusRecorder: statusRecorder{ResponseWriter: w},
+		s:              s,
+		r:              r,
+		fileStorePath:  fileStorePath,
+		last:           meta.Downloads >= meta.MaxDownloads,
+	}, true
+}
+
+/*
+ * Returns the count if the response didn't contain the file, and removes
+ * the file after its last download
+ */
+func (c *downloadCounter) finish() {
+	if c.status == http.StatusOK {
+		if c.last {
+			log.Info("Last download of ", c.fileStorePath, " completed")
+			c.s.removeExpiredFile(c.fileStorePath)
+		}
+		return
+	}
+
+	c.s.downloadCounts.Lock()
+	defer c.s.downloadCounts.Unlock()
+	meta, err := c.s.readMetadata(c.fileStorePath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Error(err)
+		return
+	}
+	if meta.Downloads > 0 {
+		meta.Downloads--
+	}
+	if err := c.s.writeMetadata(meta); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,133 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+)
+
+/*
+ * Files expire after their download limit, conditional downloads not
+ * containing the file don't count
+ */
+func TestDownloadLimit(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MaxDownloads = 2
+	s.conf.PrefixMaxDownloads = map[string]int64{"unlimited/": 0}
+
+	content := []byte("only twice")
+	s.uploadFile(t, "abc/limited.txt", content)
+	s.uploadFile(t, "unlimited/abc/file.txt", content)
+	var etag string
+	var body []byte
+	get := func(fileStorePath string, header string, value string) int {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := s.serveUpload(req)
+		etag = rr.Header().Get("ETag")
+		body = rr.Body.Bytes()
+		return rr.Code
+	}
+
+	if meta, err := s.readMetadata("unlimited/abc/file.txt"); err != nil || meta.MaxDownloads != 0 {
+		t.Errorf("limit below prefix without limit: %+v %v", meta, err)
+	}
+	if status := get("abc/limited.txt", "", ""); status != http.StatusOK {
+		t.Fatalf("first download: got %v want %v", status, http.StatusOK)
+	}
+	if status := get("abc/limited.txt", "If-None-Match", etag); status != http.StatusNotModified {
+		t.Errorf("conditional download: got %v want %v", status, http.StatusNotModified)
+	}
+	if meta, _ := s.readMetadata("abc/limited.txt"); meta.Downloads != 1 || meta.MaxDownloads != 2 {
+		t.Errorf("got %d of %d downloads want 1 of 2", meta.Downloads, meta.MaxDownloads)
+	}
+
+	// Range requests get the whole file and count, so it can't be read in parts
+	if status := get("abc/limited.txt", "Range", "bytes=1-"); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("last download: got %v %q want %v %q", status, body, http.StatusOK, content)
+	}
+	if _, err := os.Stat(s.storagePath("abc/limited.txt")); !os.IsNotExist(err) {
+		t.Errorf("file not removed after last download: %v", err)
+	}
+	if status := get("abc/limited.txt", "", ""); status != http.StatusNotFound {
+		t.Errorf("download after limit: got %v want %v", status, http.StatusNotFound)
+	}
+	for i := 0; i < 3; i++ {
+		if status := get("unlimited/abc/file.txt", "", ""); status != http.StatusOK {
+			t.Errorf("download below prefix without limit: got %v want %v", status, http.StatusOK)
+		}
+	}
+}
+
+/*
+ * A signed maxdl parameter overrides the configured limits
+ */
+func TestSignedDownloadLimit(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("once")
+	upload := func(fileStorePath string, maxdl string, signed int64) int {
+		req, _ := http.NewRequest("PUT", "/upload/"+fileStorePath, bytes.NewReader(content))
+		req.URL.RawQuery = "v2=" + s.uploadMAC("v2", fileStorePath, int64(len(content)), 0, signed) + "&maxdl=" + maxdl
+		return s.serveUpload(req).Code
+	}
+
+	if status := upload("abc/unsigned.txt", "1", 0); status != http.StatusForbidden {
+		t.Errorf("upload with unsigned maxdl: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("abc/invalid.txt", "-1", -1); status != http.StatusBadRequest {
+		t.Errorf("upload with invalid maxdl: got %v want %v", status, http.StatusBadRequest)
+	}
+	if status := upload("abc/once.txt", "1", 1); status != http.StatusCreated {
+		t.Fatalf("upload with maxdl: got %v want %v", status, http.StatusCreated)
+	}
+
+	for _, want := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ := http.NewRequest("GET", "/upload/abc/once.txt", nil)
+		if rr := s.serveUpload(req); rr.Code != want {
+			t.Errorf("download: got %v want %v", rr.Code, want)
+		}
+	}
+}
+
+/*
+ * Downloads of files with a limit must not be offloaded, since offloaded
+ * downloads can't be counted
+ */
+func TestDownloadLimitOffload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MaxDownloads = 1
+	s.conf.DownloadOffload = "x-accel-redirect"
+	s.conf.DownloadOffloadPrefix = "/internal-files/"
+
+	content := []byte("hello world")
+	s.uploadFile(t, "abc/once.txt", content)
+
+	req, _ := http.NewRequest("GET", "/upload/abc/once.txt", nil)
+	rr := s.serveUpload(req)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) || rr.Header().Get("X-Accel-Redirect") != "" {
+		t.Errorf("download of file with limit offloaded: %v %q", rr.Code, rr.Header().Get("X-Accel-Redirect"))
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/upload/abc/once.txt", nil)
+		if rr := s.serveUpload(req); rr.Code != http.StatusNotFound {
+			t.Errorf("download after limit: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Download names
+ * The dl parameter of downloads sets the name browsers save the file as,
+ * e.g. for files stored under random names. With signDownloadNames, the
+ * name must be signed with secret in the dls parameter, so links can't be
+ * changed to save files under misleading names:
+ *
+ *	dls = hex(HMAC-SHA256(secret, "<path>\n<name>"))
+ *
+ * Files uploaded under another name than the one the client knows them by
+ * (see slotObfuscateNames) keep the original name, sent with the name
+ * parameter of the upload URL, in their metadata. It is used for downloads
+ * without dl parameter and shown by the admin API.
+ */
+
+package filer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const downloadNameMaxLength = 255
+
+var (
+	errInvalidDownloadName   = errors.New("invalid dl parameter")
+	errDownloadNameSignature = errors.New("invalid dls parameter")
+)
+
+/*
+ * Returns the name of the dl parameter, or "" if there is none
+ */
+func (s *Server) downloadName(r *http.Request, fileStorePath string) (string, error) {
+	query := r.URL.Query()
+	name := query.Get("dl")
+	if name == "" {
+		return "", nil
+	}
+	if !validDownloadName(name) {
+		return "", errInvalidDownloadName
+	}
+
+	if s.conf.SignDownloadNames {
+		mac, err := hex.DecodeString(query.Get("dls"))
+		if err != nil || !hmac.Equal(mac, downloadNameMAC(s.conf.Secret, fileStorePath, name)) {
+			return "", errDownloadNameSignature
+		}
+	}
+	return name, nil
+}
+
+func downloadNameMAC(secret string, fileStorePath string, name string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fileStorePath + "\n" + name))
+	return mac.Sum(nil)
+}
+
+/*
+ * Returns the original name from the name parameter of an upload, or "" if
+ * it is missing, invalid or the name the file is stored under anyway
+ */
+func uploadName(r *http.Request, fileStorePath string) string {
+	name := r.URL.Query().Get("name")
+	if name == "" || name == path.Base(fileStorePath) || !validDownloadName(name) {
+		return ""
+	}
+	return name
+}
+
+/*
+ * Reports whether name is usable as file name: valid UTF-8 without path
+ * separators or control characters
+ */
+func validDownloadName(name string) bool {
+	if len(name) > downloadNameMaxLength || !utf8.ValidString(name) || name == "." || name == ".." {
+		return false
+	}
+	for _, char := range name {
+		if char == '/' || char == '\\' || unicode.IsControl(char) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Formats a Content-Disposition header for name. Non-ASCII names are sent
+ * as in RFC 6266, with an ASCII fallback for old clients.
+ */
+func contentDisposition(disposition string, name string) string {
+	fallback := strings.Map(func(char rune) rune {
+		if char > unicode.MaxASCII || char == '"' || char == '\\' || unicode.IsControl(char) {
+			return '_'
+		}
+		return char
+	}, name)
+
+	header := disposition + `; filename="` + fallback + `"`
+	if fallback != name {
+		header += "; filename*=UTF-8''" + strings.ReplaceAll(url.PathEscape(name), "'", "%27")
+	}
+	return header
+}
+
+/*
+ * Returns the name the client knows a quarantined file by
+ */
+func (item quarantineItem) displayName() string {
+	if item.Name != "" {
+		return item.Name
+	}
+	return path.Base(item.Path)
+}
@@ -0,0 +1,52 @@
+package filer
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+/*
+ * The dl parameter sets the Content-Disposition file name
+ */
+func TestDownloadName(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.uploadFile(t, "abc/4f2a9c.pdf", []byte("%PDF-"))
+	download := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", "/upload/abc/4f2a9c.pdf?"+query, nil)
+		rr := s.serveUpload(req)
+		return rr.Code, rr.Header().Get("Content-Disposition")
+	}
+
+	if status, disposition := download(""); status != http.StatusOK || disposition != "" {
+		t.Errorf("without dl: got %v %q", status, disposition)
+	}
+	if status, disposition := download("dl=" + url.QueryEscape("Invoice 2024.pdf")); status != http.StatusOK || disposition != `attachment; filename="Invoice 2024.pdf"` {
+		t.Errorf("ASCII name: got %v %q", status, disposition)
+	}
+	if status, disposition := download("dl=" + url.QueryEscape("Rechnung März.pdf")); status != http.StatusOK ||
+		disposition != `attachment; filename="Rechnung M_rz.pdf"; filename*=UTF-8''Rechnung%20M%C3%A4rz.pdf` {
+		t.Errorf("non-ASCII name: got %v %q", status, disposition)
+	}
+	if status, _ := download("dl=" + url.QueryEscape("../etc/passwd")); status != http.StatusBadRequest {
+		t.Errorf("name with path: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Signed names
+	s.conf.SignDownloadNames = true
+	if status, _ := download("dl=other.pdf"); status != http.StatusForbidden {
+		t.Errorf("unsigned name: got %v want %v", status, http.StatusForbidden)
+	}
+	signature := hex.EncodeToString(downloadNameMAC(s.conf.Secret, "abc/4f2a9c.pdf", "other.pdf"))
+	if status, disposition := download("dl=other.pdf&dls=" + signature); status != http.StatusOK || disposition != `attachment; filename="other.pdf"` {
+		t.Errorf("signed name: got %v %q", status, disposition)
+	}
+	if status, _ := download("dl=another.pdf&dls=" + signature); status != http.StatusForbidden {
+		t.Errorf("name with signature of another: got %v want %v", status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,468 @@
+/*
+ * At-rest encryption
+ * File contents are encrypted with AES-256-GCM in segments of 64 KiB
+ * (STREAM construction), so files can be encrypted and decrypted while
+ * streaming and downloads can still seek.
+ *
+ * Every file is encrypted with its own random data key. The data key is
+ * stored in the file header, encrypted ("wrapped") with the master key.
+ * Changing the master key therefore only requires re-wrapping data keys
+ * (see "prosody-filer rekey"), not re-encrypting the files.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+const (
+	encryptionSegmentSize = 64 * 1024
+	encryptionTagSize     = 16
+	encryptionKeyIDSize   = 8
+	encryptionNonceSize   = 12
+
+	// Data key encrypted with AES-GCM
+	wrappedKeySize = 32 + encryptionTagSize
+
+	// Key derivation salt of version 1 files
+	encryptionSaltSize = 32
+)
+
+var errDecryptionFailed = errors.New("decryption failed: file has been modified or wrong key")
+
+/*
+ * Parses a 256 bit key, either hex or base64 encoded
+ */
+func parseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, hex or base64 encoded")
+	}
+
+	return key, nil
+}
+
+/*
+ * Returns the ID of a master key, which is stored in file headers to find
+ * the key a data key has been wrapped with
+ */
+func masterKeyID(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("prosody-filer key id"), key...))
+	return sum[:encryptionKeyIDSize]
+}
+
+/*
+ * Loads the current master key from encryptionKey or encryptionKeyFile and
+ * old master keys from encryptionOldKeys and encryptionOldKeyFiles
+ */
+func (s *Server) loadEncryptionKey() error {
+	s.encryptionKey, s.encryptionKeyID = nil, nil
+	s.encryptionKeys = make(map[string][]byte)
+
+	encoded := s.conf.EncryptionKey
+	if s.conf.EncryptionKeyFile != "" {
+		data, err := os.ReadFile(s.conf.EncryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read encryption key file: %s", err)
+		}
+		encoded = string(data)
+	}
+
+	oldKeys := append([]string{}, s.conf.EncryptionOldKeys...)
+	for _, filename := range s.conf.EncryptionOldKeyFiles {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read old encryption key file: %s", err)
+		}
+		oldKeys = append(oldKeys, string(data))
+	}
+
+	for _, oldKey := range oldKeys {
+		key, err := parseKey(oldKey)
+		if err != nil {
+			return fmt.Errorf("invalid old encryption key: %s", err)
+		}
+		s.encryptionKeys[string(masterKeyID(key))] = key
+	}
+
+	// Without a current key, new files are stored unencrypted
+	if encoded == "" {
+		return nil
+	}
+
+	key, err := parseKey(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key: %s", err)
+	}
+
+	s.encryptionKey, s.encryptionKeyID = key, masterKeyID(key)
+	s.encryptionKeys[string(s.encryptionKeyID)] = key
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+ * Encrypts a data key with the current master key. Returns nonce and
+ * wrapped key. aad binds the wrapped key to the file header.
+ */
+func (s *Server) wrapDataKey(dataKey []byte, aad []byte) ([]byte, []byte, error) {
+	aead, err := newGCM(s.encryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, aead.Seal(nil, nonce, dataKey, aad), nil
+}
+
+/*
+ * Decrypts a data key with the master key identified by keyID
+ */
+func (s *Server) unwrapDataKey(keyID []byte, nonce []byte, wrapped []byte, aad []byte) ([]byte, error) {
+	masterKey, ok := s.encryptionKeys[string(keyID)]
+	if !ok {
+		if len(s.encryptionKeys) == 0 {
+			return nil, errors.New("file is encrypted, but no encryption key is configured")
+		}
+		return nil, fmt.Errorf("file is encrypted with unknown master key %x", keyID)
+	}
+
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := aead.Open(nil, nonce, wrapped, aad)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	return dataKey, nil
+}
+
+/*
+ * Returns the cipher for the content of an encrypted file
+ */
+func (s *Server) fileCipher(header *storedFileHeader) (cipher.AEAD, error) {
+	if header.version != storedFileVersion1 {
+		dataKey, err := s.unwrapDataKey(header.keyID, header.wrapNonce, header.wrappedKey, header.wrapAAD())
+		if err != nil {
+			return nil, err
+		}
+		return newGCM(dataKey)
+	}
+
+	// Version 1 files don't record which master key they are encrypted with
+	if s.encryptionKey == nil {
+		return nil, errors.New("file is encrypted, but no encryption key is configured")
+	}
+	mac := hmac.New(sha256.New, s.encryptionKey)
+	mac.Write([]byte("prosody-filer file key"))
+	mac.Write(header.salt)
+	return newGCM(mac.Sum(nil))
+}
+
+/*
+ * Nonce of a segment: zero prefix, segment counter and a flag marking the
+ * last segment, which prevents undetected truncation
+ */
+func segmentNonce(segment int64, last bool) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(segment))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+/*
+ * Encrypts everything written to it. Close() must be called to write the
+ * final segment.
+ */
+type encryptingWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	segment int64
+}
+
+func newEncryptingWriter(dst io.Writer, aead cipher.AEAD, aad []byte) *encryptingWriter {
+	return &encryptingWriter{
+		dst:  dst,
+		aead: aead,
+		aad:  aad,
+		buf:  make([]byte, 0, encryptionSegmentSize),
+	}
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only flushed once more data arrives, so the last one can be marked as such
+		if len(e.buf) == encryptionSegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.segment, last), e.buf, e.aad)
+	e.buf = e.buf[:0]
+	e.segment++
+
+	_, err := e.dst.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.flush(true)
+}
+
+/*
+ * Decrypts a file, allowing random access
+ */
+type decryptingReader struct {
+	src        io.ReaderAt
+	aead       cipher.AEAD
+	aad        []byte
+	dataOffset int64
+	segments   int64
+	size       int64
+	pos        int64
+	buf        []byte
+	bufSegment int64
+}
+
+/*
+ * Sets up decryption of encrypted data starting at dataOffset, with
+ * cipherSize bytes of segments following
+ */
+func newDecryptingReader(src io.ReaderAt, aead cipher.AEAD, aad []byte, dataOffset int64, cipherSize int64) (*decryptingReader, error) {
+	const sealedSegmentSize = encryptionSegmentSize + encryptionTagSize
+
+	segments := cipherSize / sealedSegmentSize
+	size := segments * encryptionSegmentSize
+	if remainder := cipherSize % sealedSegmentSize; remainder > 0 {
+		if remainder < encryptionTagSize {
+			return nil, errDecryptionFailed
+		}
+		segments++
+		size += remainder - encryptionTagSize
+	}
+	if segments == 0 {
+		return nil, errDecryptionFailed
+	}
+
+	return &decryptingReader{
+		src:        src,
+		aead:       aead,
+		aad:        aad,
+		dataOffset: dataOffset,
+		segments:   segments,
+		size:       size,
+		bufSegment: -1,
+	}, nil
+}
+
+/*
+ * Size of the decrypted content
+ */
+func (d *decryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	segment := d.pos / encryptionSegmentSize
+	if segment != d.bufSegment {
+		if err := d.loadSegment(segment); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf[d.pos%encryptionSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptingReader) loadSegment(segment int64) error {
+	sealed := make([]byte, encryptionSegmentSize+encryptionTagSize)
+	n, err := d.src.ReadAt(sealed, d.dataOffset+segment*int64(len(sealed)))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	plain, err := d.aead.Open(sealed[:0], segmentNonce(segment, segment == d.segments-1), sealed[:n], d.aad)
+	if err != nil {
+		return errDecryptionFailed
+	}
+
+	d.buf = plain
+	d.bufSegment = segment
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	d.pos = offset
+	return offset, nil
+}
+
+/*
+ * Re-wraps the data key of an encrypted file with the current master key.
+ * Version 1 files are re-encrypted with a new data key instead. The file
+ * is rewritten to a temporary file which then replaces it, so it can't be
+ * left half-written. Returns false if the file did not need to be changed.
+ */
+func (s *Server) rewrapFile(absFilename string) (bool, error) {
+	file, err := storage.OpenLocalFile(absFilename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header, err := readStoredFileHeader(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", absFilename, err)
+	}
+	if header == nil || header.flags&storedFileEncrypted == 0 {
+		return false, nil
+	}
+	if header.version == storedFileVersion && bytes.Equal(header.keyID, s.encryptionKeyID) {
+		return false, nil
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(absFilename), ".rekey-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if header.version == storedFileVersion1 {
+		err = s.reencryptFile(tmpFile, file, header)
+	} else {
+		err = s.copyRewrapped(tmpFile, file, header)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", absFilename, err)
+	}
+
+	if info, err := file.Stat(); err == nil {
+		tmpFile.Chmod(info.Mode().Perm())
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return false, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return false, err
+	}
+	os.Chtimes(tmpFile.Name(), file.ModTime(), file.ModTime())
+
+	if err := os.Rename(tmpFile.Name(), absFilename); err != nil {
+		return false, fmt.Errorf("failed to replace %s: %s", absFilename, err)
+	}
+	return true, nil
+}
+
+/*
+ * Writes the file with its data key wrapped with the current master key
+ */
+func (s *Server) copyRewrapped(dst io.Writer, file *storage.LocalFile, header *storedFileHeader) error {
+	dataOffset := int64(len(header.bytes()))
+
+	dataKey, err := s.unwrapDataKey(header.keyID, header.wrapNonce, header.wrappedKey, header.wrapAAD())
+	if err != nil {
+		return err
+	}
+
+	header.keyID = s.encryptionKeyID
+	header.wrapNonce, header.wrappedKey, err = s.wrapDataKey(dataKey, header.wrapAAD())
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header.bytes()); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(file, dataOffset, file.Size()-dataOffset))
+	return err
+}
+
+/*
+ * Writes the decrypted contents of a version 1 file encrypted anew
+ */
+func (s *Server) reencryptFile(dst io.Writer, file *storage.LocalFile, header *storedFileHeader) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	stored, err := s.decodeStoredFile(file)
+	if err != nil {
+		return err
+	}
+
+	writer, err := s.newStoredFileWriter(dst, nil, header.flags&storedFileCompressed != 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, stored); err != nil {
+		return err
+	}
+	return writer.Close()
+}
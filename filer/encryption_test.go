@@ -0,0 +1,407 @@
+package filer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+const testEncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+const testOldEncryptionKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+
+/*
+ * Encrypts content and returns the encrypted data with its header
+ */
+func (s *Server) encryptTestData(t *testing.T, content []byte) ([]byte, []byte) {
+	var encrypted bytes.Buffer
+	writer, err := s.newStoredFileWriter(&encrypted, content, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(content)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := readStoredFileHeader(bytes.NewReader(encrypted.Bytes()))
+	if err != nil || header == nil {
+		t.Fatalf("invalid header: %v", err)
+	}
+	return encrypted.Bytes(), header.bytes()
+}
+
+/*
+ * Decrypts data written by encryptTestData
+ */
+func (s *Server) decryptTestData(t *testing.T, encrypted []byte) (*decryptingReader, error) {
+	header, err := readStoredFileHeader(bytes.NewReader(encrypted))
+	if err != nil || header == nil {
+		t.Fatalf("invalid header: %v", err)
+	}
+	dataKey, err := s.unwrapDataKey(header.keyID, header.wrapNonce, header.wrappedKey, header.wrapAAD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := len(header.bytes())
+	return newDecryptingReader(bytes.NewReader(encrypted), aead, header.prefix(), int64(headerSize), int64(len(encrypted)-headerSize))
+}
+
+/*
+ * Encrypt and decrypt content of various sizes, including random access
+ */
+func TestEncryptionRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.EncryptionKey = testEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, 3*encryptionSegmentSize + 100} {
+		content := make([]byte, size)
+		rand.Read(content)
+
+		encrypted, _ := s.encryptTestData(t, content)
+		decrypter, err := s.decryptTestData(t, encrypted)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+
+		decrypted, err := io.ReadAll(decrypter)
+		if err != nil || !bytes.Equal(decrypted, content) || decrypter.Size() != int64(size) {
+			t.Fatalf("size %d: round trip failed: %v", size, err)
+		}
+
+		// Read a range crossing segment boundaries
+		if size > encryptionSegmentSize+10 {
+			decrypter.Seek(encryptionSegmentSize-10, io.SeekStart)
+			part := make([]byte, 20)
+			if _, err := io.ReadFull(decrypter, part); err != nil || !bytes.Equal(part, content[encryptionSegmentSize-10:encryptionSegmentSize+10]) {
+				t.Errorf("size %d: random access failed: %v", size, err)
+			}
+		}
+	}
+}
+
+/*
+ * Modified or truncated files must not decrypt
+ */
+func TestEncryptionTampering(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.EncryptionKey = testEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 2*encryptionSegmentSize+10)
+	encrypted, header := s.encryptTestData(t, content)
+
+	modified := append([]byte{}, encrypted...)
+	modified[len(header)+5] ^= 1
+	if decrypter, err := s.decryptTestData(t, modified); err == nil {
+		if _, err := io.ReadAll(decrypter); err == nil {
+			t.Errorf("modified content has been decrypted")
+		}
+	}
+
+	// Cut off last segment
+	truncated := encrypted[:len(header)+2*(encryptionSegmentSize+encryptionTagSize)]
+	if decrypter, err := s.decryptTestData(t, truncated); err == nil {
+		if _, err := io.ReadAll(decrypter); err == nil {
+			t.Errorf("truncated content has been decrypted")
+		}
+	}
+}
+
+/*
+ * Upload a file with encryption enabled and download it again
+ */
+func TestUploadEncrypted(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.EncryptionKey = testEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/catmetal.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, []byte(storedFileMagic)) || bytes.Contains(stored, catMetalFile[:64]) {
+		t.Errorf("file has not been stored encrypted")
+	}
+
+	rr := s.getCatmetal(t)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), catMetalFile) {
+		t.Errorf("download did not return original content. Status: %v", rr.Code)
+	}
+
+	// HEAD must report the decrypted size
+	req, _ := http.NewRequest("HEAD", "/upload/thomas/abc/catmetal.jpg", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(catMetalFile)) {
+		t.Errorf("HEAD returned wrong Content-Length: got %s want %d", got, len(catMetalFile))
+	}
+
+	// Range requests must work on decrypted content
+	req, _ = http.NewRequest("GET", "/upload/thomas/abc/catmetal.jpg", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), catMetalFile[100:200]) {
+		t.Errorf("range request failed. Status: %v", rr.Code)
+	}
+}
+
+/*
+ * Change the master key and re-wrap the data keys of existing files
+ */
+func TestRekey(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.EncryptionKey = testOldEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	storedFilename := filepath.Join(s.conf.StoreDir, "thomas/abc/catmetal.jpg")
+	before, err := os.ReadFile(storedFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeInfo, err := os.Stat(storedFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New master key, old one still configured for reading
+	s.conf.EncryptionKey = testEncryptionKey
+	s.conf.EncryptionOldKeys = []string{testOldEncryptionKey}
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := s.rekeyStore()
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("rekey failed: %d files, %v", rewrapped, err)
+	}
+
+	after, err := os.ReadFile(storedFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := len(storedFileMagic) + 2 + encryptionKeyIDSize + encryptionNonceSize + wrappedKeySize
+	if len(after) != len(before) || !bytes.Equal(after[headerSize:], before[headerSize:]) {
+		t.Errorf("rekey must only change the header")
+	}
+	if afterInfo, err := os.Stat(storedFilename); err != nil || os.SameFile(beforeInfo, afterInfo) {
+		t.Errorf("rekey must replace the file instead of writing to it: %v", err)
+	}
+
+	// Second run has nothing left to do
+	if rewrapped, err := s.rekeyStore(); err != nil || rewrapped != 0 {
+		t.Errorf("second rekey changed %d files, %v", rewrapped, err)
+	}
+
+	// File must be readable without the old key
+	s.conf.EncryptionOldKeys = nil
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := s.getCatmetal(t)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), catMetalFile) {
+		t.Errorf("download after rekey failed. Status: %v", rr.Code)
+	}
+}
+
+/*
+ * Files encrypted with format version 1 must still be readable and are
+ * converted by rekey
+ */
+func TestVersion1File(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove stored file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.EncryptionKey = testEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 3*encryptionSegmentSize+100)
+	rand.Read(content)
+
+	// Write file the way version 1 did
+	header := &storedFileHeader{version: storedFileVersion1, flags: storedFileEncrypted, salt: make([]byte, encryptionSaltSize)}
+	rand.Read(header.salt)
+	aead, err := s.fileCipher(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored bytes.Buffer
+	stored.Write(header.bytes())
+	writer := newEncryptingWriter(&stored, aead, header.bytes())
+	writer.Write(content)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	storedFilename := s.storagePath("thomas/abc/old.bin")
+	os.MkdirAll(filepath.Dir(storedFilename), os.ModePerm)
+	if err := os.WriteFile(storedFilename, stored.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() []byte {
+		file, err := s.openStoredFile(storedFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if !bytes.Equal(read(), content) {
+		t.Fatal("version 1 file not decrypted correctly")
+	}
+
+	if rewrapped, err := s.rekeyStore(); err != nil || rewrapped != 1 {
+		t.Fatalf("rekey failed: %d files, %v", rewrapped, err)
+	}
+	file, err := os.Open(storedFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = readStoredFileHeader(file)
+	file.Close()
+	if err != nil || header == nil || header.version != storedFileVersion {
+		t.Fatalf("rekey did not convert version 1 file: %+v, %v", header, err)
+	}
+	if !bytes.Equal(read(), content) {
+		t.Error("converted file not decrypted correctly")
+	}
+}
+
+/*
+ * Rekey must keep deduplicated files linked to each other
+ */
+func TestRekeyDeduplicated(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.Deduplicate = true
+	s.conf.EncryptionKey = testOldEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("forwarded to every MUC")
+	for _, fileStorePath := range []string{"abc/meme.txt", "def/meme.txt"} {
+		if status := s.uploadFile(t, fileStorePath, content).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s returned wrong status code: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+
+	s.conf.EncryptionKey = testEncryptionKey
+	s.conf.EncryptionOldKeys = []string{testOldEncryptionKey}
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.rekeyStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, _ := s.readMetadata("abc/meme.txt")
+	var infos []os.FileInfo
+	for _, filename := range []string{s.storagePath("abc/meme.txt"), s.storagePath("def/meme.txt"), s.blobPath(meta.SHA256)} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, info)
+	}
+	if !os.SameFile(infos[0], infos[1]) || !os.SameFile(infos[0], infos[2]) {
+		t.Error("deduplicated files are not linked anymore after rekey")
+	}
+
+	// Readable with the new key only
+	s.conf.EncryptionOldKeys = nil
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := s.openBackendFile("def/meme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if data, err := io.ReadAll(file); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("deduplicated file not readable after rekey: %v", err)
+	}
+}
+
+/*
+ * Unencrypted uploads looking like encoded files must be returned unmodified
+ */
+func TestUploadMagicCollision(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte(storedFileMagic + "\x01\x01 not actually encrypted")
+	if status := s.uploadFile(t, "thomas/abc/tricky.bin", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/thomas/abc/tricky.bin", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download did not return original content: %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Structured error bodies
+ * With structuredErrors, clients asking for JSON or XML in their Accept
+ * header get error responses they can show to users, e.g. "file too large,
+ * max 20.0 MiB", instead of the plain text error. The XML variant is the
+ * error element of XEP-0363 slot requests, with the stanza error condition
+ * matching the status code.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Returns the error body format preferred by the Accept header: "json",
+ * "xml", or "" for plain text (and error pages)
+ */
+func errorFormat(accept string) string {
+	format, best := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if value, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		var candidate string
+		switch mediaType {
+		case "application/json":
+			candidate = "json"
+		case "application/xml", "text/xml":
+			candidate = "xml"
+		case "text/plain", "text/html":
+			candidate = ""
+		default:
+			continue
+		}
+		if quality > best {
+			format, best = candidate, quality
+		}
+	}
+	return format
+}
+
+/*
+ * Replaces plain text error responses with the format the client asks for.
+ * The returned function has to be called once the handler has returned.
+ */
+func (s *Server) withErrorBodies(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	format := errorFormat(r.Header.Get("Accept"))
+	if !s.conf.StructuredErrors || format == "" {
+		return w, func() {}
+	}
+	e := &errorBodyWriter{ResponseWriter: w, format: format}
+	return e, e.flush
+}
+
+type errorBodyWriter struct {
+	http.ResponseWriter
+	format string
+
+	// Status of the error being replaced, until its message has been written
+	pending int
+	// Set once the replacement has been written; the original body is dropped
+	replaced bool
+}
+
+func (e *errorBodyWriter) WriteHeader(status int) {
+	if status < 400 || e.replaced || !strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+	e.pending = status
+}
+
+func (e *errorBodyWriter) Write(p []byte) (int, error) {
+	if e.replaced {
+		return len(p), nil
+	} else if e.pending == 0 {
+		return e.ResponseWriter.Write(p)
+	}
+
+	// Written at once by http.Error
+	e.writeError(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+/*
+ * Keeps sendfile working for successful downloads
+ */
+func (e *errorBodyWriter) ReadFrom(src io.Reader) (int64, error) {
+	if readerFrom, ok := e.ResponseWriter.(io.ReaderFrom); ok && e.pending == 0 {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{e}, src)
+}
+
+/*
+ * Writes the replacement of an error without body
+ */
+func (e *errorBodyWriter) flush() {
+	if e.pending != 0 && !e.replaced {
+		e.writeError(http.StatusText(e.pending))
+	}
+}
+
+func (e *errorBodyWriter) writeError(message string) {
+	status := e.pending
+	e.replaced = true
+
+	var maxFileSize int64
+	if value := e.Header().Get("X-Max-File-Size"); value != "" {
+		maxFileSize, _ = strconv.ParseInt(value, 10, 64)
+	}
+	var retryAfter int64
+	if value := e.Header().Get("Retry-After"); value != "" {
+		retryAfter, _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	var body []byte
+	if e.format == "json" {
+		body, _ = json.Marshal(errorBody{
+			Status:      status,
+			Error:       http.StatusText(status),
+			Message:     message,
+			MaxFileSize: maxFileSize,
+			RetryAfter:  retryAfter,
+		})
+		e.Header().Set("Content-Type", "application/json")
+	} else {
+		body = xmppErrorBody(status, message, maxFileSize, retryAfter)
+		e.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	}
+	e.ResponseWriter.WriteHeader(status)
+	e.ResponseWriter.Write(append(body, '\n'))
+}
+
+type errorBody struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// Bytes, if the upload is too large
+	MaxFileSize int64 `json:"maxFileSize,omitempty"`
+	// Seconds, if the request can be repeated later
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+}
+
+const stanzasNamespace = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+/*
+ * Error element of XEP-0363
+ */
+type xmppError struct {
+	XMLName   xml.Name `xml:"error"`
+	Type      string   `xml:"type,attr"`
+	Condition struct {
+		XMLName xml.Name
+	}
+	Text struct {
+		XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+		Text    string   `xml:",chardata"`
+	}
+	FileTooLarge *xmppFileTooLarge
+	Retry        *xmppRetry
+}
+
+type xmppFileTooLarge struct {
+	XMLName     xml.Name `xml:"urn:xmpp:http:upload:0 file-too-large"`
+	MaxFileSize int64    `xml:"max-file-size"`
+}
+
+type xmppRetry struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 retry"`
+	Stamp   string   `xml:"stamp,attr"`
+}
+
+/*
+ * Stanza error types and conditions (RFC 6120) of status codes
+ */
+var xmppErrorConditions = map[int][2]string{
+	http.StatusBadRequest:            {"modify", "bad-request"},
+	http.StatusUnauthorized:          {"auth", "not-authorized"},
+	http.StatusForbidden:             {"auth", "forbidden"},
+	http.StatusNotFound:              {"cancel", "item-not-found"},
+	http.StatusMethodNotAllowed:      {"cancel", "not-allowed"},
+	http.StatusConflict:              {"cancel", "conflict"},
+	http.StatusGone:                  {"cancel", "gone"},
+	http.StatusRequestEntityTooLarge: {"modify", "not-acceptable"},
+	http.StatusUnsupportedMediaType:  {"modify", "not-acceptable"},
+	http.StatusTooManyRequests:       {"wait", "resource-constraint"},
+	http.StatusServiceUnavailable:    {"wait", "service-unavailable"},
+	http.StatusInsufficientStorage:   {"wait", "resource-constraint"},
+}
+
+func xmppErrorBody(status int, message string, maxFileSize int64, retryAfter int64) []byte {
+	condition, ok := xmppErrorConditions[status]
+	if !ok && status >= 500 {
+		condition = [2]string{"cancel", "internal-server-error"}
+	} else if !ok {
+		condition = [2]string{"cancel", "undefined-condition"}
+	}
+
+	var body xmppError
+	body.Type = condition[0]
+	body.Condition.XMLName = xml.Name{Space: stanzasNamespace, Local: condition[1]}
+	body.Text.Text = message
+	if status == http.StatusRequestEntityTooLarge && maxFileSize > 0 {
+		body.FileTooLarge = &xmppFileTooLarge{MaxFileSize: maxFileSize}
+	}
+	if retryAfter > 0 {
+		body.Retry = &xmppRetry{Stamp: time.Now().Add(time.Duration(retryAfter) * time.Second).UTC().Format(time.RFC3339)}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	xml.NewEncoder(&buf).Encode(body)
+	return buf.Bytes()
+}
@@ -0,0 +1,82 @@
+package filer
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+ * Clients accepting JSON or XML get structured errors
+ */
+func TestStructuredErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StructuredErrors = true
+	s.conf.MaxFileSize = 10
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	upload := func(accept string) *http.Response {
+		req := s.newUploadRequest(t, "abc/large.txt", []byte("0123456789a"))
+		req.Header.Set("Accept", accept)
+		return s.serveUpload(req).Result()
+	}
+
+	resp := upload("application/json")
+	var body errorBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("invalid JSON error: %s", err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || resp.Header.Get("Content-Type") != "application/json" ||
+		body.Message != "Request Entity Too Large: file too large, max 10 bytes" || body.MaxFileSize != 10 {
+		t.Errorf("JSON error: got %v %s %+v", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	resp = upload("text/html;q=0.5, application/xml")
+	var xmlBody struct {
+		Type          string    `xml:"type,attr"`
+		NotAcceptable *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-stanzas not-acceptable"`
+		Text          string    `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text"`
+		MaxFileSize   int64     `xml:"urn:xmpp:http:upload:0 file-too-large>max-file-size"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&xmlBody); err != nil {
+		t.Fatalf("invalid XML error: %s", err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || xmlBody.Type != "modify" || xmlBody.NotAcceptable == nil || xmlBody.MaxFileSize != 10 {
+		t.Errorf("XML error: got %v %+v", resp.StatusCode, xmlBody)
+	}
+
+	// Browsers and XMPP clients keep getting plain text
+	for _, accept := range []string{"", "*/*", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"} {
+		if resp := upload(accept); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Errorf("Accept %q: got %s", accept, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// Successful responses are passed on
+	req := s.newUploadRequest(t, "abc/small.txt", []byte("0123456789"))
+	req.Header.Set("Accept", "application/json")
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Errorf("upload: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	s.conf.StructuredErrors = false
+	if resp := upload("application/json"); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("structured error while disabled: %s", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestXMPPErrorBody(t *testing.T) {
+	body := string(xmppErrorBody(http.StatusTooManyRequests, "Too Many Requests", 0, 30))
+	for _, want := range []string{`<error type="wait">`, `<resource-constraint xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">`, `<retry xmlns="urn:xmpp:http:upload:0" stamp="`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in %s", want, body)
+		}
+	}
+	if body := string(xmppErrorBody(http.StatusBadGateway, "Bad Gateway", 0, 0)); !strings.Contains(body, "<internal-server-error ") {
+		t.Errorf("unexpected condition for 502: %s", body)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Custom error pages
+ * Browsers get an HTML page for error responses, if one is configured for
+ * the status code: errorPages maps status codes to template files,
+ * errorPageTemplates to inline templates. Templates are html/templates
+ * with .Status, .StatusText and .Path. Other clients keep getting the
+ * plain text error.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Parses the configured error page templates
+ */
+func (s *Server) loadErrorPages() error {
+	s.errorPages = make(map[int]*template.Template)
+
+	add := func(code string, text string) error {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid error page status %q: must be 400 to 599", code)
+		}
+		page, err := template.New(code).Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid error page for %s: %s", code, err)
+		}
+		s.errorPages[status] = page
+		return nil
+	}
+
+	for code, filename := range s.conf.ErrorPages {
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read error page for %s: %s", code, err)
+		}
+		if err := add(code, string(text)); err != nil {
+			return err
+		}
+	}
+	for code, text := range s.conf.ErrorPageTemplates {
+		if err := add(code, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Replaces error responses to browsers with the configured pages
+ */
+func (s *Server) withErrorPages(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if len(s.errorPages) == 0 || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return w
+	}
+	return &errorPageWriter{ResponseWriter: w, pages: s.errorPages, path: r.URL.Path}
+}
+
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages map[int]*template.Template
+	path  string
+
+	// Set once the error page has been written; the original body is dropped
+	replaced bool
+}
+
+func (e *errorPageWriter) WriteHeader(status int) {
+	page := e.pages[status]
+	if page == nil {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	e.replaced = true
+	e.Header().Set("Content-Type", "text/html; charset=utf-8")
+	e.Header().Del("Content-Length")
+	e.ResponseWriter.WriteHeader(status)
+
+	err := page.Execute(e.ResponseWriter, struct {
+		Status     int
+		StatusText string
+		Path       string
+	}{status, http.StatusText(status), e.path})
+	if err != nil {
+		log.Warn("Failed to render error page for ", status, ": ", err)
+	}
+}
+
+func (e *errorPageWriter) Write(p []byte) (int, error) {
+	if e.replaced {
+		return len(p), nil
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+/*
+ * Keeps sendfile working for successful downloads
+ */
+func (e *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if readerFrom, ok := e.ResponseWriter.(io.ReaderFrom); ok && !e.replaced {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{e}, src)
+}
@@ -0,0 +1,55 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * Browsers get the configured error pages, other clients plain text
+ */
+func TestErrorPages(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	pageFile := filepath.Join(t.TempDir(), "404.html")
+	if err := os.WriteFile(pageFile, []byte("<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Path}}</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.conf.ErrorPages = map[string]string{"404": pageFile}
+	s.conf.ErrorPageTemplates = map[string]string{"403": "<h1>Nothing to see here</h1>"}
+	if err := s.loadErrorPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target string, accept string) (int, string, string) {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", accept)
+		rr := s.serveUpload(req)
+		return rr.Code, rr.Header().Get("Content-Type"), rr.Body.String()
+	}
+
+	status, contentType, body := get("/upload/abc/<missing>.jpg", "text/html,application/xhtml+xml")
+	if status != http.StatusNotFound || contentType != "text/html; charset=utf-8" ||
+		body != "<h1>404 Not Found</h1><p>/upload/abc/&lt;missing&gt;.jpg</p>" {
+		t.Errorf("404 page: got %v, %s, %q", status, contentType, body)
+	}
+
+	status, _, body = get("/upload/", "text/html")
+	if status != http.StatusForbidden || body != "<h1>Nothing to see here</h1>" {
+		t.Errorf("403 page: got %v, %q", status, body)
+	}
+
+	status, contentType, body = get("/upload/abc/missing.jpg", "*/*")
+	if status != http.StatusNotFound || !strings.HasPrefix(contentType, "text/plain") || body != "Not Found\n" {
+		t.Errorf("404 for non-browser: got %v, %s, %q", status, contentType, body)
+	}
+
+	s.conf.ErrorPageTemplates = map[string]string{"200": "OK"}
+	if err := s.loadErrorPages(); err == nil {
+		t.Error("error page for 200 has been accepted")
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Error reporting
+ * Unexpected server errors (5xx responses other than 503, which is sent on
+ * purpose, e.g. in read-only mode) and panics are reported in the
+ * background to Sentry (sentryDSN) and/or POSTed as JSON to
+ * errorWebhookURL, with the request they happened in. Query strings, which
+ * carry MACs, are not reported.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errorReportFailuresMetric = newCounter("prosody_filer_error_report_failures_total", "Error reports which could not be delivered.")
+
+const (
+	errorReportTimeout  = 10 * time.Second
+	errorReportBodySize = 512
+)
+
+type errorReport struct {
+	Time    time.Time        `json:"time"`
+	Message string           `json:"message"`
+	Status  int              `json:"status"`
+	Stack   string           `json:"stack,omitempty"`
+	Request *reportedRequest `json:"request,omitempty"`
+	Server  string           `json:"server"`
+}
+
+type reportedRequest struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	ClientIP  string `json:"clientIP"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+/*
+ * Store endpoint and key of a Sentry project
+ */
+type sentryDSN struct {
+	storeURL  string
+	publicKey string
+}
+
+/*
+ * Parses a DSN like "https://<key>@sentry.example.com/<project>"
+ */
+func parseSentryDSN(dsn string) (sentryDSN, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.User == nil || parsed.User.Username() == "" {
+		return sentryDSN{}, fmt.Errorf("invalid sentryDSN: must look like \"https://<key>@sentry.example.com/<project>\"")
+	}
+	prefix, project := path.Split(strings.TrimRight(parsed.Path, "/"))
+	if project == "" {
+		return sentryDSN{}, fmt.Errorf("invalid sentryDSN: project is missing")
+	}
+
+	storeURL := url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: path.Join(prefix, "api", project, "store") + "/"}
+	return sentryDSN{storeURL: storeURL.String(), publicKey: parsed.User.Username()}, nil
+}
+
+/*
+ * Delivers reports to sentryDSN and errorWebhookURL
+ */
+func (s *Server) startErrorReports() error {
+	var dsn sentryDSN
+	if s.conf.SentryDSN != "" {
+		var err error
+		if dsn, err = parseSentryDSN(s.conf.SentryDSN); err != nil {
+			return err
+		}
+	}
+
+	queue := make(chan errorReport, 100)
+	s.errorReports = queue
+	client := &http.Client{Timeout: errorReportTimeout}
+	go func() {
+		for report := range queue {
+			if dsn.storeURL != "" {
+				if err := sendSentryEvent(client, dsn, report); err != nil {
+					log.Error("Reporting error to Sentry failed: ", err)
+					errorReportFailuresMetric.add("", 1)
+				}
+			}
+			if s.conf.ErrorWebhookURL != "" {
+				if err := s.sendErrorWebhook(client, report); err != nil {
+					log.Error("Reporting error to errorWebhookURL failed: ", err)
+					errorReportFailuresMetric.add("", 1)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+/*
+ * Queues a report of an error in the handling of r
+ */
+func (s *Server) reportError(r *http.Request, status int, message string, stack string) {
+	server := s.cluster.node
+	if server == "" {
+		server, _ = os.Hostname()
+	}
+	report := errorReport{
+		Time:    time.Now().UTC(),
+		Message: message,
+		Status:  status,
+		Stack:   stack,
+		Server:  server,
+		Request: &reportedRequest{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			ClientIP:  s.clientIP(r),
+			UserAgent: r.UserAgent(),
+		},
+	}
+
+	select {
+	case s.errorReports <- report:
+	default:
+		log.Warn("Error report queue full, dropping report of ", message)
+		errorReportFailuresMetric.add("", 1)
+	}
+}
+
+/*
+ * Reports server errors and panics of next
+ */
+func (s *Server) withErrorReports(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &errorRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				// Used by net/http to abort responses on purpose
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				stack := string(debug.Stack())
+				log.Error("Panic serving ", r.Method, " ", r.URL.Path, ": ", recovered, "\n", stack)
+				s.reportError(r, http.StatusInternalServerError, fmt.Sprint("panic: ", recovered), stack)
+				if recorder.status == 0 {
+					httpError(recorder, http.StatusInternalServerError, "")
+				}
+				return
+			}
+
+			if recorder.status >= 500 && recorder.status != http.StatusServiceUnavailable {
+				message := strconv.Itoa(recorder.status) + " " + http.StatusText(recorder.status)
+				if body := strings.TrimSpace(recorder.body.String()); body != "" {
+					message += ": " + body
+				}
+				s.reportError(r, recorder.status, message, "")
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+/*
+ * Keeps the start of error responses for reports
+ */
+type errorRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (e *errorRecorder) Write(p []byte) (int, error) {
+	n, err := e.statusRecorder.Write(p)
+	if e.status >= 500 && e.body.Len() < errorReportBodySize {
+		keep := p[:n]
+		if len(keep) > errorReportBodySize-e.body.Len() {
+			keep = keep[:errorReportBodySize-e.body.Len()]
+		}
+		e.body.Write(keep)
+	}
+	return n, err
+}
+
+func (e *errorRecorder) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/*
+ * Sends a report as an event to Sentry's store endpoint
+ */
+func sendSentryEvent(client *http.Client, dsn sentryDSN, report errorReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   report.Time.Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "prosody-filer",
+		"release":     "prosody-filer@" + Version,
+		"server_name": report.Server,
+		"message":     report.Message,
+		"tags":        map[string]string{"status": strconv.Itoa(report.Status)},
+	}
+	if report.Request != nil {
+		event["request"] = map[string]interface{}{
+			"method":  report.Request.Method,
+			"url":     report.Request.Path,
+			"headers": map[string]string{"User-Agent": report.Request.UserAgent},
+			"env":     map[string]string{"REMOTE_ADDR": report.Request.ClientIP},
+		}
+	}
+	if report.Stack != "" {
+		event["extra"] = map[string]string{"stack": report.Stack}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, dsn.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "prosody-filer/"+Version)
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=prosody-filer/%s, sentry_key=%s", Version, dsn.publicKey))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+ * POSTs a report to errorWebhookURL, signed like webhook notifications
+ */
+func (s *Server) sendErrorWebhook(client *http.Client, report errorReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return s.postWebhook(client, s.conf.ErrorWebhookURL, body)
+}
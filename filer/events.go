@@ -0,0 +1,89 @@
+/*
+ * File events
+ * Uploads, downloads and deletions are announced to subscribers, e.g.
+ * webhooks.
+ * Subscribers are called synchronously and must not block.
+ */
+
+package filer
+
+import (
+	"strings"
+	"time"
+)
+
+/*
+ * An upload, download or deletion of a file
+ */
+type fileEvent struct {
+	Type        string    `json:"type"`
+	Path        string    `json:"path"`
+	URL         string    `json:"url,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Uploader    string    `json:"uploader,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Time        time.Time `json:"time"`
+
+	// Only for the audit log, not sent to webhooks and the like
+	ClientIP string `json:"-"`
+}
+
+/*
+ * Calls subscriber for every event until the returned function is called
+ */
+func (s *Server) subscribeEvents(subscriber func(fileEvent)) (unsubscribe func()) {
+	s.events.Lock()
+	id := s.events.nextID
+	s.events.nextID++
+	s.events.subscribers[id] = subscriber
+	s.events.Unlock()
+
+	return func() {
+		s.events.Lock()
+		delete(s.events.subscribers, id)
+		s.events.Unlock()
+	}
+}
+
+func (s *Server) publishEvent(event fileEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Uploader == "" {
+		event.Uploader = uploaderPrefix(event.Path)
+	}
+
+	s.events.RLock()
+	defer s.events.RUnlock()
+	for _, subscriber := range s.events.subscribers {
+		subscriber(event)
+	}
+}
+
+/*
+ * Returns the first path element, which XMPP servers choose per upload
+ * slot and which identifies the uploader to whoever issued the slot
+ */
+func uploaderPrefix(fileStorePath string) string {
+	if i := strings.IndexByte(fileStorePath, '/'); i > 0 {
+		return fileStorePath[:i]
+	}
+	return ""
+}
+
+/*
+ * Reports whether eventType is one of the configured event types
+ */
+func eventSelected(selected []string, eventType string) bool {
+	for _, wanted := range selected {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func isEventType(eventType string) bool {
+	return eventType == "upload" || eventType == "download" || eventType == "delete"
+}
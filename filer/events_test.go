@@ -0,0 +1,73 @@
+package filer
+
+import (
+	"net/http"
+	"testing"
+)
+
+/*
+ * Successful uploads are announced to subscribers
+ */
+func TestUploadEvent(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	var received []fileEvent
+	unsubscribe := s.subscribeEvents(func(event fileEvent) {
+		received = append(received, event)
+	})
+
+	content := []byte("event")
+	req := s.newUploadRequest(t, "abc/event.txt", content)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "upload.example.com")
+	if status := s.serveUpload(req).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	// Failed uploads are not announced
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/event.txt", []byte("other"))).Code; status != http.StatusConflict {
+		t.Fatalf("second upload returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	unsubscribe()
+	s.publishEvent(fileEvent{Type: "delete", Path: "abc/event.txt"})
+
+	if len(received) != 1 {
+		t.Fatalf("got %d events, want 1", len(received))
+	}
+	event := received[0]
+	if event.Type != "upload" || event.Path != "abc/event.txt" || event.Size != int64(len(content)) ||
+		event.ContentType != "text/plain; charset=utf-8" || event.Uploader != "abc" || len(event.SHA256) != 64 || event.Time.IsZero() ||
+		event.URL != "https://upload.example.com/upload/abc/event.txt" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestUploaderPrefix(t *testing.T) {
+	for fileStorePath, expected := range map[string]string{
+		"abc/cat.jpg":     "abc",
+		"abc/def/cat.jpg": "abc",
+		"cat.jpg":         "",
+	} {
+		if prefix := uploaderPrefix(fileStorePath); prefix != expected {
+			t.Errorf("uploaderPrefix(%q) = %q, want %q", fileStorePath, prefix, expected)
+		}
+	}
+}
+
+func TestEventSelected(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	if !eventSelected(s.conf.WebhookEvents, "upload") || eventSelected(s.conf.WebhookEvents, "delete") {
+		t.Error("by default, only upload events should be selected")
+	}
+	if !eventSelected([]string{"upload", "delete"}, "delete") {
+		t.Error("delete events have not been selected")
+	}
+}
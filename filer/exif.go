@@ -0,0 +1,249 @@
+/*
+ * Metadata stripping for unencrypted images
+ * Removes EXIF (including GPS positions), XMP, IPTC and comments from JPEG
+ * and PNG uploads while they are being received. Only the EXIF orientation
+ * is kept, so pictures are still displayed the right way up.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+/*
+ * Returns a filter function for uploads of the given (sniffed) content type
+ * or nil if there is no metadata filter for it
+ */
+func metadataFilter(contentType string) func(io.Writer, io.Reader) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata
+	case "image/png":
+		return stripPNGMetadata
+	}
+	return nil
+}
+
+/*
+ * Applies a filter to a stream, returning the filtered stream.
+ * The returned reader must be closed to stop the filter.
+ */
+func filterReader(src io.Reader, filter func(io.Writer, io.Reader) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(filter(pw, src))
+	}()
+	return pr
+}
+
+/*
+ * Writes what has been read already and copies the rest unmodified.
+ * Used whenever the input is not structured as expected.
+ */
+func passThrough(dst io.Writer, pending []byte, src io.Reader) error {
+	if _, err := dst.Write(pending); err != nil {
+		return err
+	}
+	_, err := copyBuffered(dst, src)
+	return err
+}
+
+/*
+ * Like io.ReadFull, but treats a short read at the end of the input as
+ * success. Remaining errors are read errors of the upload itself.
+ */
+func readFull(src io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+/*
+ * Copies a JPEG file, leaving out APP1 (EXIF/XMP), APP13 (IPTC) and COM
+ * segments. Everything from the start of scan on is copied unmodified.
+ */
+func stripJPEGMetadata(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+
+	soi := make([]byte, 2)
+	n, err := readFull(r, soi)
+	if err != nil {
+		return err
+	} else if n < 2 || soi[0] != 0xff || soi[1] != 0xd8 {
+		return passThrough(dst, soi[:n], r)
+	}
+	if _, err := dst.Write(soi); err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 4)
+		n, err := readFull(r, header[:2])
+		if err != nil {
+			return err
+		} else if n < 2 || header[0] != 0xff {
+			return passThrough(dst, header[:n], r)
+		}
+
+		marker := header[1]
+		if marker < 0xc0 || marker == 0xd8 || marker == 0xd9 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			// Markers without payload or unexpected ones: leave the rest alone
+			return passThrough(dst, header[:2], r)
+		}
+
+		n, err = readFull(r, header[2:])
+		if err != nil {
+			return err
+		} else if n < 2 || binary.BigEndian.Uint16(header[2:]) < 2 {
+			return passThrough(dst, header[:2+n], r)
+		}
+
+		if marker == 0xda {
+			// Start of scan: compressed image data follows
+			return passThrough(dst, header, r)
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint16(header[2:])-2)
+		n, err = readFull(r, payload)
+		if err != nil {
+			return err
+		} else if n < len(payload) {
+			return passThrough(dst, append(header, payload[:n]...), r)
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if orientation := exifOrientation(payload[6:]); orientation > 1 {
+				if _, err := dst.Write(orientationSegment(orientation)); err != nil {
+					return err
+				}
+			}
+		case marker == 0xe1, marker == 0xed, marker == 0xfe:
+			// XMP, IPTC and comments are dropped
+		default:
+			if _, err := dst.Write(append(header, payload...)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+ * Reads the orientation tag from IFD0 of an EXIF TIFF structure.
+ * Returns 0 if there is none.
+ */
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var byteOrder binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		byteOrder = binary.LittleEndian
+	case "MM":
+		byteOrder = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(byteOrder.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+
+	entries := int(byteOrder.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if byteOrder.Uint16(tiff[entry:]) == 0x0112 {
+			return int(byteOrder.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 0
+}
+
+/*
+ * Builds a minimal APP1 segment containing nothing but the orientation tag
+ */
+func orientationSegment(orientation int) []byte {
+	segment := []byte("\xff\xe1\x00\x22Exif\x00\x00" +
+		"MM\x00\x2a\x00\x00\x00\x08" + // TIFF header, IFD0 at offset 8
+		"\x00\x01" + // one entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00" + // orientation, SHORT, count 1
+		"\x00\x00\x00\x00") // no next IFD
+	binary.BigEndian.PutUint16(segment[28:], uint16(orientation))
+	return segment
+}
+
+/*
+ * PNG chunks which may carry metadata
+ */
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+/*
+ * Copies a PNG file, leaving out EXIF and text chunks
+ */
+func stripPNGMetadata(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+
+	signature := make([]byte, 8)
+	n, err := readFull(r, signature)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(signature[:n], []byte("\x89PNG\r\n\x1a\n")) {
+		return passThrough(dst, signature[:n], r)
+	}
+	if _, err := dst.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		// Chunk header: length and type
+		header := make([]byte, 8)
+		n, err := readFull(r, header)
+		if err != nil {
+			return err
+		} else if n < 8 {
+			return passThrough(dst, header[:n], r)
+		}
+
+		// Chunk data and CRC
+		length := int64(binary.BigEndian.Uint32(header)) + 4
+		chunkType := string(header[4:])
+
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, r, length); err != nil && err != io.EOF {
+				return err
+			}
+			continue
+		}
+
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, r, length); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if chunkType == "IEND" {
+			return passThrough(dst, nil, r)
+		}
+	}
+}
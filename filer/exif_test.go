@@ -0,0 +1,152 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Build catmetal.jpg with EXIF (orientation and "GPS" data) and a comment
+ */
+func jpegWithMetadata(t *testing.T) []byte {
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" +
+		"\x00\x00\x00\x00GPS 52.5163N 13.3777E")
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(exif)+2))
+	app1 = append(app1, exif...)
+
+	comment := []byte("\xff\xfe\x00\x0fsecret notes")
+
+	var buf bytes.Buffer
+	buf.Write(catMetalFile[:2])
+	buf.Write(app1)
+	buf.Write(comment)
+	buf.Write(catMetalFile[2:])
+	return buf.Bytes()
+}
+
+/*
+ * Build a PNG image with a text chunk
+ */
+func pngWithMetadata(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{255, 0, 0, 255})
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+
+	text := []byte("Comment\x00GPS 52.5163N 13.3777E")
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, text...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	// Insert after signature (8 bytes) and IHDR chunk (25 bytes)
+	raw := encoded.Bytes()
+	var buf bytes.Buffer
+	buf.Write(raw[:33])
+	buf.Write(chunk)
+	buf.Write(raw[33:])
+	return buf.Bytes()
+}
+
+/*
+ * Upload a JPEG with metadata and check that only the orientation is left
+ */
+func TestStripJPEGMetadata(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.StripImageMetadata = true
+
+	if status := s.uploadFile(t, "thomas/abc/photo.jpg", jpegWithMetadata(t)).Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/photo.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, []byte("GPS")) || bytes.Contains(stored, []byte("secret notes")) {
+		t.Errorf("metadata has not been removed")
+	}
+
+	exifStart := bytes.Index(stored, []byte("Exif\x00\x00"))
+	if exifStart < 0 || exifOrientation(stored[exifStart+6:]) != 6 {
+		t.Errorf("orientation has not been preserved")
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(stored)); err != nil {
+		t.Errorf("stored image can't be decoded: %s", err)
+	}
+}
+
+/*
+ * Upload a PNG with a text chunk and check that it has been removed
+ */
+func TestStripPNGMetadata(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.StripImageMetadata = true
+
+	if status := s.uploadFile(t, "thomas/abc/image.png", pngWithMetadata(t)).Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/image.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, []byte("GPS")) {
+		t.Errorf("metadata has not been removed")
+	}
+
+	if _, err := png.Decode(bytes.NewReader(stored)); err != nil {
+		t.Errorf("stored image can't be decoded: %s", err)
+	}
+}
+
+/*
+ * Data which only looks like an image at first must be stored unmodified
+ */
+func TestStripMetadataMalformed(t *testing.T) {
+	input := []byte("\xff\xd8\xff\xe1\x00")
+	var output bytes.Buffer
+
+	if err := stripJPEGMetadata(&output, bytes.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(input, output.Bytes()) {
+		t.Errorf("malformed input has been modified: %x", output.Bytes())
+	}
+}
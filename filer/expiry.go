@@ -0,0 +1,96 @@
+/*
+ * Per-upload expiry
+ * XMPP servers can limit the lifetime of single uploads, e.g. of large
+ * files, with an exp parameter (Unix time) covered by the MAC. Expired
+ * files are not served anymore and are removed within an hour.
+ */
+
+package filer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var expiredFilesMetric = newCounter("prosody_filer_expired_files_total", "Files removed after their expiry.")
+
+/*
+ * Returns the expiry requested by the exp parameter of an upload URL as Unix
+ * time, or 0 if there is none
+ */
+func uploadExpiry(query url.Values) (int64, error) {
+	if query["exp"] == nil {
+		return 0, nil
+	}
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || expires <= 0 {
+		return 0, fmt.Errorf("invalid exp parameter %q", query.Get("exp"))
+	}
+	return expires, nil
+}
+
+/*
+ * Reports whether the file has expired, by time or download count
+ */
+func (meta fileMetadata) expired() bool {
+	return (meta.Expires != nil && !time.Now().Before(*meta.Expires)) || (meta.MaxDownloads > 0 && meta.Downloads >= meta.MaxDownloads)
+}
+
+/*
+ * Removes an expired file, unless read-only mode forbids changes to the store
+ */
+func (s *Server) removeExpiredFile(fileStorePath string) {
+	if s.isReadOnly() {
+		return
+	}
+	log.Info("Removing expired file ", fileStorePath)
+	if err := s.deleteFile(fileStorePath, ""); err != nil && !os.IsNotExist(err) {
+		log.Error("Removing expired file failed: ", err)
+		return
+	}
+	expiredFilesMetric.add("", 1)
+}
+
+/*
+ * Removes expired files periodically, in a cluster only on the leader
+ */
+func (s *Server) startExpiryCleanup() {
+	go func() {
+		for {
+			if s.isClusterLeader() {
+				s.removeExpiredFiles()
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func (s *Server) removeExpiredFiles() {
+	filepath.Walk(s.sharedPath("meta"), func(metaFilename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(metaFilename, ".json") {
+			return nil
+		}
+
+		var meta fileMetadata
+		data, err := os.ReadFile(metaFilename)
+		if err == nil {
+			err = json.Unmarshal(data, &meta)
+		}
+		if err != nil {
+			log.Warn("Reading metadata ", metaFilename, " failed: ", err)
+			return nil
+		}
+
+		if meta.expired() {
+			s.removeExpiredFile(meta.Path)
+		}
+		return nil
+	})
+	s.releaseOrphanedBlobs()
+}
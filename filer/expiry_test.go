@@ -0,0 +1,80 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+ * Uploads with a signed exp parameter are removed once it has passed
+ */
+func TestUploadExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("short-lived")
+	upload := func(fileStorePath string, exp int64, signedExp int64) int {
+		req, err := http.NewRequest("PUT", "/upload/"+fileStorePath, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.RawQuery = "v2=" + s.uploadMAC("v2", fileStorePath, int64(len(content)), signedExp, 0) +
+			"&exp=" + strconv.FormatInt(exp, 10)
+		return s.serveUpload(req).Code
+	}
+	get := func(fileStorePath string) int {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		return s.serveUpload(req).Code
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	if status := upload("abc/unsigned.txt", exp, 0); status != http.StatusForbidden {
+		t.Errorf("upload with unsigned exp: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("abc/past.txt", 1000, 1000); status != http.StatusBadRequest {
+		t.Errorf("upload with past exp: got %v want %v", status, http.StatusBadRequest)
+	}
+	if status := upload("abc/expiring.txt", exp, exp); status != http.StatusCreated {
+		t.Fatalf("upload with exp: got %v want %v", status, http.StatusCreated)
+	}
+
+	meta, err := s.readMetadata("abc/expiring.txt")
+	if err != nil || meta.Expires == nil || meta.Expires.Unix() != exp {
+		t.Fatalf("expiry not stored: %+v, %v", meta.Expires, err)
+	}
+	if status := get("abc/expiring.txt"); status != http.StatusOK {
+		t.Errorf("download before expiry: got %v want %v", status, http.StatusOK)
+	}
+
+	// Expired files are not served and removed
+	expired := time.Now().Add(-time.Second)
+	meta.Expires = &expired
+	s.writeMetadata(meta)
+	if status := get("abc/expiring.txt"); status != http.StatusNotFound {
+		t.Errorf("download after expiry: got %v want %v", status, http.StatusNotFound)
+	}
+	if exists, _ := s.backend.Exists("abc/expiring.txt"); exists {
+		t.Error("expired file not removed on download")
+	}
+
+	// And by the periodic cleanup
+	s.uploadFile(t, "abc/permanent.txt", content)
+	if status := upload("abc/cleanup.txt", exp, exp); status != http.StatusCreated {
+		t.Fatalf("upload with exp: got %v want %v", status, http.StatusCreated)
+	}
+	meta, _ = s.readMetadata("abc/cleanup.txt")
+	meta.Expires = &expired
+	s.writeMetadata(meta)
+	s.removeExpiredFiles()
+	if exists, _ := s.backend.Exists("abc/cleanup.txt"); exists {
+		t.Error("expired file not removed by cleanup")
+	}
+	if exists, _ := s.backend.Exists("abc/permanent.txt"); !exists {
+		t.Error("file without expiry removed by cleanup")
+	}
+}
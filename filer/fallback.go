@@ -0,0 +1,68 @@
+/*
+ * Fallback store directories
+ * After a storage migration, old uploads can stay where they are: files
+ * which are not in the storage backend are looked up in the directories of
+ * fallbackStoreDirs, in order, at their upload path. These are never
+ * written to. Uploads to a path found there are refused like uploads to
+ * existing files, and deletes only apply to the storage backend.
+ */
+
+package filer
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+type fallbackBackend struct {
+	storage.Backend
+	dirs []dirBackend
+}
+
+func (f *fallbackBackend) Open(fileStorePath string) (storage.File, error) {
+	file, err := f.Backend.Open(fileStorePath)
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+	for _, dir := range f.dirs {
+		if file, dirErr := dir.Open(fileStorePath); dirErr == nil || !os.IsNotExist(dirErr) {
+			return file, dirErr
+		}
+	}
+	return nil, err
+}
+
+func (f *fallbackBackend) Exists(fileStorePath string) (bool, error) {
+	if exists, err := f.Backend.Exists(fileStorePath); exists || err != nil {
+		return exists, err
+	}
+	return f.inFallbackDir(fileStorePath)
+}
+
+/*
+ * Reports whether fileStorePath is found in one of the fallback directories
+ */
+func (f *fallbackBackend) inFallbackDir(fileStorePath string) (bool, error) {
+	for _, dir := range f.dirs {
+		if exists, err := dir.Exists(fileStorePath); exists || err != nil {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+func (f *fallbackBackend) Presign(fileStorePath string, expiry time.Duration) (string, error) {
+	if exists, _ := f.Backend.Exists(fileStorePath); !exists {
+		if found, _ := f.inFallbackDir(fileStorePath); found {
+			return "", errors.New("file is stored in a fallback directory")
+		}
+	}
+	signer, ok := f.Backend.(storage.Presigner)
+	if !ok {
+		return "", errors.New("storage backend does not support presigned URLs")
+	}
+	return signer.Presign(fileStorePath, expiry)
+}
@@ -0,0 +1,59 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Files missing in storeDir are downloaded from fallbackStoreDirs, which
+ * are never written to
+ */
+func TestFallbackStoreDirs(t *testing.T) {
+	s := newTestServer(t)
+	older, old := t.TempDir(), t.TempDir()
+	s.conf.FallbackStoreDirs = []string{old, older}
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	for dir, content := range map[string]string{old: "archived", older: "older archive"} {
+		os.MkdirAll(filepath.Join(dir, "abc"), 0755)
+		os.WriteFile(filepath.Join(dir, "abc", "archived.txt"), []byte(content), 0644)
+	}
+	os.WriteFile(filepath.Join(older, "abc", "older.txt"), []byte("older archive"), 0644)
+	if code := s.uploadFile(t, "abc/new.txt", []byte("new")).Code; code != http.StatusCreated {
+		t.Fatalf("upload: got %v want %v", code, http.StatusCreated)
+	}
+
+	for fileStorePath, want := range map[string]string{
+		"abc/new.txt":      "new",
+		"abc/archived.txt": "archived",
+		"abc/older.txt":    "older archive",
+	} {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		if rr := s.serveUpload(req); rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("download of %s: got %v %q want %q", fileStorePath, rr.Code, rr.Body.String(), want)
+		}
+	}
+	req, _ := http.NewRequest("HEAD", "/upload/abc/archived.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusOK {
+		t.Errorf("HEAD of archived file: got %v want %v", rr.Code, http.StatusOK)
+	}
+	req, _ = http.NewRequest("GET", "/upload/abc/missing.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusNotFound {
+		t.Errorf("download of missing file: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if code := s.uploadFile(t, "abc/archived.txt", []byte("replacement")).Code; code != http.StatusConflict {
+		t.Errorf("upload to archived path: got %v want %v", code, http.StatusConflict)
+	}
+	if content, _ := os.ReadFile(filepath.Join(old, "abc", "archived.txt")); string(content) != "archived" {
+		t.Errorf("archived file changed: %q", content)
+	}
+}
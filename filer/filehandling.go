@@ -0,0 +1,687 @@
+/*
+ * Storage related functions: receiving uploads into temporary files and
+ * moving them to their final location
+ */
+
+package filer
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Name of the directory inside StoreDir which holds prosody-filer's own
+ * state (temporary files etc.). It is never served to clients.
+ */
+const internalDirName = ".prosody-filer"
+
+var (
+	uploadsAbortedMetric = newCounter("prosody_filer_uploads_aborted_total", "Uploads aborted because the client disconnected.")
+	uploadSizeMetric     = newHistogram("prosody_filer_upload_size_bytes", "Size of stored uploads.", sizeBuckets)
+)
+
+/*
+ * Buffers for copying uploads, shared between requests to avoid
+ * allocating a new one for each upload
+ */
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+/*
+ * Like io.Copy, but uses a buffer from copyBufferPool
+ */
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+/*
+ * Returns the absolute path of an element inside the internal directory
+ */
+func (s *Server) internalPath(elem ...string) string {
+	return filepath.Join(append([]string{s.conf.StoreDir, internalDirName}, elem...)...)
+}
+
+/*
+ * Reports whether a requested path points into the internal directory.
+ * Case is ignored, as file names are case-insensitive on some filesystems
+ * (e.g. APFS on macOS by default).
+ */
+func isInternalPath(fileStorePath string) bool {
+	return strings.EqualFold(strings.SplitN(fileStorePath, "/", 2)[0], internalDirName)
+}
+
+/*
+ * Returns the directory receiving uploads, tempDir or one inside StoreDir
+ */
+func (s *Server) tempDir() string {
+	if s.conf.TempDir != "" {
+		return s.conf.TempDir
+	}
+	return s.internalPath("tmp")
+}
+
+/*
+ * Checks tempDir at startup. Received uploads are moved into StoreDir,
+ * which is only atomic within one filesystem, so a tempDir on another one,
+ * e.g. a tmpfs, is refused right away instead of failing every upload.
+ */
+func (s *Server) checkTempDir() error {
+	if s.conf.TempDir == "" {
+		return nil
+	}
+	// Files in StoreDir are served to clients, except for the internal directory
+	if rel, err := filepath.Rel(s.conf.StoreDir, s.conf.TempDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) &&
+		!isInternalPath(filepath.ToSlash(rel)) {
+		return fmt.Errorf("tempDir %s must not be inside storeDir, except below %s", s.conf.TempDir, internalDirName)
+	}
+
+	tmpFile, err := s.createTempFile()
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// Nothing is stored locally with other backends or in proxy mode
+	if s.conf.StorageBackend != "local" || s.conf.UpstreamURL != "" {
+		return nil
+	}
+	internalDir := s.internalPath()
+	if err := os.MkdirAll(internalDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", internalDir, err)
+	}
+	target := filepath.Join(internalDir, filepath.Base(tmpFile.Name()))
+	if err := os.Rename(tmpFile.Name(), target); err != nil {
+		return fmt.Errorf("tempDir %s must be on the same filesystem as storeDir %s: %s", s.conf.TempDir, s.conf.StoreDir, err)
+	}
+	return os.Remove(target)
+}
+
+/*
+ * Creates a new temporary file for an incoming upload
+ */
+func (s *Server) createTempFile() (*os.File, error) {
+	tmpDir := s.tempDir()
+	err := os.MkdirAll(tmpDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %s", tmpDir, err)
+	}
+
+	tmpFile, err := os.CreateTemp(tmpDir, "upload-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %s", err)
+	}
+
+	return tmpFile, nil
+}
+
+/*
+ * Moves a completely received upload to its final location, atomically
+ * replacing the file there if there is one
+ */
+func commitReplacing(tmpFilename string, absFilename string) error {
+	absDirectory := filepath.Dir(absFilename)
+	if err := os.MkdirAll(absDirectory, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", absDirectory, err)
+	}
+
+	if err := os.Rename(tmpFilename, absFilename); err != nil {
+		return fmt.Errorf("failed to move upload to %s: %s", absFilename, err)
+	}
+	return nil
+}
+
+/*
+ * Moves a completely received upload to its final location.
+ * An existing file is never replaced; storage.ErrExists is returned instead.
+ */
+func commitFile(tmpFilename string, absFilename string) error {
+	// Make sure the directory path exists
+	absDirectory := filepath.Dir(absFilename)
+	err := os.MkdirAll(absDirectory, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %s: %s", absDirectory, err)
+	}
+
+	// Linking fails if the target exists, so concurrent uploads can't overwrite each other
+	err = os.Link(tmpFilename, absFilename)
+	if os.IsExist(err) {
+		return storage.ErrExists
+	} else if err != nil {
+		// Filesystem does not support hard links: fall back to rename
+		if _, err := os.Lstat(absFilename); err == nil {
+			return storage.ErrExists
+		}
+		if err := os.Rename(tmpFilename, absFilename); err != nil {
+			return fmt.Errorf("failed to move upload to %s: %s", absFilename, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Removes a stored file with its metadata and short URL. clientIP is the
+ * client asking for it, if any.
+ */
+func (s *Server) deleteFile(fileStorePath string, clientIP string) error {
+	meta, _ := s.readMetadata(fileStorePath)
+	if err := s.backend.Delete(fileStorePath); err != nil {
+		return err
+	}
+	os.Remove(s.metadataPath(fileStorePath))
+	if meta.ShortURL != "" {
+		os.Remove(s.shortURLIndexPath(meta.ShortURL))
+	}
+	s.releaseBlob(meta.SHA256)
+
+	log.Info("Deleted ", fileStorePath)
+	s.publishEvent(fileEvent{
+		Type:        "delete",
+		Path:        fileStorePath,
+		Size:        meta.Size,
+		ContentType: meta.ContentType,
+		SHA256:      meta.SHA256,
+		ClientIP:    clientIP,
+	})
+	return nil
+}
+
+/*
+ * Receives an upload and stores it at fileStorePath.
+ * The upload is written to a temporary file first and only committed to
+ * the storage backend after all checks have passed. verifySize checks the
+ * MAC of uploads without Content-Length once their size is known.
+ */
+func (s *Server) createFile(fileStorePath string, verifySize func(size int64) bool, w http.ResponseWriter, r *http.Request) error {
+	// Target file MUST NOT exist before. Checked again when the upload is committed.
+	exists, err := s.backend.Exists(fileStorePath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to check for existing file %s: %s", fileStorePath, err)
+	} else if s.isQuarantined(fileStorePath) {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s", fileStorePath, storage.ErrExists)
+	} else if exists && s.conf.ConflictPolicy == "reject" {
+		return s.receiveRepeatedUpload(fileStorePath, verifySize, w, r)
+	}
+
+	full, err := s.prefixFull(fileStorePath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to count files of %s: %s", uploaderPrefix(fileStorePath), err)
+	} else if full {
+		httpError(w, http.StatusForbidden, "too many files")
+		return fmt.Errorf("rejected upload of %s: %s holds %d files already", fileStorePath, uploaderPrefix(fileStorePath), s.conf.MaxFilesPerPrefix)
+	}
+
+	expectedSHA256, err := clientSHA256(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "")
+		return fmt.Errorf("rejected upload of %s: malformed SHA-256 checksum", fileStorePath)
+	}
+	expectedMD5, err := clientMD5(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "")
+		return fmt.Errorf("rejected upload of %s: malformed Content-MD5 header", fileStorePath)
+	}
+
+	if r.ContentLength >= 0 && s.belowMinimumSize(r.ContentLength) {
+		httpError(w, http.StatusBadRequest, "file too small")
+		return fmt.Errorf("rejected upload of %s: %d bytes are below minimum size", fileStorePath, r.ContentLength)
+	}
+	if s.exceedsSizeLimit(fileStorePath, r.ContentLength) {
+		s.rejectTooLarge(w, fileStorePath)
+		return fmt.Errorf("rejected upload of %s: %d bytes exceed size limit", fileStorePath, r.ContentLength)
+	}
+
+	tmpFile, err := s.createTempFile()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	// Reserve disk space, failing before the body is received if the disk is full
+	preallocated := false
+	if s.conf.PreallocateUploads && r.ContentLength > 0 {
+		preallocated, err = preallocate(tmpFile, r.ContentLength)
+		if errors.Is(err, syscall.ENOSPC) {
+			httpError(w, http.StatusInsufficientStorage, "")
+			return fmt.Errorf("rejected upload of %s: no space left for %d bytes", fileStorePath, r.ContentLength)
+		} else if err != nil {
+			log.Warn("Failed to preallocate space for ", fileStorePath, ": ", err)
+		}
+	}
+
+	// Connect to clamd before receiving the upload
+	var scan *clamdScan
+	if s.conf.ClamdAddress != "" {
+		scan, err = s.startClamdScan()
+		if err != nil {
+			if err = s.handleScannerFailure(err); err != nil {
+				httpError(w, http.StatusServiceUnavailable, "")
+				return err
+			}
+		} else {
+			defer scan.close()
+		}
+	}
+
+	/*
+	 * Everything up to here is checked before reading the body. Clients
+	 * sending "Expect: 100-continue" get the final status right away,
+	 * instead of uploading a file that will be thrown away.
+	 */
+
+	progress := s.trackUpload(fileStorePath, r)
+	defer s.untrackUpload(progress)
+
+	// Uploads without Content-Length may still exceed the limit
+	var src io.Reader = &contextReader{ctx: r.Context(), src: progress}
+	var limited *sizeLimitReader
+	if limit := s.sizeLimit(fileStorePath); limit > 0 {
+		limited = &sizeLimitReader{src: src, remaining: limit}
+		src = limited
+	}
+
+	// Look at the first bytes before receiving the rest of the upload
+	bodyReader := bufio.NewReader(src)
+	head, err := peekHead(bodyReader)
+	if limited != nil && limited.exceeded {
+		s.rejectTooLarge(w, fileStorePath)
+		return fmt.Errorf("rejected upload of %s: exceeds size limit of %d bytes", fileStorePath, s.sizeLimit(fileStorePath))
+	} else if _, ok := err.(*gzipBodyError); ok {
+		httpError(w, http.StatusBadRequest, "invalid gzip body")
+		return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+	} else if err != nil && err != io.EOF {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to read upload of %s: %s", fileStorePath, err)
+	}
+
+	if s.conf.BlockExecutables {
+		if kind := detectExecutable(head); kind != "" {
+			httpError(w, http.StatusForbidden, "")
+			return fmt.Errorf("rejected upload of %s: %s executable", fileStorePath, kind)
+		}
+	}
+
+	if s.conf.MimeMismatchPolicy != "allow" {
+		declared, sniffed := extensionContentType(fileStorePath), sniffContentType(head)
+		if !contentTypesMatch(declared, sniffed) {
+			if s.conf.MimeMismatchPolicy == "reject" {
+				httpError(w, http.StatusUnsupportedMediaType, "")
+				return fmt.Errorf("rejected upload of %s: content looks like %s, not %s", fileStorePath, sniffed, declared)
+			}
+			log.Warnf("Upload of %s looks like %s, not %s", fileStorePath, sniffed, declared)
+		}
+	}
+
+	// Hash upload while it is being received
+	hasher := sha256.New()
+	var received byteCounter
+	var body io.Reader = io.TeeReader(bodyReader, io.MultiWriter(hasher, &received))
+
+	receivedMD5 := md5.New()
+	if expectedMD5 != nil {
+		body = io.TeeReader(body, receivedMD5)
+	}
+
+	// Stream upload through clamd while it is being received
+	if scan != nil {
+		body = io.TeeReader(body, scan)
+	}
+
+	sniffedType := http.DetectContentType(head)
+	modified := false
+
+	// Remove metadata from unencrypted images
+	if s.conf.StripImageMetadata {
+		if filter := metadataFilter(sniffedType); filter != nil {
+			filtered := filterReader(body, filter)
+			defer filtered.Close()
+			body = filtered
+			modified = true
+		}
+	}
+
+	// Downscale oversized unencrypted images
+	var recompressor *imageRecompressor
+	if s.conf.RecompressImages {
+		if recompressor = s.newImageRecompressor(sniffedType); recompressor != nil {
+			filtered := filterReader(body, recompressor.filter)
+			defer filtered.Close()
+			body = filtered
+			modified = true
+		}
+	}
+
+	// Hash content as it is stored, if filters may have changed it
+	storedHasher := hasher
+	if modified {
+		storedHasher = sha256.New()
+		body = io.TeeReader(body, storedHasher)
+	}
+	storedMD5 := md5.New()
+	body = io.TeeReader(body, storedMD5)
+
+	// Copy file contents to temporary file, compressing and encrypting them if configured
+	compress := s.conf.CompressFiles && shouldCompress(fileStorePath, head)
+	storedWriter, err := s.newStoredFileWriter(tmpFile, head, compress)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to write %s: %s", tmpFile.Name(), err)
+	}
+
+	written, err := copyBuffered(storedWriter, body)
+	if err != nil && limited != nil && limited.exceeded {
+		s.rejectTooLarge(w, fileStorePath)
+		return fmt.Errorf("rejected upload of %s: exceeds size limit of %d bytes", fileStorePath, s.sizeLimit(fileStorePath))
+	} else if err != nil && r.Context().Err() != nil {
+		// Nobody left to respond to. The temporary file is removed, so the client can retry.
+		uploadsAbortedMetric.add("", 1)
+		return fmt.Errorf("upload of %s aborted: client disconnected after %d bytes", fileStorePath, received)
+	} else if _, ok := err.(*gzipBodyError); ok {
+		httpError(w, http.StatusBadRequest, "invalid gzip body")
+		return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+	} else if errors.Is(err, syscall.ENOSPC) {
+		httpError(w, http.StatusInsufficientStorage, "")
+		return fmt.Errorf("failed to copy file contents to %s: %s", tmpFile.Name(), err)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to copy file contents to %s: %s", tmpFile.Name(), err)
+	}
+
+	err = storedWriter.Close()
+	if err == nil && preallocated {
+		err = trimPreallocated(tmpFile)
+	}
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if err == nil {
+		err = tmpFile.Close()
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to write %s: %s", tmpFile.Name(), err)
+	}
+
+	receivedHash := hasher.Sum(nil)
+	hash := hex.EncodeToString(receivedHash)
+
+	if s.belowMinimumSize(int64(received)) {
+		httpError(w, http.StatusBadRequest, "file too small")
+		return fmt.Errorf("rejected upload of %s: %d bytes are below minimum size", fileStorePath, received)
+	}
+
+	if verifySize != nil && !verifySize(int64(received)) {
+		s.recordMACFailure(s.clientIP(r))
+		s.tarpit(r)
+		httpError(w, uploadStatusCodes(&s.conf).InvalidMAC, "invalid MAC")
+		return fmt.Errorf("rejected chunked upload of %s: invalid MAC for %d bytes", fileStorePath, received)
+	}
+
+	// Checksums sent as trailer are known once the body has been received
+	expectedTrailerSHA256, err := trailerSHA256(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+	}
+
+	// Upload has been damaged on its way
+	if !checksumMatches(expectedMD5, receivedMD5.Sum(nil)) {
+		httpError(w, http.StatusUnprocessableEntity, "Content-MD5 mismatch")
+		return fmt.Errorf("rejected upload of %s: content does not match Content-MD5 header", fileStorePath)
+	}
+	if !checksumMatches(expectedSHA256, receivedHash) || !checksumMatches(expectedTrailerSHA256, receivedHash) {
+		httpError(w, http.StatusUnprocessableEntity, "checksum mismatch")
+		return fmt.Errorf("rejected upload of %s: SHA-256 %s does not match checksum sent by client", fileStorePath, hash)
+	}
+
+	if s.conf.HashDenylist != "" && s.isHashDenied(hash) {
+		if s.conf.HashDenylistAction == "quarantine" {
+			return s.quarantineUpload(tmpFile.Name(), fileStorePath, written, hash, "hash on denylist", w, r)
+		}
+		httpError(w, http.StatusForbidden, "")
+		return fmt.Errorf("rejected upload of %s: hash %s on denylist", fileStorePath, hash)
+	}
+
+	if scan != nil {
+		signature, err := scan.finish()
+		if err != nil {
+			if err = s.handleScannerFailure(err); err != nil {
+				httpError(w, http.StatusServiceUnavailable, "")
+				return err
+			}
+		} else if signature != "" && s.conf.ClamdInfectedAction == "quarantine" {
+			return s.quarantineUpload(tmpFile.Name(), fileStorePath, written, hash, "virus found: "+signature, w, r)
+		} else if signature != "" {
+			httpError(w, http.StatusForbidden, "")
+			return fmt.Errorf("rejected upload of %s: virus found: %s", fileStorePath, signature)
+		}
+	}
+
+	if len(s.plugins) > 0 {
+		err := s.checkUploadPlugins(pluginUpload{
+			Path:        fileStorePath,
+			Size:        int64(received),
+			ContentType: extensionContentType(fileStorePath),
+			SHA256:      hash,
+			Uploader:    uploaderPrefix(fileStorePath),
+			RemoteAddr:  s.clientIP(r),
+		})
+		if veto, ok := err.(*pluginVeto); ok {
+			httpError(w, http.StatusForbidden, "")
+			return fmt.Errorf("rejected upload of %s: %s", fileStorePath, veto)
+		} else if err != nil {
+			if err = s.handlePluginFailure(err); err != nil {
+				httpError(w, http.StatusServiceUnavailable, "")
+				return err
+			}
+		}
+	}
+	attributes, err := s.callLuaHook("post_upload", map[string]interface{}{
+		"path":         fileStorePath,
+		"size":         int64(received),
+		"content_type": extensionContentType(fileStorePath),
+		"sha256":       hash,
+		"uploader":     uploaderPrefix(fileStorePath),
+		"remote_addr":  s.clientIP(r),
+	}, "attributes")
+	if veto, ok := err.(*pluginVeto); ok {
+		httpError(w, http.StatusForbidden, "")
+		return fmt.Errorf("rejected upload of %s: %s", fileStorePath, veto)
+	} else if err != nil {
+		if err = s.handlePluginFailure(err); err != nil {
+			httpError(w, http.StatusServiceUnavailable, "")
+			return err
+		}
+	}
+
+	storedHash := hex.EncodeToString(storedHasher.Sum(nil))
+
+	deduplicated, err := s.backend.Commit(tmpFile.Name(), fileStorePath, storedHash)
+	if err == storage.ErrExists && s.isSameUpload(fileStorePath, int64(received), hash) {
+		// Stored by a concurrent attempt of the client, or replaced by the same content
+		log.Info("Upload of ", fileStorePath, " is identical to the stored file")
+		s.respondCreated(w, r, fileStorePath, written)
+		return nil
+	} else if err == storage.ErrExists && s.conf.ConflictPolicy != "reject" {
+		deduplicated, err = s.replaceFile(tmpFile.Name(), fileStorePath, storedHash)
+	}
+	if err == storage.ErrExists {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s", fileStorePath, err)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+
+	meta := fileMetadata{
+		Path:        fileStorePath,
+		Size:        written,
+		ContentType: extensionContentType(fileStorePath),
+		SHA256:      storedHash,
+		MD5:         hex.EncodeToString(storedMD5.Sum(nil)),
+		UploadedAt:  time.Now().UTC(),
+
+		Name:         uploadName(r, fileStorePath),
+		Deduplicated: deduplicated,
+		Tenant:       s.requestTenant(r, fileStorePath),
+	}
+	if int64(received) != written {
+		meta.OriginalSize = int64(received)
+	}
+	if hash != storedHash {
+		meta.OriginalSHA256 = hash
+	}
+	if recompressor != nil {
+		meta.Recompressed = recompressor.result
+	}
+	if expires, _ := uploadExpiry(r.URL.Query()); expires != 0 {
+		expiry := time.Unix(expires, 0).UTC()
+		meta.Expires = &expiry
+	}
+	meta.MaxDownloads = s.maxDownloads(r, fileStorePath)
+	if s.conf.ShortURLs {
+		if alias, err := s.createShortURL(fileStorePath); err == nil {
+			meta.ShortURL = alias
+			w.Header().Set("X-Short-URL", s.shortURL(r, alias))
+		} else {
+			log.Error(err)
+		}
+	}
+	for key, value := range attributes {
+		if meta.Attributes == nil {
+			meta.Attributes = make(map[string]string)
+		}
+		meta.Attributes[key] = value
+	}
+	s.pluginMetadata(&meta)
+	if err := s.writeMetadata(meta); err != nil {
+		log.Error(err)
+	}
+
+	s.publishEvent(fileEvent{
+		Type:        "upload",
+		Path:        fileStorePath,
+		URL:         s.fileURL(r, fileStorePath),
+		Size:        written,
+		ContentType: meta.ContentType,
+		SHA256:      storedHash,
+		ClientIP:    s.clientIP(r),
+	})
+	uploadSizeMetric.observe("", float64(written))
+
+	s.respondCreated(w, r, fileStorePath, written)
+	return nil
+}
+
+/*
+ * Fails reads once ctx is done, so uploads of disconnected clients are
+ * aborted right away instead of after the next read of the body
+ */
+type contextReader struct {
+	ctx context.Context
+	src io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.src.Read(p)
+}
+
+/*
+ * Counts bytes written to it
+ */
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+/*
+ * Puts a flagged upload into quarantine instead of storing it.
+ * The client still gets a success response; downloads are refused until
+ * the file is released by an admin.
+ */
+func (s *Server) quarantineUpload(tmpFilename string, fileStorePath string, size int64, hash string, reason string, w http.ResponseWriter, r *http.Request) error {
+	err := s.quarantineFile(tmpFilename, quarantineItem{
+		Path:       fileStorePath,
+		Reason:     reason,
+		Size:       size,
+		SHA256:     hash,
+		RemoteAddr: s.clientIP(r),
+		Name:       uploadName(r, fileStorePath),
+	})
+	if err == storage.ErrExists {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s", fileStorePath, err)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+
+	s.notifyAdmins("", fmt.Sprintf("Prosody Filer: upload of %s has been quarantined (%s)", fileStorePath, reason))
+
+	s.respondCreated(w, r, fileStorePath, size)
+	return nil
+}
+
+/*
+ * Body of responses to stored uploads with uploadResponseJSON
+ */
+type uploadResponse struct {
+	URL         string `json:"url"`
+	ShortURL    string `json:"shortURL,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+/*
+ * Tells the client that its upload of size bytes has been stored. XMPP
+ * clients only look at the status; other clients get the URL of the file
+ * in the Location header and, with uploadResponseJSON, in the body.
+ */
+func (s *Server) respondCreated(w http.ResponseWriter, r *http.Request, fileStorePath string, size int64) {
+	if s.conf.UploadLocation {
+		w.Header().Set("Location", s.fileURL(r, fileStorePath))
+	}
+	if !s.conf.UploadResponseJSON {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	writeJSON(w, http.StatusCreated, uploadResponse{
+		URL:         s.fileURL(r, fileStorePath),
+		ShortURL:    w.Header().Get("X-Short-URL"),
+		Size:        size,
+		ContentType: extensionContentType(fileStorePath),
+	})
+}
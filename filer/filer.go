@@ -0,0 +1,506 @@
+/*
+ * Package filer implements Prosody Filer, a file server for XMPP HTTP
+ * uploads (XEP-0363) handed out by mod_http_upload_external and similar
+ * modules.
+ *
+ * The command in the repository root runs it as a standalone server. Other
+ * programs can embed the upload handler instead:
+ *
+ *	config, err := filer.LoadConfig("/etc/prosody-filer/config.toml")
+ *	...
+ *	server, err := filer.New(config)
+ *	...
+ *	mux.Handle("/upload/", server)
+ *
+ * Every Server has its own configuration and state, so several of them
+ * with different configurations can run in one process. They share the
+ * logger and the metrics.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+	"github.com/ThomasLeister/prosody-filer/internal/config"
+	"github.com/ThomasLeister/prosody-filer/internal/httpserver"
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+// Version reported in logs and to external services, set at build time
+var Version = "0.0.0"
+
+/*
+ * Commands besides running the server, e.g. "prosody-filer rekey"
+ */
+var Commands = map[string]func(args []string) error{
+	"rekey":          runRekey,
+	"bench":          runBench,
+	"journal":        runJournal,
+	"audit-verify":   runAuditVerify,
+	"fix-perms":      runFixPerms,
+	"migrate":        runMigrate,
+	"import-prosody": runImportProsody,
+	"export":         runExport,
+	"import":         runImport,
+	"reshard":        runReshard,
+	"fsck":           runFsck,
+	"top":            runTop,
+}
+
+/*
+ * A file server. Request handlers and everything depending on the
+ * configuration are methods of it.
+ */
+type Server struct {
+	conf    Config
+	auth    Authenticator
+	handler http.Handler
+
+	// Set up from conf by setup()
+	backend            storage.Backend
+	trustedProxies     []*net.IPNet
+	errorPages         map[int]*template.Template
+	landingPage        []byte
+	landingPageModTime time.Time
+
+	// Master keys: the current one is used for new files, all of them for reading
+	encryptionKey   []byte
+	encryptionKeyID []byte
+	encryptionKeys  map[string][]byte
+
+	// Keys for upload tokens
+	jwtKeys jwtKeys
+
+	// Storage health checks and failover, see health.go
+	storageHealth struct {
+		primary       storage.Backend
+		secondary     storage.Backend
+		primaryDown   int32
+		secondaryDown int32
+		// 1 while a probe is running, which may hang on network filesystems
+		primaryProbing   int32
+		secondaryProbing int32
+	}
+
+	// Cluster mode, see cluster.go
+	cluster struct {
+		node   string
+		leader int32
+	}
+
+	// Proxy mode, see upstream.go
+	upstream struct {
+		client *http.Client
+		proxy  *httputil.ReverseProxy
+	}
+
+	// Locks of paths being uploaded to, see pathlock.go
+	pathLocks struct {
+		sync.Mutex
+		locks map[string]*pathLock
+	}
+
+	// Serializes updates of download counts, see downloadlimit.go
+	downloadCounts sync.Mutex
+
+	// Files being burned after reading, see burn.go
+	burning struct {
+		sync.Mutex
+		paths map[string]bool
+	}
+
+	// Serializes writes to the change journal
+	journalMutex sync.Mutex
+
+	// Serializes writes to the audit log
+	auditMutex sync.Mutex
+
+	// Reports of server errors, see errorreport.go
+	errorReports chan errorReport
+
+	// Decision cache and alert queue, see crowdsec.go
+	crowdsec crowdsecState
+
+	// Logged on SIGUSR1, see stats.go
+	stats runtimeStats
+
+	// Disk usage by uploader prefix, see usage.go
+	usage usageReport
+
+	// Users of downloadAuth, reloaded by Reload()
+	downloadUsers downloadUsers
+
+	// OpenID Connect login to the admin API, see oidc.go
+	oidc struct {
+		sync.Mutex
+		provider    *oidcProvider
+		keys        map[string]interface{}
+		keysFetched time.Time
+		sessionKey  []byte
+	}
+
+	// 1 while uploads are refused, see readonly.go
+	readOnly int32
+
+	// Planned periods of read-only mode, see maintenance.go
+	maintenance struct {
+		sync.Mutex
+		windows []maintenanceWindow
+		nextID  int
+	}
+
+	plugins []*plugin
+	lua     *luaHooks
+
+	hashDenylist struct {
+		sync.RWMutex
+		hashes map[string]bool
+	}
+
+	events struct {
+		sync.RWMutex
+		subscribers map[int]func(fileEvent)
+		nextID      int
+	}
+
+	// Clients causing too many 404 responses, see bans.go
+	bans struct {
+		sync.Mutex
+		misses  map[string]*missCount
+		until   map[string]time.Time
+		reasons map[string]string
+	}
+
+	rateLimits struct {
+		sync.Mutex
+		buckets map[string]*rateBucket
+	}
+
+	// MAC failures per client address
+	macFailures struct {
+		sync.Mutex
+		clients map[string]*macFailureCount
+	}
+
+	notifications struct {
+		sync.Mutex
+		queue chan string
+		sent  map[string]time.Time
+	}
+
+	// Partial uploads currently receiving data
+	partialActive struct {
+		sync.Mutex
+		ids map[string]bool
+	}
+
+	// Uploads being received, see progress.go
+	uploadsInFlight struct {
+		sync.Mutex
+		uploads map[*uploadProgress]bool
+	}
+}
+
+/*
+ * Reads a config file, applying defaults for missing settings
+ */
+func LoadConfig(configFilename string) (Config, error) {
+	return config.Load(configFilename)
+}
+
+/*
+ * Creates a server handling uploads and downloads and starts the background
+ * workers enabled in config. Config should start out as DefaultConfig().
+ * The server expects requests at the paths given in config, e.g.
+ * "/upload/...".
+ */
+func New(config Config) (*Server, error) {
+	s, err := newServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.setLogLevel()
+	s.setReadOnly(s.conf.ReadOnly)
+	for _, window := range s.conf.MaintenanceWindows {
+		s.scheduleMaintenance(window.Start, window.End)
+	}
+	if err := s.startWorkers(); err != nil {
+		return nil, err
+	}
+
+	s.handler = s.newHandler()
+	return s, nil
+}
+
+/*
+ * Creates a server for conf without starting anything
+ */
+func newServer(conf Config) (*Server, error) {
+	s := &Server{conf: conf}
+	s.auth = macAuthenticator{conf: &s.conf, jwtKeys: &s.jwtKeys, downloadUsers: &s.downloadUsers}
+	s.events.subscribers = make(map[int]func(fileEvent))
+	s.bans.misses = make(map[string]*missCount)
+	s.bans.until = make(map[string]time.Time)
+	s.bans.reasons = make(map[string]string)
+	s.rateLimits.buckets = make(map[string]*rateBucket)
+	s.macFailures.clients = make(map[string]*macFailureCount)
+	s.notifications.queue = make(chan string, 20)
+	s.notifications.sent = make(map[string]time.Time)
+	s.partialActive.ids = make(map[string]bool)
+	s.uploadsInFlight.uploads = make(map[*uploadProgress]bool)
+	s.pathLocks.locks = make(map[string]*pathLock)
+	s.burning.paths = make(map[string]bool)
+	s.stats.started = time.Now()
+	s.stats.uploadsByMAC = make(map[string]*int64)
+	for _, version := range hmacauth.Versions {
+		s.stats.uploadsByMAC[version] = new(int64)
+	}
+
+	if err := s.setup(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/*
+ * Serves requests with the handlers enabled in the config
+ */
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+/*
+ * Routes requests to the handlers enabled in the config
+ */
+func (s *Server) newHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	subpath := path.Join("/", s.conf.UploadSubDir)
+	subpath = strings.TrimRight(subpath, "/")
+	subpath += "/"
+	mux.HandleFunc(subpath, s.handleRequest)
+	for subDir := range s.conf.UploadSubDirs {
+		mux.HandleFunc(strings.TrimRight(path.Join("/", subDir), "/")+"/", s.handleRequest)
+	}
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	if s.conf.TusSubDir != "" {
+		mux.HandleFunc(strings.TrimRight(path.Join("/", s.conf.TusSubDir), "/")+"/", s.handleTusRequest)
+	}
+	if s.conf.ShortURLs {
+		mux.HandleFunc(path.Join("/", s.conf.ShortURLSubDir)+"/", s.handleShortURL)
+	}
+	if s.servesQRCodes() {
+		mux.HandleFunc("/qr/", s.handleQRCode)
+	}
+	if s.conf.LandingPage && subpath != "/" {
+		mux.HandleFunc("/", s.handleRoot)
+	}
+	if subpath != "/" {
+		if s.conf.RobotsTxt {
+			mux.HandleFunc("/robots.txt", handleRobotsTxt)
+		}
+		mux.HandleFunc("/favicon.ico", s.handleFavicon)
+	}
+
+	handler := s.withMiddleware(mux)
+	if s.conf.SentryDSN != "" || s.conf.ErrorWebhookURL != "" {
+		handler = s.withErrorReports(handler)
+	}
+	return handler
+}
+
+/*
+ * Starts the background workers enabled in the config
+ */
+func (s *Server) startWorkers() error {
+	// Only the leader of a cluster runs periodic cleanups
+	if s.conf.ClusterDir != "" {
+		s.renewClusterLease()
+		s.startClusterLease()
+	}
+
+	if s.conf.TusSubDir != "" || s.conf.ResumableUploads {
+		s.startPartialUploadCleanup()
+	}
+
+	// Remove files whose exp parameter has passed
+	s.startExpiryCleanup()
+
+	// Log the progress of large uploads
+	if s.conf.ProgressLogSize > 0 {
+		s.startProgressLog()
+	}
+
+	// Export disk usage by user
+	if s.conf.UserUsageInterval > 0 {
+		s.startUsageCount()
+	}
+
+	// Fail uploads over to failoverStoreDir while the storage backend is unhealthy
+	if s.conf.HealthCheckInterval > 0 {
+		s.startHealthChecks()
+	}
+
+	// Load hash denylist, reloaded by Reload()
+	if s.conf.HashDenylist != "" {
+		if err := s.loadHashDenylist(); err != nil {
+			return err
+		}
+	}
+
+	// Verify stored files periodically
+	if s.conf.ScrubInterval > 0 {
+		s.startScrubber()
+	}
+
+	// Restore bans and pick up those of other nodes
+	if s.bansEnabled() {
+		if err := s.loadBans(); err != nil {
+			return err
+		}
+		if s.conf.BanSyncInterval > 0 {
+			s.startBanSync()
+		}
+	}
+
+	// Ask CrowdSec about clients and report attacks to it
+	if s.conf.CrowdsecURL != "" {
+		s.startCrowdsec()
+	}
+
+	// Report server errors
+	if s.conf.SentryDSN != "" || s.conf.ErrorWebhookURL != "" {
+		if err := s.startErrorReports(); err != nil {
+			return err
+		}
+	}
+
+	// Notify external services of uploads
+	if s.conf.WebhookURL != "" {
+		s.startWebhook()
+	}
+	if len(s.conf.HookCommand) > 0 {
+		s.startHooks()
+	}
+
+	// Record changes for incremental backups
+	if s.conf.Journal {
+		if err := s.startJournal(); err != nil {
+			return err
+		}
+	}
+	if s.conf.MetadataBackupDir != "" {
+		s.startMetadataBackup()
+	}
+	if s.conf.AuditLog != "" {
+		if err := s.startAuditLog(); err != nil {
+			return err
+		}
+	}
+
+	// Copy uploads to a standby
+	if s.conf.MirrorURL != "" {
+		s.startMirror()
+	}
+	if len(s.conf.Plugins) > 0 {
+		if err := s.startPlugins(); err != nil {
+			return err
+		}
+	}
+	if s.conf.LuaScript != "" {
+		hooks, err := newLuaHooks(s.conf.LuaScript, s.conf.PluginTimeout)
+		if err != nil {
+			return err
+		}
+		s.lua = hooks
+	}
+	if s.conf.NatsURL != "" {
+		client, _ := newNatsClient(s.conf.NatsURL)
+		s.startBrokerPublisher("nats", client, func(eventType string) string {
+			return s.conf.NatsSubject + "." + eventType
+		})
+	}
+	if s.conf.MqttURL != "" {
+		client, _ := newMqttClient(s.conf.MqttURL)
+		go client.keepalive()
+		s.startBrokerPublisher("mqtt", client, func(eventType string) string {
+			return s.conf.MqttTopic + "/" + eventType
+		})
+	}
+
+	// Notify admins of notable events
+	if s.notificationsEnabled() {
+		s.startNotifications()
+	}
+
+	return nil
+}
+
+/*
+ * Reloads files which may change at runtime: the hash denylist and the
+ * htpasswd file of downloadAuth
+ */
+func (s *Server) Reload() {
+	if s.conf.HashDenylist != "" {
+		if err := s.loadHashDenylist(); err != nil {
+			log.Error(err, ". Keeping previous list.")
+		}
+	}
+	if s.conf.DownloadHtpasswd != "" {
+		if err := s.loadDownloadUsers(); err != nil {
+			log.Error(err, ". Keeping previous users.")
+		}
+	}
+}
+
+/*
+ * Runs the standalone server: the server returned by New on listenPort,
+ * and the admin API if enabled. Only returns on errors.
+ */
+func Run(configFilename string) error {
+	config, err := LoadConfig(configFilename)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Starting prosody-filer", Version, "...")
+	s, err := New(config)
+	if err != nil {
+		return err
+	}
+
+	if s.conf.ListenPort == "" {
+		return fmt.Errorf("listenPort is required")
+	}
+	listener, err := httpserver.Listen(s.conf.ListenPort, s.conf.UnixSocket)
+	if err != nil {
+		return fmt.Errorf("could not open listening socket: %s", err)
+	}
+	log.Printf("Server started on port %s (%s). Waiting for requests.\n", s.conf.ListenPort, s.conf.ListenProtocol)
+
+	httpserver.OnReload(func() {
+		log.Info("Received SIGHUP, reloading")
+		s.Reload()
+	})
+	httpserver.OnStatsRequest(s.logStats)
+
+	// Start admin API
+	if s.conf.AdminListenPort != "" {
+		go func() {
+			log.Fatalln("Admin API failed:", s.serveAdmin())
+		}()
+	}
+
+	return httpserver.Serve(listener, s, s.conf.ListenProtocol)
+}
@@ -0,0 +1,113 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig("../config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Secret == "" || config.ChunkedUploads != "reject" {
+		t.Errorf("settings or defaults missing: %+v", config)
+	}
+
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Errorf("missing config file accepted")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.toml")
+	os.WriteFile(invalid, []byte("secret = "), 0644)
+	if _, err := LoadConfig(invalid); err == nil {
+		t.Errorf("invalid config file accepted")
+	}
+}
+
+func TestNew(t *testing.T) {
+	config := DefaultConfig()
+	config.Secret = "secret of the embedded filer"
+	config.StoreDir = t.TempDir()
+	config.UploadSubDir = "upload/"
+	config.LogLevel = "error"
+
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req := s.newUploadRequest(t, "embedded/file.txt", []byte("hello"))
+	req.URL.Scheme, req.URL.Host, req.RequestURI = "http", strings.TrimPrefix(server.URL, "http://"), ""
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload: got %v want %v", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp, err = http.Get(server.URL + "/upload/embedded/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("download: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// A second server with its own configuration
+	config.Secret = "secret of the other filer"
+	config.StoreDir = t.TempDir()
+	other, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := other.serveUpload(s.newUploadRequest(t, "embedded/file.txt", []byte("hello"))); rr.Code != http.StatusForbidden {
+		t.Errorf("upload signed with the first secret: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := other.serveUpload(other.newUploadRequest(t, "embedded/file.txt", []byte("hello"))); rr.Code != http.StatusCreated {
+		t.Errorf("upload to second server: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+/*
+ * Weak secrets are refused unless weakSecrets = "warn"
+ */
+func TestWeakSecrets(t *testing.T) {
+	config := DefaultConfig()
+	config.StoreDir = t.TempDir()
+	config.UploadSubDir = "upload/"
+	config.LogLevel = "error"
+
+	for _, secret := range []string{"", "mysecret", "It-Is-Secret", "0123456789abcde"} {
+		config.Secret = secret
+		if _, err := New(config); err == nil {
+			t.Errorf("weak secret %q has been accepted", secret)
+		}
+	}
+
+	config.Secret = "mysecret"
+	config.WeakSecrets = "warn"
+	if _, err := New(config); err != nil {
+		t.Errorf("weak secret with weakSecrets = \"warn\": %s", err)
+	}
+
+	config.Secret = "0123456789abcdef"
+	config.WeakSecrets = "refuse"
+	if _, err := New(config); err != nil {
+		t.Errorf("secret of minimum length: %s", err)
+	}
+	config.UpstreamSecret = "secret"
+	if _, err := New(config); err == nil {
+		t.Errorf("weak upstreamSecret has been accepted")
+	}
+}
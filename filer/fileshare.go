@@ -0,0 +1,45 @@
+/*
+ * Uploads authorized by Prosody's mod_http_file_share
+ * Instead of a MAC in the URL, the upload slot comes with an
+ * "Authorization: Bearer" token, signed with http_file_share_secret.
+ * See https://prosody.im/doc/modules/mod_http_file_share
+ */
+
+package filer
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+ * Claims of an upload token issued by mod_http_file_share
+ */
+type fileShareClaims struct {
+	Slot     string `json:"slot"`
+	Filename string `json:"filename"`
+	Filesize int64  `json:"filesize"`
+	Filetype string `json:"filetype"`
+}
+
+/*
+ * Checks the bearer token of an upload
+ */
+func validateFileShareToken(r *http.Request, upload Upload, secret string) error {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	var claims fileShareClaims
+	if err := verifyJWT(token, []byte(secret), &claims); err != nil {
+		return &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: invalid token"}
+	}
+
+	// The token is only valid for this slot
+	if upload.Path != claims.Slot+"/"+claims.Filename || claims.Slot == "" {
+		log.Warnf("Token for slot %s/%s used for upload of %s", claims.Slot, claims.Filename, upload.Path)
+		return &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: invalid token"}
+	}
+	if upload.Size >= 0 && upload.Size != claims.Filesize {
+		return &AuthError{Status: http.StatusBadRequest, Message: "Bad Request: size does not match upload slot"}
+	}
+	return nil
+}
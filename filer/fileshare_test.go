@@ -0,0 +1,54 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+ * Upload with a token issued by mod_http_file_share
+ */
+func TestFileShareUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte("uploaded through mod_http_file_share")
+	claims := fileShareClaims{Slot: "Zmlsz", Filename: "cat picture.txt", Filesize: int64(len(content)), Filetype: "text/plain"}
+	upload := func(fileStorePath string, token string) int {
+		req, err := http.NewRequest("PUT", "/upload/"+fileStorePath, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return s.serveUpload(req).Code
+	}
+	token := func(claims fileShareClaims, exp int64) string {
+		return signJWT(t, s.conf.Secret, map[string]interface{}{
+			"slot": claims.Slot, "filename": claims.Filename, "filesize": claims.Filesize,
+			"filetype": claims.Filetype, "exp": exp,
+		})
+	}
+	valid := time.Now().Unix() + 300
+
+	if status := upload("Zmlsz/cat%20picture.txt", token(claims, time.Now().Unix()-1)); status != http.StatusUnauthorized {
+		t.Errorf("expired token: got %v want %v", status, http.StatusUnauthorized)
+	}
+	if status := upload("other/cat%20picture.txt", token(claims, valid)); status != http.StatusUnauthorized {
+		t.Errorf("token for other slot: got %v want %v", status, http.StatusUnauthorized)
+	}
+	wrongSize := claims
+	wrongSize.Filesize++
+	if status := upload("Zmlsz/cat%20picture.txt", token(wrongSize, valid)); status != http.StatusBadRequest {
+		t.Errorf("token for other size: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	if status := upload("Zmlsz/cat%20picture.txt", token(claims, valid)); status != http.StatusCreated {
+		t.Errorf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * "fsck" command: cross-checks metadata and stored files
+ *
+ *   prosody-filer fsck [-repair]
+ *
+ * Reports files without metadata (orphaned, with the local backend only),
+ * metadata without file (missing) and files whose size differs from their
+ * metadata. With -repair, metadata is written for orphaned files, metadata
+ * of missing files is removed, and the size and hashes in the metadata of
+ * mismatching files are replaced with those of the stored file. Contents
+ * are not verified, that's what the scrubber does.
+ */
+
+package filer
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Result of a consistency check
+ */
+type fsckResult struct {
+	Checked      int
+	Orphaned     int
+	Missing      int
+	SizeMismatch int
+	Repaired     int
+	Failed       int
+}
+
+func (r fsckResult) problems() int {
+	return r.Orphaned + r.Missing + r.SizeMismatch
+}
+
+func runFsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	repair := flags.Bool("repair", false, "Repair the problems found.")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if *repair && s.conf.ReadOnly {
+		return errors.New("cannot repair in read-only mode")
+	}
+
+	result, err := s.checkConsistency(*repair)
+	log.Infof("Checked %d files: %d orphaned, %d missing, %d size mismatches, %d repaired, %d failed",
+		result.Checked, result.Orphaned, result.Missing, result.SizeMismatch, result.Repaired, result.Failed)
+	if err != nil {
+		return err
+	} else if result.Failed > 0 {
+		return fmt.Errorf("failed to check or repair %d files", result.Failed)
+	} else if result.problems() > result.Repaired {
+		return fmt.Errorf("found %d problems, run with -repair to repair them", result.problems()-result.Repaired)
+	}
+	return nil
+}
+
+/*
+ * Checks the metadata against the storage backend and, with the local
+ * backend, the files in StoreDir against the metadata
+ */
+func (s *Server) checkConsistency(repair bool) (fsckResult, error) {
+	var result fsckResult
+
+	err := filepath.Walk(s.sharedPath("meta"), func(metaFilename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(metaFilename, ".json") {
+			return nil
+		}
+		result.Checked++
+
+		data, err := os.ReadFile(metaFilename)
+		if err != nil {
+			return err
+		}
+		var meta fileMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Errorf("Invalid metadata %s: %s", metaFilename, err)
+			result.Failed++
+			return nil
+		}
+
+		stored, err := s.openBackendFile(meta.Path)
+		if os.IsNotExist(err) {
+			log.Warn("Missing: ", meta.Path, " has metadata, but no file")
+			result.Missing++
+			if repair {
+				os.Remove(metaFilename)
+				if meta.ShortURL != "" {
+					os.Remove(s.shortURLIndexPath(meta.ShortURL))
+				}
+				result.Repaired++
+			}
+			return nil
+		} else if err != nil {
+			log.Errorf("Failed to open %s: %s", meta.Path, err)
+			result.Failed++
+			return nil
+		}
+		size := stored.size
+		stored.Close()
+
+		if size != meta.Size {
+			log.Warnf("Size mismatch: %s has %d bytes, metadata says %d", meta.Path, size, meta.Size)
+			result.SizeMismatch++
+			if repair {
+				if err := s.repairMetadata(meta); err != nil {
+					log.Error(err)
+					result.Failed++
+				} else {
+					result.Repaired++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || s.conf.StorageBackend != "local" {
+		return result, err
+	}
+
+	err = s.walkStoreDir(func(absFilename string, fileStorePath string, info os.FileInfo) error {
+		if _, err := os.Stat(s.metadataPath(fileStorePath)); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		result.Checked++
+
+		log.Warn("Orphaned: ", fileStorePath, " has no metadata")
+		result.Orphaned++
+		if repair {
+			if err := s.repairMetadata(fileMetadata{Path: fileStorePath, UploadedAt: info.ModTime().UTC()}); err != nil {
+				log.Error(err)
+				result.Failed++
+			} else {
+				result.Repaired++
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+/*
+ * Writes meta with the size and hashes of the stored file
+ */
+func (s *Server) repairMetadata(meta fileMetadata) error {
+	stored, err := s.openBackendFile(meta.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", meta.Path, err)
+	}
+	defer stored.Close()
+
+	hasher, md5Hasher := sha256.New(), md5.New()
+	size, err := copyBuffered(io.MultiWriter(hasher, md5Hasher), stored)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", meta.Path, err)
+	}
+
+	meta.Size = size
+	meta.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	meta.MD5 = hex.EncodeToString(md5Hasher.Sum(nil))
+	if meta.ContentType == "" {
+		meta.ContentType = extensionContentType(meta.Path)
+	}
+	return s.writeMetadata(meta)
+}
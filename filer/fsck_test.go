@@ -0,0 +1,46 @@
+package filer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = t.TempDir()
+
+	for _, fileStorePath := range []string{"abc/ok.txt", "abc/missing.txt", "abc/truncated.txt"} {
+		s.uploadFile(t, fileStorePath, []byte("content"))
+	}
+	os.Remove(s.storagePath("abc/missing.txt"))
+	os.WriteFile(s.storagePath("abc/truncated.txt"), []byte("cont"), 0644)
+	os.MkdirAll(filepath.Join(s.conf.StoreDir, "def"), 0755)
+	os.WriteFile(filepath.Join(s.conf.StoreDir, "def", "orphan.txt"), []byte("orphan"), 0644)
+
+	result, err := s.checkConsistency(false)
+	if err != nil || result.Orphaned != 1 || result.Missing != 1 || result.SizeMismatch != 1 || result.Repaired != 0 {
+		t.Fatalf("check: got %+v, %v", result, err)
+	}
+	if _, err := os.Stat(s.metadataPath("abc/missing.txt")); err != nil {
+		t.Errorf("metadata has been changed without -repair: %s", err)
+	}
+
+	result, err = s.checkConsistency(true)
+	if err != nil || result.problems() != 3 || result.Repaired != 3 || result.Failed != 0 {
+		t.Fatalf("repair: got %+v, %v", result, err)
+	}
+	if _, err := os.Stat(s.metadataPath("abc/missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("metadata of missing file has not been removed")
+	}
+	if meta, err := s.readMetadata("abc/truncated.txt"); err != nil || meta.Size != 4 {
+		t.Errorf("metadata of truncated file: got %+v, %v", meta, err)
+	}
+	if meta, err := s.readMetadata("def/orphan.txt"); err != nil || meta.Size != 6 || meta.SHA256 == "" {
+		t.Errorf("metadata of orphaned file: got %+v, %v", meta, err)
+	}
+
+	if result, err := s.checkConsistency(false); err != nil || result.problems() != 0 || result.Checked != 3 {
+		t.Errorf("check after repair: got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Compressed uploads
+ * With gzipUploads, clients may send uploads with "Content-Encoding: gzip"
+ * to save time on slow mobile networks. Uploads are decompressed while
+ * they are received and stored like any other upload (compressed at rest
+ * again if compressFiles is set). The MAC covers the size of the file, not
+ * of the compressed body, so it is checked once the upload has been
+ * decompressed, like for uploads without Content-Length. Size limits apply
+ * to the decompressed content.
+ */
+
+package filer
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+/*
+ * Error in the compressed body of an upload
+ */
+type gzipBodyError struct {
+	err error
+}
+
+func (e *gzipBodyError) Error() string {
+	return "invalid gzip body: " + e.err.Error()
+}
+
+/*
+ * Checks the Content-Encoding of an upload. Returns whether the body is
+ * gzip-compressed.
+ */
+func (s *Server) uploadGzipped(r *http.Request) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return false, nil
+	case "gzip", "x-gzip":
+		if s.conf.GzipUploads {
+			return true, nil
+		}
+	}
+	return false, errUnsupportedEncoding
+}
+
+/*
+ * Answers uploads with unsupported Content-Encoding, announcing the
+ * supported ones (RFC 7694)
+ */
+func (s *Server) rejectContentEncoding(w http.ResponseWriter, r *http.Request) {
+	log.Warn("Rejected upload with Content-Encoding ", r.Header.Get("Content-Encoding"))
+	accepted := "identity"
+	if s.conf.GzipUploads {
+		accepted = "gzip"
+	}
+	w.Header().Set("Accept-Encoding", accepted)
+	httpError(w, http.StatusUnsupportedMediaType, errUnsupportedEncoding.Error())
+}
+
+/*
+ * Decompresses the body of an upload. The gzip header is only read on the
+ * first Read, so clients sending "Expect: 100-continue" still get
+ * rejections before sending the body.
+ */
+type gzipBody struct {
+	src    io.ReadCloser
+	reader *gzip.Reader
+}
+
+func newGzipBody(src io.ReadCloser) *gzipBody {
+	return &gzipBody{src: src}
+}
+
+func (g *gzipBody) Read(p []byte) (int, error) {
+	if g.reader == nil {
+		reader, err := gzip.NewReader(g.src)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, &gzipBodyError{err}
+		}
+		g.reader = reader
+	}
+
+	n, err := g.reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = &gzipBodyError{err}
+	}
+	return n, err
+}
+
+func (g *gzipBody) Close() error {
+	return g.src.Close()
+}
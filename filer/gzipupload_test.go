@@ -0,0 +1,99 @@
+package filer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * Builds an upload of content, signed for its size, sent gzip-compressed
+ */
+func (s *Server) newGzipUploadRequest(t *testing.T, fileStorePath string, content []byte) *http.Request {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+
+	req := s.newUploadRequest(t, fileStorePath, content)
+	req.Body = io.NopCloser(&compressed)
+	req.ContentLength = int64(compressed.Len())
+	req.Header.Set("Content-Encoding", "gzip")
+	return req
+}
+
+func TestGzipUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.GzipUploads = true
+	s.conf.MaxFileSize = 1 << 20
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte(strings.Repeat("Jan 01 00:00:00 host daemon[123]: something happened\n", 1000))
+	rr := s.serveUpload(s.newGzipUploadRequest(t, "thomas/abc/daemon.log", content))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/daemon.log"))
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("upload has not been stored decompressed: %v", err)
+	}
+	if meta, err := s.readMetadata("thomas/abc/daemon.log"); err != nil || meta.Size != int64(len(content)) {
+		t.Errorf("wrong size in metadata: %v %v", meta.Size, err)
+	}
+
+	// The MAC covers the decompressed size
+	req := s.newGzipUploadRequest(t, "thomas/def/daemon.log", content)
+	q := req.URL.Query()
+	q.Set("v", strings.Repeat("0", 64))
+	req.URL.RawQuery = q.Encode()
+	if rr := s.serveUpload(req); rr.Code != http.StatusForbidden {
+		t.Errorf("upload with invalid MAC: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Damaged body
+	req = s.newUploadRequest(t, "thomas/ghi/daemon.log", content)
+	req.Header.Set("Content-Encoding", "gzip")
+	if rr := s.serveUpload(req); rr.Code != http.StatusBadRequest {
+		t.Errorf("upload with invalid gzip body: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Size limits apply to the decompressed content
+	s.conf.MaxFileSize = int64(len(content)) - 1
+	if rr := s.serveUpload(s.newGzipUploadRequest(t, "thomas/jkl/daemon.log", content)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload exceeding size limit: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestUnsupportedContentEncoding(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("some text")
+	rr := s.serveUpload(s.newGzipUploadRequest(t, "thomas/abc/file.txt", content))
+	if rr.Code != http.StatusUnsupportedMediaType || rr.Header().Get("Accept-Encoding") != "identity" {
+		t.Errorf("gzip upload without gzipUploads: got %v %v", rr.Code, rr.Header())
+	}
+
+	s.conf.GzipUploads = true
+	req := s.newUploadRequest(t, "thomas/abc/file.txt", content)
+	req.Header.Set("Content-Encoding", "br")
+	rr = s.serveUpload(req)
+	if rr.Code != http.StatusUnsupportedMediaType || rr.Header().Get("Accept-Encoding") != "gzip" {
+		t.Errorf("brotli upload: got %v %v", rr.Code, rr.Header())
+	}
+
+	req = s.newUploadRequest(t, "thomas/abc/file.txt", content)
+	req.Header.Set("Content-Encoding", "identity")
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Errorf("upload with identity encoding: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
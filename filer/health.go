@@ -0,0 +1,362 @@
+/*
+ * Storage health checks and failover
+ * The storage backend is probed every healthCheckInterval: storeDir by
+ * creating and removing a file and with statfs(2), an S3 bucket with a HEAD
+ * request. Probes taking longer than healthCheckTimeout fail, and no new
+ * one is started while a probe hangs, e.g. on a stale NFS mount. While it
+ * fails, uploads are stored in failoverStoreDir if configured, and files
+ * are looked up in both places; otherwise they are refused with 503.
+ * GET /healthz reports the state to load balancers and monitoring.
+ */
+
+package filer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+var storageHealthyMetric = newGauge("prosody_filer_storage_healthy", "Whether a storage backend passed its last health check, by backend.")
+
+var errDiskUsageUnsupported = errors.New("not supported on this platform")
+
+/*
+ * Probes the storage backends every healthCheckInterval
+ */
+func (s *Server) startHealthChecks() {
+	s.checkStorageHealth()
+	go func() {
+		ticker := time.NewTicker(s.conf.HealthCheckInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			s.checkStorageHealth()
+		}
+	}()
+}
+
+func (s *Server) checkStorageHealth() {
+	err := s.probeBackend(s.storageHealth.primary, &s.storageHealth.primaryProbing)
+	if setBackendHealth(&s.storageHealth.primaryDown, "primary", err) {
+		if err == nil {
+			log.Info("Storage backend is healthy again")
+		} else if s.storageHealth.secondary != nil {
+			log.Error("Storage backend is unhealthy, storing uploads in failoverStoreDir: ", err)
+		} else {
+			log.Error("Storage backend is unhealthy: ", err)
+		}
+	}
+
+	if s.storageHealth.secondary != nil {
+		err := s.probeBackend(s.storageHealth.secondary, &s.storageHealth.secondaryProbing)
+		if setBackendHealth(&s.storageHealth.secondaryDown, "secondary", err) {
+			if err == nil {
+				log.Info("failoverStoreDir is healthy again")
+			} else {
+				log.Error("failoverStoreDir is unhealthy: ", err)
+			}
+		}
+	}
+}
+
+/*
+ * Records the result of a health check. Returns true if it changed.
+ */
+func setBackendHealth(down *int32, name string, err error) bool {
+	var value int32
+	if err != nil {
+		value = 1
+	}
+	storageHealthyMetric.set(`backend="`+name+`"`, float64(1-value))
+	return atomic.SwapInt32(down, value) != value
+}
+
+/*
+ * Runs the health check of backend, giving up after healthCheckTimeout.
+ * A hanging check keeps its goroutine, so no further one is started until
+ * it returns.
+ */
+func (s *Server) probeBackend(backend storage.Backend, probing *int32) error {
+	if !atomic.CompareAndSwapInt32(probing, 0, 1) {
+		return errors.New("previous health check still hanging")
+	}
+	result := make(chan error, 1)
+	go func() {
+		err := checkBackendHealth(backend)
+		atomic.StoreInt32(probing, 0)
+		result <- err
+	}()
+
+	timeout := time.NewTimer(s.conf.HealthCheckTimeout)
+	defer timeout.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timeout.C:
+		return fmt.Errorf("health check timed out after %s", s.conf.HealthCheckTimeout)
+	}
+}
+
+func checkBackendHealth(backend storage.Backend) error {
+	checker, ok := backend.(storage.HealthChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckHealth()
+}
+
+/*
+ * Returns true if the last health check of the storage backend failed
+ */
+func (s *Server) storageDegraded() bool {
+	return atomic.LoadInt32(&s.storageHealth.primaryDown) == 1
+}
+
+/*
+ * Returns true if uploads can't be stored: the storage backend is failing,
+ * and failoverStoreDir as well if configured
+ */
+func (s *Server) storageUnavailable() bool {
+	if !s.storageDegraded() {
+		return false
+	}
+	return s.storageHealth.secondary == nil || atomic.LoadInt32(&s.storageHealth.secondaryDown) == 1
+}
+
+/*
+ * Refuses an upload while the storage is unavailable, instead of letting it
+ * block on a hanging filesystem
+ */
+func (s *Server) rejectUnavailableStorage(w http.ResponseWriter) bool {
+	if !s.storageUnavailable() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.conf.HealthCheckInterval.Seconds())))
+	httpError(w, http.StatusServiceUnavailable, "storage is unavailable")
+	return true
+}
+
+/*
+ * Creates, stats and removes a file in dir, which fails on filesystems
+ * which have been remounted read-only
+ */
+func probeWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".health-check-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	defer os.Remove(name)
+	if err := probe.Close(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+/*
+ * Checks that a directory is accessible and its filesystem not full, and
+ * that files can be created in probeDir unless it is empty
+ */
+func checkDirHealth(dir string, probeDir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	if probeDir != "" {
+		if err := probeWritable(probeDir); err != nil {
+			return err
+		}
+	}
+	used, err := diskUsage(dir)
+	if err != nil && err != errDiskUsageUnsupported {
+		return err
+	} else if err == nil && used >= 100 {
+		return errors.New("no space left on " + dir)
+	}
+	return nil
+}
+
+func (b localBackend) CheckHealth() error {
+	if b.server.conf.ReadOnly {
+		return checkDirHealth(b.server.conf.StoreDir, "")
+	}
+	// The probe file is not served from the internal directory
+	return checkDirHealth(b.server.conf.StoreDir, b.server.internalPath())
+}
+
+/*
+ * Health endpoint:
+ *   200 {"status":"ok"}
+ *   200 {"status":"degraded"}     Storage backend failing, uploads are stored in failoverStoreDir
+ *   503 {"status":"unavailable"}  Storage backend failing
+ */
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	switch {
+	case !s.storageDegraded():
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case !s.storageUnavailable():
+		writeJSON(w, http.StatusOK, map[string]string{"status": "degraded"})
+	default:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+}
+
+/*
+ * Storage backend storing uploads in failoverStoreDir while the primary
+ * backend is unhealthy. Files stay there after it has recovered.
+ */
+type failoverBackend struct {
+	storage.Backend
+	server *Server
+}
+
+func (f *failoverBackend) Commit(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	if f.server.storageDegraded() {
+		return f.server.storageHealth.secondary.Commit(tmpFilename, fileStorePath, hash)
+	}
+	return f.Backend.Commit(tmpFilename, fileStorePath, hash)
+}
+
+func (f *failoverBackend) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	if f.server.storageDegraded() {
+		return f.server.storageHealth.secondary.Replace(tmpFilename, fileStorePath, hash)
+	}
+	deduplicated, err := f.Backend.Replace(tmpFilename, fileStorePath, hash)
+	if err != nil {
+		return false, err
+	}
+	// Files in failoverStoreDir are found first, so the replaced one must go
+	if err := f.server.storageHealth.secondary.Delete(fileStorePath); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove replaced %s from failoverStoreDir: %s", fileStorePath, err)
+	}
+	return deduplicated, nil
+}
+
+func (f *failoverBackend) Open(fileStorePath string) (storage.File, error) {
+	file, err := f.server.storageHealth.secondary.Open(fileStorePath)
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+	return f.Backend.Open(fileStorePath)
+}
+
+func (f *failoverBackend) Exists(fileStorePath string) (bool, error) {
+	if exists, err := f.server.storageHealth.secondary.Exists(fileStorePath); exists || err != nil {
+		return exists, err
+	}
+	exists, err := f.Backend.Exists(fileStorePath)
+	if err != nil && f.server.storageDegraded() {
+		// Uploads to the path are stored in failoverStoreDir anyway
+		return false, nil
+	}
+	return exists, err
+}
+
+func (f *failoverBackend) Delete(fileStorePath string) error {
+	err := f.server.storageHealth.secondary.Delete(fileStorePath)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	return f.Backend.Delete(fileStorePath)
+}
+
+func (f *failoverBackend) Presign(fileStorePath string, expiry time.Duration) (string, error) {
+	if exists, _ := f.server.storageHealth.secondary.Exists(fileStorePath); exists {
+		return "", errors.New("file is stored in failoverStoreDir")
+	}
+	signer, ok := f.Backend.(storage.Presigner)
+	if !ok {
+		return "", errors.New("storage backend does not support presigned URLs")
+	}
+	return signer.Presign(fileStorePath, expiry)
+}
+
+/*
+ * Files in a local directory at their upload path, e.g. failoverStoreDir
+ */
+type dirBackend struct {
+	dir string
+}
+
+func (b dirBackend) filename(fileStorePath string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(fileStorePath))
+}
+
+func (b dirBackend) Commit(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	return false, b.store(tmpFilename, fileStorePath, commitFile)
+}
+
+func (b dirBackend) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	return false, b.store(tmpFilename, fileStorePath, commitReplacing)
+}
+
+/*
+ * Copies an upload into the directory and moves it to its location with commit
+ */
+func (b dirBackend) store(tmpFilename string, fileStorePath string, commit func(string, string) error) error {
+	filename := b.filename(fileStorePath)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+
+	// The directory is usually on another filesystem, so the upload is copied
+	source, err := os.Open(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = copyBuffered(tmpFile, source)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return commit(tmpFile.Name(), filename)
+}
+
+func (b dirBackend) Open(fileStorePath string) (storage.File, error) {
+	return storage.OpenLocalFile(b.filename(fileStorePath))
+}
+
+func (b dirBackend) Delete(fileStorePath string) error {
+	return os.Remove(b.filename(fileStorePath))
+}
+
+func (b dirBackend) Exists(fileStorePath string) (bool, error) {
+	_, err := os.Lstat(b.filename(fileStorePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b dirBackend) CheckHealth() error {
+	return checkDirHealth(b.dir, b.dir)
+}
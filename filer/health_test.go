@@ -0,0 +1,148 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * Uploads are stored in failoverStoreDir while S3 is unreachable, and
+ * downloaded from there afterwards
+ */
+func TestStorageFailover(t *testing.T) {
+	s, fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.FailoverStoreDir = t.TempDir()
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() (int, string) {
+		rr := httptest.NewRecorder()
+		s.handleHealthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+		var response struct{ Status string }
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.Status
+	}
+
+	s.checkStorageHealth()
+	if code, health := status(); code != http.StatusOK || health != "ok" {
+		t.Errorf("healthy backend: got %v %q", code, health)
+	}
+
+	fake.Down = true
+	s.checkStorageHealth()
+	if code, health := status(); code != http.StatusOK || health != "degraded" {
+		t.Errorf("failed backend: got %v %q", code, health)
+	}
+	content := []byte("stored during an outage")
+	if code := s.uploadFile(t, "abc/failover.txt", content).Code; code != http.StatusCreated {
+		t.Fatalf("upload during outage: got %v want %v", code, http.StatusCreated)
+	}
+	if stored, err := os.ReadFile(filepath.Join(s.conf.FailoverStoreDir, "abc", "failover.txt")); err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("file in failoverStoreDir: got %q, %v", stored, err)
+	}
+
+	fake.Down = false
+	s.checkStorageHealth()
+	if code, health := status(); code != http.StatusOK || health != "ok" {
+		t.Errorf("recovered backend: got %v %q", code, health)
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/failover.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download after recovery: got %v %q", rr.Code, rr.Body.String())
+	}
+	if code := s.uploadFile(t, "abc/failover.txt", []byte("other content")).Code; code != http.StatusConflict {
+		t.Errorf("upload to path in failoverStoreDir: got %v want %v", code, http.StatusConflict)
+	}
+}
+
+/*
+ * Without failoverStoreDir, a failed backend makes the filer unavailable
+ */
+func TestStorageUnavailable(t *testing.T) {
+	s, fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	fake.Down = true
+	s.checkStorageHealth()
+	rr := httptest.NewRecorder()
+	s.handleHealthz(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+/*
+ * Storage backend whose health check blocks until released
+ */
+type hangingBackend struct {
+	localBackend
+	release chan struct{}
+}
+
+func (b hangingBackend) CheckHealth() error {
+	<-b.release
+	return nil
+}
+
+/*
+ * A hanging storage backend, e.g. a stale NFS mount, makes uploads fail
+ * fast instead of blocking
+ */
+func TestStorageWatchdog(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.HealthCheckTimeout = 10 * time.Millisecond
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.checkStorageHealth()
+	if s.storageDegraded() {
+		t.Fatalf("writable storeDir reported unhealthy")
+	}
+
+	backend := hangingBackend{localBackend{s}, make(chan struct{})}
+	s.storageHealth.primary = backend
+	s.checkStorageHealth()
+	if !s.storageDegraded() {
+		t.Fatalf("hanging health check not reported")
+	}
+	if err := s.probeBackend(backend, &s.storageHealth.primaryProbing); err == nil || !strings.Contains(err.Error(), "still hanging") {
+		t.Errorf("health check started while the previous one hangs: %v", err)
+	}
+	rr := s.uploadFile(t, "abc/hanging.txt", []byte("hello"))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("upload to hanging storage: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	close(backend.release)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&s.storageHealth.primaryProbing) == 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("health check still running")
+		}
+	}
+	s.checkStorageHealth()
+	if s.storageDegraded() {
+		t.Errorf("recovered storage still reported unhealthy")
+	}
+	if rr := s.uploadFile(t, "abc/hanging.txt", []byte("hello")); rr.Code != http.StatusCreated {
+		t.Errorf("upload after recovery: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Exec hooks
+ * Runs hookCommand for events, with the path of the file appended as last
+ * argument and the details of the event in PROSODY_FILER_* environment
+ * variables. At most hookConcurrency commands run at the same time, each
+ * is killed after hookTimeout.
+ */
+
+package filer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+var hookFailuresMetric = newCounter("prosody_filer_hook_failures_total", "Hook commands which failed or could not be run.")
+
+/*
+ * Runs hookCommand for the configured events
+ */
+func (s *Server) startHooks() {
+	queue := make(chan fileEvent, 100)
+
+	s.subscribeEvents(func(event fileEvent) {
+		if !eventSelected(s.conf.HookEvents, event.Type) {
+			return
+		}
+		select {
+		case queue <- event:
+		default:
+			log.Warn("Hook queue full, skipping hook for ", event.Type, " event of ", event.Path)
+			hookFailuresMetric.add("", 1)
+		}
+	})
+
+	for i := 0; i < s.conf.HookConcurrency; i++ {
+		go func() {
+			for event := range queue {
+				if err := s.runHook(event); err != nil {
+					log.Error(err)
+					hookFailuresMetric.add("", 1)
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) runHook(event fileEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.HookTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, s.conf.HookCommand[1:]...), event.Path)
+	cmd := exec.CommandContext(ctx, s.conf.HookCommand[0], args...)
+	cmd.Env = append(os.Environ(), s.hookEnvironment(event)...)
+	// Don't wait for children of a killed command which keep its output open
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook for %s event of %s timed out after %s", event.Type, event.Path, s.conf.HookTimeout)
+	} else if err != nil {
+		return fmt.Errorf("hook for %s event of %s failed: %s: %s", event.Type, event.Path, err, output)
+	}
+	log.Debug("Hook for ", event.Type, " event of ", event.Path, " succeeded")
+	return nil
+}
+
+/*
+ * Describes an event in environment variables. PROSODY_FILER_FILE is only
+ * set for local storage; the file may be compressed or encrypted.
+ */
+func (s *Server) hookEnvironment(event fileEvent) []string {
+	env := []string{
+		"PROSODY_FILER_EVENT=" + event.Type,
+		"PROSODY_FILER_PATH=" + event.Path,
+		"PROSODY_FILER_SIZE=" + strconv.FormatInt(event.Size, 10),
+		"PROSODY_FILER_CONTENT_TYPE=" + event.ContentType,
+		"PROSODY_FILER_UPLOADER=" + event.Uploader,
+		"PROSODY_FILER_SHA256=" + event.SHA256,
+	}
+	if s.conf.StorageBackend == "local" {
+		env = append(env, "PROSODY_FILER_FILE="+s.storagePath(event.Path))
+	}
+	return env
+}
@@ -0,0 +1,43 @@
+package filer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Hooks get the path as argument and the event in their environment
+ */
+func TestRunHook(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	output := filepath.Join(t.TempDir(), "hook.out")
+	s.conf.HookCommand = []string{"sh", "-c", `echo "$1 $PROSODY_FILER_EVENT $PROSODY_FILER_SIZE $PROSODY_FILER_UPLOADER" > ` + output, "hook"}
+
+	event := fileEvent{Type: "upload", Path: "abc/cat.jpg", Size: 3, Uploader: "abc"}
+	if err := s.runHook(event); err != nil {
+		t.Fatal(err)
+	}
+	result, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "abc/cat.jpg upload 3 abc\n"; string(result) != expected {
+		t.Errorf("hook got %q, want %q", result, expected)
+	}
+
+	s.conf.HookCommand = []string{"sh", "-c", "echo broken >&2; exit 1"}
+	if err := s.runHook(event); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("failing hook: got error %v", err)
+	}
+
+	s.conf.HookCommand = []string{"sh", "-c", "sleep 10"}
+	s.conf.HookTimeout = 100 * time.Millisecond
+	if err := s.runHook(event); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("slow hook: got error %v", err)
+	}
+}
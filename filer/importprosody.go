@@ -0,0 +1,276 @@
+/*
+ * "import-prosody" command: copies files uploaded to Prosody's built-in
+ * upload modules into the store, keeping the paths of their URLs:
+ *
+ *   prosody-filer import-prosody /var/lib/prosody/upload%2eexample%2ecom/http_upload
+ *
+ * mod_http_upload stores files as <random>/<name>, like the URL path below
+ * "/upload/". mod_http_file_share stores them as <slot>.bin, their names
+ * are read from uploads.list in the parent directory (internal storage),
+ * and their URL path below "/file_share/" is <slot>/<name>. Files are
+ * stored like uploads, i.e. compressed and encrypted if configured, and
+ * files which exist in the store already are skipped, so the command can
+ * run again after an interruption.
+ */
+
+package filer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * A file uploaded to Prosody
+ */
+type prosodyUpload struct {
+	filename      string
+	fileStorePath string
+}
+
+func runImportProsody(args []string) error {
+	flags := flag.NewFlagSet("import-prosody", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	subtree := flags.String("subtree", "", "Subtree of storeDir to store the files in, e.g. to serve it with uploadSubDirs.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: prosody-filer import-prosody [options] <directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the upload directory of Prosody is required")
+	}
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if s.conf.ReadOnly {
+		return errors.New("cannot import files in read-only mode")
+	}
+
+	uploads, err := findProsodyUploads(flags.Arg(0), strings.Trim(*subtree, "/"))
+	if err != nil {
+		return err
+	}
+	log.Infof("Importing %d files from %s", len(uploads), flags.Arg(0))
+	result := s.importProsodyUploads(uploads)
+	log.Infof("Imported %d files (%s), %d existed already, %d failed", result.Copied, formatSize(result.Bytes), result.Skipped, result.Failed)
+	if result.Failed > 0 {
+		return fmt.Errorf("failed to import %d files, run the command again to retry them", result.Failed)
+	}
+	return nil
+}
+
+/*
+ * Lists the files in an upload directory of mod_http_upload or
+ * mod_http_file_share, sorted by their paths in the store
+ */
+func findProsodyUploads(dir string, subtree string) ([]prosodyUpload, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []prosodyUpload
+	var fileShareNames map[string]string
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			// mod_http_upload: <random>/<name>
+			files, err := os.ReadDir(filename)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if file.Type().IsRegular() {
+					uploads = append(uploads, prosodyUpload{
+						filename:      filepath.Join(filename, file.Name()),
+						fileStorePath: path.Join(subtree, entry.Name(), file.Name()),
+					})
+				}
+			}
+		case entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".bin"):
+			// mod_http_file_share: <slot>.bin
+			if fileShareNames == nil {
+				listFilename := filepath.Join(filepath.Dir(filepath.Clean(dir)), "uploads.list")
+				if fileShareNames, err = readFileShareNames(listFilename); err != nil {
+					return nil, fmt.Errorf("failed to read names of mod_http_file_share uploads: %s", err)
+				}
+			}
+			slot := strings.TrimSuffix(entry.Name(), ".bin")
+			name, ok := fileShareNames[slot]
+			if !ok {
+				log.Warn("Skipping ", filename, ": slot is missing from uploads.list")
+				continue
+			} else if name == "" || strings.Contains(name, "/") {
+				log.Warn("Skipping ", filename, ": invalid name ", strconv.Quote(name))
+				continue
+			}
+			uploads = append(uploads, prosodyUpload{
+				filename:      filename,
+				fileStorePath: path.Join(subtree, slot, name),
+			})
+		}
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].fileStorePath < uploads[j].fileStorePath
+	})
+	return uploads, nil
+}
+
+var (
+	fileShareItemPattern = regexp.MustCompile(`(?m)^item\(`)
+	fileShareKeyPattern  = regexp.MustCompile(`(?:\["key"\]|\bkey)\s*=\s*("(?:[^"\\]|\\.|\\\n)*")`)
+	fileShareNamePattern = regexp.MustCompile(`(?:\["filename"\]|\bfilename)\s*=\s*("(?:[^"\\]|\\.|\\\n)*")`)
+)
+
+/*
+ * Reads the names of uploads from the archive of mod_http_file_share in
+ * Prosody's internal storage, a list of items in Lua syntax. Returns the
+ * names by slot.
+ */
+func readFileShareNames(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	starts := fileShareItemPattern.FindAllIndex(data, -1)
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		item := data[start[0]:end]
+
+		key := fileShareKeyPattern.FindSubmatch(item)
+		name := fileShareNamePattern.FindSubmatch(item)
+		if key == nil || name == nil {
+			continue
+		}
+		slot, err := unquoteLuaString(string(key[1]))
+		if err != nil {
+			return nil, err
+		}
+		if names[slot], err = unquoteLuaString(string(name[1])); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+/*
+ * Decodes a double quoted Lua string literal, as written by Prosody
+ */
+func unquoteLuaString(quoted string) (string, error) {
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		return "", fmt.Errorf("invalid string %s", quoted)
+	}
+	quoted = quoted[1 : len(quoted)-1]
+
+	var unquoted strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] != '\\' {
+			unquoted.WriteByte(quoted[i])
+			continue
+		}
+		i++
+		if i == len(quoted) {
+			return "", fmt.Errorf("invalid escape sequence in %q", quoted)
+		}
+		switch c := quoted[i]; {
+		case c == 'n' || c == '\n':
+			unquoted.WriteByte('\n')
+		case c == 'r':
+			unquoted.WriteByte('\r')
+		case c == 't':
+			unquoted.WriteByte('\t')
+		case c >= '0' && c <= '9':
+			// Up to three decimal digits
+			end := i + 1
+			for end < len(quoted) && end < i+3 && quoted[end] >= '0' && quoted[end] <= '9' {
+				end++
+			}
+			value, err := strconv.Atoi(quoted[i:end])
+			if err != nil || value > 255 {
+				return "", fmt.Errorf("invalid escape sequence in %q", quoted)
+			}
+			unquoted.WriteByte(byte(value))
+			i = end - 1
+		default:
+			unquoted.WriteByte(c)
+		}
+	}
+	return unquoted.String(), nil
+}
+
+/*
+ * Stores the uploads which are not in the store yet
+ */
+func (s *Server) importProsodyUploads(uploads []prosodyUpload) migrationResult {
+	var result migrationResult
+	for _, upload := range uploads {
+		if err := checkStorePath(upload.fileStorePath, windowsPaths); err != nil {
+			log.Errorf("Cannot import %s: %s", upload.filename, err)
+			result.Failed++
+			continue
+		}
+		exists, err := s.backend.Exists(upload.fileStorePath)
+		if err != nil {
+			log.Errorf("Failed to check %s: %s", upload.fileStorePath, err)
+			result.Failed++
+			continue
+		} else if exists {
+			result.Skipped++
+			continue
+		}
+
+		size, err := s.importProsodyUpload(upload)
+		if err == storage.ErrExists {
+			result.Skipped++
+			continue
+		} else if err != nil {
+			log.Error(err)
+			result.Failed++
+			continue
+		}
+		result.Copied++
+		result.Bytes += size
+		if result.Copied%1000 == 0 {
+			log.Infof("Imported %d files (%s)", result.Copied, formatSize(result.Bytes))
+		}
+	}
+	return result
+}
+
+/*
+ * Stores a file uploaded to Prosody and writes its metadata. Returns the
+ * size of its content.
+ */
+func (s *Server) importProsodyUpload(upload prosodyUpload) (int64, error) {
+	src, err := os.Open(upload.filename)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return s.importFile(upload.fileStorePath, src, fileMetadata{UploadedAt: info.ModTime().UTC()})
+}
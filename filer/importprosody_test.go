@@ -0,0 +1,91 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportProsody(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = t.TempDir()
+
+	// mod_http_upload
+	uploadDir := t.TempDir()
+	os.Mkdir(filepath.Join(uploadDir, "Ab3dE"), 0755)
+	os.WriteFile(filepath.Join(uploadDir, "Ab3dE", "photo 1.jpg"), []byte("photo"), 0644)
+
+	// mod_http_file_share, with its names in internal storage
+	dataDir := t.TempDir()
+	fileShareDir := filepath.Join(dataDir, "http_file_share")
+	os.Mkdir(fileShareDir, 0755)
+	os.WriteFile(filepath.Join(fileShareDir, "slot-1.bin"), []byte("document"), 0644)
+	os.WriteFile(filepath.Join(fileShareDir, "slot-2.bin"), []byte("unknown"), 0644)
+	os.WriteFile(filepath.Join(dataDir, "uploads.list"), []byte(`item({
+	["attr"] = {
+		["content-type"] = "application/pdf";
+		["filename"] = "r\195\169sum\195\169 \"2024\".pdf";
+		["size"] = "8";
+	};
+	["key"] = "slot-1";
+	["name"] = "request";
+	["when"] = 1700000000;
+	["with"] = "user@example.com";
+});
+`), 0644)
+
+	uploads, err := findProsodyUploads(uploadDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileShareUploads, err := findProsodyUploads(fileShareDir, "file_share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads = append(uploads, fileShareUploads...)
+	if len(uploads) != 2 {
+		t.Fatalf("got %+v, want 2 uploads", uploads)
+	}
+
+	result := s.importProsodyUploads(uploads)
+	if result.Copied != 2 || result.Failed != 0 || result.Bytes != 13 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	for fileStorePath, content := range map[string]string{
+		"Ab3dE/photo 1.jpg":                     "photo",
+		"file_share/slot-1/résumé \"2024\".pdf": "document",
+	} {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		if rr := s.serveUpload(req); rr.Code != http.StatusOK || rr.Body.String() != content {
+			t.Errorf("download of %s: got %v %q", fileStorePath, rr.Code, rr.Body.String())
+		}
+		if meta, err := s.readMetadata(fileStorePath); err != nil || meta.Size != int64(len(content)) {
+			t.Errorf("metadata of %s: got %+v, %v", fileStorePath, meta, err)
+		}
+	}
+
+	// Imported files are skipped when running again
+	if result := s.importProsodyUploads(uploads); result.Copied != 0 || result.Skipped != 2 {
+		t.Errorf("second import: unexpected result %+v", result)
+	}
+}
+
+func TestUnquoteLuaString(t *testing.T) {
+	for quoted, expected := range map[string]string{
+		`"plain.txt"`:       "plain.txt",
+		`"a\"b\\c"`:         `a"b\c`,
+		"\"line\\\nbreak\"": "line\nbreak",
+		`"\195\169\0489"`:   "é09",
+	} {
+		if unquoted, err := unquoteLuaString(quoted); err != nil || unquoted != expected {
+			t.Errorf("unquoteLuaString(%s): got %q, %v want %q", quoted, unquoted, err, expected)
+		}
+	}
+	for _, quoted := range []string{`plain`, `"\"`, `"\256"`} {
+		if _, err := unquoteLuaString(quoted); err == nil {
+			t.Errorf("unquoteLuaString(%s): invalid string accepted", quoted)
+		}
+	}
+}
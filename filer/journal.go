@@ -0,0 +1,188 @@
+/*
+ * Change journal
+ * With journal enabled, every created and deleted file is appended to
+ * ".prosody-filer/journal.jsonl". Backup tools read it from the admin API or
+ * with "prosody-filer journal", starting at the cursor returned by their
+ * last run, instead of walking the whole store.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const journalDefaultLimit = 1000
+
+/*
+ * A created or deleted file. Cursor is the position after the entry, to
+ * continue reading from.
+ */
+type journalEntry struct {
+	Cursor int64     `json:"cursor,omitempty"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Size   int64     `json:"size,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+func (s *Server) journalPath() string {
+	return s.internalPath("journal.jsonl")
+}
+
+/*
+ * Appends uploads and deletions to the journal
+ */
+func (s *Server) startJournal() error {
+	if err := os.MkdirAll(s.internalPath(), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create journal directory: %s", err)
+	}
+	file, err := os.OpenFile(s.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %s", err)
+	}
+
+	s.subscribeEvents(func(event fileEvent) {
+		op := map[string]string{"upload": "create", "delete": "delete"}[event.Type]
+		if op == "" {
+			return
+		}
+		line, err := json.Marshal(journalEntry{Time: event.Time, Op: op, Path: event.Path, Size: event.Size, SHA256: event.SHA256})
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		// Events may be published concurrently, lines must not be interleaved
+		s.journalMutex.Lock()
+		defer s.journalMutex.Unlock()
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			log.Error("Writing journal failed: ", err)
+		}
+	})
+	return nil
+}
+
+/*
+ * Reads up to limit entries after cursor. Returns the cursor to continue
+ * from, which is the given one if there are no new entries.
+ */
+func readJournal(filename string, cursor int64, limit int) ([]journalEntry, int64, error) {
+	entries := []journalEntry{}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return entries, cursor, nil
+	} else if err != nil {
+		return nil, cursor, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(cursor, io.SeekStart); err != nil {
+		return nil, cursor, err
+	}
+	reader := bufio.NewReader(file)
+	for len(entries) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Incomplete lines are still being written
+			break
+		} else if err != nil {
+			return nil, cursor, err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, cursor, fmt.Errorf("invalid journal entry at %d: %s", cursor, err)
+		}
+		cursor += int64(len(line))
+		entry.Cursor = cursor
+		entries = append(entries, entry)
+	}
+	return entries, cursor, nil
+}
+
+/*
+ * Journal endpoint:
+ *   GET /journal?cursor=<cursor>&limit=<n>   Changes after cursor (default: from the start)
+ */
+func (s *Server) handleAdminJournal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !s.conf.Journal {
+		httpError(w, http.StatusNotImplemented, "journal is not enabled")
+		return
+	}
+
+	cursor, limit, err := parseJournalQuery(r.FormValue("cursor"), r.FormValue("limit"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	entries, next, err := readJournal(s.journalPath(), cursor, limit)
+	if err != nil {
+		log.Error("Reading journal failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries, "cursor": next})
+}
+
+func parseJournalQuery(cursorString string, limitString string) (int64, int, error) {
+	cursor, limit := int64(0), journalDefaultLimit
+	var err error
+	if cursorString != "" {
+		if cursor, err = strconv.ParseInt(cursorString, 10, 64); err != nil || cursor < 0 {
+			return 0, 0, fmt.Errorf("invalid cursor")
+		}
+	}
+	if limitString != "" {
+		if limit, err = strconv.Atoi(limitString); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit")
+		}
+	}
+	return cursor, limit, nil
+}
+
+/*
+ * "journal" command: prints the changes after a cursor as JSON lines
+ */
+func runJournal(args []string) error {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	cursor := flags.Int64("cursor", 0, "Print changes after this cursor, as returned with the last entry of an earlier run.")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if !s.conf.Journal {
+		return fmt.Errorf("journal is not enabled")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		entries, next, err := readJournal(s.journalPath(), *cursor, journalDefaultLimit)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		if len(entries) < journalDefaultLimit {
+			return nil
+		}
+		*cursor = next
+	}
+}
@@ -0,0 +1,70 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+/*
+ * Created and deleted files are read from the journal in batches
+ */
+func TestJournal(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+	s.conf.Journal = true
+	if err := s.startJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.uploadFile(t, "abc/first.txt", []byte("first"))
+	s.uploadFile(t, "abc/second.txt", []byte("second"))
+	if err := s.deleteFile("abc/first.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(target string) ([]journalEntry, int64) {
+		rr := s.adminRequest(t, "GET", target)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %v want %v", target, rr.Code, http.StatusOK)
+		}
+		var response struct {
+			Entries []journalEntry `json:"entries"`
+			Cursor  int64          `json:"cursor"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Entries, response.Cursor
+	}
+
+	entries, cursor := read("/journal")
+	if len(entries) != 3 || entries[0].Op != "create" || entries[0].Path != "abc/first.txt" || entries[0].Size != 5 ||
+		entries[2].Op != "delete" || entries[2].Path != "abc/first.txt" || entries[2].Cursor != cursor {
+		t.Fatalf("unexpected journal: %+v", entries)
+	}
+
+	// Nothing new
+	if entries, next := read("/journal?cursor=" + strconv.FormatInt(cursor, 10)); len(entries) != 0 || next != cursor {
+		t.Errorf("journal after last cursor: %+v, cursor %d want %d", entries, next, cursor)
+	}
+
+	// In batches
+	entries, next := read("/journal?limit=2")
+	if len(entries) != 2 || entries[1].Path != "abc/second.txt" {
+		t.Errorf("first batch: %+v", entries)
+	}
+	if entries, _ := read("/journal?limit=2&cursor=" + strconv.FormatInt(next, 10)); len(entries) != 1 || entries[0].Op != "delete" {
+		t.Errorf("second batch: %+v", entries)
+	}
+
+	if rr := s.adminRequest(t, "GET", "/journal?cursor=-1"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid cursor: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * JSON Web Tokens
+ * Only HS256, EdDSA (Ed25519), RS256 and ES256 signed tokens are supported.
+ */
+
+package filer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid token")
+var errTokenExpired = errors.New("token expired")
+var errTokenWithoutExpiry = errors.New("token without exp claim")
+
+/*
+ * Verifies a token and its expiry, and decodes its claims. Tokens without
+ * exp claim are refused, as they would never expire. The key is an HS256
+ * secret ([]byte), or an Ed25519, RSA or ECDSA P-256 public key.
+ */
+func verifyJWT(token string, key interface{}, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm must match the key, so a public key can't be used as HS256 secret
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		if header.Alg != "HS256" || !hmac.Equal(signature, mac.Sum(nil)) {
+			return errInvalidToken
+		}
+	case ed25519.PublicKey:
+		if header.Alg != "EdDSA" || !ed25519.Verify(key, signed, signature) {
+			return errInvalidToken
+		}
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		// Signatures are r and s, not ASN.1 encoded
+		hash := sha256.Sum256(signed)
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return errInvalidToken
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, hash[:], r, s) {
+			return errInvalidToken
+		}
+	default:
+		return errInvalidToken
+	}
+
+	var registered struct {
+		Exp *int64 `json:"exp"`
+		Nbf *int64 `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &registered); err != nil {
+		return errInvalidToken
+	}
+	if registered.Exp == nil {
+		return errTokenWithoutExpiry
+	}
+	now := time.Now().Unix()
+	if now >= *registered.Exp || (registered.Nbf != nil && now < *registered.Nbf) {
+		return errTokenExpired
+	}
+
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+/*
+ * Returns the "kid" header of a token, which selects the key of the issuer
+ * it has been signed with
+ */
+func jwtKeyID(token string) string {
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	decodeJWTPart(strings.SplitN(token, ".", 2)[0], &header)
+	return header.Kid
+}
@@ -0,0 +1,99 @@
+package filer
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+/*
+ * Create an HS256 signed token
+ */
+func signJWT(t *testing.T, secret string, claims interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Create an EdDSA signed token
+ */
+func signEdDSAJWT(t *testing.T, key ed25519.PrivateKey, claims interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+
+	token := signJWT(t, "secret", map[string]interface{}{"sub": "thomas", "exp": time.Now().Unix() + 60})
+	if err := verifyJWT(token, []byte("secret"), &claims); err != nil || claims.Sub != "thomas" {
+		t.Errorf("valid token has not been accepted: %v, %+v", err, claims)
+	}
+
+	if err := verifyJWT(token, []byte("other secret"), &claims); err != errInvalidToken {
+		t.Errorf("token with wrong signature: got %v want %v", err, errInvalidToken)
+	}
+
+	expired := signJWT(t, "secret", map[string]interface{}{"sub": "thomas", "exp": time.Now().Unix() - 1})
+	if err := verifyJWT(expired, []byte("secret"), &claims); err != errTokenExpired {
+		t.Errorf("expired token: got %v want %v", err, errTokenExpired)
+	}
+
+	// Tokens without exp claim would never expire
+	unlimited := signJWT(t, "secret", map[string]interface{}{"sub": "thomas"})
+	if err := verifyJWT(unlimited, []byte("secret"), &claims); err != errTokenWithoutExpiry {
+		t.Errorf("token without exp: got %v want %v", err, errTokenWithoutExpiry)
+	}
+
+	// Unsigned tokens must never be accepted
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"thomas"}`)) + "."
+	if err := verifyJWT(unsigned, []byte("secret"), &claims); err != errInvalidToken {
+		t.Errorf("unsigned token: got %v want %v", err, errInvalidToken)
+	}
+}
+
+func TestVerifyEdDSAJWT(t *testing.T) {
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+
+	token := signEdDSAJWT(t, privateKey, map[string]interface{}{"sub": "thomas", "exp": time.Now().Unix() + 60})
+	if err := verifyJWT(token, publicKey, &claims); err != nil || claims.Sub != "thomas" {
+		t.Errorf("valid token has not been accepted: %v, %+v", err, claims)
+	}
+	if err := verifyJWT(token, otherKey, &claims); err != errInvalidToken {
+		t.Errorf("token with wrong signature: got %v want %v", err, errInvalidToken)
+	}
+
+	// The public key is no HS256 secret
+	confused := signJWT(t, string(publicKey), map[string]interface{}{"sub": "thomas"})
+	if err := verifyJWT(confused, publicKey, &claims); err != errInvalidToken {
+		t.Errorf("HS256 token signed with public key: got %v want %v", err, errInvalidToken)
+	}
+}
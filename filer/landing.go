@@ -0,0 +1,70 @@
+/*
+ * Landing page
+ * People trimming an upload URL in their browser end up at the upload
+ * directory or at "/". With landingPage enabled, they get a page explaining
+ * what this service is, instead of an error. landingPageFile replaces the
+ * built-in page.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const defaultLandingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>XMPP file sharing</title>
+</head>
+<body>
+<h1>XMPP file sharing</h1>
+<p>This server stores files shared in XMPP (Jabber) chats.</p>
+<p>Files can only be downloaded using the full link sent in the chat. There is no way to browse or search them.</p>
+</body>
+</html>
+`
+
+func (s *Server) loadLandingPage() error {
+	s.landingPage, s.landingPageModTime = []byte(defaultLandingPage), time.Now()
+	if s.conf.LandingPageFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.conf.LandingPageFile)
+	if err == nil {
+		s.landingPage, err = os.ReadFile(s.conf.LandingPageFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read landing page: %s", err)
+	}
+	s.landingPageModTime = info.ModTime()
+	return nil
+}
+
+func (s *Server) serveLandingPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "", s.landingPageModTime, bytes.NewReader(s.landingPage))
+}
+
+/*
+ * Handles requests outside of the upload and tus directories
+ */
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		httpError(w, http.StatusNotFound, "")
+		return
+	}
+	s.serveLandingPage(w, r)
+}
@@ -0,0 +1,51 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * The landing page is served at "/" and the upload directory
+ */
+func TestLandingPage(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/upload/", nil)
+	if status := s.serveUpload(req).Code; status != http.StatusForbidden {
+		t.Errorf("upload directory without landing page: got %v want %v", status, http.StatusForbidden)
+	}
+
+	s.conf.LandingPage = true
+	rr := s.serveUpload(req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "XMPP file sharing") {
+		t.Errorf("upload directory: got %v, %q", rr.Code, rr.Body)
+	}
+
+	pageFile := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(pageFile, []byte("<h1>Welcome</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.conf.LandingPageFile = pageFile
+	if err := s.loadLandingPage(); err != nil {
+		t.Fatal(err)
+	}
+
+	for target, expected := range map[string]int{"/": http.StatusOK, "/other": http.StatusNotFound} {
+		req, _ := http.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		s.handleRoot(rr, req)
+		if rr.Code != expected {
+			t.Errorf("%s: got %v want %v", target, rr.Code, expected)
+		}
+		if expected == http.StatusOK && rr.Body.String() != "<h1>Welcome</h1>" {
+			t.Errorf("%s: unexpected page %q", target, rr.Body)
+		}
+	}
+	s.conf.LandingPageFile = ""
+}
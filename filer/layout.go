@@ -0,0 +1,123 @@
+/*
+ * Storage layout
+ * "flat": files are stored at their upload path inside StoreDir.
+ * "sharded": files are stored below two levels of directories named after
+ * the SHA-256 hash of their upload path, e.g. "abc/cat.jpg" is stored at
+ * "3f/a2/abc/cat.jpg". This keeps the number of entries per directory
+ * bounded, as every upload usually gets its own directory.
+ *
+ * After switching the layout, existing files are still found at their path
+ * in the other layout, until "prosody-filer reshard" has moved them.
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Returns the absolute path a file is stored at in the configured layout
+ */
+func (s *Server) storagePath(fileStorePath string) string {
+	if s.conf.StorageLayout == "sharded" {
+		return s.shardedPath(fileStorePath)
+	}
+	return s.flatPath(fileStorePath)
+}
+
+/*
+ * Returns the absolute path a file is stored at in the layout which is not
+ * configured
+ */
+func (s *Server) otherLayoutPath(fileStorePath string) string {
+	if s.conf.StorageLayout == "sharded" {
+		return s.flatPath(fileStorePath)
+	}
+	return s.shardedPath(fileStorePath)
+}
+
+func (s *Server) flatPath(fileStorePath string) string {
+	return filepath.Join(s.conf.StoreDir, filepath.FromSlash(fileStorePath))
+}
+
+func (s *Server) shardedPath(fileStorePath string) string {
+	hash := sha256.Sum256([]byte(fileStorePath))
+	shard := hex.EncodeToString(hash[:2])
+	return filepath.Join(s.conf.StoreDir, shard[:2], shard[2:], filepath.FromSlash(fileStorePath))
+}
+
+/*
+ * Returns the absolute path of a stored file, looking for files stored in
+ * the other layout if it does not exist in the configured one. Returns the
+ * path in the configured layout if the file does not exist.
+ */
+func (s *Server) findStoredFile(fileStorePath string) string {
+	absFilename := s.storagePath(fileStorePath)
+	if s.conf.StorageLayout == "sharded" && isShardPath(fileStorePath) {
+		return absFilename
+	}
+
+	if _, err := os.Lstat(absFilename); os.IsNotExist(err) {
+		otherFilename := s.otherLayoutPath(fileStorePath)
+		if _, err := os.Lstat(otherFilename); err == nil {
+			return otherFilename
+		}
+	}
+	return absFilename
+}
+
+/*
+ * Calls fn for every regular file in StoreDir, except for the internal
+ * directory, with the path it is uploaded to in either layout
+ */
+func (s *Server) walkStoreDir(fn func(absFilename string, fileStorePath string, info os.FileInfo) error) error {
+	return filepath.Walk(s.conf.StoreDir, func(absFilename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.conf.StoreDir, absFilename)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() && isInternalPath(rel) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// Files in shard directories belonging to their path are in the sharded layout
+		fileStorePath := rel
+		if isShardPath(rel) {
+			if unsharded := strings.SplitN(rel, "/", 3)[2]; s.shardedPath(unsharded) == absFilename {
+				fileStorePath = unsharded
+			}
+		}
+		return fn(absFilename, fileStorePath, info)
+	})
+}
+
+/*
+ * Reports whether a path starts with shard directories. Such paths are not
+ * looked up in the flat layout, as they would point into the shards.
+ */
+func isShardPath(fileStorePath string) bool {
+	parts := strings.SplitN(fileStorePath, "/", 3)
+	return len(parts) == 3 && isShardName(parts[0]) && isShardName(parts[1])
+}
+
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
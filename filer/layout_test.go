@@ -0,0 +1,129 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Uploads must be stored in shard directories, files in the flat layout
+ * must still be found
+ */
+func TestShardedLayout(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.StorageLayout = "sharded"
+
+	content := []byte("sharded content")
+	if status := s.uploadFile(t, "abc/sharded.txt", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	absFilename := s.shardedPath("abc/sharded.txt")
+	if _, err := os.Stat(absFilename); err != nil {
+		t.Fatalf("file has not been stored in shard directory: %s", err)
+	}
+	if rel, err := filepath.Rel(s.conf.StoreDir, absFilename); err != nil || !isShardPath(filepath.ToSlash(rel)) {
+		t.Errorf("unexpected sharded path %s", rel)
+	}
+
+	// File stored before switching the layout
+	flatFilename := filepath.Join(s.conf.StoreDir, "def", "flat.txt")
+	os.MkdirAll(filepath.Dir(flatFilename), os.ModePerm)
+	if err := os.WriteFile(flatFilename, []byte("flat content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileStorePath, want := range map[string]string{"abc/sharded.txt": "sharded content", "def/flat.txt": "flat content"} {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), []byte(want)) {
+			t.Errorf("download of %s failed: %v %q", fileStorePath, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Files in the flat layout must not be overwritten
+	if status := s.uploadFile(t, "def/flat.txt", content).Code; status != http.StatusConflict {
+		t.Errorf("upload to existing flat path returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+}
+
+func TestIsShardPath(t *testing.T) {
+	tests := map[string]bool{
+		"3f/a2/abc/cat.jpg": true,
+		"3f/a2":             false,
+		"3F/a2/abc/cat.jpg": false,
+		"3f/xy/abc/cat.jpg": false,
+		"abc/cat.jpg":       false,
+	}
+
+	for fileStorePath, want := range tests {
+		if got := isShardPath(fileStorePath); got != want {
+			t.Errorf("isShardPath(%s) = %v, want %v", fileStorePath, got, want)
+		}
+	}
+}
+
+/*
+ * Files are moved into the configured layout, and found in both layouts
+ * until then
+ */
+func TestReshard(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = t.TempDir()
+
+	files := map[string]string{"abc/one.txt": "one", "def/two.txt": "two", "ghi/three.txt": "three"}
+	for fileStorePath, content := range files {
+		s.uploadFile(t, fileStorePath, []byte(content))
+	}
+	checkDownloads := func(stage string) {
+		t.Helper()
+		for fileStorePath, content := range files {
+			req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+			if rr := s.serveUpload(req); rr.Code != http.StatusOK || rr.Body.String() != content {
+				t.Errorf("%s: download of %s: got %v %q", stage, fileStorePath, rr.Code, rr.Body.String())
+			}
+		}
+	}
+
+	s.conf.StorageLayout = "sharded"
+	if result, err := s.reshardStore(1); err != nil || result.Copied != 1 {
+		t.Fatalf("limited run: got %+v, %v", result, err)
+	}
+	checkDownloads("partially sharded")
+	if result, err := s.reshardStore(0); err != nil || result.Copied != 2 || result.Failed != 0 {
+		t.Fatalf("second run: got %+v, %v", result, err)
+	}
+	for fileStorePath := range files {
+		if _, err := os.Stat(s.shardedPath(fileStorePath)); err != nil {
+			t.Errorf("%s has not been moved: %s", fileStorePath, err)
+		}
+		if _, err := os.Stat(filepath.Join(s.conf.StoreDir, filepath.Dir(fileStorePath))); !os.IsNotExist(err) {
+			t.Errorf("empty directory of %s has not been removed", fileStorePath)
+		}
+	}
+	checkDownloads("sharded")
+
+	// And back
+	s.conf.StorageLayout = "flat"
+	checkDownloads("switched back")
+	if result, err := s.reshardStore(0); err != nil || result.Copied != 3 {
+		t.Fatalf("switching back: got %+v, %v", result, err)
+	}
+	if _, err := os.Stat(s.flatPath("abc/one.txt")); err != nil {
+		t.Errorf("file has not been moved back: %s", err)
+	}
+	if entries, _ := os.ReadDir(s.conf.StoreDir); len(entries) != 4 {
+		t.Errorf("unexpected entries left in storeDir: %v", entries)
+	}
+	checkDownloads("flat")
+}
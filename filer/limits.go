@@ -0,0 +1,136 @@
+/*
+ * Upload size limits
+ * maxFileSize limits all uploads; sizeLimits sets different limits by
+ * extension (".mp4") or content type ("video/mp4", "video/*"). The most
+ * specific entry wins, in that order. Limits are checked against the
+ * announced size before the body is read, and while receiving it.
+ * Uploads smaller than minFileSize, usually empty ones from broken clients
+ * or scanners, are refused. maxFilesPerPrefix limits the number of files
+ * below the first path element, which identifies the user with some XMPP
+ * servers.
+ */
+
+package filer
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errTooLarge = errors.New("upload exceeds size limit")
+
+/*
+ * Returns the maximum size for uploads to fileStorePath, or 0 if unlimited
+ */
+func (s *Server) sizeLimit(fileStorePath string) int64 {
+	if len(s.conf.SizeLimits) == 0 {
+		return s.conf.MaxFileSize
+	}
+
+	if limit, ok := s.conf.SizeLimits[strings.ToLower(path.Ext(fileStorePath))]; ok {
+		return limit
+	}
+
+	contentType, _, err := mime.ParseMediaType(extensionContentType(fileStorePath))
+	if err != nil {
+		return s.conf.MaxFileSize
+	}
+	if limit, ok := s.conf.SizeLimits[contentType]; ok {
+		return limit
+	}
+	if limit, ok := s.conf.SizeLimits[strings.SplitN(contentType, "/", 2)[0]+"/*"]; ok {
+		return limit
+	}
+	return s.conf.MaxFileSize
+}
+
+/*
+ * Reports whether size exceeds the limit for fileStorePath
+ */
+func (s *Server) exceedsSizeLimit(fileStorePath string, size int64) bool {
+	limit := s.sizeLimit(fileStorePath)
+	return limit > 0 && size > limit
+}
+
+/*
+ * Answers an upload exceeding the size limit of fileStorePath, telling the
+ * client the limit
+ */
+func (s *Server) rejectTooLarge(w http.ResponseWriter, fileStorePath string) {
+	limit := s.sizeLimit(fileStorePath)
+	w.Header().Set("X-Max-File-Size", strconv.FormatInt(limit, 10))
+	httpError(w, http.StatusRequestEntityTooLarge, "file too large, max "+formatSize(limit))
+}
+
+func (s *Server) belowMinimumSize(size int64) bool {
+	return size < s.conf.MinFileSize
+}
+
+/*
+ * Reports whether the first path element of fileStorePath holds
+ * maxFilesPerPrefix files already. Files are counted by their metadata, so
+ * files stored by older versions don't count.
+ */
+func (s *Server) prefixFull(fileStorePath string) (bool, error) {
+	prefix := uploaderPrefix(fileStorePath)
+	if s.conf.MaxFilesPerPrefix <= 0 || prefix == "" {
+		return false, nil
+	}
+
+	errFull := errors.New("full")
+	count := 0
+	err := filepath.WalkDir(s.sharedPath("meta", prefix), func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && strings.HasSuffix(name, ".json") {
+			count++
+			if count >= s.conf.MaxFilesPerPrefix {
+				return errFull
+			}
+		}
+		return nil
+	})
+
+	if err == errFull {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+/*
+ * Fails with errTooLarge once more than limit bytes have been read
+ */
+type sizeLimitReader struct {
+	src       io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		l.exceeded = true
+		return 0, errTooLarge
+	}
+	// Read one byte more than allowed to notice oversized uploads
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.src.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,151 @@
+package filer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestSizeLimit(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	if limit := s.sizeLimit("abc/cat.jpg"); limit != 0 {
+		t.Errorf("uploads should be unlimited by default, got %d", limit)
+	}
+
+	s.conf.MaxFileSize = 1000
+	s.conf.SizeLimits = map[string]int64{
+		"image/*":    5000,
+		"image/png":  3000,
+		".png":       2000,
+		"video/*":    0,
+		".exe":       10,
+		"text/plain": 100,
+	}
+	for fileStorePath, expected := range map[string]int64{
+		"abc/cat.jpg":      5000,
+		"abc/cat.gif":      5000,
+		"abc/cat.PNG":      2000,
+		"abc/cat.mp4":      0,
+		"abc/cat.txt":      100,
+		"abc/cat.pdf":      1000,
+		"abc/cat.unknown":  1000,
+		"abc/setup.exe":    10,
+		"abc/no-extension": 1000,
+	} {
+		if limit := s.sizeLimit(fileStorePath); limit != expected {
+			t.Errorf("sizeLimit(%q) = %d, want %d", fileStorePath, limit, expected)
+		}
+	}
+}
+
+/*
+ * Oversized uploads are rejected before and while receiving them
+ */
+func TestUploadSizeLimit(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ChunkedUploads = "verify"
+	s.conf.SizeLimits = map[string]int64{"text/*": 10, ".log": 1000}
+
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/small.txt", []byte("0123456789"))).Code; status != http.StatusCreated {
+		t.Errorf("upload within limit: got %v want %v", status, http.StatusCreated)
+	}
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/large.txt", []byte("0123456789a"))).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload exceeding limit: got %v want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	// Without Content-Length, the limit is noticed while receiving the upload
+	content := bytes.Repeat([]byte("a"), 100000)
+	req := s.newUploadRequest(t, "abc/chunked.txt", content)
+	req.Body = io.NopCloser(bytes.NewReader(content))
+	req.ContentLength = -1
+	if status := s.serveUpload(req).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked upload exceeding limit: got %v want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	req = s.newUploadRequest(t, "abc/chunked.log", content)
+	req.Body = io.NopCloser(bytes.NewReader(content))
+	req.ContentLength = -1
+	if status := s.serveUpload(req).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked upload exceeding limit after the first bytes: got %v want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/large.bin", content)).Code; status != http.StatusCreated {
+		t.Errorf("upload of other type: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	limited := &sizeLimitReader{src: bytes.NewReader([]byte("0123456789")), remaining: 10}
+	if data, err := io.ReadAll(limited); err != nil || len(data) != 10 {
+		t.Errorf("reading up to the limit: got %d bytes, %v", len(data), err)
+	}
+
+	limited = &sizeLimitReader{src: bytes.NewReader([]byte("0123456789")), remaining: 9}
+	if _, err := io.ReadAll(limited); err != errTooLarge || !limited.exceeded {
+		t.Errorf("reading beyond the limit: got %v", err)
+	}
+}
+
+/*
+ * Empty uploads are rejected unless minFileSize is 0
+ */
+func TestUploadMinimumSize(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ChunkedUploads = "verify"
+	s.conf.MaxFileSize = 1024
+
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/empty.txt", nil)).Code; status != http.StatusBadRequest {
+		t.Errorf("empty upload: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	req := s.newUploadRequest(t, "abc/empty.txt", nil)
+	req.Body = io.NopCloser(bytes.NewReader(nil))
+	req.ContentLength = -1
+	if status := s.serveUpload(req).Code; status != http.StatusBadRequest {
+		t.Errorf("empty chunked upload: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	s.conf.MinFileSize = 0
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/empty.txt", nil)).Code; status != http.StatusCreated {
+		t.Errorf("empty upload with minFileSize 0: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Uploads are rejected once a prefix holds maxFilesPerPrefix files
+ */
+func TestMaxFilesPerPrefix(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MaxFilesPerPrefix = 2
+
+	for i, expected := range []int{http.StatusCreated, http.StatusCreated, http.StatusForbidden} {
+		fileStorePath := "user1/" + strconv.Itoa(i) + "/file.txt"
+		if status := s.serveUpload(s.newUploadRequest(t, fileStorePath, []byte("file"))).Code; status != expected {
+			t.Errorf("upload to %s: got %v want %v", fileStorePath, status, expected)
+		}
+	}
+
+	// Other prefixes are not affected
+	if status := s.serveUpload(s.newUploadRequest(t, "user2/0/file.txt", []byte("file"))).Code; status != http.StatusCreated {
+		t.Errorf("upload to other prefix: got %v want %v", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux || freebsd || darwin
+// +build linux freebsd darwin
+
+package filer
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+ * Returns the number of hard links to a file, if the platform reports it
+ */
+func linkCount(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Nlink), true
+}
+
+/*
+ * Identifies the file a hard link points to
+ */
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+/*
+ * Returns the inode of a file, if the platform reports it
+ */
+func fileInode(info os.FileInfo) (inode, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, false
+	}
+	return inode{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
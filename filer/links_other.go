@@ -0,0 +1,16 @@
+//go:build !linux && !freebsd && !darwin
+// +build !linux,!freebsd,!darwin
+
+package filer
+
+import "os"
+
+func linkCount(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+type inode struct{}
+
+func fileInode(info os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
@@ -0,0 +1,251 @@
+/*
+ * Lua hooks
+ * Prosody admins write Lua anyway, so policy can also be a Lua script run
+ * by an embedded interpreter (luaScript). The script may define any of
+ * these functions, each called with a table describing the request:
+ *
+ *	pre_upload(request)    before the body of an upload is received
+ *	post_upload(request)   once an upload has been received and checked,
+ *	                       before it is stored
+ *	pre_download(request)  before a file is served
+ *
+ * Returning false, optionally followed by a reason, rejects the request.
+ * post_upload may add attributes to the metadata of the file by setting
+ * them in request.attributes, pre_download may add response headers in
+ * request.response_headers. Calls are spread over several interpreters,
+ * so globals set by one call are not seen by all others. Failures and
+ * calls taking longer than pluginTimeout are handled like failures of
+ * plugins, according to pluginFailureMode.
+ */
+
+package filer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Interpreters kept for later calls
+const luaIdleStates = 16
+
+var luaHookNames = []string{"pre_upload", "post_upload", "pre_download"}
+
+/*
+ * A loaded Lua script
+ */
+type luaHooks struct {
+	name    string
+	proto   *lua.FunctionProto
+	timeout time.Duration
+	defined map[string]bool
+	idle    chan *lua.LState
+}
+
+/*
+ * Compiles the script and runs it once to find the hooks it defines
+ */
+func newLuaHooks(filename string, timeout time.Duration) (*luaHooks, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Lua script: %s", err)
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Lua script: %s", err)
+	}
+	proto, err := lua.Compile(chunk, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile Lua script: %s", err)
+	}
+
+	h := &luaHooks{
+		name:    filepath.Base(filename),
+		proto:   proto,
+		timeout: timeout,
+		defined: make(map[string]bool),
+		idle:    make(chan *lua.LState, luaIdleStates),
+	}
+	L, err := h.newState()
+	if err != nil {
+		return nil, err
+	}
+	var defined []string
+	for _, hook := range luaHookNames {
+		if _, ok := L.GetGlobal(hook).(*lua.LFunction); ok {
+			h.defined[hook] = true
+			defined = append(defined, hook)
+		}
+	}
+	h.put(L)
+
+	log.Info("Loaded Lua script ", h.name, " with hooks ", strings.Join(defined, ", "))
+	return h, nil
+}
+
+/*
+ * Returns a new interpreter which has run the script
+ */
+func (h *luaHooks) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to run Lua script %s: %s", h.name, err)
+	}
+	return L, nil
+}
+
+func (h *luaHooks) get() (*lua.LState, error) {
+	select {
+	case L := <-h.idle:
+		return L, nil
+	default:
+		return h.newState()
+	}
+}
+
+func (h *luaHooks) put(L *lua.LState) {
+	select {
+	case h.idle <- L:
+	default:
+		L.Close()
+	}
+}
+
+/*
+ * Reports whether the script defines a hook. Without a script, it doesn't.
+ */
+func (h *luaHooks) handles(hook string) bool {
+	return h != nil && h.defined[hook]
+}
+
+/*
+ * Calls a hook with a request table holding fields and an empty table
+ * named annotations, if not empty. Returns the entries the hook has set
+ * in that table, or a *pluginVeto if it rejects the request.
+ */
+func (h *luaHooks) call(hook string, fields map[string]interface{}, annotations string) (map[string]string, error) {
+	L, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+
+	request := L.NewTable()
+	for key, value := range fields {
+		request.RawSetString(key, luaValue(L, value))
+	}
+	if annotations != "" {
+		request.RawSetString(annotations, L.NewTable())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: 2, Protect: true}, request)
+	L.RemoveContext()
+	if err != nil {
+		// The script may have been interrupted anywhere, so the interpreter is not reused
+		L.Close()
+		return nil, fmt.Errorf("hook %s of Lua script %s failed: %s", hook, h.name, err)
+	}
+	allow, reason := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	result := make(map[string]string)
+	if table, ok := request.RawGetString(annotations).(*lua.LTable); annotations != "" && ok {
+		table.ForEach(func(key lua.LValue, value lua.LValue) {
+			result[key.String()] = value.String()
+		})
+	}
+	h.put(L)
+
+	if allow == lua.LFalse {
+		return nil, &pluginVeto{plugin: h.name, reason: lua.LVAsString(reason)}
+	}
+	return result, nil
+}
+
+/*
+ * Converts a field of a request table
+ */
+func luaValue(L *lua.LState, value interface{}) lua.LValue {
+	switch value := value.(type) {
+	case string:
+		return lua.LString(value)
+	case int64:
+		return lua.LNumber(value)
+	case map[string]string:
+		table := L.NewTable()
+		for key, entry := range value {
+			table.RawSetString(key, lua.LString(entry))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+/*
+ * Returns the first value of each request header, by canonical name
+ */
+func luaHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		if len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	return headers
+}
+
+/*
+ * Calls a hook of the Lua script, if it defines it. See luaHooks.call().
+ */
+func (s *Server) callLuaHook(hook string, fields map[string]interface{}, annotations string) (map[string]string, error) {
+	if !s.lua.handles(hook) {
+		return nil, nil
+	}
+	result, err := s.lua.call(hook, fields, annotations)
+	if _, vetoed := err.(*pluginVeto); err != nil && !vetoed {
+		pluginFailuresMetric.add(fmt.Sprintf("plugin=%q", s.lua.name), 1)
+	}
+	return result, err
+}
+
+/*
+ * Runs the pre_upload hook for an upload of size bytes, -1 if unknown.
+ * Returns false if the upload has been rejected.
+ */
+func (s *Server) luaPreUpload(w http.ResponseWriter, r *http.Request, fileStorePath string, size int64) bool {
+	_, err := s.callLuaHook("pre_upload", map[string]interface{}{
+		"path":         fileStorePath,
+		"size":         size,
+		"content_type": extensionContentType(fileStorePath),
+		"uploader":     uploaderPrefix(fileStorePath),
+		"remote_addr":  s.clientIP(r),
+		"method":       r.Method,
+		"headers":      luaHeaders(r.Header),
+	}, "")
+	if veto, ok := err.(*pluginVeto); ok {
+		log.Warn("Rejected upload of ", fileStorePath, ": ", veto)
+		httpError(w, http.StatusForbidden, "")
+		return false
+	} else if err != nil {
+		if err = s.handlePluginFailure(err); err != nil {
+			log.Error(err)
+			httpError(w, http.StatusServiceUnavailable, "")
+			return false
+		}
+	}
+	return true
+}
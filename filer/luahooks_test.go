@@ -0,0 +1,167 @@
+package filer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testLuaScript = `
+function pre_upload(request)
+	if request.path:find("forbidden") then
+		return false, "not today"
+	end
+	if request.headers["User-Agent"] == "scanner" then
+		return false, "no scanners"
+	end
+end
+
+function post_upload(request)
+	if request.size == 4 and request.path:find("empty") then
+		return false, "placeholder"
+	end
+	request.attributes.uploader = request.uploader
+	request.attributes.sha256 = request.sha256
+	return true
+end
+
+function pre_download(request)
+	if request.path:find("private") then
+		return false, "private"
+	end
+	if request.path:find("slow") then
+		while true do end
+	end
+	request.response_headers["X-Uploader"] = request.attributes.uploader
+end
+`
+
+/*
+ * Loads script as Lua hooks of s
+ */
+func (s *Server) loadTestLuaScript(t *testing.T, script string) {
+	filename := filepath.Join(t.TempDir(), "hooks.lua")
+	if err := os.WriteFile(filename, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hooks, err := newLuaHooks(filename, s.conf.PluginTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lua = hooks
+}
+
+/*
+ * Lua hooks can reject uploads before and after receiving them, add
+ * metadata attributes, and reject or annotate downloads
+ */
+func TestLuaHooks(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.PluginTimeout = 100 * time.Millisecond
+	s.loadTestLuaScript(t, testLuaScript)
+
+	content := []byte("hooked")
+	if status := s.uploadFile(t, "abc/forbidden.txt", content).Code; status != http.StatusForbidden {
+		t.Errorf("upload rejected by pre_upload: got %v want %v", status, http.StatusForbidden)
+	}
+	req := s.newUploadRequest(t, "abc/scanned.txt", content)
+	req.Header.Set("User-Agent", "scanner")
+	if status := s.serveUpload(req).Code; status != http.StatusForbidden {
+		t.Errorf("upload rejected by pre_upload header check: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := s.uploadFile(t, "abc/empty.txt", []byte("none")).Code; status != http.StatusForbidden {
+		t.Errorf("upload rejected by post_upload: got %v want %v", status, http.StatusForbidden)
+	}
+	if exists, _ := s.backend.Exists("abc/empty.txt"); exists {
+		t.Errorf("upload rejected by post_upload has been stored")
+	}
+
+	for _, fileStorePath := range []string{"abc/hooked.txt", "abc/private.txt", "abc/slow.txt"} {
+		if status := s.uploadFile(t, fileStorePath, content).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+	meta, err := s.readMetadata("abc/hooked.txt")
+	if err != nil || meta.Attributes["uploader"] != "abc" || meta.Attributes["sha256"] != meta.SHA256 {
+		t.Errorf("attributes of post_upload not stored: %+v %v", meta.Attributes, err)
+	}
+
+	download := func(fileStorePath string) (int, http.Header) {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		rr := s.serveUpload(req)
+		return rr.Code, rr.Header()
+	}
+	if status, header := download("abc/hooked.txt"); status != http.StatusOK || header.Get("X-Uploader") != "abc" {
+		t.Errorf("download annotated by pre_download: got %v %q", status, header.Get("X-Uploader"))
+	}
+	if status, _ := download("abc/private.txt"); status != http.StatusForbidden {
+		t.Errorf("download rejected by pre_download: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Hooks running too long fail
+	if status, _ := download("abc/slow.txt"); status != http.StatusServiceUnavailable {
+		t.Errorf("download with hook timing out: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+	s.conf.PluginFailureMode = "accept"
+	if status, _ := download("abc/slow.txt"); status != http.StatusOK {
+		t.Errorf("download with hook timing out, accepting: got %v want %v", status, http.StatusOK)
+	}
+
+	// Interpreters stay usable after a hook has been interrupted
+	for i := 0; i < luaIdleStates+1; i++ {
+		if status, _ := download("abc/hooked.txt"); status != http.StatusOK {
+			t.Fatalf("download %d after timeout: got %v want %v", i, status, http.StatusOK)
+		}
+	}
+}
+
+/*
+ * pre_upload also applies to tus uploads, and is told their size
+ */
+func TestLuaHooksTus(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.TusSubDir = "tus/"
+	s.loadTestLuaScript(t, `
+function pre_upload(request)
+	return request.size < 10, "too large for hooks"
+end
+`)
+
+	rr := s.tusRequest(t, "POST", "abc/large.txt", 20, nil, map[string]string{"Upload-Length": strconv.Itoa(20)})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("tus upload rejected by pre_upload: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	rr = s.tusRequest(t, "POST", "abc/small.txt", 5, nil, map[string]string{"Upload-Length": strconv.Itoa(5)})
+	if rr.Code != http.StatusCreated {
+		t.Errorf("tus upload allowed by pre_upload: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+/*
+ * Broken scripts must be refused on startup
+ */
+func TestLuaScriptInvalid(t *testing.T) {
+	for _, script := range []string{"function pre_upload(", "error('failing on load')"} {
+		filename := filepath.Join(t.TempDir(), "hooks.lua")
+		os.WriteFile(filename, []byte(script), 0644)
+		if _, err := newLuaHooks(filename, time.Second); err == nil {
+			t.Errorf("script %q has been loaded", script)
+		}
+	}
+	if _, err := newLuaHooks(filepath.Join(t.TempDir(), "missing.lua"), time.Second); err == nil {
+		t.Error("missing script has been loaded")
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Maintenance windows
+ * Planned periods of read-only mode, from maintenanceWindows in the config
+ * or scheduled through the admin API. During a window, uploads and
+ * deletions are refused with 503 and a Retry-After header counting the
+ * seconds until the window ends, so clients retry right afterwards;
+ * downloads keep working. Windows scheduled through the admin API are kept
+ * in memory by the node which received the request.
+ */
+
+package filer
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A maintenance window, as listed by the admin API
+ */
+type maintenanceWindow struct {
+	ID    int       `json:"id"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+/*
+ * Schedules a maintenance window
+ */
+func (s *Server) scheduleMaintenance(start time.Time, end time.Time) maintenanceWindow {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+	s.maintenance.nextID++
+	window := maintenanceWindow{ID: s.maintenance.nextID, Start: start.UTC(), End: end.UTC()}
+	s.maintenance.windows = append(s.maintenance.windows, window)
+	sort.Slice(s.maintenance.windows, func(i, j int) bool {
+		return s.maintenance.windows[i].Start.Before(s.maintenance.windows[j].Start)
+	})
+	return window
+}
+
+/*
+ * Returns the windows which haven't ended yet, by start, and drops the
+ * others
+ */
+func (s *Server) maintenanceWindows() []maintenanceWindow {
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+	now := time.Now()
+	windows := s.maintenance.windows[:0]
+	for _, window := range s.maintenance.windows {
+		if window.End.After(now) {
+			windows = append(windows, window)
+		}
+	}
+	s.maintenance.windows = windows
+	return append([]maintenanceWindow{}, windows...)
+}
+
+/*
+ * Returns when the current maintenance ends, including windows overlapping
+ * it, or the zero time if there is none
+ */
+func (s *Server) maintenanceEnd() time.Time {
+	var end time.Time
+	now := time.Now()
+	for _, window := range s.maintenanceWindows() {
+		if window.Start.After(now) && window.Start.After(end) {
+			break
+		}
+		if window.End.After(end) {
+			end = window.End
+		}
+	}
+	return end
+}
+
+/*
+ * Returns the seconds clients should wait before retrying a refused upload
+ */
+func (s *Server) retryAfter() string {
+	if atomic.LoadInt32(&s.readOnly) == 0 {
+		if end := s.maintenanceEnd(); !end.IsZero() {
+			return strconv.Itoa(int(math.Ceil(time.Until(end).Seconds())))
+		}
+	}
+	return strconv.Itoa(int(s.conf.ReadOnlyRetryAfter.Seconds()))
+}
+
+/*
+ * Maintenance endpoint:
+ *   GET    /maintenance                                 List windows which haven't ended yet
+ *   POST   /maintenance?[start=<time>&]end=<time>       Schedule a window (times in RFC 3339, start defaults to now)
+ *   POST   /maintenance?[start=<time>&]duration=<d>     Schedule a window lasting duration
+ *   DELETE /maintenance?id=<id>                         Cancel or end a window
+ */
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"windows": s.maintenanceWindows(), "active": !s.maintenanceEnd().IsZero()})
+
+	case http.MethodPost:
+		start, end := time.Now(), time.Time{}
+		var err error
+		if value := r.FormValue("start"); value != "" {
+			if start, err = time.Parse(time.RFC3339, value); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid start"})
+				return
+			}
+		}
+		if value := r.FormValue("end"); value != "" {
+			if end, err = time.Parse(time.RFC3339, value); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid end"})
+				return
+			}
+		} else if value := r.FormValue("duration"); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+				return
+			}
+			end = start.Add(duration)
+		}
+		if !end.After(start) || !end.After(time.Now()) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "end or duration missing, or window in the past"})
+			return
+		}
+		window := s.scheduleMaintenance(start, end)
+		log.Warnf("Scheduled maintenance from %s to %s, refusing uploads meanwhile", window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, window)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+			return
+		}
+		s.maintenance.Lock()
+		found := false
+		for i, window := range s.maintenance.windows {
+			if window.ID == id {
+				s.maintenance.windows = append(s.maintenance.windows[:i], s.maintenance.windows[i+1:]...)
+				found = true
+				break
+			}
+		}
+		s.maintenance.Unlock()
+		if !found {
+			httpError(w, http.StatusNotFound, "")
+			return
+		}
+		log.Info("Cancelled maintenance window ", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "")
+	}
+}
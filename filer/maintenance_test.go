@@ -0,0 +1,89 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+ * Uploads are refused during maintenance windows with the seconds until
+ * the end of overlapping windows, downloads keep working
+ */
+func TestMaintenanceWindows(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+
+	s.uploadFile(t, "abc/before.txt", []byte("before"))
+	now := time.Now()
+	s.scheduleMaintenance(now.Add(-time.Minute), now.Add(10*time.Minute))
+	s.scheduleMaintenance(now.Add(5*time.Minute), now.Add(20*time.Minute))
+	s.scheduleMaintenance(now.Add(time.Hour), now.Add(2*time.Hour))
+
+	rr := s.serveUpload(s.newUploadRequest(t, "abc/during.txt", []byte("during")))
+	retryAfter, _ := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if rr.Code != http.StatusServiceUnavailable || retryAfter < 1190 || retryAfter > 1200 {
+		t.Errorf("upload during maintenance: got %v, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/before.txt", nil)
+	if status := s.serveUpload(req).Code; status != http.StatusOK {
+		t.Errorf("download during maintenance: got %v want %v", status, http.StatusOK)
+	}
+
+	// Read-only mode enabled by hand has no known end
+	s.setReadOnly(true)
+	if retryAfter := s.retryAfter(); retryAfter != "300" {
+		t.Errorf("Retry-After in read-only mode: got %q want \"300\"", retryAfter)
+	}
+	s.setReadOnly(false)
+
+	var response struct {
+		Windows []maintenanceWindow `json:"windows"`
+		Active  bool                `json:"active"`
+	}
+	for _, id := range []string{"1", "2"} {
+		if rr := s.adminRequest(t, "DELETE", "/maintenance?id="+id); rr.Code != http.StatusNoContent {
+			t.Fatalf("ending window %s: got %v want %v", id, rr.Code, http.StatusNoContent)
+		}
+	}
+	rr = s.adminRequest(t, "GET", "/maintenance")
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Active || len(response.Windows) != 1 || response.Windows[0].ID != 3 {
+		t.Errorf("unexpected windows: %s", rr.Body)
+	}
+	s.uploadFile(t, "abc/after.txt", []byte("after"))
+
+	if rr := s.adminRequest(t, "POST", "/maintenance?duration=30s"); rr.Code != http.StatusOK {
+		t.Fatalf("scheduling window: got %v %s", rr.Code, rr.Body)
+	}
+	if retryAfter := s.retryAfter(); retryAfter != "30" {
+		t.Errorf("Retry-After of scheduled window: got %q want \"30\"", retryAfter)
+	}
+	for _, query := range []string{"", "?duration=-1m", "?end=2000-01-01T00:00:00Z", "?start=now&duration=1h"} {
+		if rr := s.adminRequest(t, "POST", "/maintenance"+query); rr.Code != http.StatusBadRequest {
+			t.Errorf("invalid window %q: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+/*
+ * Maintenance windows are read from the config
+ */
+func TestMaintenanceWindowsConfig(t *testing.T) {
+	conf, err := LoadConfig(writeTestConfig(t, "maintenanceWindows = [{ start = 2030-01-01T02:00:00Z, end = 2030-01-01T04:00:00+01:00 }]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.MaintenanceWindows) != 1 || conf.MaintenanceWindows[0].End.Sub(conf.MaintenanceWindows[0].Start) != time.Hour {
+		t.Errorf("unexpected windows: %+v", conf.MaintenanceWindows)
+	}
+}
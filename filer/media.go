@@ -0,0 +1,83 @@
+/*
+ * Media streaming
+ * Web clients play shared videos and audio while downloading them and
+ * seek with range requests, which all storage layers serve without reading
+ * the file from the start. Files which have to be copied through
+ * userspace (S3, encoded files) are read in chunks of mediaReadBuffer
+ * bytes, so seeking and playing cause fewer, larger reads of the backend.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+/*
+ * Types of common media files, which minimal systems without
+ * /etc/mime.types don't know
+ */
+var mediaContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".3gp":  "video/3gpp",
+	".ogv":  "video/ogg",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".weba": "audio/webm",
+}
+
+func isMediaType(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/")
+}
+
+/*
+ * Reads through a buffer of a given size. Seeking discards the buffer
+ * unless the new position is inside it.
+ */
+type bufferedReadSeeker struct {
+	src    io.ReadSeeker
+	reader *bufio.Reader
+	pos    int64
+}
+
+func newBufferedReadSeeker(src io.ReadSeeker, size int) *bufferedReadSeeker {
+	return &bufferedReadSeeker{src: src, reader: bufio.NewReaderSize(src, size)}
+}
+
+func (b *bufferedReadSeeker) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *bufferedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset += b.pos
+		whence = io.SeekStart
+	}
+	if whence == io.SeekStart && offset >= b.pos && offset-b.pos <= int64(b.reader.Buffered()) {
+		b.reader.Discard(int(offset - b.pos))
+		b.pos = offset
+		return offset, nil
+	}
+
+	pos, err := b.src.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	b.reader.Reset(b.src)
+	b.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,89 @@
+package filer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Videos from S3 are served with range requests right away and cached in
+ * the background
+ */
+func TestMediaRangeRequests(t *testing.T) {
+	s, _, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	s.conf.DiskCacheSize = 1024 * 1024
+	s.conf.MediaReadBuffer = 64 * 1024
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(strings.Repeat("0123456789", 20000))
+	s.uploadFile(t, "abc/video.mp4", content)
+
+	req, _ := http.NewRequest("GET", "/upload/abc/video.mp4", nil)
+	req.Header.Set("Range", "bytes=150000-150009")
+	rr := s.serveUpload(req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "0123456789" {
+		t.Fatalf("range request: got %v %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "video/mp4" || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("unexpected headers: %v", rr.Header())
+	}
+
+	cache := s.backend.(*cachingBackend).cache
+	for i := 0; ; i++ {
+		if file, err := cache.open("abc/video.mp4"); err == nil {
+			file.Close()
+			break
+		} else if i == 100 {
+			t.Fatal("video has not been cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBufferedReadSeeker(t *testing.T) {
+	content := []byte(strings.Repeat("abcdefghij", 100))
+	reader := newBufferedReadSeeker(bytes.NewReader(content), 64)
+
+	read := func(n int) string {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	if got := read(5); got != "abcde" {
+		t.Errorf("got %q want abcde", got)
+	}
+	// Within the buffer
+	if pos, _ := reader.Seek(2, io.SeekCurrent); pos != 7 || read(3) != "hij" {
+		t.Errorf("seek within buffer failed at %d", pos)
+	}
+	// Beyond it
+	if pos, _ := reader.Seek(503, io.SeekStart); pos != 503 || read(4) != "defg" {
+		t.Errorf("seek beyond buffer failed at %d", pos)
+	}
+	if pos, _ := reader.Seek(-3, io.SeekEnd); pos != 997 || read(3) != "hij" {
+		t.Errorf("seek from end failed at %d", pos)
+	}
+}
+
+func TestMediaContentTypes(t *testing.T) {
+	if contentType := extensionContentType("abc/VIDEO.WEBM"); contentType != "video/webm" {
+		t.Errorf("got %s want video/webm", contentType)
+	}
+	if contentType := extensionContentType("abc/voice.opus"); !isMediaType(contentType) {
+		t.Errorf("got %s for opus", contentType)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * In-memory cache for hot files
+ * When a link is posted into a large MUC, hundreds of clients fetch the
+ * same file within seconds. Small files which are requested again within
+ * memoryCacheWindow are kept in memory, so they don't have to be read from
+ * the storage backend for every client. Files are cached as stored, i.e.
+ * still encrypted.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Storage backend serving hot files from memory
+ */
+type memoryCachingBackend struct {
+	storage.Backend
+	cache       *memoryCache
+	maxFileSize int64
+}
+
+func (c *memoryCachingBackend) Open(fileStorePath string) (storage.File, error) {
+	if file := c.cache.open(fileStorePath); file != nil {
+		cacheRequestsMetric.add(`cache="memory",result="hit"`, 1)
+		return file, nil
+	}
+	cacheRequestsMetric.add(`cache="memory",result="miss"`, 1)
+
+	file, err := c.Backend.Open(fileStorePath)
+	if err != nil || file.Size() > c.maxFileSize || !c.cache.admit(fileStorePath) {
+		return file, err
+	}
+
+	data := make([]byte, file.Size())
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		// Serve from the storage backend instead
+		log.Warn("Caching ", fileStorePath, " in memory failed: ", err)
+		return file, nil
+	}
+
+	file.Close()
+	c.cache.add(fileStorePath, data, file.ModTime())
+	return &memoryFile{Reader: bytes.NewReader(data), modTime: file.ModTime()}, nil
+}
+
+func (c *memoryCachingBackend) Delete(fileStorePath string) error {
+	c.cache.mutex.Lock()
+	c.cache.remove(fileStorePath)
+	c.cache.mutex.Unlock()
+	return c.Backend.Delete(fileStorePath)
+}
+
+func (c *memoryCachingBackend) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	deduplicated, err := c.Backend.Replace(tmpFilename, fileStorePath, hash)
+	c.cache.mutex.Lock()
+	c.cache.remove(fileStorePath)
+	c.cache.mutex.Unlock()
+	return deduplicated, err
+}
+
+func (c *memoryCachingBackend) Presign(fileStorePath string, expiry time.Duration) (string, error) {
+	signer, ok := c.Backend.(storage.Presigner)
+	if !ok {
+		return "", fmt.Errorf("storage backend does not support presigned URLs")
+	}
+	return signer.Presign(fileStorePath, expiry)
+}
+
+/*
+ * A cached file. bytes.Reader provides Size().
+ */
+type memoryFile struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+func (f *memoryFile) ModTime() time.Time {
+	return f.modTime
+}
+
+type memoryCacheEntry struct {
+	key      string
+	data     []byte
+	modTime  time.Time
+	lastUsed time.Time
+}
+
+/*
+ * Size-bounded LRU cache of file contents. Entries expire if they are not
+ * requested again within window.
+ */
+type memoryCache struct {
+	maxSize int64
+	window  time.Duration
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Last request of files which are not cached (yet)
+	seen map[string]time.Time
+}
+
+func newMemoryCache(maxSize int64, window time.Duration) *memoryCache {
+	return &memoryCache{
+		maxSize: maxSize,
+		window:  window,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+/*
+ * Returns a cached file or nil
+ */
+func (c *memoryCache) open(fileStorePath string) storage.File {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	element, ok := c.entries[fileStorePath]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	entry.lastUsed = now
+	c.lru.MoveToFront(element)
+
+	return &memoryFile{Reader: bytes.NewReader(entry.data), modTime: entry.modTime}
+}
+
+/*
+ * Reports whether a file should be cached: only files requested again
+ * within the window are, so files downloaded once don't push hot ones out.
+ */
+func (c *memoryCache) admit(fileStorePath string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	last, ok := c.seen[fileStorePath]
+	if ok && now.Sub(last) <= c.window {
+		delete(c.seen, fileStorePath)
+		return true
+	}
+
+	// Forget old requests now and then
+	if len(c.seen) >= 10000 {
+		for key, last := range c.seen {
+			if now.Sub(last) > c.window {
+				delete(c.seen, key)
+			}
+		}
+	}
+	c.seen[fileStorePath] = now
+	return false
+}
+
+/*
+ * Adds a file and evicts the least recently used ones if the cache is full
+ */
+func (c *memoryCache) add(fileStorePath string, data []byte, modTime time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Fetched by concurrent requests
+	c.remove(fileStorePath)
+
+	entry := &memoryCacheEntry{key: fileStorePath, data: data, modTime: modTime, lastUsed: time.Now()}
+	c.entries[fileStorePath] = c.lru.PushFront(entry)
+	c.size += int64(len(data))
+
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*memoryCacheEntry).key)
+	}
+	cacheSizeMetric.set(`cache="memory"`, float64(c.size))
+}
+
+/*
+ * Removes entries which have not been used within the window. Must be
+ * called with mutex held.
+ */
+func (c *memoryCache) expire(now time.Time) {
+	for c.lru.Len() > 0 {
+		entry := c.lru.Back().Value.(*memoryCacheEntry)
+		if now.Sub(entry.lastUsed) <= c.window {
+			break
+		}
+		c.remove(entry.key)
+	}
+}
+
+/*
+ * Removes an entry. Must be called with mutex held.
+ */
+func (c *memoryCache) remove(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.size -= int64(len(element.Value.(*memoryCacheEntry).data))
+	cacheSizeMetric.set(`cache="memory"`, float64(c.size))
+}
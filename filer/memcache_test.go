@@ -0,0 +1,85 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ * Files requested repeatedly must be served from memory
+ */
+func TestMemoryCache(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MemoryCacheSize = 1024 * 1024
+	s.conf.MemoryCacheWindow = time.Minute
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("hot file")
+	if status := s.uploadFile(t, "abc/hot.txt", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	download := func() int {
+		req, _ := http.NewRequest("GET", "/upload/abc/hot.txt", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK && !bytes.Equal(rr.Body.Bytes(), content) {
+			t.Errorf("download returned wrong content: %q", rr.Body.String())
+		}
+		return rr.Code
+	}
+
+	// Cached on the second request
+	download()
+	download()
+	if err := os.Remove(s.storagePath("abc/hot.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if status := download(); status != http.StatusOK {
+		t.Errorf("cached file has not been served: got %v want %v", status, http.StatusOK)
+	}
+
+	// Dropped after the window
+	cache := s.backend.(*memoryCachingBackend).cache
+	cache.mutex.Lock()
+	cache.lru.Front().Value.(*memoryCacheEntry).lastUsed = time.Now().Add(-2 * time.Minute)
+	cache.mutex.Unlock()
+	if status := download(); status != http.StatusNotFound {
+		t.Errorf("expired file has been served: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+/*
+ * Files requested only once must not be cached, and the cache must not
+ * grow beyond its size
+ */
+func TestMemoryCacheAdmission(t *testing.T) {
+	cache := newMemoryCache(10, time.Minute)
+
+	if cache.admit("a") {
+		t.Errorf("file requested once has been admitted")
+	}
+	if !cache.admit("a") {
+		t.Errorf("file requested twice has not been admitted")
+	}
+
+	cache.add("a", []byte("123456"), time.Now())
+	cache.add("b", []byte("123456"), time.Now())
+	if cache.open("a") != nil || cache.open("b") == nil {
+		t.Errorf("least recently used file has not been evicted")
+	}
+	if cache.size != 6 {
+		t.Errorf("wrong cache size: got %d want 6", cache.size)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Metadata backups
+ * Metadata (which expiry and limits depend on) and the short URL index are
+ * JSON files next to the stored files. With metadataBackupDir, they are
+ * archived periodically, e.g. to another disk, keeping the last
+ * metadataBackupKeep archives. Restore by extracting an archive into
+ * ".prosody-filer" (or clusterDir).
+ */
+
+package filer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var metadataBackupMetric = newGauge("prosody_filer_metadata_backup_last_success_timestamp_seconds", "Time the last metadata backup has been completed.")
+
+/*
+ * Backs up metadata every metadataBackupInterval, in a cluster only on the
+ * leader
+ */
+func (s *Server) startMetadataBackup() {
+	go func() {
+		ticker := time.NewTicker(s.conf.MetadataBackupInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.isClusterLeader() {
+				continue
+			}
+			if filename, err := s.backupMetadata(); err != nil {
+				log.Error(err)
+			} else {
+				log.Info("Backed up metadata to ", filename)
+			}
+		}
+	}()
+}
+
+/*
+ * Writes an archive of the metadata and short URL index to
+ * metadataBackupDir and removes old archives. Returns the archive's name.
+ */
+func (s *Server) backupMetadata() (string, error) {
+	if err := os.MkdirAll(s.conf.MetadataBackupDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create metadata backup directory: %s", err)
+	}
+
+	filename := filepath.Join(s.conf.MetadataBackupDir, "metadata-"+time.Now().UTC().Format("20060102T150405.000Z")+".tar.gz")
+	tmpFile, err := os.CreateTemp(s.conf.MetadataBackupDir, ".metadata-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create metadata backup: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	compressor := gzip.NewWriter(tmpFile)
+	archive := tar.NewWriter(compressor)
+	for _, dir := range []string{"meta", "short"} {
+		if err := archiveDir(archive, s.sharedPath(), dir); err != nil {
+			return "", fmt.Errorf("failed to back up metadata: %s", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", fmt.Errorf("failed to back up metadata: %s", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return "", fmt.Errorf("failed to back up metadata: %s", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", fmt.Errorf("failed to back up metadata: %s", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return "", fmt.Errorf("failed to back up metadata: %s", err)
+	}
+	metadataBackupMetric.set("", float64(time.Now().Unix()))
+
+	s.pruneMetadataBackups()
+	return filename, nil
+}
+
+/*
+ * Adds the files below root/dir to an archive, named relative to root
+ */
+func archiveDir(archive *tar.Writer, root string, dir string) error {
+	err := filepath.Walk(filepath.Join(root, dir), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relative)
+		if info.IsDir() {
+			header.Name += "/"
+			return archive.WriteHeader(header)
+		}
+
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = io.Copy(archive, file)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+/*
+ * Removes all but the newest metadataBackupKeep archives
+ */
+func (s *Server) pruneMetadataBackups() {
+	entries, err := os.ReadDir(s.conf.MetadataBackupDir)
+	if err != nil {
+		log.Error("Listing metadata backups failed: ", err)
+		return
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "metadata-") && strings.HasSuffix(entry.Name(), ".tar.gz") {
+			backups = append(backups, entry.Name())
+		}
+	}
+	// Names sort by time
+	sort.Strings(backups)
+	for len(backups) > s.conf.MetadataBackupKeep {
+		if err := os.Remove(filepath.Join(s.conf.MetadataBackupDir, backups[0])); err != nil {
+			log.Error("Removing old metadata backup failed: ", err)
+		}
+		backups = backups[1:]
+	}
+}
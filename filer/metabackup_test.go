@@ -0,0 +1,59 @@
+package filer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Metadata is archived and only the newest archives are kept
+ */
+func TestMetadataBackup(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MetadataBackupDir = t.TempDir()
+	s.conf.MetadataBackupKeep = 2
+	s.uploadFile(t, "abc/backed up.txt", []byte("content"))
+
+	var filename string
+	for i := 0; i < 3; i++ {
+		var err error
+		if filename, err = s.backupMetadata(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backups, _ := filepath.Glob(filepath.Join(s.conf.MetadataBackupDir, "*")); len(backups) != 2 {
+		t.Errorf("got %d files in backup directory want 2: %v", len(backups), backups)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(decompressor)
+	names := map[string]bool{}
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		names[header.Name] = true
+	}
+
+	metaFilename, _ := filepath.Rel(s.sharedPath(), s.metadataPath("abc/backed up.txt"))
+	if !names[filepath.ToSlash(metaFilename)] {
+		t.Errorf("metadata of upload missing in archive: %v", names)
+	}
+}
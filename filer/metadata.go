@@ -0,0 +1,135 @@
+/*
+ * Per-file metadata
+ * Stored as JSON next to the internal directory's copy of the upload path,
+ * e.g. uploads of "abc/cat.jpg" have their metadata in
+ * ".prosody-filer/meta/abc/cat.jpg.json".
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Information about a stored file
+ */
+type fileMetadata struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	SHA256      string    `json:"sha256"`
+	MD5         string    `json:"md5,omitempty"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+
+	// File name the client knows the file by, if it is stored under another one
+	Name string `json:"name,omitempty"`
+
+	// Size and SHA-256 hash of the upload as received, if it has been modified by filters before storing it
+	OriginalSize   int64  `json:"originalSize,omitempty"`
+	OriginalSHA256 string `json:"originalSHA256,omitempty"`
+
+	// Set if the image has been downscaled
+	Recompressed *recompressInfo `json:"recompressed,omitempty"`
+
+	// Set if the file is a hard link to an identical, previously stored file
+	Deduplicated bool `json:"deduplicated,omitempty"`
+
+	// Alias below shortURLSubDir
+	ShortURL string `json:"shortURL,omitempty"`
+
+	// Added by plugins
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Tenant of the upload, see tenants
+	Tenant string `json:"tenant,omitempty"`
+
+	// Requested with the exp parameter of the upload URL
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Downloads after which the file expires, see maxDownloads, and downloads so far
+	MaxDownloads int64 `json:"maxDownloads,omitempty"`
+	Downloads    int64 `json:"downloads,omitempty"`
+}
+
+func (s *Server) metadataPath(fileStorePath string) string {
+	return s.sharedPath("meta", filepath.FromSlash(fileStorePath)+".json")
+}
+
+/*
+ * Writes the metadata of a stored file
+ */
+func (s *Server) writeMetadata(meta fileMetadata) error {
+	filename := s.metadataPath(meta.Path)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %s", err)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so readers never see partial metadata
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata of %s: %s", meta.Path, err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("failed to write metadata of %s: %s", meta.Path, err)
+	}
+
+	return nil
+}
+
+/*
+ * Reads the metadata of a stored file
+ */
+func (s *Server) readMetadata(fileStorePath string) (fileMetadata, error) {
+	var meta fileMetadata
+
+	data, err := os.ReadFile(s.metadataPath(fileStorePath))
+	if err != nil {
+		return meta, err
+	}
+
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+/*
+ * Calculates the hex encoded SHA-256 hash of a stored file's contents
+ */
+func (s *Server) hashFile(filename string) (string, error) {
+	file, err := s.openStoredFile(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", filename, err)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+/*
+ * Returns a strong ETag for a stored file: its content hash if it is known,
+ * otherwise size and modification time
+ */
+func fileETag(meta fileMetadata, file *storedFile) string {
+	if meta.SHA256 != "" && meta.Size == file.size {
+		return `"` + meta.SHA256 + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, file.size, file.modTime.UnixNano())
+}
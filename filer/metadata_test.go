@@ -0,0 +1,112 @@
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+/*
+ * Check that metadata is written for uploads
+ */
+func TestUploadMetadata(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.uploadCatmetal(t)
+
+	meta, err := s.readMetadata("thomas/abc/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(catMetalFile)
+
+	if meta.Size != int64(len(catMetalFile)) || meta.SHA256 != hex.EncodeToString(sum[:]) || meta.ContentType != "image/jpeg" || meta.OriginalSize != 0 {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+}
+
+/*
+ * Downloads must carry an ETag and honor If-None-Match
+ */
+func TestETag(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	rr := s.getCatmetal(t)
+	etag := rr.Header().Get("ETag")
+	meta, _ := s.readMetadata("thomas/abc/catmetal.jpg")
+	if etag != `"`+meta.SHA256+`"` {
+		t.Fatalf("wrong ETag: got %s want content hash %s", etag, meta.SHA256)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		for ifNoneMatch, want := range map[string]int{
+			etag:               http.StatusNotModified,
+			`"other", ` + etag: http.StatusNotModified,
+			"W/" + etag:        http.StatusNotModified,
+			`"something-else"`: http.StatusOK,
+		} {
+			req, _ := http.NewRequest(method, "/upload/thomas/abc/catmetal.jpg", nil)
+			req.Header.Set("If-None-Match", ifNoneMatch)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+			if rr.Code != want {
+				t.Errorf("%s with If-None-Match %s returned wrong status code: got %v want %v", method, ifNoneMatch, rr.Code, want)
+			}
+		}
+	}
+
+	// Files without metadata get an ETag from size and modification time
+	os.Remove(s.metadataPath("thomas/abc/catmetal.jpg"))
+	if rr := s.getCatmetal(t); rr.Header().Get("ETag") == "" || rr.Header().Get("ETag") == etag {
+		t.Errorf("wrong ETag for file without metadata: %s", rr.Header().Get("ETag"))
+	}
+}
+
+/*
+ * Downloads must carry the configured Cache-Control header, errors must not
+ */
+func TestCacheControl(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.CacheControl = "public, max-age=31536000, immutable"
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	if got := s.getCatmetal(t).Header().Get("Cache-Control"); got != s.conf.CacheControl {
+		t.Errorf("wrong Cache-Control: got %q want %q", got, s.conf.CacheControl)
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/thomas/abc/missing.jpg", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if got := rr.Header().Get("Cache-Control"); got != "" {
+		t.Errorf("404 response must not be cacheable: %q", got)
+	}
+}
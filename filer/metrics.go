@@ -0,0 +1,217 @@
+/*
+ * Metrics
+ * Served in the Prometheus text format by the admin API at /metrics.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+ * A metric with optional labels. Values are kept per label set, formatted
+ * as in the exposition format, e.g. `result="ok"`. Histograms keep their
+ * observations in buckets instead of values.
+ */
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+
+	mutex      sync.Mutex
+	values     map[string]float64
+	histograms map[string]*histogramValues
+}
+
+/*
+ * Observations of a histogram for one label set. counts[i] is the number
+ * of observations up to buckets[i], not cumulative.
+ */
+type histogramValues struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Buckets of size histograms, 1 kB to 1 GB
+var sizeBuckets = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9}
+
+// Buckets of latency histograms in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var metricsMutex sync.Mutex
+var registeredMetrics []*metric
+
+func registerMetric(name string, kind string, help string) *metric {
+	m := &metric{name: name, help: help, kind: kind, values: make(map[string]float64), histograms: make(map[string]*histogramValues)}
+
+	metricsMutex.Lock()
+	registeredMetrics = append(registeredMetrics, m)
+	metricsMutex.Unlock()
+
+	return m
+}
+
+func newCounter(name string, help string) *metric {
+	return registerMetric(name, "counter", help)
+}
+
+func newGauge(name string, help string) *metric {
+	return registerMetric(name, "gauge", help)
+}
+
+/*
+ * Registers a histogram with the given upper bounds of buckets, ascending
+ */
+func newHistogram(name string, help string, buckets []float64) *metric {
+	m := registerMetric(name, "histogram", help)
+	m.buckets = buckets
+	return m
+}
+
+/*
+ * Adds to the value for the given labels
+ */
+func (m *metric) add(labels string, value float64) {
+	m.mutex.Lock()
+	m.values[labels] += value
+	m.mutex.Unlock()
+}
+
+/*
+ * Sets the value for the given labels
+ */
+func (m *metric) set(labels string, value float64) {
+	m.mutex.Lock()
+	m.values[labels] = value
+	m.mutex.Unlock()
+}
+
+/*
+ * Removes the values for all labels
+ */
+func (m *metric) reset() {
+	m.mutex.Lock()
+	m.values = make(map[string]float64)
+	m.histograms = make(map[string]*histogramValues)
+	m.mutex.Unlock()
+}
+
+/*
+ * Counts an observation of a histogram for the given labels
+ */
+func (m *metric) observe(labels string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	values, ok := m.histograms[labels]
+	if !ok {
+		values = &histogramValues{counts: make([]uint64, len(m.buckets))}
+		m.histograms[labels] = values
+	}
+	for i, bound := range m.buckets {
+		if value <= bound {
+			values.counts[i]++
+			break
+		}
+	}
+	values.count++
+	values.sum += value
+}
+
+/*
+ * Returns the value for the given labels
+ */
+func (m *metric) get(labels string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.values[labels]
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.kind == "histogram" {
+		m.writeHistograms(w)
+		return
+	}
+
+	labelSets := make([]string, 0, len(m.values))
+	for labels := range m.values {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+
+	for _, labels := range labelSets {
+		value := strconv.FormatFloat(m.values[labels], 'g', -1, 64)
+		if labels == "" {
+			fmt.Fprintf(w, "%s %s\n", m.name, value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, labels, value)
+		}
+	}
+}
+
+/*
+ * Writes cumulative buckets, sum and count of every label set
+ */
+func (m *metric) writeHistograms(w io.Writer) {
+	labelSets := make([]string, 0, len(m.histograms))
+	for labels := range m.histograms {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+
+	for _, labels := range labelSets {
+		values := m.histograms[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += values.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", m.name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", m.name, prefix, values.count)
+
+		sum := strconv.FormatFloat(values.sum, 'g', -1, 64)
+		if labels == "" {
+			fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", m.name, sum, m.name, values.count)
+		} else {
+			fmt.Fprintf(w, "%s_sum{%s} %s\n%s_count{%s} %d\n", m.name, labels, sum, m.name, labels, values.count)
+		}
+	}
+}
+
+/*
+ * Writes all metrics in the Prometheus text format
+ */
+func writeMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	for _, m := range registeredMetrics {
+		m.write(w)
+	}
+}
+
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -0,0 +1,68 @@
+package filer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+ * Metrics must be served in the Prometheus text format
+ */
+func TestAdminMetrics(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.AdminToken = "secret-admin-token"
+
+	m := newCounter("prosody_filer_test_total", "Test counter.")
+	m.add(`result="ok"`, 2)
+	m.add(`result="ok"`, 1)
+
+	rr := s.adminRequest(t, "GET", "/metrics")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("metrics returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE prosody_filer_test_total counter\n",
+		"prosody_filer_test_total{result=\"ok\"} 3\n",
+		"# TYPE prosody_filer_scrub_corrupt_files gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+/*
+ * Histograms are written with cumulative buckets, sum and count
+ */
+func TestHistogram(t *testing.T) {
+	m := newHistogram("prosody_filer_test_seconds", "Test histogram.", []float64{0.1, 1})
+	m.observe(`method="GET"`, 0.05)
+	m.observe(`method="GET"`, 0.5)
+	m.observe(`method="GET"`, 5)
+
+	output := new(strings.Builder)
+	m.write(output)
+	want := `# HELP prosody_filer_test_seconds Test histogram.
+# TYPE prosody_filer_test_seconds histogram
+prosody_filer_test_seconds_bucket{method="GET",le="0.1"} 1
+prosody_filer_test_seconds_bucket{method="GET",le="1"} 2
+prosody_filer_test_seconds_bucket{method="GET",le="+Inf"} 3
+prosody_filer_test_seconds_sum{method="GET"} 5.55
+prosody_filer_test_seconds_count{method="GET"} 3
+`
+	if output.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", output.String(), want)
+	}
+
+	// Requests are observed by the metrics middleware
+	s := newTestServer(t)
+	defer s.cleanup()
+	s.uploadFile(t, "abc/histogram.txt", []byte("observed"))
+	if uploadSizeMetric.histograms[""] == nil || requestDurationMetric.histograms[`method="PUT",code="201"`] == nil {
+		t.Errorf("upload not observed")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Middleware
+ * Processing shared by all public requests, like logging, bans and CORS
+ * headers, wraps the handlers in the order given by the middleware setting.
+ * Middleware listed first sees requests first and responses last.
+ * Authentication depends on the request and is done by the handlers.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	requestsMetric        = newCounter("prosody_filer_requests_total", "Public requests, by method, status code and tenant.")
+	requestDurationMetric = newHistogram("prosody_filer_request_duration_seconds", "Duration of public requests, by method, status code and tenant.", latencyBuckets)
+	downloadSizeMetric    = newHistogram("prosody_filer_download_size_bytes", "Bytes sent by successful downloads, including range requests.", sizeBuckets)
+)
+
+type middleware func(next http.Handler) http.Handler
+
+var middlewares = map[string]func(s *Server) middleware{
+	"log":        (*Server).logMiddleware,
+	"metrics":    (*Server).metricsMiddleware,
+	"errorPages": (*Server).errorPagesMiddleware,
+	"bans":       (*Server).bansMiddleware,
+	"crowdsec":   (*Server).crowdsecMiddleware,
+	"rateLimit":  (*Server).rateLimitMiddleware,
+	"cors":       (*Server).corsMiddleware,
+}
+
+/*
+ * Wraps handler in the configured middleware
+ */
+func (s *Server) withMiddleware(handler http.Handler) http.Handler {
+	for i := len(s.conf.Middleware) - 1; i >= 0; i-- {
+		handler = middlewares[s.conf.Middleware[i]](s)(handler)
+	}
+	return handler
+}
+
+func (s *Server) logMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fields := logrus.Fields{}
+			if tenant := s.urlTenant(r); tenant != "" {
+				fields["tenant"] = tenant
+			}
+			log.WithFields(fields).Info("Incoming request: ", r.Method, " ", s.requestScheme(r), "://", s.requestHost(r), r.URL.String())
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) metricsMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(recorder, r)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			labels := fmt.Sprintf(`method=%q,code="%d"`, r.Method, recorder.status) + tenantLabel(s.urlTenant(r))
+			requestsMetric.add(labels, 1)
+			requestDurationMetric.observe(labels, time.Since(started).Seconds())
+			if r.Method == http.MethodGet && (recorder.status == http.StatusOK || recorder.status == http.StatusPartialContent) {
+				downloadSizeMetric.observe("", float64(recorder.written))
+			}
+		})
+	}
+}
+
+func (s *Server) errorPagesMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w, flush := s.withErrorBodies(w, r)
+			next.ServeHTTP(s.withErrorPages(w, r), r)
+			flush()
+		})
+	}
+}
+
+func (s *Server) bansMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.rejectBanned(w, r) && !s.rejectHoneypot(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func (s *Server) rateLimitMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.rejectRateLimited(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func (s *Server) corsMiddleware() middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addCORSheaders(w)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+ * Remembers the status code and size of a response
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+/*
+ * Keeps sendfile working for downloads
+ */
+func (s *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if readerFrom, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{s.ResponseWriter}, src)
+	}
+	s.written += n
+	return n, err
+}
+
+/*
+ * Tokens of a client for rateLimit
+ */
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+/*
+ * Refuses requests of clients exceeding rateLimit. Every client may send
+ * rateLimitBurst requests at once, refilled at rateLimit per second.
+ */
+func (s *Server) rejectRateLimited(w http.ResponseWriter, r *http.Request) bool {
+	if s.conf.RateLimit <= 0 {
+		return false
+	}
+
+	client := s.clientIP(r)
+	now := time.Now()
+	burst := float64(s.conf.RateLimitBurst)
+
+	s.rateLimits.Lock()
+	// Forget clients with full buckets now and then
+	if len(s.rateLimits.buckets) >= 10000 {
+		for key, bucket := range s.rateLimits.buckets {
+			if bucket.tokens+now.Sub(bucket.updated).Seconds()*s.conf.RateLimit >= burst {
+				delete(s.rateLimits.buckets, key)
+			}
+		}
+	}
+	bucket, ok := s.rateLimits.buckets[client]
+	if !ok {
+		bucket = &rateBucket{tokens: burst, updated: now}
+		s.rateLimits.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*s.conf.RateLimit)
+	bucket.updated = now
+	limited := bucket.tokens < 1
+	if !limited {
+		bucket.tokens--
+	}
+	missing := 1 - bucket.tokens
+	s.rateLimits.Unlock()
+
+	if !limited {
+		return false
+	}
+	log.Warn("Rate limit exceeded by ", client)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(missing/s.conf.RateLimit))))
+	httpError(w, http.StatusTooManyRequests, "")
+	return true
+}
@@ -0,0 +1,68 @@
+package filer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+ * Only the configured middleware is applied
+ */
+func TestMiddlewareConfig(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	created := requestsMetric.get(`method="PUT",code="201"`)
+	if rr := s.uploadFile(t, "abc/cors.txt", []byte("cors")); rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("CORS headers missing with default middleware: %v", rr.Header())
+	}
+	if count := requestsMetric.get(`method="PUT",code="201"`); count != created+1 {
+		t.Errorf("requests metric: got %v want %v", count, created+1)
+	}
+
+	s.conf.Middleware = []string{"log"}
+	if rr := s.uploadFile(t, "abc/nocors.txt", []byte("no cors")); rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("CORS headers sent without cors middleware: %v", rr.Header())
+	}
+	if count := requestsMetric.get(`method="PUT",code="201"`); count != created+1 {
+		t.Errorf("requests counted without metrics middleware: got %v want %v", count, created+1)
+	}
+}
+
+/*
+ * Clients may send rateLimitBurst requests at once, then rateLimit per second
+ */
+func TestRateLimit(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.RateLimit = 1
+	s.conf.RateLimitBurst = 2
+	get := func(remoteAddr string) *http.Response {
+		req, _ := http.NewRequest("GET", "/upload/abc/missing.jpg", nil)
+		req.RemoteAddr = remoteAddr
+		return s.serveUpload(req).Result()
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get("192.0.2.1:4711"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("request %d: got %v want %v", i, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+	resp := get("192.0.2.1:4712")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Errorf("request over limit: got %v, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := get("192.0.2.2:4711"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request of other client: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Refilled over time
+	s.rateLimits.buckets["192.0.2.1"].updated = time.Now().Add(-time.Second)
+	if resp := get("192.0.2.1:4711"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request after a second: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+ * "migrate" command: copies all stored files from one storage backend to
+ * another, e.g. from storeDir to S3 before switching storageBackend:
+ *
+ *   prosody-filer migrate -from local -to s3://bucket/prefix
+ *
+ * Backends are "local" (storeDir in the configured storageLayout), "s3"
+ * (the configured bucket) or "s3://bucket/prefix" (another bucket or
+ * prefix at the configured endpoint, with the configured credentials).
+ * Like the scrubber, it copies all files which have metadata. Metadata
+ * stays in storeDir (or clusterDir) with any backend, so it is not copied.
+ * Files are copied as stored, i.e. still compressed or encrypted, and read
+ * back to verify them. Migrated paths are appended to a log in the internal
+ * directory, so an interrupted migration continues where it stopped.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Result of a migration run
+ */
+type migrationResult struct {
+	Copied  int
+	Skipped int
+	Failed  int
+	Bytes   int64
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	from := flags.String("from", "local", "Backend to copy files from: \"local\", \"s3\" or \"s3://bucket/prefix\".")
+	to := flags.String("to", "", "Backend to copy files to: \"local\", \"s3\" or \"s3://bucket/prefix\".")
+	verify := flags.Bool("verify", true, "Read back every copied file and compare it with the original.")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if *to == "" {
+		return errors.New("-to is required")
+	} else if *from == *to {
+		return errors.New("-from and -to must be different backends")
+	}
+	source, err := s.migrationBackend(*from)
+	if err != nil {
+		return err
+	}
+	target, err := s.migrationBackend(*to)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(*from + " " + *to))
+	logFilename := s.internalPath("migrate", hex.EncodeToString(hash[:8])+".log")
+	log.Infof("Migrating files from %s to %s, progress is kept in %s", *from, *to, logFilename)
+	result, err := s.migrateStore(source, target, logFilename, *verify)
+	log.Infof("Copied %d files (%s), %d already migrated, %d failed", result.Copied, formatSize(result.Bytes), result.Skipped, result.Failed)
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("failed to migrate %d files, run the command again to retry them", result.Failed)
+	}
+	return err
+}
+
+/*
+ * Returns the storage backend described by spec, without caches or
+ * failover
+ */
+func (s *Server) migrationBackend(spec string) (storage.Backend, error) {
+	switch {
+	case spec == "local":
+		return localBackend{s}, nil
+	case spec == "s3":
+		return storage.NewS3(s.s3Config())
+	case strings.HasPrefix(spec, "s3://"):
+		config := s.s3Config()
+		parts := strings.SplitN(strings.TrimPrefix(spec, "s3://"), "/", 2)
+		config.Bucket, config.Prefix = parts[0], ""
+		if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+			config.Prefix = strings.Trim(parts[1], "/") + "/"
+		}
+		if config.Bucket == "" {
+			return nil, fmt.Errorf("invalid backend %q: bucket is missing", spec)
+		}
+		return storage.NewS3(config)
+	}
+	return nil, fmt.Errorf("invalid backend %q: must be \"local\", \"s3\" or \"s3://bucket/prefix\"", spec)
+}
+
+/*
+ * Copies all files with metadata from source to target, skipping the paths
+ * in the log at logFilename and appending the migrated ones
+ */
+func (s *Server) migrateStore(source storage.Backend, target storage.Backend, logFilename string, verify bool) (migrationResult, error) {
+	var result migrationResult
+
+	// Paths are quoted, they may contain line breaks
+	migrated := make(map[string]bool)
+	if logFile, err := os.Open(logFilename); err == nil {
+		scanner := bufio.NewScanner(logFile)
+		for scanner.Scan() {
+			if fileStorePath, err := strconv.Unquote(scanner.Text()); err == nil {
+				migrated[fileStorePath] = true
+			}
+		}
+		logFile.Close()
+	} else if !os.IsNotExist(err) {
+		return result, err
+	}
+	if err := os.MkdirAll(filepath.Dir(logFilename), os.ModePerm); err != nil {
+		return result, err
+	}
+	logFile, err := os.OpenFile(logFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return result, err
+	}
+	defer logFile.Close()
+
+	err = filepath.Walk(s.sharedPath("meta"), func(metaFilename string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(metaFilename, ".json") {
+			return nil
+		}
+
+		data, err := os.ReadFile(metaFilename)
+		if err != nil {
+			return err
+		}
+		var meta fileMetadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			log.Errorf("Invalid metadata %s: %s", metaFilename, err)
+			result.Failed++
+			return nil
+		}
+		if migrated[meta.Path] {
+			result.Skipped++
+			return nil
+		}
+
+		size, err := s.migrateFile(source, target, meta, verify)
+		if err != nil {
+			log.Error(err)
+			result.Failed++
+			return nil
+		}
+		if _, err := fmt.Fprintln(logFile, strconv.Quote(meta.Path)); err != nil {
+			return err
+		}
+		result.Copied++
+		result.Bytes += size
+		if result.Copied%1000 == 0 {
+			log.Infof("Copied %d files (%s)", result.Copied, formatSize(result.Bytes))
+		}
+		return nil
+	})
+	return result, err
+}
+
+/*
+ * Copies a stored file from source to target. Files which exist at the
+ * target already, e.g. copied before an interruption, are compared instead.
+ * Returns the number of bytes copied.
+ */
+func (s *Server) migrateFile(source storage.Backend, target storage.Backend, meta fileMetadata, verify bool) (int64, error) {
+	file, err := source.Open(meta.Path)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%s has metadata, but is missing", meta.Path)
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %s", meta.Path, err)
+	}
+	defer file.Close()
+
+	tmpFile, err := s.createTempFile()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	hasher := sha256.New()
+	size, err := copyBuffered(io.MultiWriter(tmpFile, hasher), file)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s: %s", meta.Path, err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	_, err = target.Commit(tmpFile.Name(), meta.Path, meta.SHA256)
+	if err == storage.ErrExists {
+		log.Info(meta.Path, " exists at the destination already, comparing it")
+		size, verify = 0, true
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to store %s: %s", meta.Path, err)
+	}
+	if verify {
+		if err := verifyMigratedFile(target, meta.Path, hash); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+/*
+ * Compares a file at the destination of a migration with the SHA-256 hash
+ * of its stored contents
+ */
+func verifyMigratedFile(target storage.Backend, fileStorePath string, hash string) error {
+	file, err := target.Open(fileStorePath)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %s", fileStorePath, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := copyBuffered(hasher, file); err != nil {
+		return fmt.Errorf("failed to verify %s: %s", fileStorePath, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return fmt.Errorf("%s differs at the destination", fileStorePath)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package filer
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage/s3test"
+)
+
+/*
+ * Migrate files from storeDir to S3, continuing after an interruption
+ */
+func TestMigrate(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	fake := s3test.NewServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s.conf.S3Endpoint = server.URL
+	s.conf.S3AccessKey = "access"
+	s.conf.S3SecretKey = "secret"
+	s.conf.S3PathStyle = true
+
+	files := map[string]string{"abc/one.txt": "one", "abc/two.txt": "two", "def/three.txt": "three"}
+	for fileStorePath, content := range files {
+		s.uploadFile(t, fileStorePath, []byte(content))
+	}
+
+	source, err := s.migrationBackend("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := s.migrationBackend("s3://archive/migrated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFilename := s.internalPath("migrate", "test.log")
+
+	result, err := s.migrateStore(source, target, logFilename, true)
+	if err != nil || result.Copied != len(files) || result.Failed != 0 || result.Bytes != 11 {
+		t.Fatalf("migration: got %+v, %v", result, err)
+	}
+	for fileStorePath, content := range files {
+		if object := fake.Objects["/archive/migrated/"+fileStorePath]; string(object) != content {
+			t.Errorf("object of %s: got %q want %q", fileStorePath, object, content)
+		}
+	}
+
+	// Migrated files are skipped when the command is run again
+	if result, err := s.migrateStore(source, target, logFilename, true); err != nil || result.Skipped != len(files) || result.Copied != 0 {
+		t.Errorf("repeated migration: got %+v, %v", result, err)
+	}
+
+	// Without the log, existing files are compared
+	os.Remove(logFilename)
+	fake.Objects["/archive/migrated/abc/two.txt"] = []byte("TWO")
+	if result, err := s.migrateStore(source, target, logFilename, true); err != nil || result.Copied != len(files)-1 || result.Failed != 1 || result.Bytes != 0 {
+		t.Errorf("migration to existing files: got %+v, %v", result, err)
+	}
+
+	for _, spec := range []string{"s3://", "ftp://example.com/", "S3"} {
+		if _, err := s.migrationBackend(spec); err == nil {
+			t.Errorf("invalid backend %q accepted", spec)
+		}
+	}
+}
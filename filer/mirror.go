@@ -0,0 +1,218 @@
+/*
+ * Mirroring uploads
+ * Every upload is copied to mirrorURL in the background, for a warm standby:
+ * another filer, which receives it as a regular upload signed with
+ * mirrorSecret, or a directory. Uploads waiting to be copied are kept in
+ * ".prosody-filer/mirror", so they are retried after failures and restarts.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+)
+
+var (
+	mirrorPendingMetric  = newGauge("prosody_filer_mirror_pending", "Uploads which could not be copied to mirrorURL yet.")
+	mirrorFailuresMetric = newCounter("prosody_filer_mirror_failures_total", "Failed attempts to copy an upload to mirrorURL.")
+)
+
+const mirrorRetryInterval = time.Minute
+
+/*
+ * Copies uploads to mirrorURL, retrying failed copies every
+ * mirrorRetryInterval
+ */
+func (s *Server) startMirror() {
+	wake := make(chan struct{}, 1)
+	s.subscribeEvents(func(event fileEvent) {
+		if event.Type != "upload" {
+			return
+		}
+		if err := s.queueMirror(event.Path); err != nil {
+			log.Error(err)
+			mirrorFailuresMetric.add("", 1)
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})
+
+	client := &http.Client{Timeout: s.conf.MirrorTimeout}
+	go func() {
+		for {
+			if s.processMirrorQueue(client) > 0 {
+				select {
+				case <-wake:
+				case <-time.After(mirrorRetryInterval):
+				}
+			} else {
+				<-wake
+			}
+		}
+	}()
+}
+
+/*
+ * Remembers that fileStorePath has to be copied
+ */
+func (s *Server) queueMirror(fileStorePath string) error {
+	if err := os.MkdirAll(s.internalPath("mirror"), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create mirror queue directory: %s", err)
+	}
+
+	filename := s.internalPath("mirror", partialID(fileStorePath))
+	if err := os.WriteFile(filename+".tmp", []byte(fileStorePath), 0600); err != nil {
+		return fmt.Errorf("failed to queue %s for mirroring: %s", fileStorePath, err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		os.Remove(filename + ".tmp")
+		return fmt.Errorf("failed to queue %s for mirroring: %s", fileStorePath, err)
+	}
+	return nil
+}
+
+/*
+ * Copies all queued uploads. Returns the number of failed copies, which
+ * stay queued.
+ */
+func (s *Server) processMirrorQueue(client *http.Client) int {
+	entries, err := os.ReadDir(s.internalPath("mirror"))
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("Reading mirror queue failed: ", err)
+		return 1
+	}
+
+	failed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		filename := s.internalPath("mirror", entry.Name())
+		fileStorePath, err := os.ReadFile(filename)
+		if err != nil {
+			log.Error("Reading mirror queue failed: ", err)
+			failed++
+			continue
+		}
+
+		// Files deleted in the meantime don't need to be copied anymore
+		err = s.mirrorFile(client, string(fileStorePath))
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("Mirroring ", string(fileStorePath), " failed: ", err)
+			mirrorFailuresMetric.add("", 1)
+			failed++
+			continue
+		}
+		os.Remove(filename)
+	}
+
+	mirrorPendingMetric.set("", float64(failed))
+	return failed
+}
+
+/*
+ * Copies a stored file to mirrorURL
+ */
+func (s *Server) mirrorFile(client *http.Client, fileStorePath string) error {
+	meta, err := s.readMetadata(fileStorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if meta.expired() {
+		return nil
+	}
+
+	file, err := s.openBackendFile(fileStorePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.HasPrefix(s.conf.MirrorURL, "file://") {
+		return copyToMirrorDir(strings.TrimPrefix(s.conf.MirrorURL, "file://"), fileStorePath, file.content())
+	}
+
+	secret := s.conf.MirrorSecret
+	if secret == "" {
+		secret = s.conf.Secret
+	}
+	var expires int64
+	if meta.Expires != nil {
+		expires = meta.Expires.Unix()
+	}
+	contentType := extensionContentType(fileStorePath)
+	target := strings.TrimSuffix(s.conf.MirrorURL, "/") + "/" + (&url.URL{Path: fileStorePath}).EscapedPath() +
+		"?v2=" + hmacauth.Sign(secret, "v2", fileStorePath, file.size, contentType, expires, meta.MaxDownloads)
+	if expires != 0 {
+		target += "&exp=" + strconv.FormatInt(expires, 10)
+	}
+	if meta.MaxDownloads != 0 {
+		target += "&maxdl=" + strconv.FormatInt(meta.MaxDownloads, 10)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, target, io.NopCloser(file.content()))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = file.size
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "prosody-filer/"+Version)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Conflict: copied by an earlier attempt
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+ * Writes the content of a file below dir, unless it exists already
+ */
+func copyToMirrorDir(dir string, fileStorePath string, content io.Reader) error {
+	filename := filepath.Join(dir, filepath.FromSlash(fileStorePath))
+	if _, err := os.Lstat(filename); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(tmpFile, content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+	return err
+}
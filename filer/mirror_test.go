@@ -0,0 +1,77 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Uploads are copied to a secondary filer, also after it has been unreachable
+ */
+func TestMirrorToFiler(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	secondary := newTestServer(t)
+	secondary.conf.StoreDir = t.TempDir()
+	standby := httptest.NewServer(http.HandlerFunc(secondary.handleRequest))
+	defer standby.Close()
+
+	// Set config
+	s.conf.MirrorURL = "http://127.0.0.1:1/upload/"
+	content := []byte("copied to the standby")
+	s.uploadFile(t, "abc/mirrored file.txt", content)
+	if err := s.queueMirror("abc/mirrored file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := s.processMirrorQueue(http.DefaultClient); failed != 1 {
+		t.Errorf("copies to unreachable mirror: got %d failures want 1", failed)
+	}
+
+	s.conf.MirrorURL = standby.URL + "/upload/"
+	if failed := s.processMirrorQueue(http.DefaultClient); failed != 0 {
+		t.Errorf("copies to mirror: got %d failures want 0", failed)
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/mirrored%20file.txt", nil)
+	if rr := secondary.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download from mirror: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	// Copied only once
+	entries, _ := os.ReadDir(s.internalPath("mirror"))
+	if len(entries) != 0 {
+		t.Errorf("%d uploads left in mirror queue", len(entries))
+	}
+}
+
+/*
+ * Uploads are copied to a directory
+ */
+func TestMirrorToDirectory(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	dir := t.TempDir()
+	s.conf.MirrorURL = "file://" + dir
+	content := []byte("copied to a directory")
+	s.uploadFile(t, "abc/mirrored.txt", content)
+	s.queueMirror("abc/mirrored.txt")
+	s.queueMirror("abc/deleted.txt")
+
+	if failed := s.processMirrorQueue(http.DefaultClient); failed != 0 {
+		t.Errorf("copies to directory: got %d failures want 0", failed)
+	}
+	if copied, err := os.ReadFile(filepath.Join(dir, "abc", "mirrored.txt")); err != nil || !bytes.Equal(copied, content) {
+		t.Errorf("copy in directory: got %q, %v", copied, err)
+	}
+}
@@ -0,0 +1,122 @@
+package filer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+/*
+ * Reads a packet, returning its type and the rest of it
+ */
+func readMqttPacket(reader *bufio.Reader) (byte, []byte, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	rest := make([]byte, length)
+	_, err = io.ReadFull(reader, rest)
+	return packetType, rest, err
+}
+
+/*
+ * Publish a message to a fake MQTT broker
+ */
+func TestMqttPublish(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type packet struct {
+		packetType byte
+		rest       []byte
+	}
+	received := make(chan packet, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			packetType, rest, err := readMqttPacket(reader)
+			if err != nil {
+				break
+			}
+			if packetType == mqttConnect {
+				conn.Write([]byte{mqttConnack, 2, 0, 0})
+			}
+			received <- packet{packetType, rest}
+		}
+	}()
+
+	client, err := newMqttClient("mqtt://filer:pass@" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	if err := client.publish("prosody-filer/upload", []byte(`{"type":"upload"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := <-received
+	if connect.packetType != mqttConnect || !bytes.HasPrefix(connect.rest, []byte("\x00\x04MQTT\x04\xc2")) ||
+		!bytes.HasSuffix(connect.rest, []byte("\x00\x05filer\x00\x04pass")) {
+		t.Errorf("unexpected CONNECT %q", connect.rest)
+	}
+	publish := <-received
+	if publish.packetType != mqttPublish || string(publish.rest) != "\x00\x14prosody-filer/upload{\"type\":\"upload\"}" {
+		t.Errorf("unexpected PUBLISH %q", publish.rest)
+	}
+}
+
+func TestMqttRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		readMqttPacket(bufio.NewReader(conn))
+		// Bad user name or password
+		conn.Write([]byte{mqttConnack, 2, 0, 4})
+	}()
+
+	client, _ := newMqttClient("mqtt://" + listener.Addr().String())
+	if err := client.publish("test", []byte("test")); err == nil {
+		t.Error("refused connection has not been reported")
+	}
+}
+
+func TestMqttPacket(t *testing.T) {
+	packet := mqttPacket(mqttPublish, make([]byte, 200))
+	if !bytes.Equal(packet[:3], []byte{mqttPublish, 0xc8, 0x01}) || len(packet) != 203 {
+		t.Errorf("unexpected header %x", packet[:3])
+	}
+}
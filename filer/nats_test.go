@@ -0,0 +1,137 @@
+package filer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+/*
+ * Publish a message to a fake NATS server
+ */
+func TestNatsPublish(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for len(lines) < 4 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimSuffix(line, "\r\n")
+			if line == "PING" {
+				conn.Write([]byte("PONG\r\n"))
+			}
+			lines = append(lines, line)
+		}
+		received <- lines
+	}()
+
+	client, err := newNatsClient("nats://s3cr3t@" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	if err := client.publish("prosody-filer.upload", []byte(`{"type":"upload"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-received
+	if len(lines) != 4 {
+		t.Fatalf("got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "CONNECT ") || !strings.Contains(lines[0], `"auth_token":"s3cr3t"`) {
+		t.Errorf("unexpected CONNECT %q", lines[0])
+	}
+	if lines[2] != "PUB prosody-filer.upload 17" || lines[3] != `{"type":"upload"}` {
+		t.Errorf("unexpected message %q", lines[2:])
+	}
+}
+
+func TestNatsAuthorizationError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {}\r\n"))
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	}()
+
+	client, _ := newNatsClient("nats://" + listener.Addr().String())
+	if err := client.publish("test", []byte("test")); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("got error %v", err)
+	}
+
+	if _, err := newNatsClient("http://localhost"); err == nil {
+		t.Error("invalid scheme has been accepted")
+	}
+}
+
+/*
+ * With a "tls://" URL, TLS is started before credentials are sent, even if
+ * the server doesn't require it
+ */
+func TestNatsTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		first := make([]byte, 1)
+		conn.Read(first)
+		received <- first[0]
+	}()
+
+	client, err := newNatsClient("tls://user:s3cr3t@" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	// The fake server doesn't complete the handshake
+	if err := client.publish("test", []byte("test")); err == nil {
+		t.Error("publishing without TLS handshake succeeded")
+	}
+	// Handshake record of a TLS ClientHello
+	if first := <-received; first != 0x16 {
+		t.Errorf("got %q want a TLS handshake", first)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Admin notifications
+ * Notable events (disk nearly full, quarantined uploads, repeated MAC
+ * failures) are sent to the admins via XMPP. Notifications with the same
+ * key are sent at most once per notifyInterval.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Window for counting MAC failures of a client
+const macFailureWindow = 10 * time.Minute
+
+func (s *Server) notificationsEnabled() bool {
+	return s.conf.XmppComponentAddress != "" && len(s.conf.XmppNotifyJIDs) > 0
+}
+
+/*
+ * Sends notifications in the background and checks the disk usage
+ * periodically
+ */
+func (s *Server) startNotifications() {
+	go func() {
+		for message := range s.notifications.queue {
+			// Send whatever has piled up in one go
+			messages := []string{message}
+			for len(s.notifications.queue) > 0 {
+				messages = append(messages, <-s.notifications.queue)
+			}
+			if err := s.sendXmppMessages(messages); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	if s.conf.NotifyDiskUsage > 0 {
+		go func() {
+			for {
+				s.checkDiskUsage()
+				time.Sleep(5 * time.Minute)
+			}
+		}()
+	}
+}
+
+/*
+ * Queues a notification, unless one with the same key has been sent
+ * recently. An empty key is never suppressed.
+ */
+func (s *Server) notifyAdmins(key string, message string) {
+	if !s.notificationsEnabled() {
+		return
+	}
+
+	s.notifications.Lock()
+	defer s.notifications.Unlock()
+
+	if key != "" {
+		if last, ok := s.notifications.sent[key]; ok && time.Since(last) < s.conf.NotifyInterval {
+			return
+		}
+		s.notifications.sent[key] = time.Now()
+	}
+
+	select {
+	case s.notifications.queue <- message:
+	default:
+		log.Warn("Notification queue full, dropping notification: ", message)
+	}
+}
+
+func (s *Server) checkDiskUsage() {
+	used, err := diskUsage(s.conf.StoreDir)
+	if err != nil {
+		log.Warn("Checking disk usage failed: ", err)
+		return
+	}
+	if used >= s.conf.NotifyDiskUsage {
+		log.Warnf("Disk of %s is %d%% full", s.conf.StoreDir, used)
+		s.notifyAdmins("disk", fmt.Sprintf("Prosody Filer: disk of storeDir is %d%% full", used))
+	}
+}
+
+type macFailureCount struct {
+	count int
+	since time.Time
+}
+
+/*
+ * Counts an upload with invalid MAC and notifies the admins once a client
+ * reaches notifyMacFailures within macFailureWindow. Also counted for
+ * CrowdSec.
+ */
+func (s *Server) recordMACFailure(remoteAddr string) {
+	client, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+
+	s.recordCrowdsecMACFailure(client)
+	if !s.notificationsEnabled() || s.conf.NotifyMacFailures <= 0 {
+		return
+	}
+
+	s.macFailures.Lock()
+	defer s.macFailures.Unlock()
+
+	// Forget about clients which haven't failed for a while
+	for address, failures := range s.macFailures.clients {
+		if time.Since(failures.since) > macFailureWindow {
+			delete(s.macFailures.clients, address)
+		}
+	}
+
+	failures := s.macFailures.clients[client]
+	if failures == nil {
+		failures = &macFailureCount{since: time.Now()}
+		s.macFailures.clients[client] = failures
+	}
+	failures.count++
+
+	if failures.count == s.conf.NotifyMacFailures {
+		s.notifyAdmins("mac:"+client, fmt.Sprintf("Prosody Filer: %d uploads with invalid MAC from %s within %s. Is the secret configured correctly?",
+			failures.count, client, macFailureWindow))
+	}
+}
@@ -0,0 +1,48 @@
+package filer
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+ * Repeated MAC failures of a client are reported once
+ */
+func TestRecordMACFailure(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.XmppComponentAddress = "localhost:5347"
+	s.conf.XmppNotifyJIDs = []string{"admin@example.com"}
+	s.conf.NotifyMacFailures = 3
+
+	for i := 0; i < 5; i++ {
+		s.recordMACFailure("192.0.2.1:4711")
+	}
+	s.recordMACFailure("192.0.2.2:4711")
+
+	if len(s.notifications.queue) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(s.notifications.queue))
+	}
+	if message := <-s.notifications.queue; !strings.Contains(message, "3 uploads with invalid MAC from 192.0.2.1") {
+		t.Errorf("unexpected notification %q", message)
+	}
+
+	// Notifications with the same key are sent once per notifyInterval
+	s.notifyAdmins("test", "first")
+	s.notifyAdmins("test", "second")
+	s.notifyAdmins("", "always")
+	s.notifyAdmins("", "always")
+	if len(s.notifications.queue) != 3 {
+		t.Errorf("got %d notifications, want 3", len(s.notifications.queue))
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	used, err := diskUsage(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used < 0 || used > 100 {
+		t.Errorf("disk usage %d%% out of range", used)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Download offloading
+ * Instead of sending file contents itself, Prosody Filer can let the web
+ * server in front of it deliver them (nginx: X-Accel-Redirect, Apache and
+ * lighttpd: X-Sendfile), or redirect clients to a presigned S3 URL or a CDN.
+ * Prosody Filer still checks the request. Files which are stored encoded
+ * (encrypted or compressed) are always delivered by Prosody Filer.
+ */
+
+package filer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Hands delivery of a stored file over to the web server
+ */
+func (s *Server) offloadDownload(w http.ResponseWriter, absFilename string) error {
+	// The web server only knows storeDir, not e.g. failoverStoreDir
+	relFilename, err := filepath.Rel(s.conf.StoreDir, absFilename)
+	if err != nil {
+		return err
+	} else if strings.HasPrefix(relFilename, "..") {
+		return errors.New("file is not in storeDir")
+	}
+
+	if s.conf.DownloadOffload == "x-sendfile" {
+		absFilename, err := filepath.Abs(absFilename)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("X-Sendfile", absFilename)
+		return nil
+	}
+
+	location := &url.URL{Path: path.Join(s.conf.DownloadOffloadPrefix, filepath.ToSlash(relFilename))}
+	w.Header().Set("X-Accel-Redirect", location.EscapedPath())
+	return nil
+}
+
+/*
+ * Returns the URL clients are redirected to for downloading a file
+ */
+func (s *Server) downloadRedirectURL(fileStorePath string) (string, error) {
+	if s.conf.DownloadRedirect == "cdn" {
+		location := &url.URL{Path: "/" + fileStorePath}
+		return strings.TrimRight(s.conf.DownloadRedirectPrefix, "/") + location.EscapedPath(), nil
+	}
+
+	signer, ok := s.backend.(storage.Presigner)
+	if !ok {
+		return "", errors.New("storage backend does not support presigned URLs")
+	}
+	return signer.Presign(fileStorePath, s.conf.DownloadRedirectExpiry)
+}
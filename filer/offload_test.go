@@ -0,0 +1,59 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Downloads must be handed over to the web server, unless files are encoded
+ */
+func TestDownloadOffload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.DownloadOffload = "x-accel-redirect"
+	s.conf.DownloadOffloadPrefix = "/internal-files/"
+
+	if status := s.uploadFile(t, "abc/hello world.txt", []byte("hello")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	download := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/upload/abc/hello%20world.txt", nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := download()
+	if got := rr.Header().Get("X-Accel-Redirect"); got != "/internal-files/abc/hello%20world.txt" {
+		t.Errorf("wrong X-Accel-Redirect: %q", got)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") == "" {
+		t.Errorf("offloaded response must have headers, but no body")
+	}
+
+	s.conf.DownloadOffload = "x-sendfile"
+	absFilename, _ := filepath.Abs(filepath.Join(s.conf.StoreDir, "abc/hello world.txt"))
+	if got := download().Header().Get("X-Sendfile"); got != absFilename {
+		t.Errorf("wrong X-Sendfile: got %q want %q", got, absFilename)
+	}
+
+	// Compressed files can't be delivered by the web server
+	s.conf.CompressFiles = true
+	if status := s.uploadFile(t, "abc/compressed.txt", []byte("hello hello hello")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	req, _ := http.NewRequest("GET", "/upload/abc/compressed.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Header().Get("X-Sendfile") != "" || rr.Body.String() != "hello hello hello" {
+		t.Errorf("encoded file has been offloaded")
+	}
+}
@@ -0,0 +1,436 @@
+/*
+ * OpenID Connect login to the admin API
+ * Operators log in with their SSO provider (authorization code flow) instead
+ * of sending adminToken. After login, a session cookie signed with a key
+ * generated at startup grants access to the admin API for
+ * oidcSessionDuration; restarting the filer ends all sessions.
+ * Only users listed in oidcAdmins by their "sub" or verified "email" claim
+ * are let in.
+ */
+
+package filer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	adminSessionCookie = "prosody_filer_admin"
+	oidcLoginCookie    = "prosody_filer_oidc"
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+/*
+ * Endpoints of the provider, from its discovery document
+ */
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+/*
+ * A login in progress, kept in a cookie until the provider redirects back
+ */
+type oidcLogin struct {
+	State   string `json:"state"`
+	Nonce   string `json:"nonce"`
+	Next    string `json:"next"`
+	Expires int64  `json:"expires"`
+}
+
+type adminSession struct {
+	User    string `json:"user"`
+	Expires int64  `json:"expires"`
+}
+
+/*
+ * The "aud" claim, a string or a list of strings
+ */
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+/*
+ * Generates the key for session cookies
+ */
+func (s *Server) setupOIDC() error {
+	if s.conf.OidcIssuer == "" {
+		return nil
+	}
+
+	s.oidc.sessionKey = make([]byte, 32)
+	if _, err := rand.Read(s.oidc.sessionKey); err != nil {
+		return fmt.Errorf("failed to generate session key: %s", err)
+	}
+	return nil
+}
+
+/*
+ * Returns the user of a valid admin session cookie, or ""
+ */
+func (s *Server) adminSessionUser(r *http.Request) string {
+	if s.conf.OidcIssuer == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return ""
+	}
+
+	var session adminSession
+	if !s.verifyCookie(cookie.Value, &session) || time.Now().Unix() >= session.Expires {
+		return ""
+	}
+	return session.User
+}
+
+/*
+ * GET /oidc/login?next=<path>: redirects to the provider
+ */
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, err := s.oidcDiscover()
+	if err != nil {
+		log.Error(err)
+		httpError(w, http.StatusBadGateway, "")
+		return
+	}
+
+	// Only redirect to the admin API itself after login
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	login := oidcLogin{State: randomHex(16), Nonce: randomHex(16), Next: next, Expires: time.Now().Add(10 * time.Minute).Unix()}
+
+	target, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		log.Error("Invalid authorization endpoint of OpenID Connect provider: ", err)
+		httpError(w, http.StatusBadGateway, "")
+		return
+	}
+	query := target.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", s.conf.OidcClientID)
+	query.Set("redirect_uri", s.conf.OidcRedirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	target.RawQuery = query.Encode()
+
+	s.setCookie(w, oidcLoginCookie, s.signCookie(login), 10*time.Minute)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+/*
+ * GET /oidc/callback?code=...&state=...: completes the login
+ */
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var login oidcLogin
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil || !s.verifyCookie(cookie.Value, &login) || time.Now().Unix() >= login.Expires {
+		httpError(w, http.StatusBadRequest, "login expired, please try again")
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("state") != login.State {
+		log.Warn("OpenID Connect callback with wrong state from ", r.RemoteAddr)
+		httpError(w, http.StatusBadRequest, "")
+		return
+	} else if query.Get("error") != "" {
+		log.Warn("OpenID Connect login failed: ", query.Get("error"), ": ", query.Get("error_description"))
+		httpError(w, http.StatusForbidden, "")
+		return
+	}
+
+	idToken, err := s.oidcExchangeCode(query.Get("code"))
+	if err != nil {
+		log.Error(err)
+		httpError(w, http.StatusBadGateway, "")
+		return
+	}
+	user, err := s.oidcVerifyIDToken(idToken, login.Nonce)
+	if err != nil {
+		log.Warn("Rejected OpenID Connect login: ", err)
+		httpError(w, http.StatusForbidden, "")
+		return
+	}
+
+	log.Info("Admin ", user, " logged in from ", r.RemoteAddr)
+	session := adminSession{User: user, Expires: time.Now().Add(s.conf.OidcSessionDuration).Unix()}
+	s.setCookie(w, adminSessionCookie, s.signCookie(session), s.conf.OidcSessionDuration)
+	s.setCookie(w, oidcLoginCookie, "", -1)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+/*
+ * /oidc/logout: ends the session
+ */
+func (s *Server) handleOIDCLogout(w http.ResponseWriter, r *http.Request) {
+	s.setCookie(w, adminSessionCookie, "", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ * Fetches the discovery document of the provider once
+ */
+func (s *Server) oidcDiscover() (*oidcProvider, error) {
+	s.oidc.Lock()
+	defer s.oidc.Unlock()
+	if s.oidc.provider != nil {
+		return s.oidc.provider, nil
+	}
+
+	issuer := strings.TrimRight(s.conf.OidcIssuer, "/")
+	var provider oidcProvider
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, fmt.Errorf("OpenID Connect discovery failed: %s", err)
+	}
+	if strings.TrimRight(provider.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OpenID Connect discovery failed: issuer %q does not match oidcIssuer", provider.Issuer)
+	}
+	s.oidc.provider = &provider
+	return &provider, nil
+}
+
+/*
+ * Returns the provider's signing key with the given ID. Keys are fetched
+ * again if an unknown one is requested, at most once per minute.
+ */
+func (s *Server) oidcKey(kid string) (interface{}, error) {
+	provider, err := s.oidcDiscover()
+	if err != nil {
+		return nil, err
+	}
+
+	s.oidc.Lock()
+	defer s.oidc.Unlock()
+	if key, ok := s.oidc.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(s.oidc.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	s.oidc.keysFetched = time.Now()
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(provider.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %s", err)
+	}
+	s.oidc.keys = make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			s.oidc.keys[jwk.Kid] = key
+		}
+	}
+
+	if key, ok := s.oidc.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+/*
+ * Exchanges an authorization code for an ID token
+ */
+func (s *Server) oidcExchangeCode(code string) (string, error) {
+	provider, err := s.oidcDiscover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {s.conf.OidcRedirectURL},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.conf.OidcClientID), url.QueryEscape(s.conf.OidcClientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OpenID Connect token request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OpenID Connect token request failed: %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return "", fmt.Errorf("OpenID Connect token response without ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+/*
+ * Verifies an ID token and returns the admin it identifies
+ */
+func (s *Server) oidcVerifyIDToken(idToken string, nonce string) (string, error) {
+	key, err := s.oidcKey(jwtKeyID(idToken))
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Iss           string      `json:"iss"`
+		Sub           string      `json:"sub"`
+		Aud           jwtAudience `json:"aud"`
+		Nonce         string      `json:"nonce"`
+		Email         string      `json:"email"`
+		EmailVerified *bool       `json:"email_verified"`
+	}
+	if err := verifyJWT(idToken, key, &claims); err != nil {
+		return "", fmt.Errorf("ID token: %s", err)
+	}
+	if strings.TrimRight(claims.Iss, "/") != strings.TrimRight(s.conf.OidcIssuer, "/") {
+		return "", fmt.Errorf("ID token issued by %q", claims.Iss)
+	}
+	if !containsString(claims.Aud, s.conf.OidcClientID) {
+		return "", fmt.Errorf("ID token issued for %v", claims.Aud)
+	}
+	if claims.Nonce != nonce {
+		return "", fmt.Errorf("ID token with wrong nonce")
+	}
+
+	if claims.Sub != "" && containsString(s.conf.OidcAdmins, claims.Sub) {
+		return claims.Sub, nil
+	}
+	if claims.Email != "" && (claims.EmailVerified == nil || *claims.EmailVerified) && containsString(s.conf.OidcAdmins, claims.Email) {
+		return claims.Email, nil
+	}
+	return "", fmt.Errorf("%s (%s) is not listed in oidcAdmins", claims.Sub, claims.Email)
+}
+
+/*
+ * A public key published by the provider
+ */
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(value string) *big.Int {
+		data, _ := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(data)
+	}
+
+	switch {
+	case k.Kty == "RSA" && k.N != "" && k.E != "":
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: decode(k.X), Y: decode(k.Y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func oidcGetJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+/*
+ * Encodes v into a cookie value signed with the session key
+ */
+func (s *Server) signCookie(v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, s.oidc.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Checks the signature of a cookie value and decodes it into v
+ */
+func (s *Server) verifyCookie(value string, v interface{}) bool {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.oidc.sessionKey)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return false
+	}
+	return decodeJWTPart(parts[0], v) == nil
+}
+
+/*
+ * Sets a cookie for the admin API. A negative maxAge deletes it.
+ */
+func (s *Server) setCookie(w http.ResponseWriter, name string, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.conf.OidcRedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package filer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+/*
+ * Minimal OpenID Connect provider issuing ID tokens for the nonce of the
+ * last authorization request
+ */
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JwksURI:               p.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kid: "test",
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// Credentials are form-encoded, see RFC 6749, section 2.3.1
+		id, secret, _ := r.BasicAuth()
+		if secret, _ = url.QueryUnescape(secret); id != "filer" || secret != "client secret" || r.FormValue("code") != "code" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, p.claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+/*
+ * Browsers are sent to the provider and get a session after logging in
+ */
+func TestOIDCLogin(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.Close()
+
+	// Set config
+	s := newTestServer(t)
+	s.conf.AdminToken = ""
+	s.conf.OidcIssuer = provider.URL
+	s.conf.OidcClientID = "filer"
+	s.conf.OidcClientSecret = "client secret"
+	s.conf.OidcRedirectURL = "https://admin.example.com/oidc/callback"
+	s.conf.OidcAdmins = []string{"admin@example.com"}
+	if err := s.setupOIDC(); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.adminHandler()
+
+	request := func(target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.Header.Set("Accept", "text/html")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(claims map[string]interface{}) *httptest.ResponseRecorder {
+		rr := request("/quarantine", nil)
+		if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/oidc/login?next=%2Fquarantine" {
+			t.Fatalf("request without session: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+		}
+
+		rr = request(rr.Header().Get("Location"), nil)
+		authorize, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil || rr.Code != http.StatusFound || authorize.Path != "/authorize" {
+			t.Fatalf("login: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+		}
+		query := authorize.Query()
+		if query.Get("client_id") != "filer" || query.Get("redirect_uri") != s.conf.OidcRedirectURL {
+			t.Errorf("wrong authorization request: %s", authorize)
+		}
+
+		provider.claims = map[string]interface{}{
+			"iss": provider.URL, "aud": "filer", "sub": "1234", "exp": time.Now().Unix() + 60,
+			"nonce": query.Get("nonce"), "email": "admin@example.com", "email_verified": true,
+		}
+		for key, value := range claims {
+			provider.claims[key] = value
+		}
+		return request("/oidc/callback?code=code&state="+query.Get("state"), rr.Result().Cookies())
+	}
+
+	rr := login(nil)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/quarantine" {
+		t.Fatalf("callback: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+	}
+	session := rr.Result().Cookies()
+	if rr := request("/quarantine", session); rr.Code != http.StatusOK {
+		t.Errorf("request with session: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"other user":       {"email": "user@example.com"},
+		"unverified email": {"email_verified": false},
+		"other client":     {"aud": []string{"other"}},
+		"other issuer":     {"iss": "https://evil.example.com"},
+		"wrong nonce":      {"nonce": "replayed"},
+		"expired":          {"exp": time.Now().Unix() - 1},
+	} {
+		if rr := login(claims); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: got %v want %v", name, rr.Code, http.StatusForbidden)
+		}
+	}
+
+	// Callbacks need the state of the login
+	if rr := request("/oidc/callback?code=code&state=guessed", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("callback without login: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Sessions are signed
+	forged := &http.Cookie{Name: adminSessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte(`{"user":"1234","expires":9999999999}`)) + ".AAAA"}
+	if rr := request("/quarantine", []*http.Cookie{forged}); rr.Code != http.StatusFound {
+		t.Errorf("request with forged session: got %v want %v", rr.Code, http.StatusFound)
+	}
+
+	// API clients are not redirected
+	req, _ := http.NewRequest("GET", "/quarantine", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("API request without token: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
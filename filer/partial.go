@@ -0,0 +1,303 @@
+/*
+ * Partial uploads
+ * Incomplete uploads which can be resumed, either using tus or PUT requests
+ * with Content-Range. The received data and the state of an upload are
+ * kept in ".prosody-filer/partial", keyed by a hash of the upload path.
+ * The state records how much data has been synced to disk, so uploads can
+ * be resumed after a restart or crash.
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Received data is synced and its offset recorded at least this often
+const partialCheckpointSize = 16 << 20
+
+/*
+ * State of a partial upload. The received data is kept in a separate file,
+ * which may be longer than Offset if the filer stopped while receiving.
+ */
+type partialUpload struct {
+	Path      string    `json:"path"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (u partialUpload) expires(expiry time.Duration) time.Time {
+	return u.CreatedAt.Add(expiry)
+}
+
+/*
+ * Marks a partial upload as receiving data. Returns false if another
+ * request is writing to it already.
+ */
+func (s *Server) lockPartialUpload(id string) bool {
+	s.partialActive.Lock()
+	defer s.partialActive.Unlock()
+
+	if s.partialActive.ids[id] {
+		return false
+	}
+	s.partialActive.ids[id] = true
+	return true
+}
+
+func (s *Server) unlockPartialUpload(id string) {
+	s.partialActive.Lock()
+	delete(s.partialActive.ids, id)
+	s.partialActive.Unlock()
+}
+
+func partialID(fileStorePath string) string {
+	sum := sha256.Sum256([]byte(fileStorePath))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) partialDataPath(id string) string {
+	return s.internalPath("partial", id)
+}
+
+func (s *Server) partialInfoPath(id string) string {
+	return s.internalPath("partial", id+".json")
+}
+
+/*
+ * Reads the state of a partial upload and its current offset
+ */
+func (s *Server) readPartialUpload(id string) (partialUpload, int64, error) {
+	var upload partialUpload
+
+	data, err := os.ReadFile(s.partialInfoPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+	var recorded struct {
+		Offset *int64 `json:"offset"`
+	}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return upload, 0, fmt.Errorf("invalid state of partial upload %s: %s", id, err)
+	}
+	json.Unmarshal(data, &recorded)
+
+	info, err := os.Stat(s.partialDataPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+	// States written by older versions don't record the offset
+	if recorded.Offset == nil || info.Size() < upload.Offset {
+		upload.Offset = info.Size()
+	}
+	return upload, upload.Offset, nil
+}
+
+/*
+ * Creates an empty partial upload
+ */
+func (s *Server) writePartialUpload(id string, upload partialUpload) error {
+	if err := os.MkdirAll(s.internalPath("partial"), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create partial upload directory: %s", err)
+	}
+
+	// Data file first: an upload is only resumable once its state exists
+	if err := os.WriteFile(s.partialDataPath(id), nil, 0600); err != nil {
+		return fmt.Errorf("failed to create partial upload of %s: %s", upload.Path, err)
+	}
+	if err := s.writePartialState(id, upload); err != nil {
+		os.Remove(s.partialDataPath(id))
+		return err
+	}
+	return nil
+}
+
+/*
+ * Replaces the state of a partial upload, so it is complete even after a
+ * crash
+ */
+func (s *Server) writePartialState(id string, upload partialUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := s.partialInfoPath(id) + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state of partial upload of %s: %s", upload.Path, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, s.partialInfoPath(id))
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("failed to write state of partial upload of %s: %s", upload.Path, err)
+	}
+	return nil
+}
+
+func (s *Server) removePartialUpload(id string) {
+	os.Remove(s.partialInfoPath(id))
+	os.Remove(s.partialDataPath(id))
+}
+
+/*
+ * Appends the request body to a partial upload, up to limit bytes. What has
+ * been received is kept, even if the client disconnects.
+ */
+func (s *Server) appendPartialUpload(id string, upload *partialUpload, r *http.Request, limit int64) (int64, error) {
+	writer, err := s.openPartialUpload(id, upload)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := copyBuffered(writer, io.LimitReader(&contextReader{ctx: r.Context(), src: r.Body}, limit))
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+/*
+ * Writes received data to a partial upload. Every partialCheckpointSize
+ * bytes and when closed, the data is synced and its offset recorded.
+ */
+type partialWriter struct {
+	s       *Server
+	id      string
+	upload  *partialUpload
+	file    *os.File
+	pending int64
+}
+
+/*
+ * Opens a partial upload for appending at its recorded offset
+ */
+func (s *Server) openPartialUpload(id string, upload *partialUpload) (*partialWriter, error) {
+	file, err := os.OpenFile(s.partialDataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Data beyond the offset may be incomplete, e.g. after a crash
+	err = file.Truncate(upload.Offset)
+	if err == nil {
+		_, err = file.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open partial upload of %s: %s", upload.Path, err)
+	}
+	return &partialWriter{s: s, id: id, upload: upload, file: file}, nil
+}
+
+func (p *partialWriter) Write(data []byte) (int, error) {
+	n, err := p.file.Write(data)
+	p.pending += int64(n)
+	if err == nil && p.pending >= partialCheckpointSize {
+		err = p.checkpoint()
+	}
+	return n, err
+}
+
+func (p *partialWriter) checkpoint() error {
+	if p.pending == 0 {
+		return nil
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync partial upload of %s: %s", p.upload.Path, err)
+	}
+	p.upload.Offset += p.pending
+	p.pending = 0
+	return p.s.writePartialState(p.id, *p.upload)
+}
+
+func (p *partialWriter) Close() error {
+	err := p.checkpoint()
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+ * Passes a complete partial upload through the regular checks and stores
+ * it. Whatever the outcome, the partial upload is not needed anymore.
+ */
+func (s *Server) finishPartialUpload(id string, upload partialUpload, w http.ResponseWriter, r *http.Request) error {
+	defer s.removePartialUpload(id)
+
+	dataFile, err := os.Open(s.partialDataPath(id))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+	defer dataFile.Close()
+
+	complete := r.Clone(r.Context())
+	complete.Body = dataFile
+	complete.ContentLength = upload.Length
+	// Checksum headers of the last request don't describe the whole file
+	complete.Header.Del("Content-MD5")
+	complete.Header.Del("X-Content-SHA256")
+	complete.Trailer = nil
+
+	return s.createFile(upload.Path, nil, w, complete)
+}
+
+/*
+ * Removes expired partial uploads periodically
+ */
+func (s *Server) startPartialUploadCleanup() {
+	go func() {
+		for {
+			s.removeExpiredPartialUploads()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func (s *Server) removeExpiredPartialUploads() {
+	infoFiles, err := filepath.Glob(filepath.Join(s.internalPath("partial"), "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, infoFile := range infoFiles {
+		id := strings.TrimSuffix(filepath.Base(infoFile), ".json")
+
+		var upload partialUpload
+		data, err := os.ReadFile(infoFile)
+		if err == nil {
+			err = json.Unmarshal(data, &upload)
+		}
+		if err != nil {
+			log.Warn("Reading partial upload ", id, " failed: ", err)
+			continue
+		}
+
+		if time.Now().After(upload.expires(s.conf.PartialUploadExpiry)) && s.lockPartialUpload(id) {
+			log.Info("Removing expired partial upload of ", upload.Path)
+			s.removePartialUpload(id)
+			s.unlockPartialUpload(id)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Upload locking
+ * Concurrent uploads to the same path, e.g. a client retrying while its
+ * first attempt is still being received, are serialized: the second one
+ * waits until the first has been committed or failed, and then finds the
+ * file in place like any later upload would. With uploadLocking = "flock",
+ * a lock file in the shared directory serializes them across instances
+ * sharing clusterDir or storeDir as well.
+ */
+
+package filer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Interval of attempts to take a lock file held by another instance
+const flockRetryInterval = 50 * time.Millisecond
+
+var errFlockUnsupported = errors.New("flock is not supported on this platform")
+
+/*
+ * Lock of a path within this process, shared by all uploads waiting for it
+ */
+type pathLock struct {
+	held    chan struct{}
+	waiting int
+}
+
+/*
+ * Waits until no other upload to fileStorePath is in progress, or ctx is
+ * done. The returned function releases the lock.
+ */
+func (s *Server) lockPath(ctx context.Context, fileStorePath string) (func(), error) {
+	if s.conf.UploadLocking == "off" {
+		return func() {}, nil
+	}
+
+	s.pathLocks.Lock()
+	lock, ok := s.pathLocks.locks[fileStorePath]
+	if !ok {
+		lock = &pathLock{held: make(chan struct{}, 1)}
+		s.pathLocks.locks[fileStorePath] = lock
+	}
+	lock.waiting++
+	s.pathLocks.Unlock()
+
+	release := func() {
+		s.pathLocks.Lock()
+		if lock.waiting--; lock.waiting == 0 {
+			delete(s.pathLocks.locks, fileStorePath)
+		}
+		s.pathLocks.Unlock()
+	}
+
+	select {
+	case lock.held <- struct{}{}:
+	default:
+		log.Debug("Waiting for another upload to ", fileStorePath)
+		select {
+		case lock.held <- struct{}{}:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	unlock := func() {
+		<-lock.held
+		release()
+	}
+	if s.conf.UploadLocking != "flock" {
+		return unlock, nil
+	}
+
+	// Only one upload per process waits for the lock file
+	unlockFile, err := s.lockFile(ctx, fileStorePath)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		unlock()
+	}, nil
+}
+
+/*
+ * Takes the lock file of fileStorePath in the shared directory, polling
+ * until ctx is done. It is removed on unlock, so lock files don't pile up;
+ * a lock taken on a removed file is retried.
+ */
+func (s *Server) lockFile(ctx context.Context, fileStorePath string) (func(), error) {
+	dir := s.sharedPath("locks")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(fileStorePath))
+	filename := filepath.Join(dir, hex.EncodeToString(hash[:16]))
+
+	for {
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		locked, err := tryFlock(file)
+		for err == nil && !locked {
+			select {
+			case <-ctx.Done():
+				file.Close()
+				return nil, ctx.Err()
+			case <-time.After(flockRetryInterval):
+			}
+			locked, err = tryFlock(file)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(filename); err == nil && os.SameFile(opened, current) {
+			return func() {
+				os.Remove(filename)
+				file.Close()
+			}, nil
+		}
+		// Removed by the previous holder in the meantime
+		file.Close()
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package filer
+
+import (
+	"os"
+	"syscall"
+)
+
+const flockSupported = true
+
+/*
+ * Takes an exclusive flock(2) on file without blocking. Returns false if
+ * it is held by someone else. Closing the file releases it.
+ */
+func tryFlock(file *os.File) (bool, error) {
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return false, nil
+		}
+		return false, &os.PathError{Op: "flock", Path: file.Name(), Err: err}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package filer
+
+import "os"
+
+const flockSupported = false
+
+func tryFlock(file *os.File) (bool, error) {
+	return false, errFlockUnsupported
+}
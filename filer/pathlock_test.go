@@ -0,0 +1,104 @@
+package filer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ * A second upload to a path waits for the first one and then finds the
+ * file in place, instead of racing it
+ */
+func TestConcurrentUploads(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("first upload")
+	reader, writer := io.Pipe()
+	req := s.newUploadRequest(t, "abc/concurrent.txt", content)
+	req.Body = reader
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- s.serveUpload(req)
+	}()
+	writer.Write(content[:5])
+	for deadline := time.Now().Add(5 * time.Second); len(s.uploadsInProgress()) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first upload not started")
+		}
+	}
+
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		second <- s.uploadFile(t, "abc/concurrent.txt", []byte("other upload"))
+	}()
+	select {
+	case rr := <-second:
+		t.Fatalf("second upload did not wait for the first one: got %v", rr.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writer.Write(content[5:])
+	writer.Close()
+	if rr := <-first; rr.Code != http.StatusCreated {
+		t.Errorf("first upload: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := <-second; rr.Code != http.StatusConflict {
+		t.Errorf("second upload: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if len(s.pathLocks.locks) != 0 {
+		t.Errorf("locks not released: %v", s.pathLocks.locks)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/concurrent.txt", nil)
+	if rr := s.serveUpload(req); !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("stored file: got %q want %q", rr.Body.String(), content)
+	}
+}
+
+/*
+ * Instances sharing storeDir lock paths with lock files
+ */
+func TestFlockUploadLocking(t *testing.T) {
+	if !flockSupported {
+		t.Skip(errFlockUnsupported)
+	}
+	first, second := newTestServer(t), newTestServer(t)
+	first.conf.StoreDir = t.TempDir()
+	second.conf.StoreDir = first.conf.StoreDir
+	first.conf.UploadLocking = "flock"
+	second.conf.UploadLocking = "flock"
+
+	unlock, err := first.lockPath(context.Background(), "abc/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := second.lockPath(ctx, "abc/file.txt"); err != context.DeadlineExceeded {
+		t.Errorf("lock held by another instance: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if other, err := second.lockPath(context.Background(), "abc/other.txt"); err != nil {
+		t.Errorf("lock of another path: %s", err)
+	} else {
+		other()
+	}
+
+	unlock()
+	unlock, err = second.lockPath(context.Background(), "abc/file.txt")
+	if err != nil {
+		t.Fatalf("released lock: %s", err)
+	}
+	unlock()
+	if entries, _ := os.ReadDir(second.sharedPath("locks")); len(entries) != 0 {
+		t.Errorf("lock files not removed: %v", entries)
+	}
+}
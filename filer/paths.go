@@ -0,0 +1,86 @@
+/*
+ * Path validation
+ * Request paths are mapped to files below storeDir, so they must not leave
+ * it through "." or ".." segments. On Windows, backslashes and colons
+ * (drive letters, alternate data streams) would do so as well, and reserved
+ * device names (CON, NUL, COM1, ...), trailing dots and spaces and other
+ * characters invalid in file names would either fail or point to another
+ * file than requested. Long paths are handled by the os package, which
+ * adds the \\?\ prefix to absolute paths, so the directories of storeDir
+ * are made absolute on Windows.
+ */
+
+package filer
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Validate paths for Windows, a variable for tests on other platforms
+var windowsPaths = runtime.GOOS == "windows"
+
+/*
+ * Device names which can't be used as file names on Windows, with any
+ * extension
+ */
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+/*
+ * Returns an error if fileStorePath, separated by slashes, can't be stored
+ * below storeDir as the file it names
+ */
+func checkStorePath(fileStorePath string, windows bool) error {
+	for i, segment := range strings.Split(fileStorePath, "/") {
+		if segment == "." || segment == ".." {
+			return errors.New("relative path segments are not allowed")
+		} else if !windows {
+			continue
+		}
+
+		if strings.ContainsAny(segment, `\:*?"<>|`) || strings.IndexFunc(segment, func(r rune) bool { return r < 0x20 }) >= 0 {
+			return fmt.Errorf("%q contains characters which are invalid on Windows", segment)
+		}
+		if strings.HasSuffix(segment, ".") || strings.HasSuffix(segment, " ") {
+			return fmt.Errorf("%q ends with a dot or space, which are removed on Windows", segment)
+		}
+		name := strings.TrimRight(strings.SplitN(segment, ".", 2)[0], " ")
+		if windowsReservedNames[strings.ToUpper(name)] {
+			return fmt.Errorf("%q is a reserved name on Windows", segment)
+		}
+		// File names are case-insensitive
+		if i == 0 && strings.EqualFold(segment, internalDirName) {
+			return errors.New("access to internal directory")
+		}
+	}
+	return nil
+}
+
+/*
+ * Makes the directories files are stored in absolute, so long paths below
+ * them work on Windows
+ */
+func (s *Server) absoluteStoreDirs() error {
+	dirs := []*string{&s.conf.StoreDir, &s.conf.TempDir, &s.conf.FailoverStoreDir, &s.conf.ClusterDir}
+	for i := range s.conf.FallbackStoreDirs {
+		dirs = append(dirs, &s.conf.FallbackStoreDirs[i])
+	}
+	for _, dir := range dirs {
+		if *dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return fmt.Errorf("failed to make %s absolute: %s", *dir, err)
+		}
+		*dir = abs
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package filer
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStorePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		valid   bool
+		windows bool
+	}{
+		{"abc/file.txt", true, true},
+		{"abc/file with spaces.tar.gz", true, true},
+		{"abc/console.txt", true, true},
+		{"abc/COM10.txt", true, true},
+		{"abc/..file", true, true},
+		{"abc/../file.txt", false, false},
+		{"../file.txt", false, false},
+		{"abc/./file.txt", false, false},
+		{`abc/..\..\file.txt`, true, false},
+		{`abc/..\..\file.txt`, false, true},
+		{"abc/C:file.txt", true, false},
+		{"abc/C:file.txt", false, true},
+		{"abc/file.txt:stream", false, true},
+		{"abc/CON", true, false},
+		{"abc/CON", false, true},
+		{"abc/con.txt", false, true},
+		{"abc/Nul .tar.gz", false, true},
+		{"LPT1/file.txt", false, true},
+		{"abc/file.txt.", false, true},
+		{"abc/file.txt ", false, true},
+		{"abc/what?.txt", false, true},
+		{"abc/tab\tfile.txt", false, true},
+		{".PROSODY-FILER/meta/file.json", false, true},
+		{"abc/.PROSODY-FILER", true, true},
+	}
+	for _, test := range tests {
+		if err := checkStorePath(test.path, test.windows); (err == nil) != test.valid {
+			t.Errorf("%q (Windows: %v): got %v, valid %v", test.path, test.windows, err, test.valid)
+		}
+	}
+}
+
+/*
+ * Paths which would point to other files than requested are refused by
+ * the request handler
+ */
+func TestInvalidRequestPaths(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	for _, p := range []string{"/upload/../prosody-filer.go", "/upload/abc/../../prosody-filer.go"} {
+		req, _ := http.NewRequest("GET", "/upload/", nil)
+		req.URL.Path = p
+		if rr := s.serveUpload(req); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %v want %v", p, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	defer func(previous bool) { windowsPaths = previous }(windowsPaths)
+	windowsPaths = true
+	if rr := s.uploadFile(t, "abc/CON.txt", []byte("device")); rr.Code != http.StatusBadRequest {
+		t.Errorf("upload to reserved name: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := s.uploadFile(t, "abc/file.txt", []byte("hello")); rr.Code != http.StatusCreated {
+		t.Errorf("upload to valid path: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestAbsoluteStoreDirs(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = "uploads"
+	s.conf.TempDir = ""
+	if err := s.absoluteStoreDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(s.conf.StoreDir) || filepath.Base(s.conf.StoreDir) != "uploads" {
+		t.Errorf("storeDir: got %q", s.conf.StoreDir)
+	}
+	if s.conf.TempDir != "" {
+		t.Errorf("unset tempDir: got %q", s.conf.TempDir)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Permission audit
+ * Paths of uploads are only secret as long as nobody can list storeDir, and
+ * files can be replaced by anybody who may write to them. At startup,
+ * storeDir must not be readable or writable by others, nothing below it
+ * writable by group or others, and files must not be executable. Depending
+ * on insecurePermissions, problems are logged or refuse the start. The
+ * "fix-perms" command removes these permissions.
+ */
+
+package filer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+/*
+ * A file or directory in storeDir with insecure permissions
+ */
+type permissionProblem struct {
+	path string
+	mode os.FileMode
+	// Without the insecure permissions
+	fixed os.FileMode
+}
+
+/*
+ * Returns the permission bits of a file or directory which are too
+ * permissive
+ */
+func insecurePermissionBits(info os.FileInfo, isStoreDir bool) os.FileMode {
+	switch {
+	case info.IsDir() && isStoreDir:
+		return 0026
+	case info.IsDir():
+		return 0022
+	case info.Mode().IsRegular():
+		return 0133
+	}
+	// Symlinks and other special files are not checked
+	return 0
+}
+
+/*
+ * Walks storeDir and returns all files and directories with insecure
+ * permissions
+ */
+func (s *Server) auditPermissions() ([]permissionProblem, error) {
+	var problems []permissionProblem
+	err := filepath.Walk(s.conf.StoreDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := info.Mode().Perm()
+		if insecure := mode & insecurePermissionBits(info, path == s.conf.StoreDir); insecure != 0 {
+			problems = append(problems, permissionProblem{path: path, mode: mode, fixed: mode &^ insecure})
+		}
+		return nil
+	})
+	return problems, err
+}
+
+/*
+ * Logs insecure permissions in storeDir, and refuses to start with them if
+ * insecurePermissions = "refuse"
+ */
+func (s *Server) checkPermissions() error {
+	// File modes don't apply to ACLs on Windows
+	if s.conf.InsecurePermissions == "ignore" || runtime.GOOS == "windows" {
+		return nil
+	}
+
+	problems, err := s.auditPermissions()
+	if err != nil {
+		return fmt.Errorf("failed to check permissions in storeDir %s: %s", s.conf.StoreDir, err)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// Only some of them, there may be thousands of uploads
+	for i, problem := range problems {
+		if i == 10 {
+			log.Warnf("... and %d more", len(problems)-i)
+			break
+		}
+		log.Warnf("%s has insecure permissions %s, should be %s", problem.path, problem.mode, problem.fixed)
+	}
+	if s.conf.InsecurePermissions == "refuse" {
+		return fmt.Errorf("%d files or directories in storeDir %s have insecure permissions, run \"prosody-filer fix-perms\" to fix them", len(problems), s.conf.StoreDir)
+	}
+	log.Warnf("%d files or directories in storeDir %s have insecure permissions, run \"prosody-filer fix-perms\" to fix them", len(problems), s.conf.StoreDir)
+	return nil
+}
+
+/*
+ * Removes insecure permissions in storeDir. Returns the number of changed
+ * files and directories.
+ */
+func (s *Server) fixPermissions() (int, error) {
+	problems, err := s.auditPermissions()
+	if err != nil {
+		return 0, err
+	}
+
+	fixed := 0
+	for _, problem := range problems {
+		if err := os.Chmod(problem.path, problem.fixed); err != nil {
+			return fixed, fmt.Errorf("failed to change permissions of %s: %s", problem.path, err)
+		}
+		log.Debugf("Changed permissions of %s from %s to %s", problem.path, problem.mode, problem.fixed)
+		fixed++
+	}
+	return fixed, nil
+}
+
+func runFixPerms(args []string) error {
+	flags := flag.NewFlagSet("fix-perms", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	flags.Parse(args)
+
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	// The permissions to be fixed would refuse the start
+	config.InsecurePermissions = "ignore"
+	s, err := newServer(config)
+	if err != nil {
+		return err
+	}
+
+	fixed, err := s.fixPermissions()
+	log.Infof("Fixed permissions of %d files and directories", fixed)
+	return err
+}
@@ -0,0 +1,69 @@
+package filer
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPermissionAudit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not checked on Windows")
+	}
+	s := newTestServer(t)
+	s.conf.StoreDir = t.TempDir()
+	s.conf.InsecurePermissions = "refuse"
+
+	dir := filepath.Join(s.conf.StoreDir, "abc")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "private.txt"), []byte("hello"), 0644)
+	// Not affected by the umask
+	os.Chmod(s.conf.StoreDir, 0751)
+	os.Chmod(dir, 0755)
+	os.Chmod(filepath.Join(dir, "private.txt"), 0644)
+	if err := s.checkPermissions(); err != nil {
+		t.Fatalf("secure permissions refused: %s", err)
+	}
+
+	modes := map[string]os.FileMode{
+		s.conf.StoreDir:                          0755,
+		dir:                                      0777,
+		filepath.Join(dir, "writable.txt"):       0666,
+		filepath.Join(dir, "executable.sh"):      0755,
+		filepath.Join(dir, "group-writable.txt"): 0664,
+	}
+	for path, mode := range modes {
+		if path != s.conf.StoreDir && path != dir {
+			os.WriteFile(path, nil, mode)
+		}
+		os.Chmod(path, mode)
+	}
+	if err := s.checkPermissions(); err == nil {
+		t.Errorf("insecure permissions accepted")
+	}
+	s.conf.InsecurePermissions = "warn"
+	if err := s.checkPermissions(); err != nil {
+		t.Errorf("insecure permissions refused with insecurePermissions = \"warn\": %s", err)
+	}
+
+	if fixed, err := s.fixPermissions(); err != nil || fixed != len(modes) {
+		t.Fatalf("fixed permissions of %d files: %v", fixed, err)
+	}
+	want := map[string]os.FileMode{
+		s.conf.StoreDir:                          0751,
+		dir:                                      0755,
+		filepath.Join(dir, "writable.txt"):       0644,
+		filepath.Join(dir, "executable.sh"):      0644,
+		filepath.Join(dir, "group-writable.txt"): 0644,
+	}
+	for path, mode := range want {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("permissions of %s: got %v want %v", path, info.Mode().Perm(), mode)
+		}
+	}
+	s.conf.InsecurePermissions = "refuse"
+	if err := s.checkPermissions(); err != nil {
+		t.Errorf("fixed permissions refused: %s", err)
+	}
+}
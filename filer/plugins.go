@@ -0,0 +1,420 @@
+/*
+ * External plugins
+ * Site-specific policy runs in separate processes instead of being built
+ * into the filer. Each command in plugins is started once and restarted if
+ * it exits. Requests and responses are JSON objects, one per line, on the
+ * plugin's stdin and stdout; whatever it writes to stderr is logged.
+ *
+ * After starting, the filer sends
+ *	{"id":1,"method":"hello","params":{"version":"..."}}
+ * and the plugin answers with the calls it handles:
+ *	{"id":1,"result":{"calls":["checkUpload","metadata","event"]}}
+ *
+ * checkUpload is called before an upload is stored and checkDownload before
+ * a file is served. Both may veto the request with
+ *	{"id":2,"result":{"allow":false,"reason":"..."}}
+ * metadata is called with the metadata of a stored file and may add
+ * attributes to it with {"id":3,"result":{"attributes":{"key":"value"}}}.
+ * Errors are answered with {"id":...,"error":"..."}.
+ * Events are sent as notifications without id and are not answered.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var pluginFailuresMetric = newCounter("prosody_filer_plugin_failures_total", "Plugin calls which failed or timed out.")
+
+// Wait before restarting a plugin which exited
+var pluginRestartDelay = 5 * time.Second
+
+type pluginRequest struct {
+	ID     int         `json:"id,omitempty"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type pluginResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+/*
+ * An upload to be checked by plugins
+ */
+type pluginUpload struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	SHA256      string `json:"sha256"`
+	Uploader    string `json:"uploader"`
+	RemoteAddr  string `json:"remoteAddr"`
+}
+
+/*
+ * A download to be checked by plugins
+ */
+type pluginDownload struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Method     string `json:"method"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+/*
+ * Rejection of a request by a plugin
+ */
+type pluginVeto struct {
+	plugin string
+	reason string
+}
+
+func (v *pluginVeto) Error() string {
+	return fmt.Sprintf("vetoed by plugin %s: %s", v.plugin, v.reason)
+}
+
+/*
+ * A running plugin process
+ */
+type plugin struct {
+	name    string
+	command []string
+	timeout time.Duration
+	stderr  io.Writer
+
+	mutex sync.Mutex
+	// nil while the process is not running
+	stdin io.WriteCloser
+	// Calls handled according to the last handshake
+	calls   map[string]bool
+	nextID  int
+	pending map[int]chan pluginResponse
+}
+
+func newPlugin(command []string, timeout time.Duration) *plugin {
+	name := filepath.Base(command[0])
+	return &plugin{
+		name:    name,
+		command: command,
+		timeout: timeout,
+		stderr:  log.WithField("plugin", name).WriterLevel(logrus.WarnLevel),
+		pending: make(map[int]chan pluginResponse),
+	}
+}
+
+/*
+ * Starts the plugins and feeds them events
+ */
+func (s *Server) startPlugins() error {
+	for _, command := range s.conf.Plugins {
+		p := newPlugin(command, s.conf.PluginTimeout)
+		exited, err := p.launch()
+		if err != nil {
+			return err
+		}
+		go p.supervise(exited)
+
+		if p.handles("event") {
+			s.startPluginEvents(p)
+		}
+		s.plugins = append(s.plugins, p)
+	}
+	return nil
+}
+
+/*
+ * Starts the process and does the handshake. The returned channel receives
+ * the exit status once the process is gone.
+ */
+func (p *plugin) launch() (<-chan error, error) {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = p.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %s", p.name, err)
+	}
+
+	p.mutex.Lock()
+	p.stdin = stdin
+	p.mutex.Unlock()
+
+	exited := make(chan error, 1)
+	go func() {
+		p.readResponses(stdout)
+		err := cmd.Wait()
+
+		p.mutex.Lock()
+		p.stdin = nil
+		for id, response := range p.pending {
+			close(response)
+			delete(p.pending, id)
+		}
+		p.mutex.Unlock()
+		exited <- err
+	}()
+
+	var hello struct {
+		Calls []string `json:"calls"`
+	}
+	if err := p.call("hello", map[string]string{"version": Version}, &hello); err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return nil, fmt.Errorf("handshake with plugin %s failed: %s", p.name, err)
+	}
+
+	calls := make(map[string]bool)
+	for _, call := range hello.Calls {
+		calls[call] = true
+	}
+	p.mutex.Lock()
+	p.calls = calls
+	p.mutex.Unlock()
+
+	log.Info("Started plugin ", p.name, " handling ", strings.Join(hello.Calls, ", "))
+	return exited, nil
+}
+
+/*
+ * Restarts the plugin whenever it exits
+ */
+func (p *plugin) supervise(exited <-chan error) {
+	for {
+		err := <-exited
+		log.Error("Plugin ", p.name, " exited: ", err, ". Restarting in ", pluginRestartDelay)
+
+		for {
+			time.Sleep(pluginRestartDelay)
+			exited, err = p.launch()
+			if err == nil {
+				break
+			}
+			log.Error(err)
+		}
+	}
+}
+
+/*
+ * Hands responses to the waiting calls until stdout is closed
+ */
+func (p *plugin) readResponses(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var response pluginResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			log.Warn("Ignoring malformed response of plugin ", p.name, ": ", err)
+			continue
+		}
+
+		p.mutex.Lock()
+		waiting := p.pending[response.ID]
+		delete(p.pending, response.ID)
+		p.mutex.Unlock()
+
+		// Buffered, the caller may have given up already
+		if waiting != nil {
+			waiting <- response
+		}
+	}
+}
+
+/*
+ * Reports whether the plugin handles a call. Plugins which are restarting
+ * keep the calls of their previous handshake, so their calls fail meanwhile.
+ */
+func (p *plugin) handles(method string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.calls[method]
+}
+
+/*
+ * Sends a request and decodes the result into result. Fails if the plugin
+ * does not answer within its timeout.
+ */
+func (p *plugin) call(method string, params interface{}, result interface{}) error {
+	p.mutex.Lock()
+	if p.stdin == nil {
+		p.mutex.Unlock()
+		return fmt.Errorf("plugin %s is not running", p.name)
+	}
+	p.nextID++
+	id := p.nextID
+	response := make(chan pluginResponse, 1)
+	p.pending[id] = response
+	err := p.send(pluginRequest{ID: id, Method: method, Params: params})
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case r, ok := <-response:
+		if !ok {
+			return fmt.Errorf("plugin %s exited during %s call", p.name, method)
+		} else if r.Error != "" {
+			return fmt.Errorf("plugin %s failed %s call: %s", p.name, method, r.Error)
+		}
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return fmt.Errorf("malformed %s result of plugin %s: %s", method, p.name, err)
+		}
+		return nil
+	case <-timer.C:
+		p.mutex.Lock()
+		delete(p.pending, id)
+		p.mutex.Unlock()
+		return fmt.Errorf("plugin %s did not answer %s call within %s", p.name, method, p.timeout)
+	}
+}
+
+/*
+ * Sends a notification, which is not answered
+ */
+func (p *plugin) notify(method string, params interface{}) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stdin == nil {
+		return fmt.Errorf("plugin %s is not running", p.name)
+	}
+	return p.send(pluginRequest{Method: method, Params: params})
+}
+
+/*
+ * Writes a request to the plugin. Must be called with mutex held.
+ */
+func (p *plugin) send(request pluginRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if _, err := p.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to send %s to plugin %s: %s", request.Method, p.name, err)
+	}
+	return nil
+}
+
+/*
+ * Asks the plugins whether an upload may be stored
+ */
+func (s *Server) checkUploadPlugins(upload pluginUpload) error {
+	return s.checkPlugins("checkUpload", upload)
+}
+
+/*
+ * Asks the plugins whether a file may be downloaded
+ */
+func (s *Server) checkDownloadPlugins(download pluginDownload) error {
+	return s.checkPlugins("checkDownload", download)
+}
+
+/*
+ * Calls a check of all plugins handling it. Returns a *pluginVeto if one of
+ * them refuses, other errors if a plugin could not be asked.
+ */
+func (s *Server) checkPlugins(method string, params interface{}) error {
+	for _, p := range s.plugins {
+		if !p.handles(method) {
+			continue
+		}
+
+		var verdict struct {
+			Allow  bool   `json:"allow"`
+			Reason string `json:"reason"`
+		}
+		if err := p.call(method, params, &verdict); err != nil {
+			pluginFailuresMetric.add(fmt.Sprintf("plugin=%q", p.name), 1)
+			return err
+		}
+		if !verdict.Allow {
+			return &pluginVeto{plugin: p.name, reason: verdict.Reason}
+		}
+	}
+	return nil
+}
+
+/*
+ * Applies pluginFailureMode to a plugin which could not be asked
+ */
+func (s *Server) handlePluginFailure(err error) error {
+	if s.conf.PluginFailureMode == "accept" {
+		log.Warn("Accepting request without plugin check: ", err)
+		return nil
+	}
+
+	return err
+}
+
+/*
+ * Lets the plugins add attributes to the metadata of a stored file.
+ * Failures are logged, the metadata is stored without their attributes.
+ */
+func (s *Server) pluginMetadata(meta *fileMetadata) {
+	for _, p := range s.plugins {
+		if !p.handles("metadata") {
+			continue
+		}
+
+		var result struct {
+			Attributes map[string]string `json:"attributes"`
+		}
+		if err := p.call("metadata", meta, &result); err != nil {
+			log.Error(err)
+			pluginFailuresMetric.add(fmt.Sprintf("plugin=%q", p.name), 1)
+			continue
+		}
+		for key, value := range result.Attributes {
+			if meta.Attributes == nil {
+				meta.Attributes = make(map[string]string)
+			}
+			meta.Attributes[key] = value
+		}
+	}
+}
+
+/*
+ * Sends events to a plugin in the background
+ */
+func (s *Server) startPluginEvents(p *plugin) {
+	queue := make(chan fileEvent, 100)
+
+	s.subscribeEvents(func(event fileEvent) {
+		select {
+		case queue <- event:
+		default:
+			log.Warn("Event queue of plugin ", p.name, " full, skipping ", event.Type, " event of ", event.Path)
+			pluginFailuresMetric.add(fmt.Sprintf("plugin=%q", p.name), 1)
+		}
+	})
+
+	go func() {
+		for event := range queue {
+			if err := p.notify("event", event); err != nil {
+				log.Error(err)
+				pluginFailuresMetric.add(fmt.Sprintf("plugin=%q", p.name), 1)
+			}
+		}
+	}()
+}
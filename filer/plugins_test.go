@@ -0,0 +1,197 @@
+package filer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Not a test: runs the test binary as plugin. Vetoes uploads with
+ * "forbidden" in their path, answers late for "slow" and exits for "crash".
+ * Vetoes downloads with "private" in their path.
+ * Events are appended to the file in PROSODY_FILER_TEST_PLUGIN_EVENTS.
+ */
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("PROSODY_FILER_TEST_PLUGIN") == "" {
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var request struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &request)
+
+		var result string
+		switch request.Method {
+		case "hello":
+			result = `{"calls":["checkUpload","checkDownload","metadata","event"]}`
+		case "checkUpload":
+			var upload pluginUpload
+			json.Unmarshal(request.Params, &upload)
+			switch {
+			case strings.Contains(upload.Path, "forbidden"):
+				result = `{"allow":false,"reason":"not today"}`
+			case strings.Contains(upload.Path, "slow"):
+				time.Sleep(time.Second)
+				result = `{"allow":true}`
+			case strings.Contains(upload.Path, "crash"):
+				os.Exit(1)
+			default:
+				result = `{"allow":true}`
+			}
+		case "checkDownload":
+			var download pluginDownload
+			json.Unmarshal(request.Params, &download)
+			result = fmt.Sprintf(`{"allow":%t,"reason":"private"}`, !strings.Contains(download.Path, "private"))
+		case "metadata":
+			var meta fileMetadata
+			json.Unmarshal(request.Params, &meta)
+			result = fmt.Sprintf(`{"attributes":{"checkedBy":"test","sha256":%q}}`, meta.SHA256)
+		case "event":
+			events, _ := os.OpenFile(os.Getenv("PROSODY_FILER_TEST_PLUGIN_EVENTS"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			events.Write(append(request.Params, '\n'))
+			events.Close()
+			continue
+		}
+		fmt.Printf("{\"id\":%d,\"result\":%s}\n", request.ID, result)
+	}
+	os.Exit(0)
+}
+
+/*
+ * Plugins can veto uploads, add metadata and receive events
+ */
+func TestPlugins(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	defer func(delay time.Duration) { pluginRestartDelay = delay }(pluginRestartDelay)
+	pluginRestartDelay = 10 * time.Millisecond
+
+	events := filepath.Join(t.TempDir(), "events")
+	s.conf.Plugins = [][]string{{"env", "PROSODY_FILER_TEST_PLUGIN=1", "PROSODY_FILER_TEST_PLUGIN_EVENTS=" + events, os.Args[0], "-test.run=^TestPluginHelperProcess$"}}
+	s.conf.PluginTimeout = 200 * time.Millisecond
+	if err := s.startPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := s.uploadFile(t, "abc/allowed.txt", []byte("allowed")).Code; status != http.StatusCreated {
+		t.Fatalf("allowed upload: got %v want %v", status, http.StatusCreated)
+	}
+	meta, err := s.readMetadata("abc/allowed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Attributes["checkedBy"] != "test" || meta.Attributes["sha256"] != meta.SHA256 {
+		t.Errorf("wrong attributes: %v", meta.Attributes)
+	}
+
+	if status := s.uploadFile(t, "abc/forbidden.txt", []byte("forbidden")).Code; status != http.StatusForbidden {
+		t.Errorf("vetoed upload: got %v want %v", status, http.StatusForbidden)
+	}
+	if _, err := os.Stat(s.storagePath("abc/forbidden.txt")); !os.IsNotExist(err) {
+		t.Errorf("vetoed upload has been stored: %v", err)
+	}
+
+	// Failing plugins
+	if status := s.uploadFile(t, "abc/slow.txt", []byte("slow")).Code; status != http.StatusServiceUnavailable {
+		t.Errorf("upload with slow plugin: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+	if status := s.uploadFile(t, "abc/crash.txt", []byte("crash")).Code; status != http.StatusServiceUnavailable {
+		t.Errorf("upload with crashing plugin: got %v want %v", status, http.StatusServiceUnavailable)
+	}
+	s.conf.PluginFailureMode = "accept"
+	if status := s.uploadFile(t, "abc/slow.txt", []byte("slow")).Code; status != http.StatusCreated {
+		t.Errorf("upload with slow plugin accepted: got %v want %v", status, http.StatusCreated)
+	}
+
+	// Restarted after crashing
+	s.conf.PluginFailureMode = "reject"
+	var status int
+	for i := 0; i < 100; i++ {
+		if status = s.uploadFile(t, "abc/restarted.txt", []byte("restarted")).Code; status != http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != http.StatusCreated {
+		t.Errorf("upload after restart: got %v want %v", status, http.StatusCreated)
+	}
+
+	// Events of allowed.txt, slow.txt and restarted.txt, unless they came
+	// in while the plugin was restarting
+	var received []string
+	for i := 0; i < 100; i++ {
+		data, _ := os.ReadFile(events)
+		if received = strings.Split(strings.TrimSpace(string(data)), "\n"); len(received) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var event fileEvent
+	if err := json.Unmarshal([]byte(received[0]), &event); err != nil || event.Type != "upload" || event.Path != "abc/allowed.txt" {
+		t.Errorf("wrong first event: %s", received[0])
+	}
+}
+
+/*
+ * Plugins can veto downloads
+ */
+func TestPluginDownloads(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	s.conf.Plugins = [][]string{{"env", "PROSODY_FILER_TEST_PLUGIN=1", os.Args[0], "-test.run=^TestPluginHelperProcess$"}}
+	if err := s.startPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileStorePath := range []string{"abc/public.txt", "abc/private.txt"} {
+		if status := s.uploadFile(t, fileStorePath, []byte("content")).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+
+	for target, expected := range map[string]int{
+		"/upload/abc/public.txt":  http.StatusOK,
+		"/upload/abc/private.txt": http.StatusForbidden,
+		"/upload/abc/missing.txt": http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("GET", target, nil)
+		if status := s.serveUpload(req).Code; status != expected {
+			t.Errorf("GET %s: got %v want %v", target, status, expected)
+		}
+	}
+}
+
+/*
+ * Plugins which can't be started make the server fail
+ */
+func TestPluginStartFailure(t *testing.T) {
+	s := newTestServer(t)
+
+	s.conf.Plugins = [][]string{{"/nonexistent/plugin"}}
+	if err := s.startPlugins(); err == nil {
+		t.Error("missing plugin started")
+	}
+
+	s.conf.Plugins = [][]string{{"sh", "-c", "read request; echo '{\"id\":1,\"error\":\"unsupported\"}'"}}
+	if err := s.startPlugins(); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("failed handshake: got error %v", err)
+	}
+}
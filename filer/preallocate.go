@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package filer
+
+import (
+	"os"
+	"syscall"
+)
+
+// Allocates blocks without changing the size of the file, see fallocate(2)
+const fallocKeepSize = 0x1
+
+/*
+ * Reserves size bytes of disk space for file, so large uploads are stored
+ * contiguously and a full disk is noticed before the body is received.
+ * Returns false if the filesystem doesn't support it.
+ */
+func preallocate(file *os.File, size int64) (bool, error) {
+	for {
+		err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return false, nil
+		}
+		return false, &os.PathError{Op: "fallocate", Path: file.Name(), Err: err}
+	}
+}
+
+/*
+ * Gives back space preallocated beyond the end of file, e.g. if the stored
+ * file has been compressed
+ */
+func trimPreallocated(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return file.Truncate(info.Size())
+}
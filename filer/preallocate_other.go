@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package filer
+
+import "os"
+
+func preallocate(file *os.File, size int64) (bool, error) {
+	return false, nil
+}
+
+func trimPreallocated(file *os.File) error {
+	return nil
+}
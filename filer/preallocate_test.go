@@ -0,0 +1,53 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	preallocated, err := preallocate(file, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("abc"))
+	if preallocated {
+		if err := trimPreallocated(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != 3 {
+		t.Errorf("preallocation changed the file size: %v %v", info.Size(), err)
+	}
+}
+
+/*
+ * Files stored smaller than their upload are not padded
+ */
+func TestPreallocatedUpload(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.PreallocateUploads = true
+	s.conf.CompressFiles = true
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := bytes.Repeat([]byte("compressible "), 10000)
+	if rr := s.uploadFile(t, "abc/file.txt", content); rr.Code != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/abc/file.txt", nil)
+	if rr := s.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download returned %v, %d bytes", rr.Code, rr.Body.Len())
+	}
+}
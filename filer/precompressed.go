@@ -0,0 +1,151 @@
+/*
+ * Precompressed downloads
+ * With servePrecompressed, files are sent compressed to clients which
+ * accept it: files compressed at rest are sent as their zstd frames
+ * without decompressing them, and files with a sibling "<file>.br" or
+ * "<file>.gz" (e.g. uploaded by a client or prepared by an admin) are sent
+ * as that file, with the matching Content-Encoding.
+ */
+
+package filer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Sibling files, in order of preference
+ */
+var precompressedSiblings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+/*
+ * A compressed representation of a stored file
+ */
+type precompressedVariant struct {
+	encoding string
+	content  io.ReadSeeker
+	close    func() error
+}
+
+/*
+ * Returns the content codings r accepts, "identity" aside
+ */
+func acceptedEncodings(r *http.Request) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding == "" || coding == "identity" {
+				continue
+			}
+			acceptable := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					acceptable = err == nil && q > 0
+				}
+			}
+			accepted[coding] = acceptable
+		}
+	}
+	return accepted
+}
+
+/*
+ * Finds a compressed representation of fileStorePath which r accepts.
+ * Returns nil if there is none.
+ */
+func (s *Server) findPrecompressed(r *http.Request, fileStorePath string, stored *storedFile) *precompressedVariant {
+	if !s.conf.ServePrecompressed || isCompressedContentType(extensionContentType(fileStorePath)) {
+		return nil
+	}
+	accepted := acceptedEncodings(r)
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	if stored.decompressor != nil && accepted["zstd"] {
+		return &precompressedVariant{
+			encoding: "zstd",
+			content:  stored.decompressor.frames(),
+			close:    func() error { return nil },
+		}
+	}
+
+	for _, sibling := range precompressedSiblings {
+		if !accepted[sibling.encoding] {
+			continue
+		}
+		variant, err := s.openBackendFile(fileStorePath + sibling.extension)
+		if err != nil {
+			continue
+		}
+		return &precompressedVariant{encoding: sibling.encoding, content: variant.content(), close: variant.Close}
+	}
+	return nil
+}
+
+/*
+ * Returns the compressed frames, without frame table, which form a valid
+ * zstd stream
+ */
+func (d *decompressingReader) frames() io.ReadSeeker {
+	return &sectionReadSeeker{src: d.src, size: d.frameOffsets[len(d.frameOffsets)-1]}
+}
+
+/*
+ * Reads the first size bytes of src
+ */
+type sectionReadSeeker struct {
+	src  io.ReadSeeker
+	size int64
+	pos  int64
+}
+
+func (s *sectionReadSeeker) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.size-s.pos {
+		p = p[:s.size-s.pos]
+	}
+	if _, err := s.src.Seek(s.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := s.src.Read(p)
+	s.pos += int64(n)
+	if err == io.EOF && s.pos < s.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *sectionReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	s.pos = offset
+	return offset, nil
+}
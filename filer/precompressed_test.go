@@ -0,0 +1,129 @@
+package filer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0.8, br;q=0, ZSTD, identity")
+	accepted := acceptedEncodings(req)
+	if !accepted["gzip"] || accepted["br"] || !accepted["zstd"] || accepted["identity"] {
+		t.Errorf("unexpected encodings: %v", accepted)
+	}
+}
+
+/*
+ * Files compressed at rest are sent as zstd, with and without encryption
+ */
+func TestServePrecompressedZstd(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ServePrecompressed = true
+
+	// Several frames
+	content := []byte(strings.Repeat("Jan 01 00:00:00 host daemon[123]: something happened\n", 50000))
+	for _, key := range []string{"", testEncryptionKey} {
+		func() {
+			// Remove uploaded file after test
+			defer s.cleanup()
+
+			s.conf.CompressFiles = true
+			s.conf.EncryptionKey = key
+			if err := s.loadEncryptionKey(); err != nil {
+				t.Fatal(err)
+			}
+			s.uploadFile(t, "thomas/abc/daemon.log", content)
+
+			req, _ := http.NewRequest("GET", "/upload/thomas/abc/daemon.log", nil)
+			req.Header.Set("Accept-Encoding", "gzip, zstd")
+			rr := s.serveUpload(req)
+			if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "zstd" {
+				t.Fatalf("got %v %v", rr.Code, rr.Header())
+			}
+			if rr.Header().Get("Content-Type") != extensionContentType("daemon.log") || rr.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("unexpected headers: %v", rr.Header())
+			}
+			if rr.Body.Len() >= len(content)/10 {
+				t.Errorf("response has not been compressed: %d bytes", rr.Body.Len())
+			}
+
+			decoder, _ := zstd.NewReader(nil)
+			defer decoder.Close()
+			decoded, err := decoder.DecodeAll(rr.Body.Bytes(), nil)
+			if err != nil || !bytes.Equal(decoded, content) {
+				t.Errorf("zstd response does not decode to the original content: %v", err)
+			}
+
+			// Without zstd, the file is decompressed
+			req, _ = http.NewRequest("GET", "/upload/thomas/abc/daemon.log", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr = s.serveUpload(req)
+			if rr.Header().Get("Content-Encoding") != "" || !bytes.Equal(rr.Body.Bytes(), content) {
+				t.Errorf("uncompressed download failed: %v", rr.Header())
+			}
+		}()
+	}
+}
+
+/*
+ * Sibling .gz files are sent to clients accepting gzip
+ */
+func TestServePrecompressedSibling(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.ServePrecompressed = true
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte(strings.Repeat("body { color: black; }\n", 1000))
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+	s.uploadFile(t, "thomas/abc/style.css", content)
+	s.uploadFile(t, "thomas/abc/style.css.gz", compressed.Bytes())
+
+	req, _ := http.NewRequest("GET", "/upload/thomas/abc/style.css", nil)
+	req.Header.Set("Accept-Encoding", "br;q=0, gzip")
+	rr := s.serveUpload(req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(rr.Body.Bytes(), compressed.Bytes()) {
+		t.Fatalf("got %v %v", rr.Code, rr.Header())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("wrong content type: %s", rr.Header().Get("Content-Type"))
+	}
+	gzipETag := rr.Header().Get("ETag")
+	if !strings.HasSuffix(gzipETag, `-gzip"`) {
+		t.Errorf("ETag of compressed response must differ: %s", gzipETag)
+	}
+
+	reader, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(reader); !bytes.Equal(decoded, content) {
+		t.Errorf("gzip response does not decode to the original content")
+	}
+
+	// Without gzip, the original is sent
+	req, _ = http.NewRequest("GET", "/upload/thomas/abc/style.css", nil)
+	rr = s.serveUpload(req)
+	if rr.Header().Get("Content-Encoding") != "" || !bytes.Equal(rr.Body.Bytes(), content) || rr.Header().Get("ETag") == gzipETag {
+		t.Errorf("uncompressed download failed: %v", rr.Header())
+	}
+
+	// The compressed file itself is sent as it is
+	req, _ = http.NewRequest("GET", "/upload/thomas/abc/style.css.gz", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr = s.serveUpload(req)
+	if rr.Header().Get("Content-Encoding") != "" || !bytes.Equal(rr.Body.Bytes(), compressed.Bytes()) {
+		t.Errorf("download of .gz file failed: %v", rr.Header())
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Preview pages
+ * With previewPages enabled, browsers opening an upload URL get a small
+ * page with the file name, size and a download button, plus OpenGraph and
+ * Twitter meta tags for link previews. XMPP clients don't ask for HTML and
+ * still get the file itself, as does the download button ("?raw"). The page
+ * shows a QR code of the link, see qr.go.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<meta property="og:title" content="{{.Name}}">
+<meta property="og:description" content="{{.Size}}, {{.ContentType}}">
+<meta property="og:url" content="{{.URL}}">
+{{- if eq .Kind "image"}}
+<meta property="og:type" content="website">
+<meta property="og:image" content="{{.RawURL}}">
+<meta property="og:image:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.RawURL}}">
+{{- else if eq .Kind "video"}}
+<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.RawURL}}">
+<meta property="og:video:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{- else if eq .Kind "audio"}}
+<meta property="og:type" content="music.song">
+<meta property="og:audio" content="{{.RawURL}}">
+<meta property="og:audio:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary">
+{{- else}}
+<meta property="og:type" content="website">
+<meta name="twitter:card" content="summary">
+{{- end}}
+<meta name="twitter:title" content="{{.Name}}">
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; text-align: center; }
+img, video, audio { max-width: 100%; margin: 1em 0; }
+a.button { display: inline-block; padding: .6em 1.2em; border-radius: .3em; background: #1a73e8; color: #fff; text-decoration: none; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>{{.Size}}, {{.ContentType}}</p>
+{{- if eq .Kind "image"}}
+<img src="{{.RawURL}}" alt="{{.Name}}">
+{{- else if eq .Kind "video"}}
+<video src="{{.RawURL}}" controls preload="metadata"></video>
+{{- else if eq .Kind "audio"}}
+<audio src="{{.RawURL}}" controls preload="metadata"></audio>
+{{- end}}
+<p><a class="button" href="{{.RawURL}}" download="{{.Name}}">Download</a></p>
+{{- if .ShortURL}}
+<p>Short link: <a href="{{.ShortURL}}">{{.ShortURL}}</a></p>
+{{- end}}
+{{- if .QRCode}}
+<p><img src="{{.QRCode}}" alt="QR code" width="200" height="200"></p>
+{{- end}}
+</body>
+</html>
+`))
+
+type previewData struct {
+	Name        string
+	Size        string
+	ContentType string
+	// "image", "video", "audio" or "" for files shown inline
+	Kind   string
+	URL    string
+	RawURL string
+	// Short URL, if the file has one
+	ShortURL string
+	// QR code image of the link
+	QRCode string
+}
+
+/*
+ * Reports whether a download request should get the preview page
+ */
+func (s *Server) wantsPreview(r *http.Request) bool {
+	if !s.conf.PreviewPages || r.Method != http.MethodGet {
+		return false
+	}
+	if _, raw := r.URL.Query()["raw"]; raw {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+/*
+ * Writes the preview page for a stored file
+ */
+func (s *Server) servePreviewPage(w http.ResponseWriter, r *http.Request, fileStorePath string, size int64) {
+	contentType := extensionContentType(fileStorePath)
+	kind := ""
+	if major := strings.SplitN(contentType, "/", 2)[0]; major == "image" || major == "video" || major == "audio" {
+		kind = major
+	}
+
+	pageURL := s.requestBaseURL(r) + r.URL.EscapedPath()
+	data := previewData{
+		Name:        path.Base(fileStorePath),
+		Size:        formatSize(size),
+		ContentType: contentType,
+		Kind:        kind,
+		URL:         pageURL,
+		RawURL:      pageURL + "?raw",
+	}
+	if meta, err := s.readMetadata(fileStorePath); err == nil && meta.ShortURL != "" && s.conf.ShortURLs {
+		data.ShortURL = s.shortURL(r, meta.ShortURL)
+	}
+	if s.servesQRCodes() {
+		data.QRCode = "/qr/" + (&url.URL{Path: fileStorePath}).EscapedPath()
+	}
+
+	var page bytes.Buffer
+	err := previewTemplate.Execute(&page, data)
+	if err != nil {
+		log.Error("Rendering preview page failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(page.Bytes())
+}
+
+/*
+ * Returns scheme and host the request was sent to, e.g.
+ * "https://upload.example.com", followed by the path prefix stripped by a
+ * reverse proxy, if any. Behind trusted proxies, these are the ones the
+ * client used.
+ */
+func (s *Server) requestBaseURL(r *http.Request) string {
+	if s.conf.PublicURL != "" {
+		if u, err := url.Parse(s.conf.PublicURL); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return s.requestScheme(r) + "://" + s.requestHost(r) + (&url.URL{Path: s.forwardedPrefix(r)}).EscapedPath()
+}
+
+/*
+ * Returns the absolute URL of a stored file, as seen by the client of r
+ */
+func (s *Server) fileURL(r *http.Request, fileStorePath string) string {
+	return s.requestBaseURL(r) + path.Join("/", s.conf.UploadSubDir) + "/" + (&url.URL{Path: fileStorePath}).EscapedPath()
+}
+
+/*
+ * Formats a file size for humans, e.g. "1.5 MiB"
+ */
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < 5 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[unit-1])
+}
@@ -0,0 +1,64 @@
+package filer
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreviewPage(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.PreviewPages = true
+	defer s.cleanup()
+
+	if rr := s.serveUpload(s.newUploadRequest(t, "preview/cat.jpg", []byte("meow"))); rr.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %v", rr.Code)
+	}
+
+	// Browsers get the preview page
+	req, _ := http.NewRequest("GET", "/upload/preview/cat.jpg", nil)
+	req.Host = "upload.example.com"
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rr := s.serveUpload(req)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("preview page: got %v, %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`<meta property="og:image" content="http://upload.example.com/upload/preview/cat.jpg?raw">`,
+		`<meta property="og:title" content="cat.jpg">`,
+		`4 bytes, image/jpeg`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("preview page is missing %s", want)
+		}
+	}
+	if rr.Header().Get("Vary") != "Accept" {
+		t.Errorf("missing Vary header")
+	}
+
+	// The download button and other clients get the file
+	req, _ = http.NewRequest("GET", "/upload/preview/cat.jpg?raw", nil)
+	req.Header.Set("Accept", "text/html")
+	if rr := s.serveUpload(req); rr.Body.String() != "meow" {
+		t.Errorf("raw download: got %q", rr.Body)
+	}
+	req, _ = http.NewRequest("GET", "/upload/preview/cat.jpg", nil)
+	req.Header.Set("Accept", "*/*")
+	if rr := s.serveUpload(req); rr.Body.String() != "meow" {
+		t.Errorf("client download: got %q", rr.Body)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for size, want := range map[int64]string{
+		0:       "0 bytes",
+		1023:    "1023 bytes",
+		1536:    "1.5 KiB",
+		5 << 30: "5.0 GiB",
+	} {
+		if got := formatSize(size); got != want {
+			t.Errorf("formatSize(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
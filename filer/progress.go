@@ -0,0 +1,177 @@
+/*
+ * Upload progress
+ * Uploads are tracked while they are received, so operators can tell
+ * whether a large upload is progressing or stuck: the admin API lists them,
+ * and uploads of at least progressLogSize bytes are logged every
+ * progressLogInterval with the rate since the last message and the time
+ * left. Uploads of unknown size are logged once they reach progressLogSize.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * An upload being received, counting the bytes read from its body
+ */
+type uploadProgress struct {
+	// Accessed atomically, first for alignment on 32 bit platforms
+	received int64
+
+	path     string
+	clientIP string
+	size     int64
+	started  time.Time
+	src      io.Reader
+
+	// Only used by the progress log
+	loggedReceived int64
+	loggedAt       time.Time
+}
+
+func (p *uploadProgress) Read(b []byte) (int, error) {
+	n, err := p.src.Read(b)
+	atomic.AddInt64(&p.received, int64(n))
+	return n, err
+}
+
+/*
+ * Tracks the upload of fileStorePath in r until untrackUpload is called.
+ * The body has to be read through the returned uploadProgress.
+ */
+func (s *Server) trackUpload(fileStorePath string, r *http.Request) *uploadProgress {
+	progress := &uploadProgress{
+		path:     fileStorePath,
+		clientIP: s.clientIP(r),
+		size:     r.ContentLength,
+		started:  time.Now(),
+		src:      r.Body,
+	}
+	progress.loggedAt = progress.started
+
+	s.uploadsInFlight.Lock()
+	s.uploadsInFlight.uploads[progress] = true
+	s.uploadsInFlight.Unlock()
+	return progress
+}
+
+func (s *Server) untrackUpload(progress *uploadProgress) {
+	s.uploadsInFlight.Lock()
+	delete(s.uploadsInFlight.uploads, progress)
+	s.uploadsInFlight.Unlock()
+}
+
+/*
+ * Returns the uploads being received, oldest first
+ */
+func (s *Server) uploadsInProgress() []*uploadProgress {
+	s.uploadsInFlight.Lock()
+	uploads := make([]*uploadProgress, 0, len(s.uploadsInFlight.uploads))
+	for progress := range s.uploadsInFlight.uploads {
+		uploads = append(uploads, progress)
+	}
+	s.uploadsInFlight.Unlock()
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].started.Before(uploads[j].started)
+	})
+	return uploads
+}
+
+/*
+ * Returns the time left at rate bytes per second, or 0 if unknown
+ */
+func (p *uploadProgress) timeLeft(received int64, rate float64) time.Duration {
+	if p.size < 0 || rate <= 0 || received >= p.size {
+		return 0
+	}
+	return time.Duration(float64(p.size-received) / rate * float64(time.Second)).Round(time.Second)
+}
+
+func (s *Server) startProgressLog() {
+	go func() {
+		for {
+			time.Sleep(s.conf.ProgressLogInterval)
+			s.logProgress()
+		}
+	}()
+}
+
+/*
+ * Logs the progress of large uploads
+ */
+func (s *Server) logProgress() {
+	now := time.Now()
+	for _, progress := range s.uploadsInProgress() {
+		received := atomic.LoadInt64(&progress.received)
+		if progress.size < s.conf.ProgressLogSize && received < s.conf.ProgressLogSize {
+			continue
+		}
+
+		status := formatSize(received)
+		if progress.size >= 0 {
+			status = fmt.Sprintf("%s of %s (%d%%)", status, formatSize(progress.size), received*100/progress.size)
+		}
+		elapsed := now.Sub(progress.loggedAt)
+		rate := float64(received-progress.loggedReceived) / elapsed.Seconds()
+		progress.loggedReceived, progress.loggedAt = received, now
+
+		if rate == 0 {
+			log.Warnf("Upload of %s from %s stalled: %s received, nothing in the last %s", progress.path, progress.clientIP, status, elapsed.Round(time.Second))
+		} else if left := progress.timeLeft(received, rate); left > 0 {
+			log.Infof("Upload of %s from %s: %s received, %s/s, %s left", progress.path, progress.clientIP, status, formatSize(int64(rate)), left)
+		} else {
+			log.Infof("Upload of %s from %s: %s received, %s/s", progress.path, progress.clientIP, status, formatSize(int64(rate)))
+		}
+	}
+}
+
+/*
+ * An upload being received, as listed by the admin API
+ */
+type uploadStatus struct {
+	Path     string    `json:"path"`
+	ClientIP string    `json:"clientIP"`
+	Size     int64     `json:"size"`
+	Received int64     `json:"received"`
+	Started  time.Time `json:"started"`
+	// Average bytes per second, and estimated seconds left if the size is known
+	Rate     int64 `json:"rate"`
+	TimeLeft int64 `json:"timeLeft,omitempty"`
+}
+
+/*
+ * Uploads endpoint:
+ *   GET /uploads   List uploads being received, oldest first. size is -1
+ *                  for uploads of unknown size.
+ */
+func (s *Server) handleAdminUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	now := time.Now()
+	uploads := []uploadStatus{}
+	for _, progress := range s.uploadsInProgress() {
+		received := atomic.LoadInt64(&progress.received)
+		rate := float64(received) / now.Sub(progress.started).Seconds()
+		uploads = append(uploads, uploadStatus{
+			Path:     progress.path,
+			ClientIP: progress.clientIP,
+			Size:     progress.size,
+			Received: received,
+			Started:  progress.started.UTC(),
+			Rate:     int64(rate),
+			TimeLeft: int64(progress.timeLeft(received, rate).Seconds()),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"uploads": uploads})
+}
@@ -0,0 +1,82 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Uploads being received are listed by the admin API and logged
+ */
+func TestUploadProgress(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+	s.conf.ProgressLogSize = 1000
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := bytes.Repeat([]byte("0123456789"), 200)
+	reader, writer := io.Pipe()
+	req := s.newUploadRequest(t, "abc/big.bin", content)
+	req.Body = reader
+	req.RemoteAddr = "192.0.2.1:1234"
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- s.serveUpload(req)
+	}()
+	writer.Write(content[:1000])
+
+	var listed struct {
+		Uploads []uploadStatus `json:"uploads"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rr := s.adminRequest(t, "GET", "/uploads")
+		if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("invalid response %q: %s", rr.Body.String(), err)
+		}
+		if len(listed.Uploads) == 1 && listed.Uploads[0].Received == 1000 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("upload not listed: %+v", listed)
+		}
+	}
+	if upload := listed.Uploads[0]; upload.Path != "abc/big.bin" || upload.ClientIP != "192.0.2.1" || upload.Size != int64(len(content)) {
+		t.Errorf("unexpected upload %+v", upload)
+	}
+
+	output := new(bytes.Buffer)
+	previousOut, previousLevel := log.Out, log.GetLevel()
+	log.Out = output
+	log.SetLevel(logrus.InfoLevel)
+	defer func() {
+		log.Out = previousOut
+		log.SetLevel(previousLevel)
+	}()
+	s.logProgress()
+	if !strings.Contains(output.String(), "abc/big.bin from 192.0.2.1: 1000 bytes of 2.0 KiB (50%) received, ") {
+		t.Errorf("unexpected progress message: %s", output.String())
+	}
+	output.Reset()
+	s.logProgress()
+	if !strings.Contains(output.String(), "stalled") {
+		t.Errorf("stalled upload not reported: %s", output.String())
+	}
+
+	writer.Write(content[1000:])
+	writer.Close()
+	if rr := <-done; rr.Code != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if uploads := s.uploadsInProgress(); len(uploads) != 0 {
+		t.Errorf("finished upload still tracked: %+v", uploads)
+	}
+}
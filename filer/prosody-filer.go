@@ -0,0 +1,683 @@
+/*
+ * This module allows upload via mod_http_upload_external
+ * Also see: https://modules.prosody.im/mod_http_upload_external.html
+ */
+
+package filer
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+	"github.com/ThomasLeister/prosody-filer/internal/config"
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Configuration of this server, see internal/config
+ */
+type Config = config.Config
+
+var log = &logrus.Logger{
+	Out:       os.Stdout,
+	Formatter: new(logrus.TextFormatter),
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.DebugLevel,
+}
+
+var ALLOWED_METHODS string = strings.Join(
+	[]string{
+		http.MethodOptions,
+		http.MethodHead,
+		http.MethodGet,
+		http.MethodPut,
+	},
+	", ",
+)
+
+/*
+ * Sets CORS headers
+ */
+func addCORSheaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", ALLOWED_METHODS)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Encoding, Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, Location, X-Max-File-Size, X-Short-URL")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Max-Age", "7200")
+}
+
+/*
+ * Answers with an error: the status text, followed by detail if not empty.
+ * Details are shown to clients and must not contain paths or error
+ * messages of the system, which only belong in the log.
+ */
+func httpError(w http.ResponseWriter, status int, detail string) {
+	message := http.StatusText(status)
+	if detail != "" {
+		message += ": " + detail
+	}
+	http.Error(w, message, status)
+}
+
+/*
+ * Handlers for the methods allowed below uploadSubDir
+ */
+var uploadMethods = map[string]func(s *Server, w http.ResponseWriter, r *http.Request, fileStorePath string){
+	http.MethodPut:     (*Server).handleUpload,
+	http.MethodGet:     (*Server).handleDownload,
+	http.MethodHead:    (*Server).handleDownload,
+	http.MethodDelete:  (*Server).handleDelete,
+	http.MethodOptions: (*Server).handleOptions,
+}
+
+/*
+ * Request handler
+ * Is activated when a clients requests the file, file information or an upload
+ */
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	// Parse URL and args
+	p := r.URL.Path
+
+	_, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		log.Warn("Failed to parse query: ", err)
+		httpError(w, http.StatusBadRequest, "invalid query")
+		return
+	}
+
+	subDir, storeSubtree := s.matchUploadSubDir(p)
+	fileStorePath := strings.TrimPrefix(p, path.Join("/", subDir))
+	if (fileStorePath == "" || fileStorePath == "/") && s.conf.LandingPage && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		s.serveLandingPage(w, r)
+		return
+	} else if fileStorePath == "" || fileStorePath == "/" {
+		log.Warn("Access to / forbidden")
+		httpError(w, http.StatusForbidden, "")
+		return
+	} else if fileStorePath[0] == '/' {
+		fileStorePath = fileStorePath[1:]
+	}
+
+	if storeSubtree != "" {
+		fileStorePath = storeSubtree + "/" + fileStorePath
+	}
+	if err := checkStorePath(fileStorePath, windowsPaths); err != nil {
+		log.Warn("Rejected invalid path ", fileStorePath, ": ", err)
+		httpError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if isInternalPath(fileStorePath) {
+		log.Warn("Access to internal directory forbidden")
+		httpError(w, http.StatusForbidden, "")
+		return
+	}
+
+	handler, ok := uploadMethods[r.Method]
+	if !ok {
+		// Client is using a prohibited / unsupported method
+		log.Warn("Invalid method ", r.Method, " for access to ", subDir)
+		w.Header().Set("Allow", ALLOWED_METHODS)
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	w, done := s.trackRequest(w, r, fileStorePath)
+	defer done()
+	handler(s, w, r, fileStorePath)
+}
+
+/*
+ * User client tries to upload file
+ */
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	if s.rejectReadOnly(w) || s.rejectUnavailableStorage(w) {
+		return
+	}
+
+	gzipped, err := s.uploadGzipped(r)
+	if err != nil {
+		s.rejectContentEncoding(w, r)
+		return
+	}
+
+	// Size of the whole file, signed by the MAC. Resumed uploads only send a part of it.
+	subDir, storeSubtree := s.matchUploadSubDir(r.URL.Path)
+	upload := Upload{Path: signedUploadPath(fileStorePath, storeSubtree), EscapedPath: escapedStorePath(r, subDir), SubDir: subDir, Size: r.ContentLength}
+
+	// The XMPP server signed the path as seen in front of the reverse proxy
+	if prefix := s.forwardedPrefix(r); prefix != "" {
+		upload.Path = path.Join(prefix[1:], upload.Path)
+		upload.EscapedPath = path.Join((&url.URL{Path: prefix[1:]}).EscapedPath(), upload.EscapedPath)
+	}
+	var contentRange *uploadRange
+	if gzipped && r.Header.Get("Content-Range") != "" {
+		log.Warn("Rejected resumed upload with Content-Encoding gzip")
+		httpError(w, http.StatusBadRequest, "compressed uploads can't be resumed")
+		return
+	} else if gzipped {
+		// Not known before the body has been decompressed
+		r.Body = newGzipBody(r.Body)
+		r.ContentLength = -1
+		upload.Size = -1
+	} else if s.conf.ResumableUploads && r.Header.Get("Content-Range") != "" {
+		contentRange, err = parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil {
+			log.Warn("Rejected upload with invalid Content-Range ", r.Header.Get("Content-Range"))
+			httpError(w, http.StatusBadRequest, "invalid Content-Range")
+			return
+		}
+		upload.Size = contentRange.total
+	}
+
+	if upload.Size < 0 && s.conf.ChunkedUploads != "verify" && !gzipped {
+		log.Warn("Rejected chunked upload without Content-Length")
+		httpError(w, http.StatusLengthRequired, "uploads must be sent with a Content-Length header")
+		return
+	}
+	// The MAC is checked once the body has been received, which must not fill the disk meanwhile
+	if upload.Size < 0 && s.sizeLimit(fileStorePath) <= 0 {
+		log.Warn("Rejected upload of unknown size to ", fileStorePath, ": no size limit applies")
+		httpError(w, http.StatusLengthRequired, "uploads must be sent with a Content-Length header")
+		return
+	}
+
+	if expires, err := uploadExpiry(r.URL.Query()); err != nil || (expires != 0 && expires <= time.Now().Unix()) {
+		log.Warn("Rejected upload with invalid or past exp parameter ", r.URL.Query().Get("exp"))
+		httpError(w, http.StatusBadRequest, "invalid exp parameter")
+		return
+	}
+	if _, err := uploadMaxDownloads(r.URL.Query()); err != nil {
+		log.Warn("Rejected upload with invalid maxdl parameter ", r.URL.Query().Get("maxdl"))
+		httpError(w, http.StatusBadRequest, "invalid maxdl parameter")
+		return
+	}
+
+	if err := s.auth.ValidatePut(r, upload); err != nil {
+		if authErr, ok := err.(*AuthError); ok && authErr.Invalid {
+			s.countUploadMAC(r, upload.SubDir, false)
+		}
+		s.rejectUnauthorized(w, r, err)
+		return
+	} else if upload.Size >= 0 {
+		s.countUploadMAC(r, upload.SubDir, true)
+	}
+	if !s.luaPreUpload(w, r, fileStorePath, upload.Size) {
+		return
+	}
+
+	/*
+	 * Chunked uploads don't announce their size, which is part of the MAC.
+	 * If allowed, the MAC is checked against the number of bytes received.
+	 */
+	var verifySize func(size int64) bool
+	if upload.Size < 0 {
+		verifySize = func(size int64) bool {
+			upload.Size = size
+			valid := s.auth.ValidatePut(r, upload) == nil
+			s.countUploadMAC(r, upload.SubDir, valid)
+			return valid
+		}
+	}
+
+	// Upstream serializes forwarded uploads itself
+	if s.conf.UpstreamURL == "" {
+		unlock, err := s.lockPath(r.Context(), fileStorePath)
+		if err != nil && r.Context().Err() != nil {
+			uploadsAbortedMetric.add("", 1)
+			log.Error("Upload of ", fileStorePath, " aborted while waiting for another upload to the same path")
+			return
+		} else if err != nil {
+			httpError(w, http.StatusInternalServerError, "")
+			log.Error("Failed to lock ", fileStorePath, ": ", err)
+			return
+		}
+		defer unlock()
+	}
+
+	if s.conf.UpstreamURL != "" {
+		err = s.forwardUpload(fileStorePath, upload, verifySize, w, r)
+	} else if contentRange != nil {
+		err = s.resumeUpload(fileStorePath, contentRange, w, r)
+	} else if s.conf.ResumableUploads && verifySize == nil {
+		err = s.createResumableFile(fileStorePath, w, r)
+	} else {
+		err = s.createFile(fileStorePath, verifySize, w, r)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+/*
+ * User client tries to download a file
+ */
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	if err := s.auth.ValidateGet(r, fileStorePath); err != nil {
+		s.rejectUnauthorized(w, r, err)
+		return
+	}
+
+	if s.conf.UpstreamURL != "" {
+		s.forwardDownload(w, r, fileStorePath)
+		return
+	}
+
+	storedFile, err := s.openBackendFile(fileStorePath)
+	if os.IsNotExist(err) && s.isQuarantined(fileStorePath) {
+		log.Warn("Access to quarantined file ", fileStorePath)
+		httpError(w, s.conf.QuarantineStatus, "")
+		return
+	} else if os.IsNotExist(err) {
+		log.Error("Getting file information failed:", err)
+		s.recordNotFound(r)
+		httpError(w, http.StatusNotFound, "")
+		return
+	} else if err == storage.ErrIsDirectory {
+		log.Warning("Directory listing forbidden!")
+		httpError(w, http.StatusForbidden, "")
+		return
+	} else if err != nil {
+		log.Error("Opening file failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+	defer storedFile.Close()
+
+	// Metadata is missing for files stored by older versions
+	meta, err := s.readMetadata(fileStorePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("Reading metadata failed: ", err)
+	}
+	if meta.expired() {
+		storedFile.Close()
+		s.removeExpiredFile(fileStorePath)
+		httpError(w, http.StatusNotFound, "")
+		return
+	}
+
+	if len(s.plugins) > 0 {
+		err := s.checkDownloadPlugins(pluginDownload{
+			Path:       fileStorePath,
+			Size:       storedFile.size,
+			Method:     r.Method,
+			RemoteAddr: s.clientIP(r),
+		})
+		if veto, ok := err.(*pluginVeto); ok {
+			log.Warn("Rejected download of ", fileStorePath, ": ", veto)
+			httpError(w, http.StatusForbidden, "")
+			return
+		} else if err != nil {
+			if err = s.handlePluginFailure(err); err != nil {
+				log.Error(err)
+				httpError(w, http.StatusServiceUnavailable, "")
+				return
+			}
+		}
+	}
+	headers, err := s.callLuaHook("pre_download", map[string]interface{}{
+		"path":         fileStorePath,
+		"size":         storedFile.size,
+		"content_type": extensionContentType(fileStorePath),
+		"attributes":   meta.Attributes,
+		"method":       r.Method,
+		"remote_addr":  s.clientIP(r),
+		"headers":      luaHeaders(r.Header),
+	}, "response_headers")
+	if veto, ok := err.(*pluginVeto); ok {
+		log.Warn("Rejected download of ", fileStorePath, ": ", veto)
+		httpError(w, http.StatusForbidden, "")
+		return
+	} else if err != nil {
+		if err = s.handlePluginFailure(err); err != nil {
+			log.Error(err)
+			httpError(w, http.StatusServiceUnavailable, "")
+			return
+		}
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+
+	// Browsers and XMPP clients get different responses for the same URL
+	if s.conf.PreviewPages {
+		w.Header().Add("Vary", "Accept")
+	}
+	if s.wantsPreview(r) {
+		s.servePreviewPage(w, r, fileStorePath, storedFile.size)
+		return
+	}
+
+	burn := r.Method == http.MethodGet && s.burnsAfterReading(fileStorePath)
+	if burn {
+		reader, ok := s.claimBurn(w, r, fileStorePath)
+		if !ok {
+			return
+		}
+		defer reader.finish()
+		w = reader
+		// Only complete responses burn the file, so parts of it can't be read repeatedly
+		r.Header.Del("Range")
+	} else if r.Method == http.MethodGet && meta.MaxDownloads > 0 {
+		counter, ok := s.countDownload(w, r, fileStorePath)
+		if !ok {
+			httpError(w, http.StatusNotFound, "")
+			return
+		}
+		defer counter.finish()
+		w = counter
+		// Every download counts, so the file can't be read repeatedly in parts
+		r.Header.Del("Range")
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		s.publishEvent(fileEvent{
+			Type:        "download",
+			Path:        fileStorePath,
+			URL:         s.requestBaseURL(r) + r.URL.EscapedPath(),
+			Size:        storedFile.size,
+			ContentType: extensionContentType(fileStorePath),
+		})
+	}
+
+	name, err := s.downloadName(r, fileStorePath)
+	if err == errDownloadNameSignature {
+		log.Warn("Rejected download of ", fileStorePath, ": ", err)
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if name != "" {
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	} else if meta.Name != "" {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", meta.Name))
+	}
+
+	if s.conf.ServePrecompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	// Whether compressed downloads are complete can't be told from Content-Length
+	var variant *precompressedVariant
+	if !burn {
+		variant = s.findPrecompressed(r, fileStorePath, storedFile)
+	}
+	if variant != nil {
+		defer variant.close()
+	}
+
+	// Let clients download unencoded files from S3 or a CDN directly, unless
+	// there is a name to send, which redirect targets don't know about, or
+	// downloads are counted
+	if s.conf.DownloadRedirect != "" && !storedFile.encoded && variant == nil && w.Header().Get("Content-Disposition") == "" && meta.MaxDownloads == 0 && !burn {
+		location, err := s.downloadRedirectURL(fileStorePath)
+		if err == nil {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		log.Error("Redirecting download failed: ", err)
+	}
+
+	/*
+	 * Find out the content type to sent correct header. There is a Go function for retrieving the
+	 * MIME content type, but this does not work with encrypted files (=> OMEMO). Therefore we're just
+	 * relying on file extensions.
+	 */
+	w.Header().Set("Content-Type", extensionContentType(fileStorePath))
+
+	etag := fileETag(meta, storedFile)
+	if variant != nil {
+		// Compressed representations are different entities
+		w.Header().Set("Content-Encoding", variant.encoding)
+		etag = strings.TrimSuffix(etag, `"`) + "-" + variant.encoding + `"`
+	}
+	w.Header().Set("ETag", etag)
+
+	// All storage layers support seeking
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// Stored files never change, so they may be cached for a long time
+	if s.conf.CacheControl != "" {
+		w.Header().Set("Cache-Control", s.conf.CacheControl)
+	}
+
+	// Content-MD5 describes the response body, so it can't be sent for partial content
+	if s.conf.SendContentMD5 && meta.MD5 != "" && r.Header.Get("Range") == "" && variant == nil {
+		if sum, err := hex.DecodeString(meta.MD5); err == nil {
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+
+	// Whether offloaded downloads complete is unknown, and they can't be counted
+	if s.conf.DownloadOffload != "" && !storedFile.encoded && variant == nil && meta.MaxDownloads == 0 && !burn {
+		absFilename := s.findStoredFile(fileStorePath)
+		if local, ok := storedFile.file.(*storage.LocalFile); ok {
+			absFilename = local.Name()
+		}
+		err := s.offloadDownload(w, absFilename)
+		if err == nil {
+			return
+		}
+		log.Error("Offloading download failed: ", err)
+	}
+
+	// Handles HEAD, conditional and range requests
+	content := storedFile.content()
+	if variant != nil {
+		content = variant.content
+	}
+	if _, ok := content.(*os.File); !ok && s.conf.MediaReadBuffer > 0 && isMediaType(extensionContentType(fileStorePath)) {
+		content = newBufferedReadSeeker(content, s.conf.MediaReadBuffer)
+	}
+	http.ServeContent(w, r, path.Base(fileStorePath), storedFile.modTime, content)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	if err := s.auth.ValidateDelete(r, fileStorePath); err != nil {
+		s.rejectUnauthorized(w, r, err)
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+	if s.conf.UpstreamURL != "" {
+		httpError(w, http.StatusNotImplemented, "deletes are not forwarded upstream")
+		return
+	}
+
+	if err := s.deleteFile(fileStorePath, s.clientIP(r)); os.IsNotExist(err) {
+		httpError(w, http.StatusNotFound, "")
+	} else if err != nil {
+		log.Error("Deleting file failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+/*
+ * Client CORS request: Return allowed methods
+ */
+func (s *Server) handleOptions(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	w.Header().Set("Allow", ALLOWED_METHODS)
+}
+
+/*
+ * Returns the requested path below subDir as sent by the client, i.e. with
+ * percent-encoding
+ */
+func escapedStorePath(r *http.Request, subDir string) string {
+	escapedPath := strings.TrimPrefix(r.URL.EscapedPath(), path.Join("/", subDir))
+	return strings.TrimPrefix(escapedPath, "/")
+}
+
+/*
+ * Calculates the MAC of an upload of size bytes to fileStorePath, expiring at
+ * the Unix time expires (0 = never) or after maxDownloads downloads (0 =
+ * unlimited)
+ */
+func (s *Server) uploadMAC(protocolVersion string, fileStorePath string, size int64, expires int64, maxDownloads int64) string {
+	return hmacauth.Sign(s.conf.Secret, protocolVersion, fileStorePath, size, extensionContentType(fileStorePath), expires, maxDownloads)
+}
+
+/*
+ * Default values for settings which are missing in the config file
+ */
+func DefaultConfig() Config {
+	return config.Default()
+}
+
+/*
+ * Reads a config file and creates a server for it
+ */
+func readConfig(configFilename string) (*Server, error) {
+	config, err := LoadConfig(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(config)
+}
+
+/*
+ * Validates the config and loads the files it refers to
+ */
+func (s *Server) setup() error {
+	if err := s.validateConfig(); err != nil {
+		return err
+	}
+
+	if err := s.setupCluster(); err != nil {
+		return err
+	}
+
+	if err := s.loadEncryptionKey(); err != nil {
+		return err
+	}
+
+	if err := s.loadJWTKeys(); err != nil {
+		return err
+	}
+
+	if err := s.loadDownloadUsers(); err != nil {
+		return err
+	}
+
+	if err := s.setupOIDC(); err != nil {
+		return err
+	}
+
+	if err := s.loadErrorPages(); err != nil {
+		return err
+	}
+
+	if err := s.loadLandingPage(); err != nil {
+		return err
+	}
+
+	if err := s.checkFavicon(); err != nil {
+		return err
+	}
+
+	s.setupUpstream()
+
+	if windowsPaths {
+		if err := s.absoluteStoreDirs(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkStoreDir(); err != nil {
+		return err
+	}
+
+	if err := s.checkPermissions(); err != nil {
+		return err
+	}
+
+	if err := s.checkTempDir(); err != nil {
+		return err
+	}
+
+	return s.setupBackend()
+}
+
+/*
+ * Checks settings depending on other parts of the filer. Everything else
+ * is checked by Config.Validate.
+ */
+func (s *Server) validateConfig() error {
+	if err := s.conf.Validate(); err != nil {
+		return err
+	}
+	if err := s.checkSecrets(); err != nil {
+		return err
+	}
+
+	if s.conf.UploadLocking == "flock" && !flockSupported {
+		return fmt.Errorf("uploadLocking = \"flock\": %s", errFlockUnsupported)
+	}
+
+	if s.conf.SentryDSN != "" {
+		if _, err := parseSentryDSN(s.conf.SentryDSN); err != nil {
+			return err
+		}
+	}
+
+	for _, eventType := range s.conf.WebhookEvents {
+		if !isEventType(eventType) {
+			return fmt.Errorf("invalid webhookEvents entry %q: must be \"upload\", \"download\" or \"delete\"", eventType)
+		}
+	}
+	for _, eventType := range s.conf.HookEvents {
+		if !isEventType(eventType) {
+			return fmt.Errorf("invalid hookEvents entry %q: must be \"upload\", \"download\" or \"delete\"", eventType)
+		}
+	}
+	for _, eventType := range s.conf.BrokerEvents {
+		if !isEventType(eventType) {
+			return fmt.Errorf("invalid brokerEvents entry %q: must be \"upload\", \"download\" or \"delete\"", eventType)
+		}
+	}
+	if s.conf.NatsURL != "" {
+		if _, err := newNatsClient(s.conf.NatsURL); err != nil {
+			return err
+		}
+	}
+	if s.conf.MqttURL != "" {
+		if _, err := newMqttClient(s.conf.MqttURL); err != nil {
+			return err
+		}
+	}
+
+	networks, err := parseTrustedProxies(s.conf.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	s.trustedProxies = networks
+
+	return nil
+}
+
+func (s *Server) setLogLevel() {
+	switch s.conf.LogLevel {
+	case "info":
+		log.SetLevel(logrus.InfoLevel)
+	case "warn":
+		log.SetLevel(logrus.WarnLevel)
+	case "error":
+		log.SetLevel(logrus.ErrorLevel)
+	default:
+		log.SetLevel(logrus.WarnLevel)
+		fmt.Print("Invalid log level set in config. Defaulting to \"warn\"")
+	}
+}
@@ -0,0 +1,1143 @@
+package filer
+
+/*
+ * Manual testing with CURL
+ * Send with:
+ * curl -X PUT "http://localhost:5050/upload/thomas/abc/catmetal.jpg?v=7b8879e2d1c733b423a70cde30cecc3a3c64a03f790d1b5bcbb2a6aca52b477e" --data-binary '@catmetal.jpg'
+ * HMAC: 7b8879e2d1c733b423a70cde30cecc3a3c64a03f790d1b5bcbb2a6aca52b477e
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (s *Server) mockUpload() {
+	os.MkdirAll(filepath.Join(s.conf.StoreDir, "thomas/abc/"), os.ModePerm)
+	from, err := os.Open("testdata/catmetal.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(filepath.Join(s.conf.StoreDir, "thomas/abc/catmetal.jpg"), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer to.Close()
+
+	_, err = io.Copy(to, from)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/*
+ * Upload catmetal.jpg using the v1 / v MAC parameter and record the response
+ */
+func (s *Server) uploadCatmetal(t *testing.T) *httptest.ResponseRecorder {
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := req.URL.Query()
+	q.Add("v", "7b8879e2d1c733b423a70cde30cecc3a3c64a03f790d1b5bcbb2a6aca52b477e")
+	req.URL.RawQuery = q.Encode()
+
+	rr := httptest.NewRecorder()
+	handler := s.withMiddleware(http.HandlerFunc(s.handleRequest))
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+/*
+ * Upload arbitrary content to fileStorePath using a v1 / v MAC calculated
+ * with the configured secret and record the response
+ */
+func (s *Server) uploadFile(t *testing.T, fileStorePath string, content []byte) *httptest.ResponseRecorder {
+	return s.serveUpload(s.newUploadRequest(t, fileStorePath, content))
+}
+
+/*
+ * Builds an upload request with a valid "v" MAC, which can be modified
+ * before passing it to serveUpload()
+ */
+func (s *Server) newUploadRequest(t testing.TB, fileStorePath string, content []byte) *http.Request {
+	mac := hmac.New(sha256.New, []byte(s.conf.Secret))
+	mac.Write([]byte(fileStorePath + "\x20" + strconv.Itoa(len(content))))
+
+	req, err := http.NewRequest("PUT", "/upload/"+fileStorePath, bytes.NewBuffer(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := req.URL.Query()
+	q.Add("v", hex.EncodeToString(mac.Sum(nil)))
+	req.URL.RawQuery = q.Encode()
+
+	return req
+}
+
+func (s *Server) serveUpload(req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler := s.withMiddleware(http.HandlerFunc(s.handleRequest))
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+/*
+ * Remove all uploaded files after an upload test
+ */
+func (s *Server) cleanup() {
+	// Clean up
+	if _, err := os.Stat(s.conf.StoreDir); err == nil {
+		err := os.RemoveAll(s.conf.StoreDir)
+		if err != nil {
+			log.Println("Error while cleaning up:", err)
+		}
+	}
+}
+
+/*
+ * Creates a server with the test configuration
+ */
+func newTestServer(t testing.TB) *Server {
+	config, err := LoadConfig("../config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test MACs are signed with the example secret
+	config.WeakSecrets = "warn"
+	s, err := newServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+/*
+ * Writes the test configuration with settings prepended to a temporary
+ * file, for commands reading it
+ */
+func writeTestConfig(t testing.TB, settings string) string {
+	configData, err := os.ReadFile("../config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test MACs are signed with the example secret
+	settings += "\nweakSecrets = \"warn\"\n"
+	configFile := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(configFile, []byte(settings+string(configData)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+/*
+ * Test if reading the config file works
+ */
+func TestReadConfig(t *testing.T) {
+	// Set config
+	newTestServer(t)
+
+	log.SetLevel(logrus.FatalLevel)
+}
+
+/*
+ * Run an upload test using the v1 / v MAC parameter
+ */
+func TestUploadValidV1(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+	q := req.URL.Query()
+	q.Add("v", "7b8879e2d1c733b423a70cde30cecc3a3c64a03f790d1b5bcbb2a6aca52b477e")
+	req.URL.RawQuery = q.Encode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusCreated, rr.Body.String())
+	}
+}
+
+/*
+ * Run an upload test using the v2 MAC parameter
+ */
+func TestUploadValidV2(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+	q := req.URL.Query()
+	q.Add("v2", "7318cd44d4c40731e3b2ff869f553ab2326eae631868e7b8054db20d4aee1c06")
+	req.URL.RawQuery = q.Encode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusCreated, rr.Body.String())
+	}
+}
+
+/*
+ * Run an upload test using the token MAC parameter
+ */
+func TestUploadValidMetronomeToken(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+	q := req.URL.Query()
+	q.Add("token", "7318cd44d4c40731e3b2ff869f553ab2326eae631868e7b8054db20d4aee1c06")
+	req.URL.RawQuery = q.Encode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusCreated, rr.Body.String())
+	}
+}
+
+/*
+ * Run an upload test using no MAC parameter
+ */
+func TestUploadMissingMAC(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusForbidden, rr.Body.String())
+	}
+}
+
+/*
+ * Run an upload test using an invalid MAC parameter
+ */
+func TestUploadInvalidMAC(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("PUT", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+	q := req.URL.Query()
+	q.Add("v", "thisisinvalid")
+	req.URL.RawQuery = q.Encode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusForbidden, rr.Body.String())
+	}
+}
+
+/*
+ * Test upload using an invalid HTTP method (POST)
+ */
+func TestUploadInvalidMethod(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	// Read catmetal file
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create request
+	req, err := http.NewRequest("POST", "/upload/thomas/abc/catmetal.jpg", bytes.NewBuffer(catMetalFile))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusMethodNotAllowed, rr.Body.String())
+	}
+}
+
+/*
+ * Test if HEAD requests work
+ */
+func TestDownloadHead(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// Mock upload
+	s.mockUpload()
+	defer s.cleanup()
+
+	// Create request
+	req, err := http.NewRequest("HEAD", "/upload/thomas/abc/catmetal.jpg", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusOK, rr.Body.String())
+	}
+}
+
+/*
+ * Test if HEAD requests return the same headers as GET and honor conditionals
+ */
+func TestDownloadHeadConditional(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// Mock upload
+	s.mockUpload()
+	defer s.cleanup()
+
+	req, _ := http.NewRequest("HEAD", "/upload/thomas/abc/catmetal.jpg", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+
+	lastModified := rr.Header().Get("Last-Modified")
+	if lastModified == "" || rr.Header().Get("Accept-Ranges") != "bytes" || rr.Header().Get("Content-Length") == "" {
+		t.Errorf("HEAD is missing headers: %v", rr.Header())
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("HEAD returned a body")
+	}
+
+	req, _ = http.NewRequest("HEAD", "/upload/thomas/abc/catmetal.jpg", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("HEAD with If-Modified-Since returned wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+}
+
+/*
+ * Test if GET download requests work
+ */
+func TestDownloadGet(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// moch upload
+	s.mockUpload()
+	defer s.cleanup()
+
+	// Create request
+	req, err := http.NewRequest("GET", "/upload/thomas/abc/catmetal.jpg", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusOK, rr.Body.String())
+	}
+}
+
+/*
+ * Test if asking for an empty file name works
+ */
+func TestEmptyGet(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// Create request
+	req, err := http.NewRequest("GET", "", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusForbidden, rr.Body.String())
+	}
+}
+
+/*
+ * Check if access to subdirectory is forbidden.
+ * PASS if access is blocked with HTTP "Forbidden" response.
+ * FAIL if there is any other response or even a directory listing exposed.
+ * Introduced to check issue #14 (resolved in 7dff0209)
+ */
+func TestDirListing(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	s.mockUpload()
+	defer s.cleanup()
+
+	// Create request
+	req, err := http.NewRequest("GET", "/upload/thomas/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+
+	// Send request and record response
+	handler.ServeHTTP(rr, req)
+
+	// Check status code
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v. HTTP body: %s", status, http.StatusForbidden, rr.Body.String())
+	}
+}
+
+/*
+ * Check that the internal directory can't be accessed
+ */
+func TestInternalDirForbidden(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	// Case-insensitive filesystems would find the directory under other spellings
+	for _, dir := range []string{".prosody-filer", ".PROSODY-FILER", ".Prosody-Filer"} {
+		// Create request
+		req, err := http.NewRequest("GET", "/upload/"+dir+"/tmp/upload-123", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(s.handleRequest)
+
+		// Send request and record response
+		handler.ServeHTTP(rr, req)
+
+		// Check status code
+		if status := rr.Code; status != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v. HTTP body: %s", dir, status, http.StatusForbidden, rr.Body.String())
+		}
+	}
+}
+
+/*
+ * The MAC may be calculated over the percent-encoded path, depending on
+ * macPathEncoding
+ */
+func TestUploadMacPathEncoding(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte("umlauts")
+	upload := func(escapedPath string, macPath string) int {
+		req, err := http.NewRequest("PUT", "/upload/"+escapedPath, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.RawQuery = "v=" + s.uploadMAC("v", macPath, int64(len(content)), 0, 0)
+		return s.serveUpload(req).Code
+	}
+
+	if status := upload("abc/k%C3%A4se%201.txt", "abc/k%C3%A4se%201.txt"); status != http.StatusForbidden {
+		t.Errorf("MAC over escaped path: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("abc/k%C3%A4se%201.txt", "abc/käse 1.txt"); status != http.StatusCreated {
+		t.Errorf("MAC over decoded path: got %v want %v", status, http.StatusCreated)
+	}
+
+	s.conf.MacPathEncoding = "escaped"
+	if status := upload("abc/k%C3%A4se%202.txt", "abc/käse 2.txt"); status != http.StatusForbidden {
+		t.Errorf("MAC over decoded path: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("abc/k%C3%A4se%202.txt", "abc/k%C3%A4se%202.txt"); status != http.StatusCreated {
+		t.Errorf("MAC over escaped path: got %v want %v", status, http.StatusCreated)
+	}
+
+	s.conf.MacPathEncoding = "both"
+	if status := upload("abc/k%C3%A4se%203.txt", "abc/k%C3%A4se%203.txt"); status != http.StatusCreated {
+		t.Errorf("MAC over escaped path: got %v want %v", status, http.StatusCreated)
+	}
+	if status := upload("abc/k%C3%A4se%204.txt", "abc/käse 4.txt"); status != http.StatusCreated {
+		t.Errorf("MAC over decoded path: got %v want %v", status, http.StatusCreated)
+	}
+
+	if _, err := os.Stat(s.storagePath("abc/käse 3.txt")); err != nil {
+		t.Errorf("file has not been stored at the decoded path: %s", err)
+	}
+}
+
+/*
+ * Uploads without Content-Length are rejected unless the MAC is verified
+ * against the received size
+ */
+func TestUploadChunked(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte("chunked upload")
+	chunkedRequest := func(fileStorePath string, macSize int) *http.Request {
+		req := s.newUploadRequest(t, fileStorePath, make([]byte, macSize))
+		req.Body = io.NopCloser(bytes.NewReader(content))
+		req.ContentLength = -1
+		return req
+	}
+
+	if status := s.serveUpload(chunkedRequest("abc/chunked.txt", len(content))).Code; status != http.StatusLengthRequired {
+		t.Errorf("chunked upload returned wrong status code: got %v want %v", status, http.StatusLengthRequired)
+	}
+
+	// Without size limit, chunked uploads could fill the disk before their MAC is checked
+	s.conf.ChunkedUploads = "verify"
+	if status := s.serveUpload(chunkedRequest("abc/chunked.txt", len(content))).Code; status != http.StatusLengthRequired {
+		t.Errorf("chunked upload without size limit returned wrong status code: got %v want %v", status, http.StatusLengthRequired)
+	}
+
+	s.conf.MaxFileSize = 1024
+	if status := s.serveUpload(chunkedRequest("abc/chunked.txt", len(content)+1)).Code; status != http.StatusForbidden {
+		t.Errorf("chunked upload with wrong size returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := s.serveUpload(chunkedRequest("abc/chunked.txt", len(content))).Code; status != http.StatusCreated {
+		t.Errorf("chunked upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Uploads which are rejected anyway must be rejected before the client is
+ * asked to send the body
+ */
+func TestUploadExpectContinue(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	server := httptest.NewServer(http.HandlerFunc(s.handleRequest))
+	defer server.Close()
+
+	if status := s.uploadFile(t, "abc/existing.txt", []byte("existing")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	existing := s.newUploadRequest(t, "abc/existing.txt", make([]byte, 1000000))
+
+	for _, test := range []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"invalid MAC", "/upload/abc/new.txt?v=invalid", http.StatusForbidden},
+		{"existing file", existing.URL.RequestURI(), http.StatusConflict},
+	} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "PUT %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000000\r\nExpect: 100-continue\r\n\r\n", test.target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %v want %v", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
+
+/*
+ * Endless upload body which cancels the request after the first read
+ */
+type disconnectingReader struct {
+	cancel context.CancelFunc
+}
+
+func (d *disconnectingReader) Read(p []byte) (int, error) {
+	d.cancel()
+	for i := range p {
+		p[i] = 0x42
+	}
+	return len(p), nil
+}
+
+/*
+ * An upload aborted by the client must not leave any files behind, so it
+ * can be retried
+ */
+func TestUploadClientDisconnect(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+
+	content := []byte("complete upload")
+	req := s.newUploadRequest(t, "abc/disconnect.txt", content)
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Body = io.NopCloser(&disconnectingReader{cancel: cancel})
+
+	aborted := uploadsAbortedMetric.get("")
+	s.serveUpload(req)
+	if uploadsAbortedMetric.get("") != aborted+1 {
+		t.Errorf("aborted upload has not been counted")
+	}
+
+	if entries, err := os.ReadDir(s.internalPath("tmp")); err != nil || len(entries) != 0 {
+		t.Errorf("temporary files have been left behind: %v %v", entries, err)
+	}
+
+	if status := s.uploadFile(t, "abc/disconnect.txt", content).Code; status != http.StatusCreated {
+		t.Errorf("retried upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Download a large file over TCP, once as served by handleRequest and once
+ * copied through userspace buffers like encoded files are
+ */
+func BenchmarkDownload(b *testing.B) {
+	s := newTestServer(b)
+
+	// Remove file after benchmark
+	defer s.cleanup()
+
+	// Set config
+	log.SetLevel(logrus.WarnLevel)
+	defer log.SetLevel(logrus.DebugLevel)
+
+	const size = 256 * 1024 * 1024
+	absFilename := s.storagePath("bench/large.bin")
+	if err := os.MkdirAll(filepath.Dir(absFilename), os.ModePerm); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(absFilename, bytes.Repeat([]byte{0x42}, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	buffered := func(w http.ResponseWriter, r *http.Request) {
+		storedFile, err := s.openBackendFile("bench/large.bin")
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer storedFile.Close()
+		http.ServeContent(w, r, "large.bin", storedFile.modTime, storedFile)
+	}
+
+	for _, bench := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"sendfile", s.handleRequest},
+		{"buffered", buffered},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			server := httptest.NewServer(bench.handler)
+			defer server.Close()
+
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL + "/upload/bench/large.bin")
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("download failed: %d bytes, %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+/*
+ * Upload files concurrently, reporting allocations
+ */
+func BenchmarkUpload(b *testing.B) {
+	s := newTestServer(b)
+
+	// Remove uploaded files after benchmark
+	defer s.cleanup()
+
+	// Set config
+	log.SetLevel(logrus.WarnLevel)
+	defer log.SetLevel(logrus.DebugLevel)
+
+	content := bytes.Repeat([]byte{0x42}, 1024*1024)
+	var uploads int64
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			fileStorePath := "bench/" + strconv.FormatInt(atomic.AddInt64(&uploads, 1), 10) + ".bin"
+			if status := s.serveUpload(s.newUploadRequest(b, fileStorePath, content)).Code; status != http.StatusCreated {
+				b.Errorf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+			}
+		}
+	})
+}
+
+/*
+ * serverType selects the accepted MAC parameters and the path encoding
+ */
+func TestServerType(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	readServerTypeConfig := func(settings string) {
+		var err error
+		if s, err = readConfig(writeTestConfig(t, settings)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := []byte("server type")
+	upload := func(protocolVersion string, escapedPath string, macPath string) int {
+		req, err := http.NewRequest("PUT", "/upload/"+escapedPath, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.RawQuery = protocolVersion + "=" + s.uploadMAC(protocolVersion, macPath, int64(len(content)), 0, 0)
+		return s.serveUpload(req).Code
+	}
+
+	readServerTypeConfig(`serverType = "ejabberd"`)
+	if s.conf.MacPathEncoding != "escaped" {
+		t.Errorf("ejabberd preset: got macPathEncoding %q want %q", s.conf.MacPathEncoding, "escaped")
+	}
+	if status := upload("v2", "abc/ejabberd.txt", "abc/ejabberd.txt"); status != http.StatusForbidden {
+		t.Errorf("ejabberd preset, v2 MAC: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("v", "abc/ejabberd%201.txt", "abc/ejabberd%201.txt"); status != http.StatusCreated {
+		t.Errorf("ejabberd preset, v MAC: got %v want %v", status, http.StatusCreated)
+	}
+
+	// Explicit settings take precedence over the preset
+	readServerTypeConfig("serverType = \"ejabberd\"\nmacPathEncoding = \"decoded\"")
+	if s.conf.MacPathEncoding != "decoded" {
+		t.Errorf("ejabberd preset with macPathEncoding: got %q want %q", s.conf.MacPathEncoding, "decoded")
+	}
+
+	readServerTypeConfig(`serverType = "metronome"`)
+	if status := upload("v", "abc/metronome.txt", "abc/metronome.txt"); status != http.StatusForbidden {
+		t.Errorf("metronome preset, v MAC: got %v want %v", status, http.StatusForbidden)
+	}
+	if status := upload("token", "abc/metronome.txt", "abc/metronome.txt"); status != http.StatusCreated {
+		t.Errorf("metronome preset, token MAC: got %v want %v", status, http.StatusCreated)
+	}
+
+	readServerTypeConfig(`serverType = "auto"`)
+	if status := upload("v", "abc/auto%201.txt", "abc/auto%201.txt"); status != http.StatusCreated {
+		t.Errorf("auto, v MAC over escaped path: got %v want %v", status, http.StatusCreated)
+	}
+	if status := upload("v2", "abc/auto%202.txt", "abc/auto 2.txt"); status != http.StatusCreated {
+		t.Errorf("auto, v2 MAC over decoded path: got %v want %v", status, http.StatusCreated)
+	}
+
+	if _, err := newServer(Config{ServerType: "openfire", MacPathEncoding: "decoded", ChunkedUploads: "reject"}); err == nil {
+		t.Error("unknown serverType has been accepted")
+	}
+}
+
+/*
+ * With allowV1 = false, only MACs covering the content type are accepted
+ */
+func TestDisallowV1(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.AllowV1 = false
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("no v1")
+	if rr := s.uploadFile(t, "abc/v1.txt", content); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "expecting v2 or token") {
+		t.Errorf("upload with v MAC: got %v %q", rr.Code, rr.Body.String())
+	}
+	req, _ := http.NewRequest("PUT", "/upload/abc/v2.txt", bytes.NewReader(content))
+	req.URL.RawQuery = "v2=" + s.uploadMAC("v2", "abc/v2.txt", int64(len(content)), 0, 0)
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Errorf("upload with v2 MAC: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+/*
+ * macVersions and subDirMacVersions pin the accepted MAC parameters
+ */
+func TestPinnedMacVersions(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.MacVersions = []string{"v2"}
+	s.conf.UploadSubDirs = map[string]string{"team/": "team-files"}
+	s.conf.SubDirMacVersions = map[string][]string{"/team": {"token"}}
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("pinned")
+	upload := func(target string, protocolVersion string, macPath string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", target, bytes.NewReader(content))
+		req.URL.RawQuery = protocolVersion + "=" + s.uploadMAC(protocolVersion, macPath, int64(len(content)), 0, 0)
+		return s.serveUpload(req)
+	}
+
+	if rr := upload("/upload/abc/v.txt", "v", "abc/v.txt"); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "MAC version v not accepted, expecting v2") {
+		t.Errorf("v MAC: got %v %q", rr.Code, rr.Body.String())
+	}
+	if rr := upload("/upload/abc/v2.txt", "v2", "abc/v2.txt"); rr.Code != http.StatusCreated {
+		t.Errorf("v2 MAC: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := upload("/team/abc/v2.txt", "v2", "abc/v2.txt"); rr.Code != http.StatusForbidden {
+		t.Errorf("v2 MAC below team/: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if rr := upload("/team/abc/token.txt", "token", "abc/token.txt"); rr.Code != http.StatusCreated {
+		t.Errorf("token MAC below team/: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+/*
+ * protocolStatusCodes answers rejected uploads like the upload module of
+ * the XMPP server
+ */
+func TestProtocolStatusCodes(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("status codes")
+	s.uploadFile(t, "abc/exists.txt", content)
+	upload := func(query string) int {
+		req := s.newUploadRequest(t, "abc/exists.txt", []byte("other content"))
+		if query != "" {
+			req.URL.RawQuery = query
+		}
+		return s.serveUpload(req).Code
+	}
+
+	tests := []struct {
+		serverType string
+		protocol   bool
+		missingMAC int
+		invalidMAC int
+		fileExists int
+	}{
+		{"prosody", false, http.StatusForbidden, http.StatusForbidden, http.StatusConflict},
+		{"prosody", true, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict},
+		{"ejabberd", true, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden},
+		{"metronome", true, http.StatusBadRequest, http.StatusForbidden, http.StatusConflict},
+		{"", true, http.StatusForbidden, http.StatusForbidden, http.StatusConflict},
+	}
+	for _, test := range tests {
+		s.conf.ServerType = test.serverType
+		s.conf.ProtocolStatusCodes = test.protocol
+		if status := upload("x=1"); status != test.missingMAC {
+			t.Errorf("%q, protocol %v, missing MAC: got %v want %v", test.serverType, test.protocol, status, test.missingMAC)
+		}
+		macVersion := macVersions(&s.conf, s.conf.UploadSubDir)[0]
+		if status := upload(macVersion + "=" + strings.Repeat("0", 64)); status != test.invalidMAC {
+			t.Errorf("%q, protocol %v, invalid MAC: got %v want %v", test.serverType, test.protocol, status, test.invalidMAC)
+		}
+		size := int64(len("other content"))
+		if status := upload(macVersion + "=" + s.uploadMAC(macVersion, "abc/exists.txt", size, 0, 0)); status != test.fileExists {
+			t.Errorf("%q, protocol %v, existing file: got %v want %v", test.serverType, test.protocol, status, test.fileExists)
+		}
+	}
+}
+
+/*
+ * Error responses consist of the status text and details for the client,
+ * never paths or internal errors
+ */
+func TestErrorResponses(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, bytes.NewBufferString("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.serveUpload(req)
+	}
+
+	for _, test := range []struct {
+		method string
+		target string
+		status int
+		body   string
+	}{
+		{"PUT", "/upload/abc/missing-mac.txt", http.StatusForbidden, "Forbidden: missing MAC, expecting \"v\", \"v2\" or \"token\" parameter\n"},
+		{"PUT", "/upload/abc/invalid-mac.txt?v=00", http.StatusForbidden, "Forbidden: invalid MAC\n"},
+		{"PUT", "/upload/abc/query.txt?v=%zz", http.StatusBadRequest, "Bad Request: invalid query\n"},
+		{"PATCH", "/upload/abc/method.txt", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+		{"GET", "/upload/abc/missing.txt", http.StatusNotFound, "Not Found\n"},
+	} {
+		rr := request(test.method, test.target)
+		if rr.Code != test.status || rr.Body.String() != test.body {
+			t.Errorf("%s %s: got %v %q want %v %q", test.method, test.target, rr.Code, rr.Body.String(), test.status, test.body)
+		}
+	}
+
+	// Files which can't be read
+	if err := os.MkdirAll(filepath.Join(s.conf.StoreDir, "abc", "directory.txt"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if rr := request("GET", "/upload/abc/directory.txt"); rr.Code == http.StatusOK || strings.Contains(rr.Body.String(), s.conf.StoreDir) {
+		t.Errorf("unreadable file: got %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+/*
+ * Uploads are received in tempDir, which must be on the filesystem of
+ * StoreDir and not be served
+ */
+func TestTempDir(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = t.TempDir()
+
+	for _, tempDir := range []string{s.conf.StoreDir, filepath.Join(s.conf.StoreDir, "tmp")} {
+		s.conf.TempDir = tempDir
+		if err := s.checkTempDir(); err == nil {
+			t.Errorf("tempDir %s inside storeDir accepted", tempDir)
+		}
+	}
+
+	for _, tempDir := range []string{filepath.Join(s.conf.StoreDir, internalDirName, "incoming"), t.TempDir()} {
+		s.conf.TempDir = tempDir
+		if err := s.checkTempDir(); err != nil {
+			t.Errorf("tempDir %s: %s", tempDir, err)
+		}
+	}
+
+	tmpFile, err := s.createTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+	os.Remove(tmpFile.Name())
+	if filepath.Dir(tmpFile.Name()) != s.conf.TempDir {
+		t.Errorf("temporary file %s created outside of tempDir", tmpFile.Name())
+	}
+
+	content := []byte("received in tempDir")
+	if rr := s.uploadFile(t, "abc/file.txt", content); rr.Code != http.StatusCreated {
+		t.Errorf("upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+/*
+ * With uploadResponseJSON, clients other than XMPP clients learn the URL
+ * of the stored file
+ */
+func TestUploadResponseJSON(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("<p>hello</p>")
+	if rr := s.uploadFile(t, "abc/plain.html", content); rr.Code != http.StatusCreated || rr.Body.Len() != 0 {
+		t.Errorf("upload without uploadResponseJSON: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	s.conf.UploadResponseJSON = true
+	req := s.newUploadRequest(t, "abc/page one.html", content)
+	req.Host = "upload.example.com"
+	rr := s.serveUpload(req)
+	var response uploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); rr.Code != http.StatusCreated || err != nil {
+		t.Fatalf("upload with uploadResponseJSON: got %v %q", rr.Code, rr.Body.String())
+	}
+	if response.URL != "http://upload.example.com/upload/abc/page%20one.html" || response.Size != int64(len(content)) ||
+		response.ContentType != extensionContentType("page.html") || response.ShortURL != "" {
+		t.Errorf("unexpected response %+v", response)
+	}
+}
+
+func TestUploadLocation(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("located")
+	req := s.newUploadRequest(t, "abc/file.txt", content)
+	req.Host = "upload.example.com"
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated || rr.Header().Get("Location") != "http://upload.example.com/upload/abc/file.txt" {
+		t.Errorf("upload: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	s.conf.UploadLocation = false
+	if rr := s.uploadFile(t, "abc/other.txt", content); rr.Code != http.StatusCreated || rr.Header().Get("Location") != "" {
+		t.Errorf("upload without uploadLocation: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,588 @@
+/*
+ * QR codes
+ * Minimal QR code encoder (ISO/IEC 18004) for download links: byte mode and
+ * error correction level M only, which is all URLs need. With previewPages
+ * enabled, "/qr/<path>" returns the link of an upload as PNG image, so it
+ * can be opened on a phone next to the screen.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Pixels per module and width of the light border around the code, in modules
+	qrScale      = 8
+	qrQuietZone  = 4
+	qrMaxVersion = 40
+)
+
+// Error correction codewords per block and number of blocks for level M, by version
+var qrECCPerBlock = [qrMaxVersion + 1]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+var qrECCBlocks = [qrMaxVersion + 1]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+
+var errQRTooLong = errors.New("data too long for a QR code")
+
+/*
+ * A QR code: dark modules are true. isFunction marks finder, timing,
+ * alignment, format and version modules, which are never masked.
+ */
+type qrCode struct {
+	version    int
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+/*
+ * Number of modules available for data and error correction
+ */
+func qrRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawDataModules(version)/8 - qrECCPerBlock[version]*qrECCBlocks[version]
+}
+
+/*
+ * Encodes data in the smallest possible QR code
+ */
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; ; version++ {
+		if version > qrMaxVersion {
+			return nil, errQRTooLong
+		}
+		if 4+qrCountBits(version)+8*len(data) <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+
+	// Byte mode segment, terminator and padding
+	var bits qrBits
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - uint(i%8))
+		}
+	}
+
+	q := &qrCode{version: version, size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.isFunction = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.isFunction[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns()
+	q.drawCodewords(q.addECCAndInterleave(codewords))
+
+	// Use the mask with the lowest penalty
+	bestMask, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); minPenalty < 0 || penalty < minPenalty {
+			bestMask, minPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(bestMask)
+
+	return q, nil
+}
+
+/*
+ * Length of the character count field of byte mode segments
+ */
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>uint(i))&1 != 0)
+	}
+}
+
+func (q *qrCode) setFunctionModule(x int, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns() {
+	// Timing patterns
+	for i := 0; i < q.size; i++ {
+		q.setFunctionModule(6, i, i%2 == 0)
+		q.setFunctionModule(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, overwriting the timing patterns
+	q.drawFinderPattern(3, 3)
+	q.drawFinderPattern(q.size-4, 3)
+	q.drawFinderPattern(3, q.size-4)
+
+	// Alignment patterns, except where they would overlap finder patterns
+	positions := q.alignmentPatternPositions()
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if !(i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0) {
+				q.drawAlignmentPattern(x, y)
+			}
+		}
+	}
+
+	// Reserve the format areas, drawn for real once the mask is known
+	q.drawFormatBits(0)
+	q.drawVersion()
+}
+
+func (q *qrCode) drawFinderPattern(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			dist := qrMax(qrAbs(dx), qrAbs(dy))
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < q.size && yy >= 0 && yy < q.size {
+				q.setFunctionModule(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+func (q *qrCode) drawAlignmentPattern(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunctionModule(x+dx, y+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+		}
+	}
+}
+
+/*
+ * Returns the centers of the alignment patterns, in both directions
+ */
+func (q *qrCode) alignmentPatternPositions() []int {
+	if q.version == 1 {
+		return nil
+	}
+	numAlign := q.version/7 + 2
+	step := (q.version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	positions := make([]int, numAlign)
+	positions[0] = 6
+	for i, pos := numAlign-1, q.size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+/*
+ * Draws error correction level (M) and mask, protected by a BCH code
+ */
+func (q *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// Next to the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		q.setFunctionModule(8, i, bit(i))
+	}
+	q.setFunctionModule(8, 7, bit(6))
+	q.setFunctionModule(8, 8, bit(7))
+	q.setFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunctionModule(14-i, 8, bit(i))
+	}
+
+	// Next to the other finder patterns
+	for i := 0; i < 8; i++ {
+		q.setFunctionModule(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunctionModule(8, q.size-15+i, bit(i))
+	}
+	q.setFunctionModule(8, q.size-8, true)
+}
+
+/*
+ * Draws the version information of versions 7 and above
+ */
+func (q *qrCode) drawVersion() {
+	if q.version < 7 {
+		return
+	}
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := q.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.setFunctionModule(a, b, dark)
+		q.setFunctionModule(b, a, dark)
+	}
+}
+
+/*
+ * Splits data into blocks, adds Reed-Solomon error correction to each and
+ * interleaves the result
+ */
+func (q *qrCode) addECCAndInterleave(data []byte) []byte {
+	numBlocks := qrECCBlocks[q.version]
+	blockECCLen := qrECCPerBlock[q.version]
+	rawCodewords := qrRawDataModules(q.version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(blockECCLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		dataLen := shortBlockLen - blockECCLen
+		if i >= numShortBlocks {
+			dataLen++
+		}
+		block := append([]byte{}, data[k:k+dataLen]...)
+		k += dataLen
+		ecc := reedSolomonRemainder(block, divisor)
+		// Short blocks get a placeholder, skipped when interleaving
+		if i < numShortBlocks {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-blockECCLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+/*
+ * Places the codewords in the zigzag pattern, two columns at a time from
+ * the bottom right
+ */
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		// Skip the vertical timing pattern
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i/8]>>(7-uint(i%8)))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+/*
+ * Inverts data modules selected by the mask. Applying it twice undoes it.
+ */
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunction[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+/*
+ * Rates how hard the code is to scan: long runs, blocks of the same color,
+ * patterns looking like finder patterns and unbalanced dark/light ratio
+ */
+func (q *qrCode) penalty() int {
+	result := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 0
+			for x := 0; x < q.size; x++ {
+				if x > 0 && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					result += 3
+				} else if run > 5 {
+					result++
+				}
+			}
+
+			// 1:1:3:1:1 pattern with four light modules on one side
+			for x := 0; x+11 <= q.size; x++ {
+				var line [11]bool
+				for i := range line {
+					line[i] = at(x+i, y, vertical)
+				}
+				if line == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					line == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					result += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y][x-1] && c == q.modules[y-1][x] && c == q.modules[y-1][x-1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+
+	return result
+}
+
+/*
+ * Renders the code as PNG image
+ */
+func (q *qrCode) png() ([]byte, error) {
+	width := (q.size + 2*qrQuietZone) * qrScale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < qrScale; dy++ {
+				offset := img.PixOffset((x+qrQuietZone)*qrScale, (y+qrQuietZone)*qrScale+dy)
+				for dx := 0; dx < qrScale; dx++ {
+					img.Pix[offset+dx] = 1
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+ * Computes the generator polynomial of the given degree over GF(2^8)
+ */
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = reedSolomonMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = reedSolomonMultiply(root, 0x02)
+	}
+	return result
+}
+
+/*
+ * Computes the error correction codewords of data
+ */
+func reedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= reedSolomonMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+/*
+ * Multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+ */
+func reedSolomonMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+/*
+ * Reports whether /qr/ is served. With uploadSubDir "/", it would hide
+ * uploads.
+ */
+func (s *Server) servesQRCodes() bool {
+	return s.conf.PreviewPages && path.Join("/", s.conf.UploadSubDir) != "/"
+}
+
+/*
+ * Request handler for "/qr/<path>": QR code of the file's download link,
+ * or its short URL if it has one
+ */
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	fileStorePath := strings.TrimPrefix(r.URL.Path, "/qr/")
+	if fileStorePath == "" || isInternalPath(fileStorePath) {
+		httpError(w, http.StatusForbidden, "")
+		return
+	} else if checkStorePath(fileStorePath, windowsPaths) != nil {
+		httpError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if err := s.auth.ValidateGet(r, fileStorePath); err != nil {
+		s.rejectUnauthorized(w, r, err)
+		return
+	}
+	exists, err := s.backend.Exists(fileStorePath)
+	if err != nil {
+		log.Error("Failed to check for existing file ", fileStorePath, ": ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	} else if !exists {
+		s.recordNotFound(r)
+		httpError(w, http.StatusNotFound, "")
+		return
+	}
+
+	link := s.fileURL(r, fileStorePath)
+	if meta, err := s.readMetadata(fileStorePath); err == nil && meta.ShortURL != "" && s.conf.ShortURLs {
+		link = s.shortURL(r, meta.ShortURL)
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Warn("Reading metadata failed: ", err)
+	}
+
+	code, err := encodeQR([]byte(link))
+	if err == errQRTooLong {
+		httpError(w, http.StatusRequestURITooLong, "")
+		return
+	}
+	var qrImage []byte
+	if err == nil {
+		qrImage, err = code.png()
+	}
+	if err != nil {
+		log.Error("Creating QR code failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(qrImage)
+}
@@ -0,0 +1,200 @@
+package filer
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as version 1-M code, see https://www.thonky.com/qr-code-tutorial/
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if ecc := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ecc, expected) {
+		t.Errorf("got %v want %v", ecc, expected)
+	}
+}
+
+/*
+ * Reads a QR code back: format bits, mask and the byte mode payload,
+ * checking the error correction of every block
+ */
+func decodeQR(t *testing.T, q *qrCode) []byte {
+	t.Helper()
+
+	// Format bits next to the top left finder pattern
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		bits |= b2i(q.modules[i][8]) << uint(i)
+	}
+	bits |= b2i(q.modules[7][8])<<6 | b2i(q.modules[8][8])<<7 | b2i(q.modules[8][7])<<8
+	for i := 9; i < 15; i++ {
+		bits |= b2i(q.modules[8][14-i]) << uint(i)
+	}
+	bits ^= 0x5412
+	if bits>>13 != 0 {
+		t.Fatalf("unexpected error correction level %d", bits>>13)
+	}
+	mask := bits >> 10 & 7
+
+	// Unmask and read the zigzag
+	clone := *q
+	clone.modules = make([][]bool, q.size)
+	for y := range q.modules {
+		clone.modules[y] = append([]bool{}, q.modules[y]...)
+	}
+	clone.applyMask(mask)
+	var raw []byte
+	var current, count int
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.isFunction[y][x] {
+					continue
+				}
+				current = current<<1 | b2i(clone.modules[y][x])
+				if count++; count%8 == 0 {
+					raw = append(raw, byte(current))
+					current = 0
+				}
+			}
+		}
+	}
+	raw = raw[:qrRawDataModules(q.version)/8]
+
+	// Deinterleave: data codewords of all blocks, then their error correction codewords
+	numBlocks := qrECCBlocks[q.version]
+	eccLen := qrECCPerBlock[q.version]
+	numLong := len(raw) % numBlocks
+	shortData := len(raw)/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	i := 0
+	for k := 0; k <= shortData; k++ {
+		for b := range blocks {
+			if k < shortData || b >= numBlocks-numLong {
+				blocks[b] = append(blocks[b], raw[i])
+				i++
+			}
+		}
+	}
+	var data []byte
+	for b := range blocks {
+		ecc := []byte{raw[i+b]}
+		for k := 1; k < eccLen; k++ {
+			ecc = append(ecc, raw[i+k*numBlocks+b])
+		}
+		if expected := reedSolomonRemainder(blocks[b], reedSolomonDivisor(eccLen)); !bytes.Equal(ecc, expected) {
+			t.Fatalf("version %d, block %d: error correction mismatch", q.version, b)
+		}
+		data = append(data, blocks[b]...)
+	}
+
+	// Byte mode segment
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("unexpected mode %x", data[0]>>4)
+	}
+	if qrCountBits(q.version) == 8 {
+		length := int(data[0]&0xf)<<4 | int(data[1]>>4)
+		payload := make([]byte, length)
+		for k := range payload {
+			payload[k] = data[1+k]<<4 | data[2+k]>>4
+		}
+		return payload
+	}
+	length := int(data[0]&0xf)<<12 | int(data[1])<<4 | int(data[2]>>4)
+	payload := make([]byte, length)
+	for k := range payload {
+		payload[k] = data[2+k]<<4 | data[3+k]>>4
+	}
+	return payload
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, test := range []struct {
+		data    string
+		version int
+	}{
+		{"https://x.io/", 1},
+		{"https://upload.example.com/s/k3x9q2mfa7c0", 3},
+		{"https://upload.example.com/upload/0b4e1c8a2f7d6e5c3b9a8f7e6d5c4b3a2f1e0d9c/cat%20picture.jpg", 6},
+		{strings.Repeat("a", 300), 13},
+		{strings.Repeat("b", 2000), 38},
+	} {
+		q, err := encodeQR([]byte(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.version != test.version || q.size != test.version*4+17 {
+			t.Errorf("%d bytes: got version %d want %d", len(test.data), q.version, test.version)
+		}
+		if decoded := decodeQR(t, q); string(decoded) != test.data {
+			t.Errorf("%d bytes: decoded %q", len(test.data), decoded)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, 3000)); err != errQRTooLong {
+		t.Errorf("got %v want %v", err, errQRTooLong)
+	}
+}
+
+func TestQRVersionInformation(t *testing.T) {
+	q, err := encodeQR([]byte(strings.Repeat("c", 120)))
+	if err != nil || q.version != 7 {
+		t.Fatalf("got version %d, %v", q.version, err)
+	}
+
+	// Version 7: 000111110010010100, least significant bit first
+	bits := 0
+	for i := 0; i < 18; i++ {
+		bits |= b2i(q.modules[i/3][q.size-11+i%3]) << uint(i)
+	}
+	if bits != 0x07C94 {
+		t.Errorf("got %018b", bits)
+	}
+}
+
+func TestQRCodeEndpoint(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.PreviewPages = true
+	defer s.cleanup()
+
+	if rr := s.serveUpload(s.newUploadRequest(t, "qr/cat.jpg", []byte("meow"))); rr.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %v", rr.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/qr/qr/cat.jpg", nil)
+	rr := httptest.NewRecorder()
+	s.handleQRCode(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("got %v, %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if _, err := png.Decode(rr.Body); err != nil {
+		t.Errorf("invalid PNG: %s", err)
+	}
+
+	req, _ = http.NewRequest("GET", "/qr/qr/dog.jpg", nil)
+	rr = httptest.NewRecorder()
+	s.handleQRCode(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing file: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
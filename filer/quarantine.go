@@ -0,0 +1,209 @@
+/*
+ * Quarantine for flagged uploads
+ * Uploads flagged by the virus scanner (or other checks) can be held back in
+ * the quarantine directory instead of being rejected. Quarantined files are
+ * not served to clients until an admin releases them.
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Metadata stored alongside every quarantined file
+ */
+type quarantineItem struct {
+	ID            string    `json:"id"`
+	Path          string    `json:"path"`
+	Reason        string    `json:"reason"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+	Name          string    `json:"name,omitempty"`
+}
+
+/*
+ * Returns the ID of the quarantine entry for a file path.
+ * IDs are derived from the path so lookups don't need an index.
+ */
+func quarantineID(fileStorePath string) string {
+	sum := sha256.Sum256([]byte(fileStorePath))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Checks if id is a well-formed quarantine ID
+ */
+func isQuarantineID(id string) bool {
+	raw, err := hex.DecodeString(id)
+	return err == nil && len(raw) == sha256.Size
+}
+
+func (s *Server) quarantineDir(id string) string {
+	return s.sharedPath("quarantine", id)
+}
+
+/*
+ * Moves a received upload into quarantine
+ */
+func (s *Server) quarantineFile(tmpFilename string, item quarantineItem) error {
+	item.ID = quarantineID(item.Path)
+	item.QuarantinedAt = time.Now().UTC()
+
+	if err := os.MkdirAll(s.sharedPath("quarantine"), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %s", err)
+	}
+
+	// Path is already taken if there is a quarantined file for it
+	dir := s.quarantineDir(item.ID)
+	if err := os.Mkdir(dir, os.ModePerm); os.IsExist(err) {
+		return storage.ErrExists
+	} else if err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %s", err)
+	}
+
+	if err := os.Rename(tmpFilename, filepath.Join(dir, "file")); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to move %s to quarantine: %s", item.Path, err)
+	}
+
+	metaData, err := json.Marshal(item)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "meta.json"), metaData, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to write quarantine metadata for %s: %s", item.Path, err)
+	}
+
+	log.Warnf("Quarantined upload of %s: %s", item.Path, item.Reason)
+	return nil
+}
+
+/*
+ * Reports whether the file at fileStorePath is held in quarantine
+ */
+func (s *Server) isQuarantined(fileStorePath string) bool {
+	_, err := os.Stat(s.quarantineDir(quarantineID(fileStorePath)))
+	return err == nil
+}
+
+/*
+ * Reads the metadata of a quarantined file
+ */
+func (s *Server) getQuarantineItem(id string) (quarantineItem, error) {
+	var item quarantineItem
+
+	metaData, err := os.ReadFile(filepath.Join(s.quarantineDir(id), "meta.json"))
+	if err != nil {
+		return item, err
+	}
+
+	err = json.Unmarshal(metaData, &item)
+	return item, err
+}
+
+/*
+ * Lists all quarantined files, oldest first
+ */
+func (s *Server) listQuarantine() ([]quarantineItem, error) {
+	items := []quarantineItem{}
+
+	entries, err := os.ReadDir(s.sharedPath("quarantine"))
+	if os.IsNotExist(err) {
+		return items, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !isQuarantineID(entry.Name()) {
+			continue
+		}
+
+		item, err := s.getQuarantineItem(entry.Name())
+		if err != nil {
+			log.Warn("Skipping broken quarantine entry ", entry.Name(), ": ", err)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].QuarantinedAt.Before(items[j].QuarantinedAt)
+	})
+
+	return items, nil
+}
+
+/*
+ * Moves a quarantined file to its original location, making it downloadable
+ */
+func (s *Server) releaseQuarantined(id string) error {
+	item, err := s.getQuarantineItem(id)
+	if err != nil {
+		return err
+	}
+
+	quarantinedFile := filepath.Join(s.quarantineDir(id), "file")
+	hash, err := s.hashFile(quarantinedFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.backend.Commit(quarantinedFile, item.Path, hash)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeMetadata(fileMetadata{
+		Path:        item.Path,
+		Size:        item.Size,
+		ContentType: extensionContentType(item.Path),
+		SHA256:      hash,
+		UploadedAt:  item.QuarantinedAt,
+		Name:        item.Name,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+
+	log.Info("Released ", item.Path, " from quarantine")
+	s.publishEvent(fileEvent{
+		Type:        "upload",
+		Path:        item.Path,
+		Size:        item.Size,
+		ContentType: extensionContentType(item.Path),
+		SHA256:      hash,
+	})
+	return os.RemoveAll(s.quarantineDir(id))
+}
+
+/*
+ * Deletes a quarantined file for good
+ */
+func (s *Server) purgeQuarantined(id string) error {
+	item, err := s.getQuarantineItem(id)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Purging quarantined file ", id)
+	if err := os.RemoveAll(s.quarantineDir(id)); err != nil {
+		return err
+	}
+	s.publishEvent(fileEvent{Type: "delete", Path: item.Path, Size: item.Size, SHA256: item.SHA256})
+	return nil
+}
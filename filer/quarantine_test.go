@@ -0,0 +1,140 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+ * Send a request to the admin API and record the response
+ */
+func (s *Server) adminRequest(t *testing.T, method string, url string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.conf.AdminToken)
+
+	rr := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rr, req)
+
+	return rr
+}
+
+/*
+ * Download catmetal.jpg and return the response
+ */
+func (s *Server) getCatmetal(t *testing.T) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/upload/thomas/abc/catmetal.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.handleRequest)
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+/*
+ * Quarantine an infected upload, check that it can't be downloaded and
+ * release it using the admin API
+ */
+func TestQuarantineRelease(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ClamdAddress = fakeClamd(t, "stream: Eicar-Signature FOUND")
+	s.conf.ClamdInfectedAction = "quarantine"
+	s.conf.AdminToken = "admintoken"
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	if status := s.getCatmetal(t).Code; status != http.StatusUnavailableForLegalReasons {
+		t.Errorf("download returned wrong status code: got %v want %v", status, http.StatusUnavailableForLegalReasons)
+	}
+
+	// Uploading to the same path again must fail
+	if status := s.uploadCatmetal(t).Code; status != http.StatusConflict {
+		t.Errorf("second upload returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	// List quarantine
+	rr := s.adminRequest(t, "GET", "/quarantine")
+	var items []quarantineItem
+	if err := json.Unmarshal(rr.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "thomas/abc/catmetal.jpg" {
+		t.Fatalf("unexpected quarantine listing: %s", rr.Body.String())
+	}
+
+	// Release file
+	if status := s.adminRequest(t, "POST", "/quarantine/"+items[0].ID+"/release").Code; status != http.StatusNoContent {
+		t.Errorf("release returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if status := s.getCatmetal(t).Code; status != http.StatusOK {
+		t.Errorf("download returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+/*
+ * Purge a quarantined file
+ */
+func TestQuarantinePurge(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ClamdAddress = fakeClamd(t, "stream: Eicar-Signature FOUND")
+	s.conf.ClamdInfectedAction = "quarantine"
+	s.conf.QuarantineStatus = http.StatusNotFound
+	s.conf.AdminToken = "admintoken"
+
+	s.uploadCatmetal(t)
+	if status := s.getCatmetal(t).Code; status != http.StatusNotFound {
+		t.Errorf("download returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	id := quarantineID("thomas/abc/catmetal.jpg")
+	if status := s.adminRequest(t, "DELETE", "/quarantine/"+id).Code; status != http.StatusNoContent {
+		t.Errorf("purge returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if s.isQuarantined("thomas/abc/catmetal.jpg") {
+		t.Errorf("file is still quarantined after purge")
+	}
+}
+
+/*
+ * Admin API must refuse requests without valid token
+ */
+func TestAdminUnauthorized(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+
+	req, err := http.NewRequest("GET", "/quarantine", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer wrongtoken")
+
+	rr := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Read-only mode
+ * While enabled, uploads are refused with 503 and a Retry-After header,
+ * downloads keep working. It is enabled with readOnly in the config, or at
+ * runtime through the admin API, e.g. for storage migrations and backups.
+ * Maintenance windows enable it for planned periods, see maintenance.go.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+var readOnlyMetric = newGauge("prosody_filer_read_only", "1 if uploads are refused because of read-only mode.")
+
+func (s *Server) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1 || !s.maintenanceEnd().IsZero()
+}
+
+func (s *Server) setReadOnly(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.readOnly, value) != value {
+		if enabled {
+			log.Warn("Read-only mode enabled, refusing uploads")
+		} else {
+			log.Info("Read-only mode disabled, accepting uploads")
+		}
+	}
+	readOnlyMetric.set("", float64(value))
+}
+
+/*
+ * Refuses an upload if read-only mode is enabled
+ */
+func (s *Server) rejectReadOnly(w http.ResponseWriter) bool {
+	if !s.isReadOnly() {
+		return false
+	}
+	w.Header().Set("Retry-After", s.retryAfter())
+	httpError(w, http.StatusServiceUnavailable, "uploads are disabled for maintenance")
+	return true
+}
+
+/*
+ * Read-only endpoint:
+ *   GET    /readonly   Show whether read-only mode is enabled
+ *   POST   /readonly   Enable read-only mode
+ *   DELETE /readonly   Disable read-only mode
+ */
+func (s *Server) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.setReadOnly(true)
+	case http.MethodDelete:
+		s.setReadOnly(false)
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"readOnly": s.isReadOnly()})
+}
@@ -0,0 +1,44 @@
+package filer
+
+import (
+	"net/http"
+	"testing"
+)
+
+/*
+ * Uploads are refused in read-only mode, downloads keep working
+ */
+func TestReadOnly(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/before.txt", []byte("before"))).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	if rr := s.adminRequest(t, "POST", "/readonly"); rr.Code != http.StatusOK || rr.Body.String() != "{\"readOnly\":true}\n" {
+		t.Fatalf("enabling read-only mode failed: %v %s", rr.Code, rr.Body)
+	}
+
+	rr := s.serveUpload(s.newUploadRequest(t, "abc/during.txt", []byte("during")))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "300" {
+		t.Errorf("upload in read-only mode: got %v, Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/abc/before.txt", nil)
+	if status := s.serveUpload(req).Code; status != http.StatusOK {
+		t.Errorf("download in read-only mode: got %v want %v", status, http.StatusOK)
+	}
+
+	if rr := s.adminRequest(t, "DELETE", "/readonly"); rr.Body.String() != "{\"readOnly\":false}\n" {
+		t.Fatalf("disabling read-only mode failed: %v %s", rr.Code, rr.Body)
+	}
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/during.txt", []byte("during"))).Code; status != http.StatusCreated {
+		t.Errorf("upload after read-only mode: got %v want %v", status, http.StatusCreated)
+	}
+}
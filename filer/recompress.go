@@ -0,0 +1,195 @@
+/*
+ * Image recompression
+ * Downscales unencrypted images exceeding a maximum resolution before they
+ * are stored. The file keeps its name and format.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+/*
+ * Result of a recompression, recorded in the file's metadata
+ */
+type recompressInfo struct {
+	OriginalWidth  int `json:"originalWidth"`
+	OriginalHeight int `json:"originalHeight"`
+	Width          int `json:"width"`
+	Height         int `json:"height"`
+}
+
+/*
+ * Recompresses a single upload
+ */
+type imageRecompressor struct {
+	conf        *Config
+	contentType string
+	result      *recompressInfo
+}
+
+/*
+ * Returns a recompressor for uploads of the given (sniffed) content type or
+ * nil if images of this type are not recompressed
+ */
+func (s *Server) newImageRecompressor(contentType string) *imageRecompressor {
+	for _, recompressType := range s.conf.RecompressTypes {
+		if recompressType == contentType {
+			return &imageRecompressor{conf: &s.conf, contentType: contentType}
+		}
+	}
+	return nil
+}
+
+/*
+ * Filter function: reads the whole image and writes the recompressed one,
+ * or the original if it is small enough, too large to be handled or can't
+ * be decoded. Images with more than recompressMaxPixels pixels are left
+ * alone, as a small file may declare a huge canvas, which would be
+ * allocated while decoding.
+ */
+func (c *imageRecompressor) filter(dst io.Writer, src io.Reader) error {
+	original, err := io.ReadAll(io.LimitReader(src, c.conf.RecompressMaxInputSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(original)) > c.conf.RecompressMaxInputSize {
+		return passThrough(dst, original, src)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil || (config.Width <= c.conf.RecompressMaxDimension && config.Height <= c.conf.RecompressMaxDimension) {
+		return passThrough(dst, original, src)
+	}
+
+	if int64(config.Width)*int64(config.Height) > c.conf.RecompressMaxPixels {
+		log.Warnf("Not recompressing image of %dx%d pixels, exceeds recompressMaxPixels", config.Width, config.Height)
+		return passThrough(dst, original, src)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		log.Warn("Failed to decode image for recompression: ", err)
+		return passThrough(dst, original, src)
+	}
+
+	width, height := fitDimensions(config.Width, config.Height, c.conf.RecompressMaxDimension)
+	scaled := downscale(img, width, height)
+
+	var recompressed bytes.Buffer
+	if c.contentType == "image/png" {
+		err = png.Encode(&recompressed, scaled)
+	} else {
+		err = jpeg.Encode(&recompressed, scaled, &jpeg.Options{Quality: c.conf.RecompressQuality})
+
+		// Re-encoding drops EXIF, so the orientation has to be carried over
+		if orientation := jpegOrientation(original); err == nil && orientation > 1 {
+			encoded := recompressed.Bytes()
+			recompressed = *bytes.NewBuffer(append(append(encoded[:2:2], orientationSegment(orientation)...), encoded[2:]...))
+		}
+	}
+	if err != nil || recompressed.Len() >= len(original) {
+		return passThrough(dst, original, src)
+	}
+
+	c.result = &recompressInfo{
+		OriginalWidth:  config.Width,
+		OriginalHeight: config.Height,
+		Width:          width,
+		Height:         height,
+	}
+	_, err = dst.Write(recompressed.Bytes())
+	return err
+}
+
+/*
+ * Calculates dimensions fitting into maxDimension x maxDimension while keeping the aspect ratio
+ */
+func fitDimensions(width int, height int, maxDimension int) (int, int) {
+	if width >= height {
+		return maxDimension, max1(height * maxDimension / width)
+	}
+	return max1(width * maxDimension / height), maxDimension
+}
+
+func max1(i int) int {
+	if i < 1 {
+		return 1
+	}
+	return i
+}
+
+/*
+ * Scales an image down by averaging all source pixels covered by each target pixel
+ */
+func downscale(src image.Image, width int, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcWidth, srcHeight := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[(sy-rgba.Rect.Min.Y)*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[(sx-rgba.Rect.Min.X)*4:]
+					sum[0] += int(pixel[0])
+					sum[1] += int(pixel[1])
+					sum[2] += int(pixel[2])
+					sum[3] += int(pixel[3])
+				}
+			}
+
+			count := (y1 - y0) * (x1 - x0)
+			target := dst.Pix[y*dst.Stride+x*4:]
+			for i := range sum {
+				target[i] = uint8(sum[i] / count)
+			}
+		}
+	}
+
+	return dst
+}
+
+/*
+ * Finds the EXIF orientation of a JPEG file
+ */
+func jpegOrientation(data []byte) int {
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xff {
+		marker := data[offset+1]
+		length := int(data[offset+2])<<8 | int(data[offset+3])
+		if marker == 0xda || length < 2 || offset+2+length > len(data) {
+			break
+		}
+
+		payload := data[offset+4 : offset+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return exifOrientation(payload[6:])
+		}
+		offset += 2 + length
+	}
+	return 0
+}
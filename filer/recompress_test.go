@@ -0,0 +1,130 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Upload an image exceeding the maximum dimension and check that it is
+ * stored downscaled with recompression info in its metadata
+ */
+func TestRecompressImage(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.RecompressImages = true
+	s.conf.RecompressMaxDimension = 100
+
+	img := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	for x := 0; x < 600; x++ {
+		for y := 0; y < 400; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	var original bytes.Buffer
+	if err := jpeg.Encode(&original, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := s.uploadFile(t, "thomas/abc/large.jpg", original.Bytes()).Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/large.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || config.Width != 100 || config.Height != 66 {
+		t.Errorf("unexpected stored image: %s %dx%d", format, config.Width, config.Height)
+	}
+
+	meta, err := s.readMetadata("thomas/abc/large.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Recompressed == nil || meta.Recompressed.OriginalWidth != 600 || meta.Size != int64(len(stored)) || meta.OriginalSize != int64(original.Len()) {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+}
+
+/*
+ * Images within the limits must be stored unmodified
+ */
+func TestRecompressSmallImage(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.RecompressImages = true
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	original, _ := os.ReadFile("testdata/catmetal.jpg")
+	stored, _ := os.ReadFile(filepath.Join(s.conf.StoreDir, "thomas/abc/catmetal.jpg"))
+	if !bytes.Equal(original, stored) {
+		t.Errorf("small image has been modified")
+	}
+}
+
+/*
+ * Images declaring a huge canvas are stored unmodified, without decoding
+ * them
+ */
+func TestRecompressHugeCanvas(t *testing.T) {
+	var encoded bytes.Buffer
+	png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 1, 1)))
+
+	// Claim 100000x100000 pixels in IHDR, which follows the 8 byte signature
+	huge := encoded.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	conf := DefaultConfig()
+	recompressor := &imageRecompressor{conf: &conf, contentType: "image/png"}
+	var stored bytes.Buffer
+	if err := recompressor.filter(&stored, bytes.NewReader(huge)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Bytes(), huge) || recompressor.result != nil {
+		t.Errorf("image with huge canvas has been modified")
+	}
+}
+
+/*
+ * Check that downscaling averages pixels
+ */
+func TestDownscale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{255, 255, 255, 255})
+	img.Set(1, 1, color.RGBA{255, 255, 255, 255})
+	img.Set(0, 1, color.RGBA{0, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 0, 0, 255})
+
+	scaled := downscale(img, 1, 1)
+	if got := scaled.RGBAAt(0, 0); got.R != 127 || got.A != 255 {
+		t.Errorf("unexpected pixel value: %v", got)
+	}
+}
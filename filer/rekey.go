@@ -0,0 +1,107 @@
+/*
+ * "rekey" command: re-wraps the data keys of all encrypted files with the
+ * current master key after the master key has been changed
+ */
+
+package filer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if s.encryptionKey == nil {
+		return errors.New("no encryption key configured")
+	}
+	if s.conf.StorageBackend != "local" {
+		return errors.New("rekey only supports the local storage backend")
+	}
+
+	rewrapped, err := s.rekeyStore()
+	log.Infof("Re-wrapped data keys of %d files", rewrapped)
+	return err
+}
+
+/*
+ * Re-wraps the data keys of all files in StoreDir, including quarantined
+ * ones. Returns the number of changed files.
+ */
+func (s *Server) rekeyStore() (int, error) {
+	rewrapped, failed := 0, 0
+	tmpDir := s.tempDir()
+
+	// Rewritten files by their former inode, to keep deduplicated files linked
+	replaced := make(map[inode]string)
+
+	err := filepath.Walk(s.conf.StoreDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Uploads in progress are already written with the current key
+		if info.IsDir() && path == tmpDir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// Earlier links may have been replaced already, so the link count can't tell
+		id, hasInode := fileInode(info)
+		if replacement, ok := replaced[id]; hasInode && ok {
+			if err := relinkFile(replacement, path); err != nil {
+				log.Error(err)
+				failed++
+			} else {
+				rewrapped++
+			}
+			return nil
+		}
+
+		changed, err := s.rewrapFile(path)
+		if err != nil {
+			log.Error(err)
+			failed++
+		} else if changed {
+			rewrapped++
+			if links, _ := linkCount(info); hasInode && links > 1 {
+				replaced[id] = path
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return rewrapped, err
+	}
+	if failed > 0 {
+		return rewrapped, fmt.Errorf("failed to re-wrap data keys of %d files", failed)
+	}
+	return rewrapped, nil
+}
+
+/*
+ * Replaces absFilename with a hard link to target
+ */
+func relinkFile(target string, absFilename string) error {
+	tmpFilename := filepath.Join(filepath.Dir(absFilename), ".rekey-"+filepath.Base(absFilename))
+	os.Remove(tmpFilename)
+	if err := os.Link(target, tmpFilename); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %s", absFilename, target, err)
+	}
+	if err := os.Rename(tmpFilename, absFilename); err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("failed to replace %s: %s", absFilename, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * "reshard" command: moves files stored in the other layout into the
+ * configured storageLayout, e.g. after switching to "sharded":
+ *
+ *   prosody-filer reshard -limit 10000
+ *
+ * Files are moved one at a time while the server keeps running, as
+ * downloads look for files in both layouts. Directories left empty are
+ * removed. With -limit, a run stops after moving that many files, so the
+ * store can be converted in batches.
+ */
+
+package filer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errReshardLimit = errors.New("limit reached")
+
+func runReshard(args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	limit := flags.Int("limit", 0, "Stop after moving this many files, 0 for no limit.")
+	flags.Parse(args)
+
+	s, err := readConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	if s.conf.StorageBackend != "local" {
+		return errors.New("storageLayout only applies to the local storage backend")
+	}
+	if s.conf.ReadOnly {
+		return errors.New("cannot move files in read-only mode")
+	}
+
+	log.Infof("Moving files in %s into the %s layout", s.conf.StoreDir, s.conf.StorageLayout)
+	result, err := s.reshardStore(*limit)
+	log.Infof("Moved %d files (%s), %d failed", result.Copied, formatSize(result.Bytes), result.Failed)
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("failed to move %d files, run the command again to retry them", result.Failed)
+	}
+	return err
+}
+
+/*
+ * Moves up to limit files (0 for all) from the other layout into the
+ * configured one
+ */
+func (s *Server) reshardStore(limit int) (migrationResult, error) {
+	var result migrationResult
+
+	err := s.walkStoreDir(func(absFilename string, fileStorePath string, info os.FileInfo) error {
+		target := s.storagePath(fileStorePath)
+		if target == absFilename {
+			return nil
+		}
+
+		if limit > 0 && result.Copied >= limit {
+			return errReshardLimit
+		}
+		if err := s.moveStoredFile(absFilename, target); err != nil {
+			log.Errorf("Failed to move %s: %s", fileStorePath, err)
+			result.Failed++
+			return nil
+		}
+		result.Copied++
+		result.Bytes += info.Size()
+		if result.Copied%1000 == 0 {
+			log.Infof("Moved %d files (%s)", result.Copied, formatSize(result.Bytes))
+		}
+		return nil
+	})
+	if err == errReshardLimit {
+		log.Info("Stopped after moving ", limit, " files, run the command again to continue")
+		err = nil
+	}
+	return result, err
+}
+
+/*
+ * Moves a stored file and removes the directories left empty. Linking it
+ * first never replaces a file at the target, and keeps deduplicated files
+ * linked.
+ */
+func (s *Server) moveStoredFile(absFilename string, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Link(absFilename, target); os.IsExist(err) {
+		return fmt.Errorf("%s exists already", target)
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(absFilename); err != nil {
+		return err
+	}
+
+	// Removing fails once a directory is not empty
+	storeDir := filepath.Clean(s.conf.StoreDir)
+	for dir := filepath.Dir(absFilename); dir != storeDir && strings.HasPrefix(dir, storeDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Resuming interrupted PUT uploads
+ * If a regular upload is interrupted, the data received so far is kept as
+ * partial upload. The client continues it with a PUT request carrying
+ * "Content-Range: bytes <offset>-<last>/<size>", or asks for the received
+ * range with an empty PUT request and "*" as range. Incomplete uploads are
+ * answered with "308 Resume Incomplete" and a Range header.
+ * The MAC covers the size of the whole file, as for regular uploads.
+ */
+
+package filer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Parsed Content-Range header of a PUT request
+ */
+type uploadRange struct {
+	first int64
+	last  int64
+	total int64
+
+	// Range "*": the client asks for the received range
+	query bool
+}
+
+var errInvalidContentRange = errors.New("invalid Content-Range header")
+
+/*
+ * Parses a Content-Range header: "bytes <first>-<last>/<total>", or with
+ * "*" instead of first and last byte
+ */
+func parseContentRange(header string) (*uploadRange, error) {
+	spec := strings.TrimPrefix(header, "bytes ")
+	slash := strings.IndexByte(spec, '/')
+	if spec == header || slash < 0 {
+		return nil, errInvalidContentRange
+	}
+
+	total, err := strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err != nil || total < 0 {
+		return nil, errInvalidContentRange
+	}
+	if spec[:slash] == "*" {
+		return &uploadRange{total: total, query: true}, nil
+	}
+
+	bounds := strings.SplitN(spec[:slash], "-", 2)
+	if len(bounds) != 2 {
+		return nil, errInvalidContentRange
+	}
+	first, err1 := strconv.ParseInt(bounds[0], 10, 64)
+	last, err2 := strconv.ParseInt(bounds[1], 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first || last >= total {
+		return nil, errInvalidContentRange
+	}
+
+	return &uploadRange{first: first, last: last, total: total}, nil
+}
+
+/*
+ * Tells the client how much of a partial upload has been received
+ */
+func writeResumeIncomplete(w http.ResponseWriter, offset int64) {
+	if offset > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", offset-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+/*
+ * Receives a regular upload, keeping the received data if the client
+ * disconnects or the filer stops
+ */
+func (s *Server) createResumableFile(fileStorePath string, w http.ResponseWriter, r *http.Request) error {
+	// Another request is writing to the partial upload, keep it
+	id := partialID(fileStorePath)
+	if !s.lockPartialUpload(id) {
+		return s.createFile(fileStorePath, nil, w, r)
+	}
+	defer s.unlockPartialUpload(id)
+
+	// The upload starts over, replacing the data of earlier attempts
+	s.removePartialUpload(id)
+	upload := partialUpload{Path: fileStorePath, Length: r.ContentLength, CreatedAt: time.Now().UTC()}
+	if err := s.writePartialUpload(id, upload); err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+	spool, err := s.openPartialUpload(id, &upload)
+	if err != nil {
+		s.removePartialUpload(id)
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, spool), r.Body}
+
+	err = s.createFile(fileStorePath, nil, w, r)
+	spoolErr := spool.Close()
+	if r.Context().Err() == nil || upload.Offset == 0 {
+		s.removePartialUpload(id)
+		return err
+	}
+	if spoolErr != nil {
+		s.removePartialUpload(id)
+		return fmt.Errorf("%s, failed to keep partial upload: %s", err, spoolErr)
+	}
+	return fmt.Errorf("%s, %d bytes kept for resuming", err, upload.Offset)
+}
+
+/*
+ * Continues a partial upload with the range sent by the client, or
+ * reports the received range
+ */
+func (s *Server) resumeUpload(fileStorePath string, contentRange *uploadRange, w http.ResponseWriter, r *http.Request) error {
+	if s.belowMinimumSize(contentRange.total) {
+		httpError(w, http.StatusBadRequest, "file too small")
+		return fmt.Errorf("rejected upload of %s: %d bytes are below minimum size", fileStorePath, contentRange.total)
+	}
+	if s.exceedsSizeLimit(fileStorePath, contentRange.total) {
+		s.rejectTooLarge(w, fileStorePath)
+		return fmt.Errorf("rejected upload of %s: %d bytes exceed size limit", fileStorePath, contentRange.total)
+	}
+
+	id := partialID(fileStorePath)
+
+	// Only one request at a time may write to an upload
+	if !s.lockPartialUpload(id) {
+		httpError(w, http.StatusConflict, "upload in progress")
+		return fmt.Errorf("failed to resume upload of %s: upload in progress", fileStorePath)
+	}
+	defer s.unlockPartialUpload(id)
+
+	exists, err := s.backend.Exists(fileStorePath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to check for existing file %s: %s", fileStorePath, err)
+	} else if exists || s.isQuarantined(fileStorePath) {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s", fileStorePath, storage.ErrExists)
+	}
+
+	upload, offset, err := s.readPartialUpload(id)
+	if os.IsNotExist(err) {
+		if contentRange.query || contentRange.first > 0 {
+			// Nothing has been received yet
+			writeResumeIncomplete(w, 0)
+			return nil
+		}
+		upload = partialUpload{Path: fileStorePath, Length: contentRange.total, CreatedAt: time.Now().UTC()}
+		err = s.writePartialUpload(id, upload)
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	} else if upload.Length != contentRange.total {
+		httpError(w, http.StatusConflict, "")
+		return fmt.Errorf("failed to resume upload of %s: size changed from %d to %d bytes", fileStorePath, upload.Length, contentRange.total)
+	}
+
+	if contentRange.query || contentRange.first != offset {
+		writeResumeIncomplete(w, offset)
+		return nil
+	}
+	if r.ContentLength >= 0 && r.ContentLength != contentRange.last-contentRange.first+1 {
+		httpError(w, http.StatusBadRequest, "Content-Length does not match Content-Range")
+		return fmt.Errorf("rejected upload of %s: Content-Length does not match Content-Range", fileStorePath)
+	}
+
+	written, err := s.appendPartialUpload(id, &upload, r, contentRange.last-contentRange.first+1)
+	offset += written
+	if err != nil && r.Context().Err() != nil {
+		return fmt.Errorf("upload of %s interrupted at %d of %d bytes", fileStorePath, offset, upload.Length)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to write partial upload of %s: %s", fileStorePath, err)
+	}
+
+	if offset < upload.Length {
+		writeResumeIncomplete(w, offset)
+		return nil
+	}
+
+	return s.finishPartialUpload(id, upload, w, r)
+}
@@ -0,0 +1,171 @@
+package filer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+/*
+ * Upload body which returns part of the content and then fails as if the
+ * client had disconnected
+ */
+type interruptedReader struct {
+	part   []byte
+	cancel context.CancelFunc
+}
+
+func (i *interruptedReader) Read(p []byte) (int, error) {
+	if len(i.part) == 0 {
+		i.cancel()
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, i.part)
+	i.part = i.part[n:]
+	return n, nil
+}
+
+/*
+ * Resume an interrupted PUT upload with Content-Range
+ */
+func TestResumeUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ResumableUploads = true
+
+	content := []byte("an upload which is interrupted after a few bytes")
+	size := len(content)
+	rangeRequest := func(contentRange string, body []byte) *httptest.ResponseRecorder {
+		req := s.newUploadRequest(t, "abc/resume.txt", content)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Range", contentRange)
+		return s.serveUpload(req)
+	}
+
+	// Interrupted after 10 bytes
+	req := s.newUploadRequest(t, "abc/resume.txt", content)
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Body = io.NopCloser(&interruptedReader{part: content[:10], cancel: cancel})
+	s.serveUpload(req)
+
+	rr := rangeRequest("bytes */"+strconv.Itoa(size), nil)
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Range") != "bytes=0-9" {
+		t.Fatalf("range query failed: %v, range %q", rr.Code, rr.Header().Get("Range"))
+	}
+
+	// Wrong offset
+	rr = rangeRequest("bytes 5-9/"+strconv.Itoa(size), content[5:10])
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Range") != "bytes=0-9" {
+		t.Errorf("upload with wrong offset returned %v, range %q", rr.Code, rr.Header().Get("Range"))
+	}
+
+	// MAC covers the size of the whole file
+	rr = rangeRequest("bytes 10-19/20", content[10:20])
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("upload with wrong size returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr = rangeRequest("bytes 10-19/"+strconv.Itoa(size), content[10:20])
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Range") != "bytes=0-19" {
+		t.Fatalf("partial upload failed: %v, range %q", rr.Code, rr.Header().Get("Range"))
+	}
+
+	rr = rangeRequest("bytes 20-"+strconv.Itoa(size-1)+"/"+strconv.Itoa(size), content[20:])
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("last part returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/resume.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download of resumed upload failed: %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+/*
+ * Partial uploads survive a restart. Data received after the last recorded
+ * offset is discarded, as it may not have been synced before a crash.
+ */
+func TestResumeAfterRestart(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ResumableUploads = true
+
+	content := []byte("an upload which is interrupted by a crash")
+	req := s.newUploadRequest(t, "abc/crash.txt", content)
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Body = io.NopCloser(&interruptedReader{part: content[:10], cancel: cancel})
+	s.serveUpload(req)
+
+	// Unsynced data written before the crash
+	id := partialID("abc/crash.txt")
+	dataFile, err := os.OpenFile(s.partialDataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFile.Write([]byte("\x00\x00\x00"))
+	dataFile.Close()
+
+	restarted := newTestServer(t)
+	restarted.conf.ResumableUploads = true
+	rangeRequest := func(contentRange string, body []byte) *httptest.ResponseRecorder {
+		req := restarted.newUploadRequest(t, "abc/crash.txt", content)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Range", contentRange)
+		return restarted.serveUpload(req)
+	}
+
+	size := strconv.Itoa(len(content))
+	rr := rangeRequest("bytes */"+size, nil)
+	if rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Range") != "bytes=0-9" {
+		t.Fatalf("range query after restart: %v, range %q", rr.Code, rr.Header().Get("Range"))
+	}
+	rr = rangeRequest("bytes 10-"+strconv.Itoa(len(content)-1)+"/"+size, content[10:])
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("resumed upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/crash.txt", nil)
+	if rr := restarted.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download of resumed upload failed: %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	valid := map[string]uploadRange{
+		"bytes 0-9/100":   {first: 0, last: 9, total: 100},
+		"bytes 90-99/100": {first: 90, last: 99, total: 100},
+		"bytes */100":     {total: 100, query: true},
+	}
+	for header, expected := range valid {
+		if contentRange, err := parseContentRange(header); err != nil || *contentRange != expected {
+			t.Errorf("parseContentRange(%q) = %v, %v, want %v", header, contentRange, err, expected)
+		}
+	}
+
+	for _, header := range []string{"", "bytes", "0-9/100", "bytes 9-0/100", "bytes 0-100/100", "bytes 0-9/*", "bytes -1-9/100"} {
+		if _, err := parseContentRange(header); err == nil {
+			t.Errorf("parseContentRange(%q) did not fail", header)
+		}
+	}
+}
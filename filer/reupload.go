@@ -0,0 +1,93 @@
+/*
+ * Repeated uploads
+ * Clients retrying an upload after a timeout may find the file stored by
+ * their first attempt already. If the retry has the same content, it gets
+ * the response to a successful upload instead of 409 Conflict. Uploads are
+ * compared by size and SHA-256 hash as received, before any filters, so
+ * only files with metadata qualify.
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+/*
+ * Returns size and SHA-256 hash of the upload a file has been stored from
+ */
+func (meta fileMetadata) uploaded() (int64, string) {
+	size, hash := meta.Size, meta.SHA256
+	if meta.OriginalSize != 0 {
+		size = meta.OriginalSize
+	}
+	if meta.OriginalSHA256 != "" {
+		hash = meta.OriginalSHA256
+	}
+	return size, hash
+}
+
+/*
+ * Reports whether the file stored at fileStorePath has been uploaded with
+ * the same content
+ */
+func (s *Server) isSameUpload(fileStorePath string, size int64, hash string) bool {
+	meta, err := s.readMetadata(fileStorePath)
+	if err != nil {
+		return false
+	}
+	storedSize, storedHash := meta.uploaded()
+	return size == storedSize && hash == storedHash
+}
+
+/*
+ * Answers an upload to fileStorePath, which is stored already. Uploads of
+ * another size are refused before receiving the body, others are compared
+ * to the stored file once they have been received.
+ */
+func (s *Server) receiveRepeatedUpload(fileStorePath string, verifySize func(size int64) bool, w http.ResponseWriter, r *http.Request) error {
+	meta, err := s.readMetadata(fileStorePath)
+	storedSize, storedHash := meta.uploaded()
+	if err != nil || storedHash == "" || (r.ContentLength >= 0 && r.ContentLength != storedSize) {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s", fileStorePath, storage.ErrExists)
+	}
+
+	// Longer uploads can't match
+	hasher := sha256.New()
+	received, err := copyBuffered(hasher, io.LimitReader(&contextReader{ctx: r.Context(), src: r.Body}, storedSize+1))
+	if err != nil && r.Context().Err() != nil {
+		uploadsAbortedMetric.add("", 1)
+		return fmt.Errorf("repeated upload of %s aborted: client disconnected after %d bytes", fileStorePath, received)
+	} else if _, ok := err.(*gzipBodyError); ok {
+		httpError(w, http.StatusBadRequest, "invalid gzip body")
+		return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to read repeated upload of %s: %s", fileStorePath, err)
+	}
+
+	if verifySize != nil && received <= storedSize && !verifySize(received) {
+		s.recordMACFailure(s.clientIP(r))
+		s.tarpit(r)
+		httpError(w, uploadStatusCodes(&s.conf).InvalidMAC, "invalid MAC")
+		return fmt.Errorf("rejected chunked upload of %s: invalid MAC for %d bytes", fileStorePath, received)
+	}
+	if received != storedSize || hex.EncodeToString(hasher.Sum(nil)) != storedHash {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return fmt.Errorf("failed to create file %s: %s with other content", fileStorePath, storage.ErrExists)
+	}
+
+	log.Info("Upload of ", fileStorePath, " is identical to the stored file")
+	if meta.ShortURL != "" && s.conf.ShortURLs {
+		w.Header().Set("X-Short-URL", s.shortURL(r, meta.ShortURL))
+	}
+	s.respondCreated(w, r, fileStorePath, meta.Size)
+	return nil
+}
@@ -0,0 +1,65 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Retries of successful uploads succeed as well
+ */
+func TestRepeatedUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("uploaded twice")
+	if rr := s.uploadFile(t, "abc/retry.txt", content); rr.Code != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	var events int
+	unsubscribe := s.subscribeEvents(func(event fileEvent) {
+		events++
+	})
+	defer unsubscribe()
+
+	if rr := s.uploadFile(t, "abc/retry.txt", content); rr.Code != http.StatusCreated || rr.Header().Get("Location") == "" {
+		t.Errorf("repeated upload: got %v, Location %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if events != 0 {
+		t.Errorf("repeated upload has been announced")
+	}
+
+	// Same size, other content
+	if rr := s.uploadFile(t, "abc/retry.txt", bytes.ToUpper(content)); rr.Code != http.StatusConflict {
+		t.Errorf("upload of other content: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := s.uploadFile(t, "abc/retry.txt", append(content, '!')); rr.Code != http.StatusConflict {
+		t.Errorf("upload of longer content: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, "abc/retry.txt")); err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("stored file has been changed: %q %v", stored, err)
+	}
+
+	// Files without metadata can't be compared
+	os.Remove(s.metadataPath("abc/retry.txt"))
+	if rr := s.uploadFile(t, "abc/retry.txt", content); rr.Code != http.StatusConflict {
+		t.Errorf("repeated upload without metadata: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestUploadedBeforeFilters(t *testing.T) {
+	meta := fileMetadata{Size: 10, SHA256: "stored"}
+	if size, hash := meta.uploaded(); size != 10 || hash != "stored" {
+		t.Errorf("got %d %s", size, hash)
+	}
+	meta.OriginalSize, meta.OriginalSHA256 = 12, "received"
+	if size, hash := meta.uploaded(); size != 12 || hash != "received" {
+		t.Errorf("got %d %s for a filtered upload", size, hash)
+	}
+}
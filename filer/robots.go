@@ -0,0 +1,71 @@
+/*
+ * robots.txt and favicon
+ * Upload links end up in public places now and then. robots.txt asks
+ * search engines not to index them. Browsers ask for a favicon on every
+ * visit; without favicon configured, they get an empty response instead
+ * of a 404.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const robotsTxt = "User-agent: *\nDisallow: /\n"
+
+var startTime = time.Now()
+
+func handleRobotsTxt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "robots.txt", startTime, strings.NewReader(robotsTxt))
+}
+
+func (s *Server) handleFavicon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if s.conf.Favicon == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	favicon, err := os.Open(s.conf.Favicon)
+	if err != nil {
+		log.Error("Failed to open favicon: ", err)
+		httpError(w, http.StatusNotFound, "")
+		return
+	}
+	defer favicon.Close()
+
+	info, err := favicon.Stat()
+	if err != nil {
+		log.Error("Failed to open favicon: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, s.conf.Favicon, info.ModTime(), favicon)
+}
+
+/*
+ * Checks that the favicon can be read
+ */
+func (s *Server) checkFavicon() error {
+	if s.conf.Favicon == "" {
+		return nil
+	}
+	if _, err := os.Stat(s.conf.Favicon); err != nil {
+		return fmt.Errorf("failed to read favicon: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package filer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRobotsTxt(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/robots.txt", nil)
+	rr := httptest.NewRecorder()
+	handleRobotsTxt(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Errorf("unexpected robots.txt: %v %q", rr.Code, rr.Body)
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", "/favicon.ico", nil)
+	rr := httptest.NewRecorder()
+	s.handleFavicon(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("without favicon: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	s.conf.Favicon = "testdata/catmetal.jpg"
+	rr = httptest.NewRecorder()
+	s.handleFavicon(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("with favicon: got %v, %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
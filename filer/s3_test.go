@@ -0,0 +1,148 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage/s3test"
+)
+
+/*
+ * Configures the S3 backend with a fake S3 server
+ */
+func setupFakeS3(t *testing.T) (*Server, *s3test.Server, func()) {
+	fake := s3test.NewServer()
+	server := httptest.NewServer(fake)
+
+	s := newTestServer(t)
+	s.conf.StorageBackend = "s3"
+	s.conf.S3Endpoint = server.URL
+	s.conf.S3Bucket = "uploads"
+	s.conf.S3Prefix = "files/"
+	s.conf.S3AccessKey = "access"
+	s.conf.S3SecretKey = "secret"
+	s.conf.S3PathStyle = true
+	if err := s.validateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setupBackend(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, fake, server.Close
+}
+
+/*
+ * Upload files to S3 and download them again
+ */
+func TestS3Backend(t *testing.T) {
+	s, fake, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	content := []byte(strings.Repeat("stored in a bucket ", 1000))
+	if status := s.uploadFile(t, "abc/bucket.txt", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	if !bytes.Equal(fake.Objects["/uploads/files/abc/bucket.txt"], content) {
+		t.Fatalf("object has not been stored: %v", fake.Objects)
+	}
+
+	if status := s.uploadFile(t, "abc/bucket.txt", []byte("other content")).Code; status != http.StatusConflict {
+		t.Errorf("upload to existing path returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/abc/bucket.txt", nil)
+	req.Header.Set("Range", "bytes=1000-1999")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), content[1000:2000]) {
+		t.Errorf("range request failed. Status: %v", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/missing.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("download of missing file returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Encrypted and compressed
+	s.conf.EncryptionKey = testEncryptionKey
+	s.conf.CompressFiles = true
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.uploadFile(t, "abc/encrypted.txt", content).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	req, _ = http.NewRequest("GET", "/upload/abc/encrypted.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download of encrypted file failed. Status: %v", rr.Code)
+	}
+}
+
+/*
+ * Downloads must be redirected to presigned URLs or a CDN
+ */
+func TestDownloadRedirect(t *testing.T) {
+	s, _, teardown := setupFakeS3(t)
+	defer teardown()
+
+	// Remove internal files after test
+	defer s.cleanup()
+
+	s.conf.DownloadRedirect = "presigned"
+
+	if status := s.uploadFile(t, "abc/redirect.txt", []byte("redirect me")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	download := func(fileStorePath string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := download("abc/redirect.txt")
+	location := rr.Header().Get("Location")
+	if rr.Code != http.StatusFound || !strings.HasPrefix(location, s.conf.S3Endpoint+"/uploads/files/abc/redirect.txt?") || !strings.Contains(location, "X-Amz-Signature=") {
+		t.Fatalf("download has not been redirected to a presigned URL: %v %s", rr.Code, location)
+	}
+
+	// Presigned URL must work
+	resp, err := http.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("presigned URL returned wrong status code: %v", resp.StatusCode)
+	}
+
+	s.conf.DownloadRedirect = "cdn"
+	s.conf.DownloadRedirectPrefix = "https://cdn.example.com/files/"
+	if location := download("abc/redirect.txt").Header().Get("Location"); location != "https://cdn.example.com/files/abc/redirect.txt" {
+		t.Errorf("wrong CDN redirect: %s", location)
+	}
+
+	// Encrypted files can't be downloaded directly
+	s.conf.EncryptionKey = testEncryptionKey
+	if err := s.loadEncryptionKey(); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.uploadFile(t, "abc/secret.txt", []byte("secret")).Code; status != http.StatusCreated {
+		t.Fatalf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	if rr := download("abc/secret.txt"); rr.Code != http.StatusOK || rr.Body.String() != "secret" {
+		t.Errorf("encrypted file has been redirected: %v", rr.Code)
+	}
+}
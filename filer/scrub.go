@@ -0,0 +1,173 @@
+/*
+ * Integrity verification
+ * A background scrubber periodically re-reads all stored files and compares
+ * their content with the SHA-256 hash recorded in their metadata. Reading
+ * is throttled to scrubRate bytes per second, so downloads don't suffer.
+ */
+
+package filer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	scrubFilesMetric     = newCounter("prosody_filer_scrub_files_total", "Files verified by the scrubber, by result.")
+	scrubBytesMetric     = newCounter("prosody_filer_scrub_bytes_total", "Bytes read by the scrubber.")
+	scrubCorruptMetric   = newGauge("prosody_filer_scrub_corrupt_files", "Corrupt files found by the last completed scrub.")
+	scrubCompletedMetric = newGauge("prosody_filer_scrub_last_completed_timestamp_seconds", "Time the last scrub has been completed.")
+)
+
+/*
+ * Result of a scrub run
+ */
+type scrubResult struct {
+	Verified int
+	Corrupt  int
+	Missing  int
+	Failed   int
+}
+
+/*
+ * Runs the scrubber every scrubInterval, in a cluster only on the leader
+ */
+func (s *Server) startScrubber() {
+	go func() {
+		ticker := time.NewTicker(s.conf.ScrubInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.isClusterLeader() {
+				continue
+			}
+			log.Info("Starting scrub of stored files")
+			result := s.scrubStore()
+			log.Infof("Scrub completed: %d files verified, %d corrupt, %d missing, %d failed",
+				result.Verified, result.Corrupt, result.Missing, result.Failed)
+		}
+	}()
+}
+
+/*
+ * Verifies all files which have metadata
+ */
+func (s *Server) scrubStore() scrubResult {
+	var result scrubResult
+	metaDir := s.sharedPath("meta")
+
+	filepath.Walk(metaDir, func(metaFilename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Error("Scrub: ", err)
+			}
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(metaFilename, ".json") {
+			return nil
+		}
+
+		switch err := s.scrubFile(metaFilename); {
+		case err == nil:
+			result.Verified++
+			scrubFilesMetric.add(`result="ok"`, 1)
+		case err == errFileCorrupt:
+			result.Corrupt++
+			scrubFilesMetric.add(`result="corrupt"`, 1)
+		case os.IsNotExist(err):
+			result.Missing++
+			scrubFilesMetric.add(`result="missing"`, 1)
+		default:
+			log.Error("Scrub: ", err)
+			result.Failed++
+			scrubFilesMetric.add(`result="error"`, 1)
+		}
+		return nil
+	})
+
+	scrubCorruptMetric.set("", float64(result.Corrupt))
+	scrubCompletedMetric.set("", float64(time.Now().Unix()))
+	return result
+}
+
+var errFileCorrupt = errors.New("file is corrupt")
+
+/*
+ * Verifies the file described by a metadata file
+ */
+func (s *Server) scrubFile(metaFilename string) error {
+	data, err := os.ReadFile(metaFilename)
+	if err != nil {
+		return err
+	}
+	var meta fileMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("invalid metadata %s: %s", metaFilename, err)
+	}
+
+	file, err := s.openBackendFile(meta.Path)
+	if os.IsNotExist(err) {
+		log.Errorf("Scrub: %s is missing", meta.Path)
+		return err
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, &throttledReader{src: file, rate: s.conf.ScrubRate})
+	scrubBytesMetric.add("", float64(size))
+	if err == errDecryptionFailed {
+		log.Errorf("Scrub: %s is corrupt: %s", meta.Path, err)
+		return errFileCorrupt
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %s", meta.Path, err)
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != meta.SHA256 || size != meta.Size {
+		log.Errorf("Scrub: %s is corrupt: expected hash %s, got %s", meta.Path, meta.SHA256, hash)
+		return errFileCorrupt
+	}
+	return nil
+}
+
+/*
+ * Limits reading to rate bytes per second. A rate of 0 means no limit.
+ */
+type throttledReader struct {
+	src   io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.rate <= 0 {
+		return t.src.Read(p)
+	}
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	// Read at most a tenth of a second's worth at once
+	if limit := t.rate/10 + 1; int64(len(p)) > limit {
+		p = p[:limit]
+	}
+
+	n, err := t.src.Read(p)
+	t.read += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,63 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ * Scrubber must find corrupt and missing files
+ */
+func TestScrubStore(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.ScrubRate = 0
+
+	for _, fileStorePath := range []string{"abc/ok.txt", "def/corrupt.txt", "ghi/missing.txt"} {
+		if status := s.uploadFile(t, fileStorePath, []byte("content of "+fileStorePath)).Code; status != http.StatusCreated {
+			t.Fatalf("upload of %s returned wrong status code: got %v want %v", fileStorePath, status, http.StatusCreated)
+		}
+	}
+
+	corruptFilename := filepath.Join(s.conf.StoreDir, "def/corrupt.txt")
+	content, _ := os.ReadFile(corruptFilename)
+	content[3] ^= 1
+	if err := os.WriteFile(corruptFilename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(s.conf.StoreDir, "ghi/missing.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	result := s.scrubStore()
+	if result != (scrubResult{Verified: 1, Corrupt: 1, Missing: 1}) {
+		t.Errorf("unexpected scrub result: %+v", result)
+	}
+	if got := scrubCorruptMetric.get(""); got != 1 {
+		t.Errorf("corrupt files metric: got %v want 1", got)
+	}
+}
+
+/*
+ * Throttled reading must take about as long as the rate allows
+ */
+func TestThrottledReader(t *testing.T) {
+	start := time.Now()
+	var out bytes.Buffer
+	out.ReadFrom(&throttledReader{src: bytes.NewReader(make([]byte, 20000)), rate: 100000})
+
+	if out.Len() != 20000 {
+		t.Fatalf("read %d bytes, want 20000", out.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("reading was not throttled: took %s", elapsed)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Secret strength
+ * MACs are only as good as the secret they are signed with. Empty secrets,
+ * secrets shorter than minSecretLength and example values from
+ * documentation and tutorials are refused at startup, or only logged with
+ * weakSecrets = "warn".
+ */
+
+package filer
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * Secrets found in documentation of XMPP servers and in tutorials
+ */
+var exampleSecrets = []string{
+	"mysecret",
+	"secret",
+	"it-is-secret",
+	"this is a secret string!",
+	"changeme",
+	"change-me",
+	"yoursecret",
+	"your-secret",
+	"supersecret",
+	"a long random string",
+	"secret of the standby",
+	"secret of the central filer",
+}
+
+/*
+ * Returns why secret is weak, or "" if it isn't
+ */
+func (s *Server) secretWeakness(secret string) string {
+	for _, example := range exampleSecrets {
+		if strings.EqualFold(strings.TrimSpace(secret), example) {
+			return "is a well-known example value"
+		}
+	}
+	if secret == "" {
+		return "is empty"
+	} else if len(secret) < s.conf.MinSecretLength {
+		return fmt.Sprintf("is shorter than %d characters", s.conf.MinSecretLength)
+	}
+	return ""
+}
+
+/*
+ * Checks the secrets MACs and tokens are signed with
+ */
+func (s *Server) checkSecrets() error {
+	secrets := []struct {
+		setting string
+		value   string
+	}{
+		{"secret", s.conf.Secret},
+		{"upstreamSecret", s.conf.UpstreamSecret},
+		{"mirrorSecret", s.conf.MirrorSecret},
+		{"jwtSecret", s.conf.JwtSecret},
+	}
+	for i, secret := range secrets {
+		// Optional ones default to secret
+		if i > 0 && secret.value == "" {
+			continue
+		}
+		weakness := s.secretWeakness(secret.value)
+		if weakness == "" {
+			continue
+		}
+
+		message := fmt.Sprintf("%s %s, which makes MACs easy to forge. Generate one with \"openssl rand -hex 32\".", secret.setting, weakness)
+		if s.conf.WeakSecrets != "warn" {
+			return fmt.Errorf("%s Set weakSecrets = \"warn\" to start anyway.", message)
+		}
+		log.Warn("WARNING: ", message)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Short URLs
+ * With shortURLs enabled, every upload gets an alias below shortURLSubDir,
+ * e.g. "/s/k3x9q2mfa7c0", which redirects to the file. Aliases consist of
+ * a random ID and a signature made with the secret, so guessed aliases are
+ * rejected without touching the disk. They are lower case only, as the
+ * alias index may live on a case-insensitive file system.
+ *
+ * The alias is stored in the file's metadata, and the index in
+ * ".prosody-filer/short/<alias>" maps it back to the upload path.
+ */
+
+package filer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	shortURLAlphabet    = "0123456789abcdefghijklmnopqrstuvwxyz"
+	shortURLIDLength    = 8
+	shortURLSigLength   = 4
+	shortURLAliasLength = shortURLIDLength + shortURLSigLength
+	shortURLMaxAttempts = 5
+)
+
+/*
+ * Encodes bytes using shortURLAlphabet. Slightly biased, which doesn't
+ * matter for signatures.
+ */
+func shortURLEncode(b []byte) string {
+	encoded := make([]byte, len(b))
+	for i, c := range b {
+		encoded[i] = shortURLAlphabet[int(c)%len(shortURLAlphabet)]
+	}
+	return string(encoded)
+}
+
+func (s *Server) shortURLSignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(s.conf.Secret))
+	mac.Write([]byte("short-url " + id))
+	return shortURLEncode(mac.Sum(nil)[:shortURLSigLength])
+}
+
+/*
+ * Returns a new random, signed alias
+ */
+func (s *Server) newShortURLAlias() (string, error) {
+	id := make([]byte, 0, shortURLIDLength)
+	buf := make([]byte, 16)
+	for len(id) < shortURLIDLength {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			// Skip values which would make some characters more likely
+			if int(c) < 256-256%len(shortURLAlphabet) && len(id) < shortURLIDLength {
+				id = append(id, shortURLAlphabet[int(c)%len(shortURLAlphabet)])
+			}
+		}
+	}
+	return string(id) + s.shortURLSignature(string(id)), nil
+}
+
+/*
+ * Reports whether alias has been signed with the secret
+ */
+func (s *Server) validShortURLAlias(alias string) bool {
+	if len(alias) != shortURLAliasLength {
+		return false
+	}
+	id := alias[:shortURLIDLength]
+	return subtle.ConstantTimeCompare([]byte(alias[shortURLIDLength:]), []byte(s.shortURLSignature(id))) == 1
+}
+
+func (s *Server) shortURLIndexPath(alias string) string {
+	return s.sharedPath("short", alias)
+}
+
+/*
+ * Creates an alias for fileStorePath and adds it to the index
+ */
+func (s *Server) createShortURL(fileStorePath string) (string, error) {
+	if err := os.MkdirAll(s.sharedPath("short"), os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create short URL directory: %s", err)
+	}
+
+	for attempt := 0; attempt < shortURLMaxAttempts; attempt++ {
+		alias, err := s.newShortURLAlias()
+		if err != nil {
+			return "", err
+		}
+
+		index, err := os.OpenFile(s.shortURLIndexPath(alias), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed to create short URL for %s: %s", fileStorePath, err)
+		}
+		_, err = index.WriteString(fileStorePath)
+		if closeErr := index.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(s.shortURLIndexPath(alias))
+			return "", fmt.Errorf("failed to create short URL for %s: %s", fileStorePath, err)
+		}
+		return alias, nil
+	}
+
+	return "", errors.New("failed to create short URL: no free alias found")
+}
+
+/*
+ * Returns the upload path an alias points to
+ */
+func (s *Server) resolveShortURL(alias string) (string, error) {
+	if !s.validShortURLAlias(alias) {
+		return "", os.ErrNotExist
+	}
+	fileStorePath, err := os.ReadFile(s.shortURLIndexPath(alias))
+	return string(fileStorePath), err
+}
+
+/*
+ * Returns the alias of a stored file, creating it if the file has none yet
+ */
+func (s *Server) shortURLFor(fileStorePath string) (string, error) {
+	meta, err := s.readMetadata(fileStorePath)
+	if err == nil && meta.ShortURL != "" {
+		return meta.ShortURL, nil
+	} else if os.IsNotExist(err) {
+		// Files stored by older versions have no metadata
+		meta = fileMetadata{Path: fileStorePath}
+	} else if err != nil {
+		return "", err
+	}
+
+	alias, err := s.createShortURL(fileStorePath)
+	if err != nil {
+		return "", err
+	}
+	meta.ShortURL = alias
+	if err := s.writeMetadata(meta); err != nil {
+		os.Remove(s.shortURLIndexPath(alias))
+		return "", err
+	}
+	return alias, nil
+}
+
+/*
+ * Returns the public URL of an alias
+ */
+func (s *Server) shortURL(r *http.Request, alias string) string {
+	return s.requestBaseURL(r) + path.Join("/", s.conf.ShortURLSubDir, alias)
+}
+
+/*
+ * Request handler for short URLs: redirects to the file
+ */
+func (s *Server) handleShortURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	alias := strings.TrimPrefix(r.URL.Path, path.Join("/", s.conf.ShortURLSubDir)+"/")
+	fileStorePath, err := s.resolveShortURL(alias)
+	if os.IsNotExist(err) {
+		log.Warn("Unknown short URL ", r.URL.Path)
+		s.recordNotFound(r)
+		httpError(w, http.StatusNotFound, "")
+		return
+	} else if err != nil {
+		log.Error("Resolving short URL failed: ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	location := path.Join("/", s.conf.UploadSubDir) + "/" + (&url.URL{Path: fileStorePath}).EscapedPath()
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+/*
+ * Short URL endpoint:
+ *   POST /short?path=<path>   Return the short URL of a stored file, creating it if needed
+ */
+func (s *Server) handleAdminShortURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !s.conf.ShortURLs {
+		httpError(w, http.StatusNotImplemented, "shortURLs is not enabled")
+		return
+	}
+
+	fileStorePath := strings.TrimPrefix(path.Clean("/"+r.FormValue("path")), "/")
+	if fileStorePath == "" || isInternalPath(fileStorePath) || checkStorePath(fileStorePath, windowsPaths) != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing or invalid path"})
+		return
+	}
+	exists, err := s.backend.Exists(fileStorePath)
+	if err != nil {
+		log.Error("Failed to check for existing file ", fileStorePath, ": ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	} else if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found"})
+		return
+	}
+
+	alias, err := s.shortURLFor(fileStorePath)
+	if err != nil {
+		log.Error(err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	response := map[string]string{"alias": alias, "path": path.Join("/", s.conf.ShortURLSubDir, alias)}
+	if s.conf.PublicURL != "" {
+		response["url"] = s.shortURL(r, alias)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,84 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestShortURLAlias(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	alias, err := s.newShortURLAlias()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alias) != shortURLAliasLength || strings.ToLower(alias) != alias {
+		t.Errorf("unexpected alias %q", alias)
+	}
+	if !s.validShortURLAlias(alias) {
+		t.Errorf("alias %q not accepted", alias)
+	}
+
+	tampered := "00000000" + alias[shortURLIDLength:]
+	if s.validShortURLAlias(tampered) || s.validShortURLAlias(alias[1:]) {
+		t.Errorf("forged alias accepted")
+	}
+}
+
+func TestShortURL(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.ShortURLs = true
+	s.conf.AdminToken = "admintoken"
+	defer s.cleanup()
+
+	rr := s.serveUpload(s.newUploadRequest(t, "abc/long name.txt", []byte("hello")))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %v", rr.Code)
+	}
+	short := rr.Header().Get("X-Short-URL")
+	if !strings.HasPrefix(short, "http://") {
+		t.Fatalf("missing short URL: %q", short)
+	}
+	alias := path.Base(short)
+
+	meta, err := s.readMetadata("abc/long name.txt")
+	if err != nil || meta.ShortURL != alias {
+		t.Errorf("alias not stored in metadata: %v, %q", err, meta.ShortURL)
+	}
+
+	// Aliases redirect to the file
+	req, _ := http.NewRequest("GET", "/s/"+alias, nil)
+	rr = httptest.NewRecorder()
+	s.handleShortURL(rr, req)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/upload/abc/long%20name.txt" {
+		t.Errorf("redirect: got %v, %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// Unknown or forged aliases are not found
+	for _, unknown := range []string{"nope", "00000000" + alias[shortURLIDLength:]} {
+		req, _ = http.NewRequest("GET", "/s/"+unknown, nil)
+		rr = httptest.NewRecorder()
+		s.handleShortURL(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: got %v want %v", unknown, rr.Code, http.StatusNotFound)
+		}
+	}
+
+	// The admin API returns the existing alias
+	rr = s.adminRequest(t, "POST", "/short?path=abc/long%20name.txt")
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || response["alias"] != alias {
+		t.Errorf("admin API: got %v %s", rr.Code, rr.Body)
+	}
+
+	rr = s.adminRequest(t, "POST", "/short?path=abc/missing.txt")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing file: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Upload slots (XEP-0363)
+ * XMPP servers without mod_http_upload_external (or a bridge or bot acting
+ * for them) can request upload slots from the admin API. Prosody Filer
+ * picks a random path, signs it with the secret and returns the PUT and
+ * GET URLs to hand out to the client. With slotObfuscateNames, the file
+ * name is random as well.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"time"
+)
+
+/*
+ * Upload slot, as handed out to XMPP clients
+ */
+type uploadSlot struct {
+	Put string `json:"put"`
+	Get string `json:"get"`
+}
+
+/*
+ * Slot endpoint:
+ *   POST /slot?filename=<name>&size=<bytes>[&exp=<unix time>][&maxdl=<n>]   Request an upload slot
+ */
+func (s *Server) handleAdminSlot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if s.conf.PublicURL == "" {
+		httpError(w, http.StatusNotImplemented, "publicURL is not configured")
+		return
+	}
+	if s.rejectReadOnly(w) {
+		return
+	}
+
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing or invalid size"})
+		return
+	}
+	expires, err := uploadExpiry(r.Form)
+	if err != nil || (expires != 0 && expires <= time.Now().Unix()) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid exp"})
+		return
+	}
+	maxDownloads, err := uploadMaxDownloads(r.Form)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid maxdl"})
+		return
+	}
+	filename := r.FormValue("filename")
+	fileStorePath := path.Join(randomHex(16), slotFilename(filename))
+	if s.conf.SlotObfuscateNames {
+		fileStorePath = path.Join(randomHex(16), randomHex(16)+slotExtension(filename))
+	}
+	maxSize := s.sizeLimit(fileStorePath)
+	if s.conf.SlotMaxSize > 0 && (maxSize == 0 || s.conf.SlotMaxSize < maxSize) {
+		maxSize = s.conf.SlotMaxSize
+	}
+	if maxSize > 0 && size > maxSize {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+			"error":       "file too large",
+			"maxFileSize": maxSize,
+		})
+		return
+	}
+
+	escapedPath := (&url.URL{Path: fileStorePath}).EscapedPath()
+	baseURL := strings.TrimSuffix(s.conf.PublicURL, "/") + "/"
+	macPath := fileStorePath
+	if s.conf.MacPathEncoding == "escaped" {
+		macPath = escapedPath
+	}
+	protocolVersion := macVersions(&s.conf, s.conf.UploadSubDir)[0]
+	query := protocolVersion + "=" + s.uploadMAC(protocolVersion, macPath, size, expires, maxDownloads)
+	if expires != 0 {
+		query += "&exp=" + strconv.FormatInt(expires, 10)
+	}
+	if maxDownloads != 0 {
+		query += "&maxdl=" + strconv.FormatInt(maxDownloads, 10)
+	}
+	// Recorded with the upload if the file gets another name
+	if filename != "" && filename != path.Base(fileStorePath) && validDownloadName(filename) {
+		query += "&name=" + url.QueryEscape(filename)
+	}
+
+	log.Info("Issued upload slot for ", fileStorePath, " (", size, " bytes)")
+	writeJSON(w, http.StatusOK, uploadSlot{
+		Put: baseURL + escapedPath + "?" + query,
+		Get: baseURL + escapedPath,
+	})
+}
+
+/*
+ * Returns the extension of a client supplied filename, which determines
+ * the content type, or "" if it isn't usable
+ */
+func slotExtension(filename string) string {
+	ext := path.Ext(slotFilename(filename))
+	if len(ext) > 16 || ext == "." {
+		return ""
+	}
+	return ext
+}
+
+/*
+ * Makes a client supplied filename safe to use as last path element
+ */
+func slotFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	filename = strings.TrimLeft(filename, ".")
+
+	// Keep the extension, which determines the content type
+	if len(filename) > 128 {
+		ext := path.Ext(filename)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		filename = strings.ToValidUTF8(filename[:128-len(ext)], "") + ext
+	}
+
+	if filename == "" {
+		return "file"
+	}
+	return filename
+}
@@ -0,0 +1,126 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*
+ * Request an upload slot and use it
+ */
+func TestSlot(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+	s.conf.SlotToken = "slottoken"
+	s.conf.SlotMaxSize = 1000
+	s.conf.PublicURL = "https://upload.example.com/upload/"
+
+	slotRequest := func(token string, target string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	content := []byte("file uploaded to a slot")
+	rr := slotRequest("slottoken", "/slot?filename=my%20cat.txt&size=23")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("slot request returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var slot uploadSlot
+	if err := json.Unmarshal(rr.Body.Bytes(), &slot); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(slot.Get, s.conf.PublicURL) || !strings.HasSuffix(slot.Get, "/my%20cat.txt") {
+		t.Errorf("unexpected GET URL %s", slot.Get)
+	}
+
+	putURL, err := url.Parse(slot.Put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", putURL.RequestURI(), bytes.NewReader(content))
+	if status := s.serveUpload(req).Code; status != http.StatusCreated {
+		t.Errorf("upload to slot returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	if status := slotRequest("slottoken", "/slot?filename=big.bin&size=1001").Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("slot request for large file returned wrong status code: got %v want %v", status, http.StatusRequestEntityTooLarge)
+	}
+
+	// The slot token can't be used for anything else
+	if status := slotRequest("slottoken", "/quarantine").Code; status != http.StatusUnauthorized {
+		t.Errorf("slot token has been accepted for /quarantine: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestSlotFilename(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"cat.jpg":                         "cat.jpg",
+		"../../etc/passwd":                "_.._etc_passwd",
+		".prosody-filer":                  "prosody-filer",
+		"":                                "file",
+		"a\nb.txt":                        "a_b.txt",
+		strings.Repeat("x", 200) + ".jpg": strings.Repeat("x", 124) + ".jpg",
+	} {
+		if name := slotFilename(filename); name != expected {
+			t.Errorf("slotFilename(%q) = %q, want %q", filename, name, expected)
+		}
+	}
+}
+
+/*
+ * With slotObfuscateNames, files get random names and keep the requested
+ * one in their metadata
+ */
+func TestSlotObfuscateNames(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+	s.conf.PublicURL = "https://upload.example.com/upload/"
+	s.conf.SlotObfuscateNames = true
+
+	rr := s.adminRequest(t, "POST", "/slot?filename="+url.QueryEscape("Urlaub März.jpg")+"&size=4")
+	var slot uploadSlot
+	if err := json.Unmarshal(rr.Body.Bytes(), &slot); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(slot.Get, "Urlaub") || !strings.HasSuffix(slot.Get, ".jpg") {
+		t.Errorf("unexpected GET URL %s", slot.Get)
+	}
+
+	putURL, err := url.Parse(slot.Put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", putURL.RequestURI(), bytes.NewReader([]byte("meow")))
+	if status := s.serveUpload(req).Code; status != http.StatusCreated {
+		t.Fatalf("upload to slot returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	fileStorePath := strings.TrimPrefix(putURL.Path, "/upload/")
+	if meta, err := s.readMetadata(fileStorePath); err != nil || meta.Name != "Urlaub März.jpg" {
+		t.Errorf("original name not recorded: %+v, %v", meta, err)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/"+fileStorePath, nil)
+	disposition := s.serveUpload(req).Header().Get("Content-Disposition")
+	if disposition != `inline; filename="Urlaub M_rz.jpg"; filename*=UTF-8''Urlaub%20M%C3%A4rz.jpg` {
+		t.Errorf("unexpected Content-Disposition %q", disposition)
+	}
+}
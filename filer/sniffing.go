@@ -0,0 +1,159 @@
+/*
+ * Content sniffing
+ * Checks on the first bytes of an upload, which are inspected before the
+ * rest of the body is received.
+ */
+
+package filer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Number of bytes looked at by content checks
+const sniffLen = 512
+
+/*
+ * Returns the first sniffLen bytes of reader without consuming them. They
+ * are copied, as the buffer Peek returns is overwritten once the rest is
+ * read, e.g. by image filters running concurrently.
+ */
+func peekHead(reader *bufio.Reader) ([]byte, error) {
+	head, err := reader.Peek(sniffLen)
+	return append([]byte{}, head...), err
+}
+
+/*
+ * Detects executables by their magic bytes. Returns a description of the
+ * executable type or an empty string.
+ * Checks are strict enough that random data (e.g. OMEMO encrypted files)
+ * practically never matches.
+ */
+func detectExecutable(head []byte) string {
+	switch {
+	case isPE(head):
+		return "Windows PE"
+	case bytes.HasPrefix(head, []byte("\x7fELF")) && len(head) > 4 && (head[4] == 1 || head[4] == 2):
+		return "ELF"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}),
+		bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "Mach-O"
+	case bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "Mach-O universal / Java class"
+	case bytes.HasPrefix(head, []byte("#!/")), bytes.HasPrefix(head, []byte("#! /")):
+		return "script"
+	}
+
+	return ""
+}
+
+/*
+ * Checks for a DOS header ("MZ") pointing to a PE signature
+ */
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+
+	peOffset := binary.LittleEndian.Uint32(head[0x3c:0x40])
+	if peOffset > uint32(len(head)-4) {
+		// PE header lies beyond what we have seen. Real executables keep it close to the start.
+		return false
+	}
+
+	return bytes.Equal(head[peOffset:peOffset+4], []byte("PE\x00\x00"))
+}
+
+/*
+ * Returns the content type implied by the file extension. This is the type
+ * clients sign in v2 / token MACs and the type sent on downloads.
+ */
+func extensionContentType(fileStorePath string) string {
+	contentType := mime.TypeByExtension(filepath.Ext(fileStorePath))
+	if contentType == "" {
+		contentType = mediaContentTypes[strings.ToLower(filepath.Ext(fileStorePath))]
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+/*
+ * Determines the type of an upload from its first bytes.
+ * Executables are reported as "application/x-executable".
+ */
+func sniffContentType(head []byte) string {
+	if detectExecutable(head) != "" {
+		return "application/x-executable"
+	}
+	return http.DetectContentType(head)
+}
+
+/*
+ * Content types which are executables themselves. Sniffing an executable
+ * is only consistent with one of these.
+ */
+var executableContentTypes = map[string]bool{
+	"application/x-executable":                      true,
+	"application/x-msdownload":                      true,
+	"application/x-msdos-program":                   true,
+	"application/x-mach-binary":                     true,
+	"application/x-sh":                              true,
+	"application/x-shellscript":                     true,
+	"application/x-python-code":                     true,
+	"application/java-archive":                      true,
+	"application/java-vm":                           true,
+	"text/x-python":                                 true,
+	"text/x-sh":                                     true,
+	"text/x-shellscript":                            true,
+	"application/x-perl":                            true,
+	"application/vnd.microsoft.portable-executable": true,
+}
+
+/*
+ * Checks whether a sniffed content type is plausible for the declared one.
+ * Unknown content (e.g. OMEMO encrypted files, which look like random data)
+ * always matches, as do types of the same media family (image/png uploaded
+ * as .jpg is a naming problem, not an attack).
+ */
+func contentTypesMatch(declared string, sniffed string) bool {
+	declared, _, _ = mime.ParseMediaType(declared)
+	sniffed, _, _ = mime.ParseMediaType(sniffed)
+
+	if sniffed == "application/octet-stream" || declared == "application/octet-stream" || sniffed == declared {
+		return true
+	}
+
+	declaredFamily := strings.SplitN(declared, "/", 2)[0]
+	sniffedFamily := strings.SplitN(sniffed, "/", 2)[0]
+
+	switch {
+	case sniffed == "application/x-executable":
+		return executableContentTypes[declared]
+	case sniffed == "text/html" || sniffed == "text/xml":
+		// Markup can be rendered by browsers and is only fine where expected
+		return strings.Contains(declared, "html") || strings.Contains(declared, "xml")
+	case sniffed == "text/plain":
+		// Plain text fits all text-like formats, but not binary media
+		return declaredFamily != "image" && declaredFamily != "audio" && declaredFamily != "video"
+	case sniffed == "application/zip":
+		// Lots of document and package formats are zip containers
+		return strings.HasSuffix(declared, "+zip") || strings.HasPrefix(declared, "application/vnd.") ||
+			declared == "application/java-archive" || declared == "application/x-zip-compressed"
+	case sniffed == "application/ogg":
+		return declaredFamily == "audio" || declaredFamily == "video"
+	case sniffedFamily == "image" || sniffedFamily == "audio" || sniffedFamily == "video":
+		return declaredFamily == sniffedFamily
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+package filer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net/http"
+	"os"
+	"testing"
+)
+
+/*
+ * The head of an upload stays intact while the rest is read in small
+ * pieces, refilling the buffer it was peeked from
+ */
+func TestPeekHead(t *testing.T) {
+	content := make([]byte, 3*4096)
+	rand.Read(content)
+
+	reader := bufio.NewReader(bytes.NewReader(content))
+	peeked, _ := reader.Peek(sniffLen)
+	head, err := peekHead(reader)
+	if err != nil || !bytes.Equal(head, content[:sniffLen]) {
+		t.Fatalf("unexpected head: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	for {
+		if _, err := reader.Read(buf); err != nil {
+			break
+		}
+	}
+	if bytes.Equal(peeked, content[:sniffLen]) {
+		t.Fatal("peeked buffer not reused, test doesn't show anything")
+	}
+	if !bytes.Equal(head, content[:sniffLen]) {
+		t.Error("head overwritten while reading the rest")
+	}
+}
+
+/*
+ * Test executable detection on known magic bytes and on harmless content
+ */
+func TestDetectExecutable(t *testing.T) {
+	pe := make([]byte, 0x100)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x80)
+	copy(pe[0x80:], "PE\x00\x00")
+
+	dosOnly := make([]byte, 0x100)
+	copy(dosOnly, "MZ")
+
+	catMetalFile, err := os.ReadFile("testdata/catmetal.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := make([]byte, sniffLen)
+	rand.Read(random)
+	random[0] = 0
+
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"pe", pe, "Windows PE"},
+		{"mz without pe header", dosOnly, ""},
+		{"elf", []byte("\x7fELF\x02\x01\x01\x00"), "ELF"},
+		{"mach-o", []byte{0xcf, 0xfa, 0xed, 0xfe, 0x07, 0x00}, "Mach-O"},
+		{"shebang", []byte("#!/bin/sh\necho hi\n"), "script"},
+		{"jpeg", catMetalFile[:sniffLen], ""},
+		{"text", []byte("hello world"), ""},
+		{"random", random, ""},
+	}
+
+	for _, test := range tests {
+		if got := detectExecutable(test.head); got != test.want {
+			t.Errorf("%s: got %q want %q", test.name, got, test.want)
+		}
+	}
+}
+
+/*
+ * Upload a shell script disguised as image with executable blocking enabled
+ */
+func TestUploadExecutableBlocked(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.BlockExecutables = true
+
+	rr := s.uploadFile(t, "thomas/abc/cute.jpg", []byte("#!/bin/sh\nrm -rf ~\n"))
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Regular files must still be accepted
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Test which sniffed content types are accepted for declared ones
+ */
+func TestContentTypesMatch(t *testing.T) {
+	tests := []struct {
+		declared string
+		sniffed  string
+		want     bool
+	}{
+		{"image/jpeg", "image/jpeg", true},
+		{"image/jpeg", "image/png", true},
+		{"image/jpeg", "application/octet-stream", true},
+		{"application/octet-stream", "application/pdf", true},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8", true},
+		{"application/json", "text/plain; charset=utf-8", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip", true},
+		{"audio/ogg", "application/ogg", true},
+		{"image/jpeg", "text/html; charset=utf-8", false},
+		{"image/jpeg", "text/plain; charset=utf-8", false},
+		{"image/jpeg", "application/x-executable", false},
+		{"image/jpeg", "application/pdf", false},
+		{"video/mp4", "image/gif", false},
+	}
+
+	for _, test := range tests {
+		if got := contentTypesMatch(test.declared, test.sniffed); got != test.want {
+			t.Errorf("contentTypesMatch(%q, %q) = %v, want %v", test.declared, test.sniffed, got, test.want)
+		}
+	}
+}
+
+/*
+ * Upload HTML disguised as image with mismatch policy "reject"
+ */
+func TestUploadMimeMismatchRejected(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MimeMismatchPolicy = "reject"
+
+	rr := s.uploadFile(t, "thomas/abc/cute.jpg", []byte("<html><script>alert(1)</script></html>"))
+	if status := rr.Code; status != http.StatusUnsupportedMediaType {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnsupportedMediaType)
+	}
+
+	if status := s.uploadCatmetal(t).Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Live event stream
+ * GET /events on the admin API streams file events as server-sent events
+ * (text/event-stream), e.g. for dashboards and moderation tools.
+ */
+
+package filer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const eventStreamKeepalive = 30 * time.Second
+
+/*
+ * Event stream endpoint:
+ *   GET /events?types=upload,delete   Stream events, optionally only some types
+ */
+func (s *Server) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+
+	var types []string
+	if r.FormValue("types") != "" {
+		types = strings.Split(r.FormValue("types"), ",")
+		for _, eventType := range types {
+			if !isEventType(eventType) {
+				httpError(w, http.StatusBadRequest, "unknown event type "+eventType)
+				return
+			}
+		}
+	}
+
+	// Events are dropped rather than slowing down uploads for a slow client
+	queue := make(chan fileEvent, 100)
+	unsubscribe := s.subscribeEvents(func(event fileEvent) {
+		if types != nil && !eventSelected(types, event.Type) {
+			return
+		}
+		select {
+		case queue <- event:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	log.Info("Event stream opened by ", r.RemoteAddr)
+	defer log.Info("Event stream closed by ", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-queue:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error("Failed to encode event: ", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
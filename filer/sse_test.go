@@ -0,0 +1,69 @@
+package filer
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+ * Events are streamed to admin API clients
+ */
+func TestEventStream(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+
+	server := httptest.NewServer(s.adminHandler())
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/events?types=upload,delete", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.conf.AdminToken)
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	if line, err := stream.ReadString('\n'); err != nil || line != ": connected\n" {
+		t.Fatalf("unexpected start of stream %q: %v", line, err)
+	}
+	stream.ReadString('\n')
+
+	// Downloads have not been requested
+	s.publishEvent(fileEvent{Type: "download", Path: "abc/cat.jpg"})
+	s.publishEvent(fileEvent{Type: "upload", Path: "abc/cat.jpg", Size: 3})
+
+	var lines []string
+	for len(lines) < 2 {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: upload" || !strings.HasPrefix(lines[1], `data: {"type":"upload","path":"abc/cat.jpg","size":3,`) {
+		t.Errorf("unexpected event %q", lines)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/events?types=rename", nil)
+	req.Header.Set("Authorization", "Bearer "+s.conf.AdminToken)
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown event type: got %v want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
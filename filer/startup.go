@@ -0,0 +1,52 @@
+/*
+ * Startup checks
+ * Problems with storeDir are reported when the filer starts, instead of
+ * answering the first upload with 500: it is created if missing and must
+ * be writable (unless readOnly is set), and at least minFreeSpace bytes
+ * must be available on its file system.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"os"
+)
+
+func (s *Server) checkStoreDir() error {
+	if s.conf.StoreDir == "" {
+		return fmt.Errorf("storeDir is required")
+	}
+	if info, err := os.Stat(s.conf.StoreDir); os.IsNotExist(err) {
+		// Others may traverse it to read files, but not list them
+		if err := os.MkdirAll(s.conf.StoreDir, 0751); err != nil {
+			return fmt.Errorf("storeDir %s does not exist and can't be created: %s", s.conf.StoreDir, err)
+		}
+		log.Info("Created storeDir ", s.conf.StoreDir)
+	} else if err != nil {
+		return fmt.Errorf("storeDir %s is not accessible: %s", s.conf.StoreDir, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("storeDir %s is not a directory", s.conf.StoreDir)
+	}
+
+	if !s.conf.ReadOnly {
+		if err := probeWritable(s.conf.StoreDir); err != nil {
+			return fmt.Errorf("storeDir %s is not writable: %s", s.conf.StoreDir, err)
+		}
+	}
+
+	if s.conf.MinFreeSpace <= 0 {
+		return nil
+	}
+	free, err := diskFree(s.conf.StoreDir)
+	if err == errDiskUsageUnsupported {
+		log.Warn("minFreeSpace can't be checked: ", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to check free space in storeDir %s: %s", s.conf.StoreDir, err)
+	}
+	if free < uint64(s.conf.MinFreeSpace) {
+		return fmt.Errorf("only %s available in storeDir %s, less than minFreeSpace (%s)", formatSize(int64(free)), s.conf.StoreDir, formatSize(s.conf.MinFreeSpace))
+	}
+	return nil
+}
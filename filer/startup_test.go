@@ -0,0 +1,38 @@
+package filer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStoreDir(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.StoreDir = filepath.Join(t.TempDir(), "missing", "uploads")
+	if err := s.checkStoreDir(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.conf.StoreDir); err != nil || !info.IsDir() {
+		t.Errorf("missing storeDir has not been created: %v", err)
+	}
+
+	s.conf.StoreDir = ""
+	if err := s.checkStoreDir(); err == nil {
+		t.Errorf("empty storeDir accepted")
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, []byte("not a directory"), 0644)
+	s.conf.StoreDir = file
+	if err := s.checkStoreDir(); err == nil {
+		t.Errorf("file as storeDir accepted")
+	}
+
+	s.conf.StoreDir = t.TempDir()
+	s.conf.MinFreeSpace = 1 << 62
+	if _, err := diskFree(s.conf.StoreDir); err == nil {
+		if err := s.checkStoreDir(); err == nil {
+			t.Errorf("storeDir below minFreeSpace accepted")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Runtime stats
+ * On SIGUSR1, a snapshot of what the filer is doing is logged: running
+ * uploads and downloads, bytes served since the start, goroutines and
+ * usage of storeDir. A quick diagnostic without a metrics stack:
+ *
+ *	kill -USR1 $(pidof prosody-filer)
+ *
+ * Every upload and download is logged with its duration and throughput.
+ * For uploads, the time spent waiting for the client to send data is
+ * logged as well; the rest is spent storing the file.
+ */
+
+package filer
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	transferBytesMetric   = newCounter("prosody_filer_transfer_bytes_total", "Bytes transferred by uploads (PUT) and downloads (GET), by method and tenant.")
+	transferSecondsMetric = newCounter("prosody_filer_transfer_seconds_total", "Duration of uploads (PUT) and downloads (GET), by method and tenant.")
+	uploadWaitMetric      = newCounter("prosody_filer_upload_client_wait_seconds_total", "Time uploads spent waiting for the client to send data.")
+)
+
+type runtimeStats struct {
+	started         time.Time
+	activeUploads   int64
+	activeDownloads int64
+	bytesServed     int64
+	bytesReceived   int64
+
+	// Uploads with valid MAC, by MAC parameter
+	uploadsByMAC map[string]*int64
+}
+
+/*
+ * Counts a request in the stats until the returned function is called,
+ * which also logs the transfer. Returns the ResponseWriter to use, which
+ * counts bytes sent.
+ */
+func (s *Server) trackRequest(w http.ResponseWriter, r *http.Request, fileStorePath string) (http.ResponseWriter, func()) {
+	started := time.Now()
+	tenant := s.requestTenant(r, fileStorePath)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		atomic.AddInt64(&s.stats.activeDownloads, 1)
+		counter := &countingResponseWriter{ResponseWriter: w, count: &s.stats.bytesServed}
+		return counter, func() {
+			atomic.AddInt64(&s.stats.activeDownloads, -1)
+			logTransfer(r, tenant, counter.written, time.Since(started), -1)
+		}
+	case http.MethodPut, http.MethodPost:
+		atomic.AddInt64(&s.stats.activeUploads, 1)
+		counter := &countingReadCloser{ReadCloser: http.NoBody, count: &s.stats.bytesReceived}
+		if r.Body != nil {
+			counter.ReadCloser = r.Body
+			r.Body = counter
+		}
+		return w, func() {
+			atomic.AddInt64(&s.stats.activeUploads, -1)
+			logTransfer(r, tenant, counter.read, time.Since(started), counter.waiting)
+		}
+	}
+	return w, func() {}
+}
+
+/*
+ * Logs and counts the duration and throughput of a transfer. clientWait is
+ * the time spent waiting for the client to send data, -1 for downloads.
+ */
+func logTransfer(r *http.Request, tenant string, bytes int64, duration time.Duration, clientWait time.Duration) {
+	// Requests without body, e.g. refused ones, don't tell anything about throughput
+	if bytes == 0 {
+		return
+	}
+
+	fields := logrus.Fields{
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"bytes":      bytes,
+		"duration":   duration.Round(time.Millisecond).String(),
+		"throughput": formatThroughput(bytes, duration),
+	}
+	if tenant != "" {
+		fields["tenant"] = tenant
+	}
+	if clientWait >= 0 {
+		fields["clientWait"] = clientWait.Round(time.Millisecond).String()
+		uploadWaitMetric.add("", clientWait.Seconds())
+	}
+	log.WithFields(fields).Info("Transfer completed")
+
+	labels := `method="` + r.Method + `"` + tenantLabel(tenant)
+	transferBytesMetric.add(labels, float64(bytes))
+	transferSecondsMetric.add(labels, duration.Seconds())
+}
+
+/*
+ * Formats bytes per duration, e.g. "1.5 MB/s"
+ */
+func formatThroughput(bytes int64, duration time.Duration) string {
+	if duration <= 0 {
+		return "-"
+	}
+	perSecond := float64(bytes) / duration.Seconds()
+	units := []string{"B/s", "kB/s", "MB/s", "GB/s"}
+	unit := 0
+	for perSecond >= 1000 && unit < len(units)-1 {
+		perSecond /= 1000
+		unit++
+	}
+	return strconv.FormatFloat(perSecond, 'f', 1, 64) + " " + units[unit]
+}
+
+/*
+ * Logs the current stats
+ */
+func (s *Server) logStats() {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	fields := logrus.Fields{
+		"uptime":          time.Since(s.stats.started).Round(time.Second).String(),
+		"activeUploads":   atomic.LoadInt64(&s.stats.activeUploads),
+		"activeDownloads": atomic.LoadInt64(&s.stats.activeDownloads),
+		"bytesServed":     atomic.LoadInt64(&s.stats.bytesServed),
+		"bytesReceived":   atomic.LoadInt64(&s.stats.bytesReceived),
+		"goroutines":      runtime.NumGoroutine(),
+		"heapBytes":       memory.HeapAlloc,
+	}
+	var byMAC []string
+	for _, version := range hmacauth.Versions {
+		byMAC = append(byMAC, version+"="+strconv.FormatInt(atomic.LoadInt64(s.stats.uploadsByMAC[version]), 10))
+	}
+	fields["uploadsByMAC"] = strings.Join(byMAC, " ")
+	if used, err := diskUsage(s.conf.StoreDir); err == nil {
+		fields["storeDirUsedPercent"] = used
+	}
+	s.usage.RLock()
+	if !s.usage.updated.IsZero() {
+		fields["storedFiles"] = s.usage.files
+		fields["storedBytes"] = s.usage.bytes
+	}
+	s.usage.RUnlock()
+
+	log.WithFields(fields).Info("Runtime stats")
+}
+
+/*
+ * Counts bytes sent in count, shared by all requests, and written
+ */
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count   *int64
+	written int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	atomic.AddInt64(c.count, int64(n))
+	c.written += int64(n)
+	return n, err
+}
+
+/*
+ * Keeps sendfile working for downloads
+ */
+func (c *countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if readerFrom, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.ResponseWriter}, src)
+	}
+	atomic.AddInt64(c.count, n)
+	c.written += n
+	return n, err
+}
+
+func (c *countingResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/*
+ * Counts bytes received in count, shared by all requests, and read, and
+ * the time spent waiting for them
+ */
+type countingReadCloser struct {
+	io.ReadCloser
+	count   *int64
+	read    int64
+	waiting time.Duration
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	started := time.Now()
+	n, err := c.ReadCloser.Read(p)
+	c.waiting += time.Since(started)
+	atomic.AddInt64(c.count, int64(n))
+	c.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,94 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * Transferred bytes are counted and logged with the stats
+ */
+func TestLogStats(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("counted in the stats")
+	s.uploadFile(t, "abc/stats.txt", content)
+	req, _ := http.NewRequest("GET", "/upload/abc/stats.txt", nil)
+	s.serveUpload(req)
+
+	if s.stats.bytesReceived != int64(len(content)) || s.stats.bytesServed != int64(len(content)) {
+		t.Errorf("got %d bytes received, %d served want %d", s.stats.bytesReceived, s.stats.bytesServed, len(content))
+	}
+	if s.stats.activeUploads != 0 || s.stats.activeDownloads != 0 {
+		t.Errorf("requests still active after completion: %d uploads, %d downloads", s.stats.activeUploads, s.stats.activeDownloads)
+	}
+
+	output := new(bytes.Buffer)
+	previousOut, previousLevel := log.Out, log.GetLevel()
+	log.Out = output
+	log.SetLevel(logrus.InfoLevel)
+	defer func() {
+		log.Out = previousOut
+		log.SetLevel(previousLevel)
+	}()
+	s.logStats()
+	if !strings.Contains(output.String(), "bytesServed=20") || !strings.Contains(output.String(), "activeUploads=0") {
+		t.Errorf("unexpected stats: %s", output.String())
+	}
+}
+
+/*
+ * Uploads and downloads are logged with duration and throughput
+ */
+func TestLogTransfer(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	output := new(bytes.Buffer)
+	previousOut, previousLevel := log.Out, log.GetLevel()
+	log.Out = output
+	log.SetLevel(logrus.InfoLevel)
+	defer func() {
+		log.Out = previousOut
+		log.SetLevel(previousLevel)
+	}()
+
+	uploadedBefore := transferBytesMetric.get(`method="PUT"`)
+	s.uploadFile(t, "abc/transfer.txt", []byte("transferred"))
+	req, _ := http.NewRequest("GET", "/upload/abc/transfer.txt", nil)
+	s.serveUpload(req)
+
+	logged := output.String()
+	if !strings.Contains(logged, `msg="Transfer completed" bytes=11 clientWait=`) || !strings.Contains(logged, "method=GET") {
+		t.Errorf("transfers not logged: %s", logged)
+	}
+	if uploaded := transferBytesMetric.get(`method="PUT"`) - uploadedBefore; uploaded != 11 {
+		t.Errorf("got %v bytes uploaded want 11", uploaded)
+	}
+}
+
+func TestFormatThroughput(t *testing.T) {
+	for _, test := range []struct {
+		bytes    int64
+		duration time.Duration
+		want     string
+	}{
+		{500, time.Second, "500.0 B/s"},
+		{3000000, 2 * time.Second, "1.5 MB/s"},
+		{1, 0, "-"},
+	} {
+		if got := formatThroughput(test.bytes, test.duration); got != test.want {
+			t.Errorf("%d bytes in %s: got %s want %s", test.bytes, test.duration, got, test.want)
+		}
+	}
+}
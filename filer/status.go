@@ -0,0 +1,134 @@
+/*
+ * Status endpoint
+ * A summary of what the filer is doing, for "prosody-filer top": runtime
+ * stats, usage of storeDir and the last warnings and errors logged, which
+ * are kept in memory by a log hook.
+ */
+
+package filer
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const recentErrorsKept = 50
+
+/*
+ * A warning or error message which has been logged
+ */
+type recentError struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+/*
+ * Keeps the last recentErrorsKept warnings and errors
+ */
+type recentErrorLog struct {
+	sync.Mutex
+	entries []recentError
+}
+
+var recentErrors = &recentErrorLog{}
+
+func init() {
+	log.AddHook(recentErrors)
+}
+
+func (l *recentErrorLog) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (l *recentErrorLog) Fire(entry *logrus.Entry) error {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, recentError{
+		Time:    entry.Time.UTC(),
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	})
+	if len(l.entries) > recentErrorsKept {
+		l.entries = append([]recentError{}, l.entries[len(l.entries)-recentErrorsKept:]...)
+	}
+	return nil
+}
+
+/*
+ * Returns the kept messages, newest first
+ */
+func (l *recentErrorLog) list() []recentError {
+	l.Lock()
+	defer l.Unlock()
+	entries := make([]recentError, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entries = append(entries, l.entries[i])
+	}
+	return entries
+}
+
+/*
+ * Status as returned by the admin API
+ */
+type serverStatus struct {
+	Version         string    `json:"version"`
+	Started         time.Time `json:"started"`
+	ReadOnly        bool      `json:"readOnly"`
+	ActiveUploads   int64     `json:"activeUploads"`
+	ActiveDownloads int64     `json:"activeDownloads"`
+	BytesReceived   int64     `json:"bytesReceived"`
+	BytesServed     int64     `json:"bytesServed"`
+
+	// Of the file system containing storeDir, unless unknown
+	StoreDirUsedPercent *int   `json:"storeDirUsedPercent,omitempty"`
+	StoreDirFree        uint64 `json:"storeDirFree,omitempty"`
+
+	// Counted every userUsageInterval
+	StoredFiles  int64      `json:"storedFiles,omitempty"`
+	StoredBytes  int64      `json:"storedBytes,omitempty"`
+	UsageCounted *time.Time `json:"usageCounted,omitempty"`
+
+	Errors []recentError `json:"errors"`
+}
+
+/*
+ * Status endpoint:
+ *   GET /status   Runtime stats, usage of storeDir and the last warnings
+ *                 and errors logged, newest first
+ */
+func (s *Server) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+
+	status := serverStatus{
+		Version:         Version,
+		Started:         s.stats.started.UTC(),
+		ReadOnly:        s.isReadOnly(),
+		ActiveUploads:   atomic.LoadInt64(&s.stats.activeUploads),
+		ActiveDownloads: atomic.LoadInt64(&s.stats.activeDownloads),
+		BytesReceived:   atomic.LoadInt64(&s.stats.bytesReceived),
+		BytesServed:     atomic.LoadInt64(&s.stats.bytesServed),
+		Errors:          recentErrors.list(),
+	}
+	if used, err := diskUsage(s.conf.StoreDir); err == nil {
+		status.StoreDirUsedPercent = &used
+	}
+	if free, err := diskFree(s.conf.StoreDir); err == nil {
+		status.StoreDirFree = free
+	}
+	s.usage.RLock()
+	if !s.usage.updated.IsZero() {
+		updated := s.usage.updated.UTC()
+		status.StoredFiles, status.StoredBytes, status.UsageCounted = s.usage.files, s.usage.bytes, &updated
+	}
+	s.usage.RUnlock()
+
+	writeJSON(w, http.StatusOK, status)
+}
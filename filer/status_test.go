@@ -0,0 +1,63 @@
+package filer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAdminStatus(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+
+	previousLevel := log.GetLevel()
+	log.SetLevel(logrus.ErrorLevel)
+	log.Error("status test error")
+	log.SetLevel(previousLevel)
+	rr := s.adminRequest(t, "GET", "/status")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status: got %v", rr.Code)
+	}
+	var status serverStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid response %q: %s", rr.Body.String(), err)
+	}
+	if status.Version != Version || status.StoreDirUsedPercent == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+	found := false
+	for _, entry := range status.Errors {
+		found = found || entry.Message == "status test error" && entry.Level == "error"
+	}
+	if !found {
+		t.Errorf("logged error missing from %+v", status.Errors)
+	}
+}
+
+/*
+ * Only the last warnings and errors are kept, newest first
+ */
+func TestRecentErrors(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	errors := &recentErrorLog{}
+	logger.AddHook(errors)
+
+	for i := 0; i < recentErrorsKept+5; i++ {
+		logger.Error(fmt.Sprintf("error %d", i))
+	}
+	logger.Info("not an error")
+	logger.Warn("a warning")
+
+	entries := errors.list()
+	if len(entries) != recentErrorsKept {
+		t.Fatalf("got %d entries, want %d", len(entries), recentErrorsKept)
+	}
+	if entries[0].Message != "a warning" || entries[0].Level != "warning" || entries[1].Message != fmt.Sprintf("error %d", recentErrorsKept+4) {
+		t.Errorf("unexpected newest entries %+v", entries[:2])
+	}
+}
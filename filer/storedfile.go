@@ -0,0 +1,309 @@
+/*
+ * Format of stored files
+ * Files are stored as they were uploaded, unless they need to be encoded
+ * (compressed and/or encrypted). Encoded files start with a header:
+ *
+ *   "PFILER"    magic (6 bytes)
+ *   version     format version (1 byte)
+ *   flags       encodings applied (1 byte)
+ *
+ * followed by these fields for encrypted files:
+ *
+ *   key ID      ID of the master key (8 bytes)
+ *   nonce       nonce used for wrapping the data key (12 bytes)
+ *   wrapped key data key, encrypted with the master key (48 bytes)
+ *
+ * Content is compressed first, then encrypted.
+ *
+ * Version 1 files, written before data keys were introduced, are still
+ * read: their file key is derived from the current master key and a salt
+ * (32 bytes) which follows the flags of encrypted files. "prosody-filer
+ * rekey" converts them to the current version.
+ *
+ * Uploads which happen to start with the magic are stored with a header
+ * without any flags, so they can't be mistaken for encoded files.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/storage"
+)
+
+const (
+	storedFileMagic   = "PFILER"
+	storedFileVersion = 2
+
+	// Files encrypted with salted keys derived from the master key
+	storedFileVersion1 = 1
+
+	storedFileEncrypted  = 1 << 0
+	storedFileCompressed = 1 << 1
+)
+
+/*
+ * Header of an encoded file
+ */
+type storedFileHeader struct {
+	version    byte
+	flags      byte
+	salt       []byte
+	keyID      []byte
+	wrapNonce  []byte
+	wrappedKey []byte
+}
+
+/*
+ * Fixed part of the header: magic, version and flags. Authenticated as
+ * additional data of every encrypted segment.
+ */
+func (h *storedFileHeader) prefix() []byte {
+	return append([]byte(storedFileMagic), h.version, h.flags)
+}
+
+/*
+ * Additional data for wrapping the data key
+ */
+func (h *storedFileHeader) wrapAAD() []byte {
+	return append(h.prefix(), h.keyID...)
+}
+
+func (h *storedFileHeader) bytes() []byte {
+	header := h.prefix()
+	if h.version == storedFileVersion1 {
+		return append(header, h.salt...)
+	}
+	if h.flags&storedFileEncrypted != 0 {
+		header = append(header, h.keyID...)
+		header = append(header, h.wrapNonce...)
+		header = append(header, h.wrappedKey...)
+	}
+	return header
+}
+
+/*
+ * Reads the header of a stored file. Returns nil if the file is not encoded.
+ */
+func readStoredFileHeader(file io.Reader) (*storedFileHeader, error) {
+	prefix := make([]byte, len(storedFileMagic)+2)
+	if _, err := io.ReadFull(file, prefix); err != nil || !bytes.HasPrefix(prefix, []byte(storedFileMagic)) {
+		return nil, nil
+	}
+
+	header := &storedFileHeader{
+		version: prefix[len(storedFileMagic)],
+		flags:   prefix[len(storedFileMagic)+1],
+	}
+	if header.version == storedFileVersion1 {
+		if header.flags&storedFileEncrypted != 0 {
+			header.salt = make([]byte, encryptionSaltSize)
+			if _, err := io.ReadFull(file, header.salt); err != nil {
+				return nil, errors.New("truncated header")
+			}
+		}
+		return header, nil
+	} else if header.version != storedFileVersion {
+		return nil, fmt.Errorf("unsupported file format version %d", header.version)
+	}
+
+	if header.flags&storedFileEncrypted != 0 {
+		fields := make([]byte, encryptionKeyIDSize+encryptionNonceSize+wrappedKeySize)
+		if _, err := io.ReadFull(file, fields); err != nil {
+			return nil, errors.New("truncated header")
+		}
+		header.keyID = fields[:encryptionKeyIDSize]
+		header.wrapNonce = fields[encryptionKeyIDSize : encryptionKeyIDSize+encryptionNonceSize]
+		header.wrappedKey = fields[encryptionKeyIDSize+encryptionNonceSize:]
+	}
+
+	return header, nil
+}
+
+/*
+ * A stored file opened for reading its (decoded) contents
+ */
+type storedFile struct {
+	io.ReadSeeker
+	file    storage.File
+	size    int64
+	modTime time.Time
+
+	// False if the file is stored as it was uploaded
+	encoded bool
+
+	decompressor *decompressingReader
+}
+
+func (f *storedFile) Close() error {
+	if f.decompressor != nil {
+		f.decompressor.Close()
+	}
+	return f.file.Close()
+}
+
+/*
+ * Returns the contents to serve. Unencoded local files are served as the
+ * *os.File itself, which lets net/http pass them to sendfile(2) instead of
+ * copying them through userspace buffers.
+ */
+func (f *storedFile) content() io.ReadSeeker {
+	if local, ok := f.file.(*storage.LocalFile); ok && !f.encoded {
+		return local.File
+	}
+	return f
+}
+
+/*
+ * Opens a file in the storage backend, decoding it if necessary
+ */
+func (s *Server) openBackendFile(fileStorePath string) (*storedFile, error) {
+	file, err := s.backend.Open(fileStorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := s.decodeStoredFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", fileStorePath, err)
+	}
+	return stored, nil
+}
+
+/*
+ * Opens a file on the local filesystem, e.g. a quarantined one, decoding it
+ * if necessary
+ */
+func (s *Server) openStoredFile(absFilename string) (*storedFile, error) {
+	file, err := storage.OpenLocalFile(absFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := s.decodeStoredFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", absFilename, err)
+	}
+	return stored, nil
+}
+
+func (s *Server) decodeStoredFile(file storage.File) (*storedFile, error) {
+	stored := &storedFile{
+		ReadSeeker: file,
+		file:       file,
+		size:       file.Size(),
+		modTime:    file.ModTime(),
+	}
+
+	header, err := readStoredFileHeader(file)
+	if err != nil {
+		return nil, err
+	} else if header == nil {
+		// Not encoded
+		_, err = file.Seek(0, io.SeekStart)
+		return stored, err
+	}
+
+	stored.encoded = true
+	dataOffset := int64(len(header.bytes()))
+	stored.size = file.Size() - dataOffset
+
+	stored.ReadSeeker = io.NewSectionReader(file, dataOffset, stored.size)
+
+	if header.flags&storedFileEncrypted != 0 {
+		aead, err := s.fileCipher(header)
+		if err != nil {
+			return nil, err
+		}
+		aad := header.prefix()
+		if header.version == storedFileVersion1 {
+			aad = header.bytes()
+		}
+		decrypter, err := newDecryptingReader(file, aead, aad, dataOffset, stored.size)
+		if err != nil {
+			return nil, err
+		}
+
+		stored.ReadSeeker = decrypter
+		stored.size = decrypter.Size()
+	}
+
+	if header.flags&storedFileCompressed != 0 {
+		decompressor, err := newDecompressingReader(stored.ReadSeeker, stored.size)
+		if err != nil {
+			return nil, err
+		}
+
+		stored.ReadSeeker = decompressor
+		stored.size = decompressor.Size()
+		stored.decompressor = decompressor
+	}
+
+	return stored, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+/*
+ * Wraps dst so that everything written is encoded as configured.
+ * head are the first bytes of the content. Close() must be called after
+ * the content has been written.
+ */
+func (s *Server) newStoredFileWriter(dst io.Writer, head []byte, compress bool) (io.WriteCloser, error) {
+	header := &storedFileHeader{version: storedFileVersion}
+	if compress {
+		header.flags |= storedFileCompressed
+	}
+
+	// Encrypt with a new random data key
+	var dataKey []byte
+	if s.encryptionKey != nil {
+		dataKey = make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+
+		header.flags |= storedFileEncrypted
+		header.keyID = s.encryptionKeyID
+		var err error
+		header.wrapNonce, header.wrappedKey, err = s.wrapDataKey(dataKey, header.wrapAAD())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Plain content which could be mistaken for an encoded file gets a header without flags
+	if header.flags != 0 || bytes.HasPrefix(head, []byte(storedFileMagic)) {
+		if _, err := dst.Write(header.bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	var writer io.WriteCloser = nopWriteCloser{dst}
+	if dataKey != nil {
+		aead, err := newGCM(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		writer = newEncryptingWriter(dst, aead, header.prefix())
+	}
+
+	if compress {
+		return s.newCompressingWriter(writer)
+	}
+	return writer, nil
+}
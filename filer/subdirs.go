@@ -0,0 +1,50 @@
+/*
+ * Further upload subdirectories
+ * Besides uploadSubDir, uploads and downloads are answered below the
+ * subdirectories in uploadSubDirs, e.g. to keep serving "/upload/" while
+ * the XMPP server hands out URLs below "/files/". Each of them maps to a
+ * subtree of storeDir, "" being storeDir itself. MACs cover the path below
+ * the subdirectory, as signed by the XMPP server, not the stored path.
+ */
+
+package filer
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+ * Returns the subdirectory the URL path urlPath is below, and the subtree
+ * of storeDir it maps to. Like the routing of requests, the longest
+ * matching subdirectory wins.
+ */
+func (s *Server) matchUploadSubDir(urlPath string) (subDir string, storeSubtree string) {
+	subDir = s.conf.UploadSubDir
+	longest := 0
+	if isBelowSubDir(urlPath, subDir) {
+		longest = len(path.Join("/", subDir))
+	}
+	for dir, subtree := range s.conf.UploadSubDirs {
+		if isBelowSubDir(urlPath, dir) && len(path.Join("/", dir)) > longest {
+			subDir, storeSubtree, longest = dir, subtree, len(path.Join("/", dir))
+		}
+	}
+	return subDir, storeSubtree
+}
+
+func isBelowSubDir(urlPath string, dir string) bool {
+	prefix := strings.TrimRight(path.Join("/", dir), "/") + "/"
+	return strings.HasPrefix(urlPath, prefix) || urlPath+"/" == prefix
+}
+
+/*
+ * Returns the path an upload to fileStorePath was signed for, i.e. without
+ * the subtree of storeDir its subdirectory maps to
+ */
+func signedUploadPath(fileStorePath string, storeSubtree string) string {
+	if storeSubtree == "" {
+		return fileStorePath
+	}
+	return strings.TrimPrefix(fileStorePath, storeSubtree+"/")
+}
@@ -0,0 +1,71 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSubDirs(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.UploadSubDirs = map[string]string{"files/": "", "new/": "migrated"}
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	content := []byte("uploaded below another subdirectory")
+	for _, test := range []struct {
+		url    string
+		stored string
+	}{
+		{"/files/abc/file.txt", "abc/file.txt"},
+		{"/new/def/file.txt", "migrated/def/file.txt"},
+	} {
+		// Signed for the path below the subdirectory
+		req := s.newUploadRequest(t, test.stored[len(test.stored)-len("abc/file.txt"):], content)
+		req.URL.Path = test.url
+		if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+			t.Fatalf("upload to %s: got %v want %v", test.url, rr.Code, http.StatusCreated)
+		}
+		if stored, err := os.ReadFile(filepath.Join(s.conf.StoreDir, test.stored)); err != nil || !bytes.Equal(stored, content) {
+			t.Errorf("upload to %s not stored at %s: %v", test.url, test.stored, err)
+		}
+
+		for _, url := range []string{test.url, "/upload/" + test.stored} {
+			req, _ := http.NewRequest("GET", url, nil)
+			if rr := s.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+				t.Errorf("download of %s: got %v", url, rr.Code)
+			}
+		}
+	}
+
+	// The MAC must not cover the subtree
+	req := s.newUploadRequest(t, "migrated/ghi/file.txt", content)
+	req.URL.Path = "/new/ghi/file.txt"
+	if rr := s.serveUpload(req); rr.Code != http.StatusForbidden {
+		t.Errorf("upload signed for stored path: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestMatchUploadSubDir(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.UploadSubDirs = map[string]string{"files/": "a", "files/old/": "b", "upload/x/": "c"}
+
+	for _, test := range []struct {
+		path    string
+		subDir  string
+		subtree string
+	}{
+		{"/upload/abc/file.txt", "upload/", ""},
+		{"/files/abc/file.txt", "files/", "a"},
+		{"/files/old/abc/file.txt", "files/old/", "b"},
+		{"/upload/x/abc/file.txt", "upload/x/", "c"},
+	} {
+		subDir, subtree := s.matchUploadSubDir(test.path)
+		if subDir != test.subDir || subtree != test.subtree {
+			t.Errorf("%s: got %q %q want %q %q", test.path, subDir, subtree, test.subDir, test.subtree)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+/*
+ * Tarpit
+ * Responses to requests with missing or invalid MACs are delayed by about
+ * macFailureDelay (between half and one and a half times as long), which
+ * slows down brute-forcing the secret and scanners. Legitimate clients
+ * don't send invalid MACs, so they are not affected.
+ */
+
+package filer
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Requests held at the same time, beyond which responses are not delayed
+const maxTarpitted = 1000
+
+var tarpitSlots = make(chan struct{}, maxTarpitted)
+
+/*
+ * Delays the response to r, unless the client disconnects
+ */
+func (s *Server) tarpit(r *http.Request) {
+	if s.conf.MacFailureDelay <= 0 {
+		return
+	}
+
+	select {
+	case tarpitSlots <- struct{}{}:
+		defer func() { <-tarpitSlots }()
+	default:
+		return
+	}
+
+	delay := s.conf.MacFailureDelay/2 + time.Duration(rand.Int63n(int64(s.conf.MacFailureDelay)+1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,49 @@
+package filer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+ * Responses to invalid MACs are delayed, others are not
+ */
+func TestTarpit(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.MacFailureDelay = 200 * time.Millisecond
+
+	req := s.newUploadRequest(t, "abc/tarpit.txt", []byte("tarpit"))
+	req.URL.RawQuery = "v=" + s.uploadMAC("v", "abc/other.txt", 6, 0, 0)
+	start := time.Now()
+	if status := s.serveUpload(req).Code; status != http.StatusForbidden {
+		t.Errorf("invalid MAC: got %v want %v", status, http.StatusForbidden)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Errorf("response to invalid MAC took %s", elapsed)
+	}
+
+	start = time.Now()
+	if status := s.serveUpload(s.newUploadRequest(t, "abc/tarpit.txt", []byte("tarpit"))).Code; status != http.StatusCreated {
+		t.Errorf("valid MAC: got %v want %v", status, http.StatusCreated)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("response to valid MAC took %s", elapsed)
+	}
+
+	// Clients giving up are not held
+	s.conf.MacFailureDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	s.tarpit(req.WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("tarpit held disconnected client for %s", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Tenants
+ * A hoster serving many domains from one filer can map host names and
+ * subtrees of storeDir (e.g. from uploadSubDirs) to tenants. Requests are
+ * then counted in the metrics and logged with their tenant, uploads keep
+ * it in their metadata and disk usage is summed up by tenant as well.
+ * Subtrees take precedence over host names, as stored files have no host.
+ */
+
+package filer
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/*
+ * Returns the tenant of a file uploaded or downloaded with host, "" if
+ * none matches. The longest matching subtree wins.
+ */
+func (s *Server) tenant(host string, fileStorePath string) string {
+	tenant, longest := "", 0
+	for key, name := range s.conf.Tenants {
+		if strings.HasPrefix(key, "/") && strings.HasPrefix("/"+fileStorePath+"/", key+"/") && len(key) > longest {
+			tenant, longest = name, len(key)
+		}
+	}
+	if tenant != "" || host == "" {
+		return tenant
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return s.conf.Tenants[strings.ToLower(strings.TrimSuffix(host, "."))]
+}
+
+/*
+ * Returns the tenant of a request for fileStorePath
+ */
+func (s *Server) requestTenant(r *http.Request, fileStorePath string) string {
+	if len(s.conf.Tenants) == 0 {
+		return ""
+	}
+	return s.tenant(s.requestHost(r), fileStorePath)
+}
+
+/*
+ * Returns the tenant of a request before its path has been checked, for
+ * middleware
+ */
+func (s *Server) urlTenant(r *http.Request) string {
+	if len(s.conf.Tenants) == 0 {
+		return ""
+	}
+	subDir, storeSubtree := s.matchUploadSubDir(r.URL.Path)
+	fileStorePath := strings.Trim(strings.TrimPrefix(r.URL.Path, path.Join("/", subDir)), "/")
+	if storeSubtree != "" {
+		fileStorePath = storeSubtree + "/" + fileStorePath
+	}
+	return s.tenant(s.requestHost(r), fileStorePath)
+}
+
+/*
+ * Returns the label to append to those of a metric for tenant, "" without
+ * tenant
+ */
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+	return `,tenant="` + escapeLabelValue(tenant) + `"`
+}
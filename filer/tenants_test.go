@@ -0,0 +1,87 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTenant(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.Tenants = map[string]string{"chat.example.com": "example", "/team": "team", "/team/sales": "sales"}
+
+	for _, test := range []struct {
+		host          string
+		fileStorePath string
+		want          string
+	}{
+		{"chat.example.com", "abc/file.txt", "example"},
+		{"Chat.Example.com:443", "abc/file.txt", "example"},
+		{"chat.example.com.", "abc/file.txt", "example"},
+		{"other.example.com", "abc/file.txt", ""},
+		{"chat.example.com", "team/abc/file.txt", "team"},
+		{"", "team/sales/file.txt", "sales"},
+		{"", "teamwork/file.txt", ""},
+	} {
+		if tenant := s.tenant(test.host, test.fileStorePath); tenant != test.want {
+			t.Errorf("%s %s: got %q want %q", test.host, test.fileStorePath, tenant, test.want)
+		}
+	}
+}
+
+/*
+ * Uploads are counted and stored with their tenant, usage is summed up
+ * by tenant
+ */
+func TestTenantUsage(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+	s.conf.UserUsageInterval = 1
+	s.conf.Tenants = map[string]string{"chat.example.com": "example", "/team": "team"}
+
+	requestsBefore := requestsMetric.get(`method="PUT",code="201",tenant="example"`)
+	bytesBefore := transferBytesMetric.get(`method="PUT",tenant="example"`)
+	req := s.newUploadRequest(t, "alice/file.txt", []byte("by host"))
+	req.Host = "chat.example.com"
+	if rr := s.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Fatalf("upload: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	s.uploadFile(t, "team/bob/file.txt", []byte("by subtree"))
+	s.uploadFile(t, "carol/file.txt", []byte("none"))
+
+	if value := requestsMetric.get(`method="PUT",code="201",tenant="example"`) - requestsBefore; value != 1 {
+		t.Errorf("requests of tenant: got %v want 1", value)
+	}
+	if value := transferBytesMetric.get(`method="PUT",tenant="example"`) - bytesBefore; value != 7 {
+		t.Errorf("bytes of tenant: got %v want 7", value)
+	}
+	if meta, err := s.readMetadata("alice/file.txt"); err != nil || meta.Tenant != "example" {
+		t.Errorf("tenant not in metadata: %+v %v", meta, err)
+	}
+	if meta, err := s.readMetadata("carol/file.txt"); err != nil || meta.Tenant != "" {
+		t.Errorf("unexpected tenant in metadata: %+v %v", meta, err)
+	}
+
+	if err := s.countUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if value := tenantBytesMetric.get(`tenant="team"`); value != 10 {
+		t.Errorf("usage metric of team: got %v want 10", value)
+	}
+
+	var response struct {
+		Tenants []tenantUsage `json:"tenants"`
+	}
+	rr := s.adminRequest(t, "GET", "/usage")
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Tenants) != 2 || response.Tenants[0] != (tenantUsage{"team", 1, 10}) || response.Tenants[1] != (tenantUsage{"example", 1, 7}) {
+		t.Errorf("unexpected usage: %+v", response.Tenants)
+	}
+}
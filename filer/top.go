@@ -0,0 +1,305 @@
+/*
+ * "top" command: a terminal monitor for admins who prefer SSH over
+ * dashboards. It polls the admin API of a running filer (adminListenPort,
+ * with adminToken) and shows transfers, usage of storeDir, the users using
+ * the most space and recent warnings and errors:
+ *
+ *   prosody-filer top -config /etc/prosody-filer/config.toml
+ *
+ * With -once, a single snapshot is printed, e.g. for scripts.
+ */
+
+package filer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+const topListLength = 10
+
+/*
+ * Client of the admin API
+ */
+type topClient struct {
+	client  *http.Client
+	baseURL string
+	token   string
+}
+
+/*
+ * What the filer was doing at one point in time
+ */
+type topSnapshot struct {
+	at      time.Time
+	status  serverStatus
+	uploads []uploadStatus
+	// Nil if usage is not counted
+	usage []prefixUsage
+}
+
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	configFile := flags.String("config", "./config.toml", "Path to configuration file \"config.toml\".")
+	interval := flags.Duration("interval", 2*time.Second, "Time between updates.")
+	once := flags.Bool("once", false, "Print a single snapshot and exit.")
+	flags.Parse(args)
+
+	conf, err := LoadConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %s", err)
+	}
+	client, err := newTopClient(conf)
+	if err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	width, height, terminal := terminalSize()
+	if *once || !terminal {
+		snapshot, err := client.snapshot()
+		if err != nil {
+			return err
+		}
+		renderTop(os.Stdout, snapshot, nil, width, 0)
+		return nil
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// Hide the cursor while redrawing
+	fmt.Print("\033[?25l")
+	defer fmt.Print("\033[?25h\n")
+	var previous *topSnapshot
+	for {
+		width, height, _ = terminalSize()
+		var screen bytes.Buffer
+		if snapshot, err := client.snapshot(); err != nil {
+			fmt.Fprintf(&screen, "%s\n\nRetrying every %s, press Ctrl-C to quit.\n", err, *interval)
+		} else {
+			renderTop(&screen, snapshot, previous, width, height)
+			previous = &snapshot
+		}
+		fmt.Print("\033[H\033[2J", screen.String())
+
+		select {
+		case <-signals:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+ * Returns a client of the admin API configured in conf
+ */
+func newTopClient(conf Config) (*topClient, error) {
+	if conf.AdminListenPort == "" {
+		return nil, errors.New("adminListenPort is not set, the admin API is disabled")
+	}
+	if conf.AdminToken == "" {
+		return nil, errors.New("adminToken is not set")
+	}
+
+	c := &topClient{client: &http.Client{Timeout: 10 * time.Second}, token: conf.AdminToken}
+	if conf.AdminUnixSocket {
+		c.baseURL = "http://admin"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", conf.AdminListenPort)
+			},
+		}
+		return c, nil
+	}
+
+	host, port, err := net.SplitHostPort(conf.AdminListenPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid adminListenPort %q: %s", conf.AdminListenPort, err)
+	}
+	// Listening on all addresses includes localhost
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	c.baseURL = "http://" + net.JoinHostPort(host, port)
+	return c, nil
+}
+
+/*
+ * Requests an admin API endpoint and decodes its JSON response into v.
+ * Returns the status code.
+ */
+func (c *topClient) get(path string, v interface{}) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("cannot reach the admin API: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, fmt.Errorf("admin API: GET %s: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return resp.StatusCode, fmt.Errorf("admin API: GET %s: %s", path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *topClient) snapshot() (topSnapshot, error) {
+	snapshot := topSnapshot{at: time.Now()}
+	if _, err := c.get("/status", &snapshot.status); err != nil {
+		return snapshot, err
+	}
+
+	var uploads struct {
+		Uploads []uploadStatus `json:"uploads"`
+	}
+	if _, err := c.get("/uploads", &uploads); err != nil {
+		return snapshot, err
+	}
+	snapshot.uploads = uploads.Uploads
+
+	var usage struct {
+		Prefixes []prefixUsage `json:"prefixes"`
+	}
+	// Usage may not be configured or counted yet
+	status, err := c.get(fmt.Sprintf("/usage?limit=%d", topListLength), &usage)
+	if err == nil {
+		snapshot.usage = usage.Prefixes
+	} else if status != http.StatusNotImplemented && status != http.StatusServiceUnavailable {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+/*
+ * Writes a screen showing snapshot. Transfer rates are calculated since
+ * the previous snapshot, if there is one. Lines are cut at width columns
+ * and the screen at height lines, unless they are 0.
+ */
+func renderTop(w io.Writer, snapshot topSnapshot, previous *topSnapshot, width int, height int) {
+	var lines []string
+	addf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	addTable := func(header string, rows [][]string) {
+		var table bytes.Buffer
+		writer := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, header)
+		for _, row := range rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		writer.Flush()
+		lines = append(lines, strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n")...)
+	}
+	status := snapshot.status
+
+	mode := ""
+	if status.ReadOnly {
+		mode = ", READ-ONLY"
+	}
+	addf("prosody-filer %s, up %s%s, %s", status.Version, snapshot.at.Sub(status.Started).Round(time.Second), mode, snapshot.at.Format("15:04:05"))
+
+	transfers := fmt.Sprintf("Transfers: %d uploads, %d downloads", status.ActiveUploads, status.ActiveDownloads)
+	if previous != nil {
+		elapsed := snapshot.at.Sub(previous.at)
+		transfers += fmt.Sprintf(", receiving %s, sending %s",
+			formatThroughput(status.BytesReceived-previous.status.BytesReceived, elapsed),
+			formatThroughput(status.BytesServed-previous.status.BytesServed, elapsed))
+	}
+	lines = append(lines, transfers)
+
+	storage := []string{}
+	if status.StoreDirUsedPercent != nil {
+		storage = append(storage, fmt.Sprintf("%d%% used, %s free", *status.StoreDirUsedPercent, formatSize(int64(status.StoreDirFree))))
+	}
+	if status.UsageCounted != nil {
+		storage = append(storage, fmt.Sprintf("%d files with %s stored (counted at %s)", status.StoredFiles, formatSize(status.StoredBytes), status.UsageCounted.Local().Format("15:04")))
+	}
+	if len(storage) == 0 {
+		storage = append(storage, "unknown")
+	}
+	addf("Storage: %s", strings.Join(storage, ", "))
+	lines = append(lines, "")
+
+	var rows [][]string
+	for i, upload := range snapshot.uploads {
+		if i == topListLength {
+			break
+		}
+		progress := formatSize(upload.Received)
+		if upload.Size > 0 {
+			progress = fmt.Sprintf("%s of %s (%d%%)", progress, formatSize(upload.Size), upload.Received*100/upload.Size)
+		}
+		left := "-"
+		if upload.TimeLeft > 0 {
+			left = (time.Duration(upload.TimeLeft) * time.Second).String()
+		}
+		rows = append(rows, []string{upload.Path, upload.ClientIP, progress, formatThroughput(upload.Rate, time.Second), left})
+	}
+	addf("UPLOADS IN PROGRESS (%d)", len(snapshot.uploads))
+	if len(rows) > 0 {
+		addTable("PATH\tCLIENT\tRECEIVED\tRATE\tLEFT", rows)
+	}
+	lines = append(lines, "")
+
+	if snapshot.usage != nil {
+		rows = nil
+		for _, usage := range snapshot.usage {
+			rows = append(rows, []string{usage.Prefix, fmt.Sprint(usage.Files), formatSize(usage.Bytes)})
+		}
+		addf("TOP USERS")
+		addTable("PREFIX\tFILES\tSIZE", rows)
+		lines = append(lines, "")
+	}
+
+	addf("RECENT WARNINGS AND ERRORS")
+	for i, entry := range status.Errors {
+		if i == topListLength {
+			break
+		}
+		addf("%s %-7s %s", entry.Time.Local().Format("01-02 15:04:05"), entry.Level, strings.ReplaceAll(entry.Message, "\n", " "))
+	}
+
+	if height > 0 && len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, cutLine(line, width))
+	}
+}
+
+/*
+ * Cuts line to width characters, unless width is 0
+ */
+func cutLine(line string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width])
+}
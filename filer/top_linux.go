@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package filer
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+ * Returns the size of the terminal on standard output in columns and
+ * lines, or false if it is not a terminal
+ */
+func terminalSize() (int, int, bool) {
+	var size struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.cols == 0 {
+		return 0, 0, false
+	}
+	return int(size.cols), int(size.rows), true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package filer
+
+func terminalSize() (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,69 @@
+package filer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopSnapshot(t *testing.T) {
+	s := newTestServer(t)
+	s.conf.AdminToken = "admintoken"
+	server := httptest.NewServer(s.adminHandler())
+	defer server.Close()
+
+	client := &topClient{client: http.DefaultClient, baseURL: server.URL, token: "admintoken"}
+	previous, err := client.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous.usage != nil {
+		t.Errorf("usage shown, but not counted")
+	}
+
+	snapshot := previous
+	snapshot.at = previous.at.Add(2 * time.Second)
+	snapshot.status.BytesServed += 3000
+	snapshot.uploads = []uploadStatus{{Path: "abc/video.mp4", ClientIP: "192.0.2.1", Size: 2048, Received: 1024, Rate: 512, TimeLeft: 2}}
+	snapshot.usage = []prefixUsage{{Prefix: "alice", Files: 3, Bytes: 4096}}
+	snapshot.status.Errors = []recentError{{Time: snapshot.at, Level: "warning", Message: "disk almost\nfull"}}
+
+	var screen bytes.Buffer
+	renderTop(&screen, snapshot, &previous, 0, 0)
+	for _, expected := range []string{"sending 1.5 kB/s", "UPLOADS IN PROGRESS (1)", "abc/video.mp4  192.0.2.1  1.0 KiB of 2.0 KiB (50%)", "alice   3", "warning disk almost full"} {
+		if !strings.Contains(screen.String(), expected) {
+			t.Errorf("%q missing from screen:\n%s", expected, screen.String())
+		}
+	}
+
+	screen.Reset()
+	renderTop(&screen, snapshot, nil, 20, 5)
+	if lines := strings.Split(strings.TrimSuffix(screen.String(), "\n"), "\n"); len(lines) != 4 || len(lines[0]) != 20 {
+		t.Errorf("screen has not been cut to size:\n%s", screen.String())
+	}
+
+	client.token = "wrong"
+	if _, err := client.snapshot(); err == nil {
+		t.Errorf("snapshot with invalid token succeeded")
+	}
+}
+
+func TestTopClientAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"[::1]:5051":     "http://[::1]:5051",
+		"[::]:5051":      "http://localhost:5051",
+		":5051":          "http://localhost:5051",
+		"127.0.0.1:5051": "http://127.0.0.1:5051",
+	} {
+		conf := Config{AdminListenPort: address, AdminToken: "token"}
+		if client, err := newTopClient(conf); err != nil || client.baseURL != expected {
+			t.Errorf("newTopClient(%s): got %+v, %v want %s", address, client, err, expected)
+		}
+	}
+	if _, err := newTopClient(Config{AdminListenPort: "[::1]:5051"}); err == nil {
+		t.Errorf("missing adminToken accepted")
+	}
+}
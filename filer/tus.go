@@ -0,0 +1,255 @@
+/*
+ * tus resumable uploads (https://tus.io/protocols/resumable-upload)
+ * Served below TusSubDir, using the same paths and MACs as regular uploads:
+ * the MAC of "tus/abc/cat.jpg?v=..." is calculated over "abc/cat.jpg" and
+ * the Upload-Length. Completed uploads go through the regular upload checks.
+ */
+
+package filer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+/*
+ * Sets the headers required by tus, and overrides CORS headers
+ */
+func (s *Server) addTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, HEAD, POST, PATCH")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Upload-Expires, Upload-Length, Upload-Offset")
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if s.conf.MaxFileSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.conf.MaxFileSize, 10))
+	}
+}
+
+/*
+ * Request handler for tus uploads
+ */
+func (s *Server) handleTusRequest(w http.ResponseWriter, r *http.Request) {
+	log.Info("Incoming tus request: ", r.Method, r.URL.String())
+
+	s.addTusHeaders(w)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		httpError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+
+	fileStorePath := strings.TrimPrefix(r.URL.Path, path.Join("/", s.conf.TusSubDir))
+	fileStorePath = strings.TrimPrefix(fileStorePath, "/")
+	if fileStorePath == "" || isInternalPath(fileStorePath) {
+		log.Warn("Access to ", r.URL.Path, " forbidden")
+		httpError(w, http.StatusForbidden, "")
+		return
+	} else if err := checkStorePath(fileStorePath, windowsPaths); err != nil {
+		log.Warn("Rejected invalid path ", fileStorePath, ": ", err)
+		httpError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "")
+		return
+	} else if query["exp"] != nil {
+		// Expiry is only stored for PUT uploads
+		httpError(w, http.StatusBadRequest, "exp is not supported for tus uploads")
+		return
+	}
+	upload := Upload{Path: fileStorePath, EscapedPath: escapedStorePath(r, s.conf.TusSubDir), SubDir: s.conf.TusSubDir, Size: -1}
+	if err := s.auth.ValidatePut(r, upload); err != nil {
+		s.rejectUnauthorized(w, r, err)
+		return
+	}
+	validMAC := func(length int64) bool {
+		upload.Size = length
+		return s.auth.ValidatePut(r, upload) == nil
+	}
+
+	id := partialID(fileStorePath)
+
+	if (r.Method == http.MethodPost || r.Method == http.MethodPatch) && (s.rejectReadOnly(w) || s.rejectUnavailableStorage(w)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.createTusUpload(fileStorePath, id, validMAC, w, r)
+	case http.MethodHead:
+		upload, offset, err := s.readPartialUpload(id)
+		if os.IsNotExist(err) || (err == nil && !validMAC(upload.Length)) {
+			httpError(w, http.StatusNotFound, "")
+			return
+		} else if err != nil {
+			log.Error(err)
+			httpError(w, http.StatusInternalServerError, "")
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.expires(s.conf.PartialUploadExpiry).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+	case http.MethodPatch:
+		if err := s.patchTusUpload(id, validMAC, w, r); err != nil {
+			log.Error(err)
+		}
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+/*
+ * Creates a partial upload. Creating it again returns the existing one.
+ */
+func (s *Server) createTusUpload(fileStorePath string, id string, validMAC func(int64) bool, w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		httpError(w, http.StatusBadRequest, "missing or invalid Upload-Length")
+		return
+	}
+	valid := validMAC(length)
+	s.countUploadMAC(r, s.conf.TusSubDir, valid)
+	if !valid {
+		log.Warning("Invalid MAC.")
+		s.recordMACFailure(s.clientIP(r))
+		s.tarpit(r)
+		httpError(w, uploadStatusCodes(&s.conf).InvalidMAC, "invalid MAC")
+		return
+	}
+	if s.belowMinimumSize(length) {
+		httpError(w, http.StatusBadRequest, "file too small")
+		return
+	}
+	if s.exceedsSizeLimit(fileStorePath, length) {
+		s.rejectTooLarge(w, fileStorePath)
+		return
+	}
+	if !s.luaPreUpload(w, r, fileStorePath, length) {
+		return
+	}
+
+	exists, err := s.backend.Exists(fileStorePath)
+	if err != nil {
+		log.Error("Failed to check for existing file ", fileStorePath, ": ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	} else if exists || s.isQuarantined(fileStorePath) {
+		httpError(w, uploadStatusCodes(&s.conf).FileExists, "")
+		return
+	}
+
+	upload, _, err := s.readPartialUpload(id)
+	if os.IsNotExist(err) {
+		upload = partialUpload{Path: fileStorePath, Length: length, CreatedAt: time.Now().UTC()}
+		err = s.writePartialUpload(id, upload)
+	}
+	if err != nil {
+		log.Error(err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	} else if upload.Length != length {
+		httpError(w, http.StatusConflict, "")
+		return
+	}
+
+	w.Header().Set("Location", s.requestBaseURL(r)+r.URL.RequestURI())
+	w.Header().Set("Upload-Expires", upload.expires(s.conf.PartialUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+ * Appends the request body to a partial upload and stores the upload once
+ * it is complete
+ */
+func (s *Server) patchTusUpload(id string, validMAC func(int64) bool, w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		httpError(w, http.StatusUnsupportedMediaType, "")
+		return nil
+	}
+
+	// Only one request at a time may write to an upload
+	if !s.lockPartialUpload(id) {
+		httpError(w, http.StatusConflict, "upload in progress")
+		return nil
+	}
+	defer s.unlockPartialUpload(id)
+
+	upload, offset, err := s.readPartialUpload(id)
+	if os.IsNotExist(err) || (err == nil && !validMAC(upload.Length)) {
+		httpError(w, http.StatusNotFound, "")
+		return nil
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+
+	if requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || requested != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		httpError(w, http.StatusConflict, "wrong Upload-Offset")
+		return nil
+	}
+
+	written, err := s.appendPartialUpload(id, &upload, r, upload.Length-offset)
+	offset += written
+	if err != nil && r.Context().Err() != nil {
+		return fmt.Errorf("tus upload of %s interrupted at %d of %d bytes", upload.Path, offset, upload.Length)
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return fmt.Errorf("failed to write partial upload of %s: %s", upload.Path, err)
+	}
+
+	if offset < upload.Length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return s.finishPartialUpload(id, upload, &tusResponseWriter{ResponseWriter: w, offset: offset}, r)
+}
+
+/*
+ * Turns the 201 response of createFile into the response to the last PATCH
+ * request, which has no body
+ */
+type tusResponseWriter struct {
+	http.ResponseWriter
+	offset int64
+	noBody bool
+}
+
+func (t *tusResponseWriter) WriteHeader(status int) {
+	if status == http.StatusCreated {
+		t.Header().Set("Upload-Offset", strconv.FormatInt(t.offset, 10))
+		t.Header().Del("Content-Type")
+		t.Header().Del("Location")
+		status = http.StatusNoContent
+		t.noBody = true
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *tusResponseWriter) Write(p []byte) (int, error) {
+	if t.noBody {
+		return len(p), nil
+	}
+	return t.ResponseWriter.Write(p)
+}
@@ -0,0 +1,154 @@
+package filer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+ * Send a tus request for fileStorePath with a MAC over size bytes
+ */
+func (s *Server) tusRequest(t *testing.T, method string, fileStorePath string, size int, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	req := s.newUploadRequest(t, fileStorePath, make([]byte, size))
+	req.Method = method
+	req.URL.Path = "/tus/" + fileStorePath
+	req.Body = http.NoBody
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleTusRequest).ServeHTTP(rr, req)
+	return rr
+}
+
+/*
+ * Upload a file in two parts using tus
+ */
+func TestTusUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.TusSubDir = "tus/"
+	s.conf.UploadResponseJSON = true
+
+	content := []byte("resumable upload of a file in two parts")
+	size := len(content)
+	patch := func(offset int, part []byte) *httptest.ResponseRecorder {
+		return s.tusRequest(t, "PATCH", "abc/tus.txt", size, part, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		})
+	}
+
+	rr := s.tusRequest(t, "POST", "abc/tus.txt", size, nil, map[string]string{"Upload-Length": "1"})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("creation with wrong length returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	rr = s.tusRequest(t, "POST", "abc/tus.txt", size, nil, map[string]string{"Upload-Length": strconv.Itoa(size)})
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") == "" {
+		t.Fatalf("creation returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	if rr := patch(0, content[:10]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("first PATCH failed: %v, offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = s.tusRequest(t, "HEAD", "abc/tus.txt", size, nil, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("HEAD returned wrong offset: %v, offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	if rr := patch(0, content); rr.Code != http.StatusConflict {
+		t.Errorf("PATCH with wrong offset returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// The response to the last PATCH has no body, even with uploadResponseJSON, and no Location
+	if rr := patch(10, content[10:]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != strconv.Itoa(size) ||
+		rr.Body.Len() != 0 || rr.Header().Get("Location") != "" {
+		t.Fatalf("last PATCH failed: %v, offset %s", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	// Stored like a regular upload
+	req, _ := http.NewRequest("GET", "/upload/abc/tus.txt", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleRequest).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download of tus upload failed: %v %q", rr.Code, rr.Body.String())
+	}
+
+	if rr := s.tusRequest(t, "HEAD", "abc/tus.txt", size, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("partial upload has not been removed: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+/*
+ * Requests without Tus-Resumable header must be refused, and expired
+ * partial uploads removed
+ */
+func TestTusVersionAndExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.TusSubDir = "tus/"
+
+	rr := s.tusRequest(t, "POST", "abc/tus.txt", 5, nil, map[string]string{"Upload-Length": "5", "Tus-Resumable": "0.2.2"})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("request with wrong version returned wrong status code: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	if rr := s.tusRequest(t, "POST", "abc/tus.txt", 5, nil, map[string]string{"Upload-Length": "5"}); rr.Code != http.StatusCreated {
+		t.Fatalf("creation returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	s.removeExpiredPartialUploads()
+	if rr := s.tusRequest(t, "HEAD", "abc/tus.txt", 5, nil, nil); rr.Code != http.StatusOK {
+		t.Errorf("partial upload has been removed before expiry: got %v", rr.Code)
+	}
+
+	s.conf.PartialUploadExpiry = -time.Second
+	s.removeExpiredPartialUploads()
+	if rr := s.tusRequest(t, "HEAD", "abc/tus.txt", 5, nil, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expired partial upload has not been removed: got %v", rr.Code)
+	}
+}
+
+/*
+ * tus uploads are rejected with the status codes of protocolStatusCodes
+ * like PUT uploads
+ */
+func TestTusProtocolStatusCodes(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded file after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.TusSubDir = "tus/"
+	s.conf.ServerType = "ejabberd"
+	s.conf.ProtocolStatusCodes = true
+
+	content := []byte("exists")
+	s.uploadFile(t, "abc/exists.txt", content)
+	rr := s.tusRequest(t, "POST", "abc/exists.txt", len(content), nil, map[string]string{"Upload-Length": strconv.Itoa(len(content))})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("creation of existing file: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Uploads authorized by JWTs
+ * Systems other than XMPP servers can authorize uploads with a token in the
+ * "Authorization: Bearer" header instead of a MAC in the URL. The token is
+ * signed with jwtSecret (HS256) or the private key to jwtPublicKeyFile
+ * (EdDSA) and limits the upload by its path, maxSize and exp claims.
+ */
+
+package filer
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+ * Claims of an upload token. A path ending in "/" allows uploads to any
+ * file below it.
+ */
+type uploadClaims struct {
+	Path    string `json:"path"`
+	MaxSize int64  `json:"maxSize"`
+}
+
+/*
+ * Keys upload tokens may be signed with
+ */
+type jwtKeys struct {
+	secret    []byte
+	publicKey ed25519.PublicKey
+}
+
+func (k *jwtKeys) list() []interface{} {
+	var keys []interface{}
+	if k.secret != nil {
+		keys = append(keys, k.secret)
+	}
+	if k.publicKey != nil {
+		keys = append(keys, k.publicKey)
+	}
+	return keys
+}
+
+/*
+ * Loads the keys for upload tokens
+ */
+func (s *Server) loadJWTKeys() error {
+	s.jwtKeys = jwtKeys{}
+	if s.conf.JwtSecret != "" {
+		s.jwtKeys.secret = []byte(s.conf.JwtSecret)
+	}
+	if s.conf.JwtPublicKeyFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.conf.JwtPublicKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read JWT public key file: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("invalid JWT public key file %s: no PEM data found", s.conf.JwtPublicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid JWT public key file %s: %s", s.conf.JwtPublicKeyFile, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("invalid JWT public key file %s: not an Ed25519 key", s.conf.JwtPublicKeyFile)
+	}
+	s.jwtKeys.publicKey = publicKey
+	return nil
+}
+
+/*
+ * Checks the upload token of a request. Returns false if the token is no
+ * upload token, e.g. one issued by mod_http_file_share.
+ */
+func validateUploadToken(r *http.Request, upload Upload, keys *jwtKeys) (bool, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	var claims uploadClaims
+	err := errInvalidToken
+	for _, key := range keys.list() {
+		if err = verifyJWT(token, key, &claims); err != errInvalidToken {
+			break
+		}
+	}
+	if err == errInvalidToken || (err == nil && claims.Path == "") {
+		return false, nil
+	} else if err != nil {
+		return true, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: " + err.Error()}
+	}
+
+	if upload.Path != claims.Path && !(strings.HasSuffix(claims.Path, "/") && strings.HasPrefix(upload.Path, claims.Path)) {
+		log.Warnf("Token for %s used for upload of %s", claims.Path, upload.Path)
+		return true, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: invalid token"}
+	}
+	if claims.MaxSize > 0 && upload.Size > claims.MaxSize {
+		return true, &AuthError{Status: http.StatusRequestEntityTooLarge, Message: "Request Entity Too Large"}
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package filer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ * Uploads with a token signed with jwtSecret
+ */
+func TestUploadToken(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.JwtSecret = "upload token secret"
+	if err := s.loadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("uploaded with a token")
+	upload := func(fileStorePath string, token string) int {
+		req, err := http.NewRequest("PUT", "/upload/"+fileStorePath, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return s.serveUpload(req).Code
+	}
+	token := func(path string, maxSize int64, exp int64) string {
+		return signJWT(t, s.conf.JwtSecret, map[string]interface{}{"path": path, "maxSize": maxSize, "exp": exp})
+	}
+	valid := time.Now().Unix() + 300
+
+	for name, test := range map[string]struct {
+		path   string
+		token  string
+		status int
+	}{
+		"expired":     {"abc/expired.txt", token("abc/expired.txt", 0, time.Now().Unix()-1), http.StatusUnauthorized},
+		"without exp": {"abc/noexp.txt", signJWT(t, s.conf.JwtSecret, map[string]interface{}{"path": "abc/noexp.txt"}), http.StatusUnauthorized},
+		"other path":  {"abc/other.txt", token("abc/token.txt", 0, valid), http.StatusUnauthorized},
+		"other dir":   {"abcd/dir.txt", token("abc/", 0, valid), http.StatusUnauthorized},
+		"too large":   {"abc/large.txt", token("abc/large.txt", 3, valid), http.StatusRequestEntityTooLarge},
+		"file":        {"abc/token.txt", token("abc/token.txt", 100, valid), http.StatusCreated},
+		"directory":   {"abc/dir.txt", token("abc/", 0, valid), http.StatusCreated},
+		"wrong key":   {"abc/wrong.txt", signJWT(t, "other secret", map[string]interface{}{"path": "abc/wrong.txt"}), http.StatusUnauthorized},
+		"without MAC": {"abc/nomac.txt", "", http.StatusUnauthorized},
+	} {
+		if status := upload(test.path, test.token); status != test.status {
+			t.Errorf("%s: got %v want %v", name, status, test.status)
+		}
+	}
+
+	// Tokens of mod_http_file_share are still accepted
+	fileShareToken := signJWT(t, s.conf.Secret, map[string]interface{}{
+		"slot": "Zmlsz", "filename": "share.txt", "filesize": len(content), "exp": valid,
+	})
+	if status := upload("Zmlsz/share.txt", fileShareToken); status != http.StatusCreated {
+		t.Errorf("mod_http_file_share token: got %v want %v", status, http.StatusCreated)
+	}
+}
+
+/*
+ * Uploads with a token signed with the private key to jwtPublicKeyFile
+ */
+func TestUploadTokenEdDSA(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conf.JwtPublicKeyFile = filepath.Join(t.TempDir(), "jwt.pem")
+	if err := os.WriteFile(s.conf.JwtPublicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.loadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", "/upload/abc/eddsa.txt", bytes.NewReader([]byte("signed with EdDSA")))
+	req.Header.Set("Authorization", "Bearer "+signEdDSAJWT(t, privateKey, map[string]interface{}{"path": "abc/eddsa.txt", "exp": time.Now().Unix() + 60}))
+	if status := s.serveUpload(req).Code; status != http.StatusCreated {
+		t.Errorf("upload returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	os.WriteFile(s.conf.JwtPublicKeyFile, []byte("not a key"), 0644)
+	if err := s.loadJWTKeys(); err == nil {
+		t.Error("invalid key file has been accepted")
+	}
+}
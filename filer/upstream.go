@@ -0,0 +1,241 @@
+/*
+ * Proxy mode
+ * With upstreamURL, this instance is an edge node close to the users,
+ * while files are stored by another filer. Uploads are authorized here and
+ * streamed to upstreamURL, signed with upstreamSecret; downloads are
+ * passed through. Nothing is stored locally, so upstream does the
+ * bookkeeping: metadata, expiry, scans and events.
+ */
+
+package filer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThomasLeister/prosody-filer/internal/auth/hmacauth"
+)
+
+var upstreamFailuresMetric = newCounter("prosody_filer_upstream_failures_total", "Requests which could not be forwarded to upstreamURL, by method.")
+
+/*
+ * Headers of upstream responses which are not passed on to clients: hop
+ * by hop headers and CORS headers, which are set by this instance
+ */
+func isUpstreamOnlyHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Trailer", "Upgrade":
+		return true
+	}
+	return strings.HasPrefix(http.CanonicalHeaderKey(name), "Access-Control-")
+}
+
+/*
+ * Prepares the client for upstreamURL
+ */
+func (s *Server) setupUpstream() {
+	if s.conf.UpstreamURL == "" {
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s.conf.UpstreamTimeout
+	s.upstream.client = &http.Client{
+		Transport: transport,
+		// Redirects of downloads are passed on to the client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	s.upstream.proxy = &httputil.ReverseProxy{
+		// Requests are rewritten by forwardDownload
+		Director:  func(req *http.Request) {},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					resp.Header.Del(name)
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Error("Forwarding download of ", r.URL.Path, " failed: ", err)
+			upstreamFailuresMetric.add(`method="`+r.Method+`"`, 1)
+			httpError(w, http.StatusBadGateway, "")
+		},
+	}
+}
+
+/*
+ * Returns the URL of fileStorePath at upstreamURL, without query
+ */
+func (s *Server) upstreamFileURL(fileStorePath string) string {
+	return strings.TrimSuffix(s.conf.UpstreamURL, "/") + "/" + (&url.URL{Path: fileStorePath}).EscapedPath()
+}
+
+/*
+ * Passes a download through to upstreamURL
+ */
+func (s *Server) forwardDownload(w http.ResponseWriter, r *http.Request, fileStorePath string) {
+	target, err := url.Parse(s.upstreamFileURL(fileStorePath))
+	if err != nil {
+		log.Error("Invalid upstream URL for ", fileStorePath, ": ", err)
+		httpError(w, http.StatusInternalServerError, "")
+		return
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	out := r.Clone(r.Context())
+	out.URL = target
+	out.Host = target.Host
+	out.RequestURI = ""
+	out.Header.Set("User-Agent", "prosody-filer/"+Version)
+	s.upstream.proxy.ServeHTTP(w, out)
+}
+
+/*
+ * Streams an upload to upstreamURL, signed with upstreamSecret, and passes
+ * the response on to the client. Uploads without known size (chunked or
+ * compressed) are received into a temporary file first, to check the MAC
+ * and sign the size.
+ */
+func (s *Server) forwardUpload(fileStorePath string, upload Upload, verifySize func(size int64) bool, w http.ResponseWriter, r *http.Request) error {
+	if upload.Size >= 0 && s.belowMinimumSize(upload.Size) {
+		httpError(w, http.StatusBadRequest, "file too small")
+		return fmt.Errorf("rejected upload of %s: %d bytes are below minimum size", fileStorePath, upload.Size)
+	}
+	if s.exceedsSizeLimit(fileStorePath, upload.Size) {
+		s.rejectTooLarge(w, fileStorePath)
+		return fmt.Errorf("rejected upload of %s: %d bytes exceed size limit", fileStorePath, upload.Size)
+	}
+
+	progress := s.trackUpload(fileStorePath, r)
+	defer s.untrackUpload(progress)
+
+	var body io.Reader = progress
+	size := upload.Size
+	var trailerChecksum []byte
+	if verifySize != nil {
+		tmpFile, err := s.createTempFile()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "")
+			return err
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		var src io.Reader = &contextReader{ctx: r.Context(), src: progress}
+		limited := &sizeLimitReader{src: src, remaining: s.sizeLimit(fileStorePath)}
+		if limited.remaining > 0 {
+			src = limited
+		}
+		size, err = copyBuffered(tmpFile, src)
+		if err != nil && limited.exceeded {
+			s.rejectTooLarge(w, fileStorePath)
+			return fmt.Errorf("rejected upload of %s: exceeds size limit of %d bytes", fileStorePath, s.sizeLimit(fileStorePath))
+		} else if _, ok := err.(*gzipBodyError); ok {
+			httpError(w, http.StatusBadRequest, "invalid gzip body")
+			return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+		} else if err != nil {
+			uploadsAbortedMetric.add("", 1)
+			return fmt.Errorf("upload of %s aborted: %s", fileStorePath, err)
+		}
+		if s.belowMinimumSize(size) {
+			httpError(w, http.StatusBadRequest, "file too small")
+			return fmt.Errorf("rejected upload of %s: %d bytes are below minimum size", fileStorePath, size)
+		}
+		if !verifySize(size) {
+			s.recordMACFailure(s.clientIP(r))
+			s.tarpit(r)
+			httpError(w, uploadStatusCodes(&s.conf).InvalidMAC, "invalid MAC")
+			return fmt.Errorf("rejected chunked upload of %s: invalid MAC for %d bytes", fileStorePath, size)
+		}
+		// Checked by upstream
+		if trailerChecksum, err = trailerSHA256(r); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return fmt.Errorf("rejected upload of %s: %s", fileStorePath, err)
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			httpError(w, http.StatusInternalServerError, "")
+			return err
+		}
+		body = tmpFile
+	}
+
+	secret := s.conf.UpstreamSecret
+	if secret == "" {
+		secret = s.conf.Secret
+	}
+	expires, _ := uploadExpiry(r.URL.Query())
+	maxDownloads, _ := uploadMaxDownloads(r.URL.Query())
+	contentType := extensionContentType(fileStorePath)
+	query := url.Values{}
+	query.Set("v2", hmacauth.Sign(secret, "v2", fileStorePath, size, contentType, expires, maxDownloads))
+	if expires != 0 {
+		query.Set("exp", strconv.FormatInt(expires, 10))
+	}
+	if maxDownloads != 0 {
+		query.Set("maxdl", strconv.FormatInt(maxDownloads, 10))
+	}
+	for _, name := range []string{"name", "sha256"} {
+		if value := r.URL.Query().Get(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	// Bodies of size 0 would be sent chunked
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, s.upstreamFileURL(fileStorePath)+"?"+query.Encode(), io.NopCloser(body))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "")
+		return err
+	}
+	req.ContentLength = size
+	for _, name := range []string{"Content-Type", "Content-MD5", "X-Content-SHA256"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	if trailerChecksum != nil {
+		req.Header.Set("X-Content-SHA256", hex.EncodeToString(trailerChecksum))
+	}
+	req.Header.Set("User-Agent", "prosody-filer/"+Version)
+	req.Header.Set("X-Forwarded-For", s.clientIP(r))
+
+	started := time.Now()
+	resp, err := s.upstream.client.Do(req)
+	if err != nil && r.Context().Err() != nil {
+		uploadsAbortedMetric.add("", 1)
+		return fmt.Errorf("upload of %s aborted: client disconnected", fileStorePath)
+	} else if err != nil {
+		upstreamFailuresMetric.add(`method="PUT"`, 1)
+		httpError(w, http.StatusBadGateway, "")
+		return fmt.Errorf("forwarding upload of %s failed: %s", fileStorePath, err)
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		if !isUpstreamOnlyHeader(name) {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upstream refused upload of %s: %s", fileStorePath, resp.Status)
+	}
+	log.Info("Forwarded upload of ", fileStorePath, " (", size, " bytes) to upstream in ", time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,125 @@
+package filer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*
+ * Sets up an edge filer forwarding to a central filer with another secret
+ */
+func setupUpstream(t *testing.T) (edge *Server, central *Server, teardown func()) {
+	central = newTestServer(t)
+	central.conf.StoreDir = t.TempDir()
+	central.conf.Secret = "central secret"
+	server := httptest.NewServer(central.withMiddleware(http.HandlerFunc(central.handleRequest)))
+
+	edge = newTestServer(t)
+	edge.conf.UpstreamURL = server.URL + "/upload/"
+	edge.conf.UpstreamSecret = "central secret"
+	edge.setupUpstream()
+	return edge, central, server.Close
+}
+
+func TestForwardUpload(t *testing.T) {
+	edge, central, teardown := setupUpstream(t)
+	defer teardown()
+
+	// Remove uploaded files after test
+	defer edge.cleanup()
+
+	content := []byte("stored centrally")
+	rr := edge.uploadFile(t, "abc/forwarded file.txt", content)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("forwarded upload: got %v %q", rr.Code, rr.Body.String())
+	}
+	if exists, _ := edge.backend.Exists("abc/forwarded file.txt"); exists {
+		t.Errorf("forwarded upload has been stored locally")
+	}
+
+	req, _ := http.NewRequest("GET", "/upload/abc/forwarded%20file.txt", nil)
+	if rr := central.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download from upstream: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	// Responses of upstream are passed on
+	if rr := edge.uploadFile(t, "abc/forwarded file.txt", []byte("other content")); rr.Code != http.StatusConflict {
+		t.Errorf("upload of existing file: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// The MAC is checked locally
+	req = edge.newUploadRequest(t, "abc/other.txt", content)
+	req.URL.RawQuery = "v=" + strings.Repeat("0", 64)
+	if rr := edge.serveUpload(req); rr.Code != http.StatusForbidden {
+		t.Errorf("upload with invalid MAC: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	if exists, _ := central.backend.Exists("abc/other.txt"); exists {
+		t.Errorf("upload with invalid MAC has been forwarded")
+	}
+}
+
+/*
+ * Uploads of unknown size are received before forwarding them
+ */
+func TestForwardGzipUpload(t *testing.T) {
+	edge, central, teardown := setupUpstream(t)
+	defer teardown()
+
+	// Remove uploaded files after test
+	defer edge.cleanup()
+
+	edge.conf.GzipUploads = true
+	edge.conf.MaxFileSize = 1 << 20
+	content := []byte(strings.Repeat("compressible ", 1000))
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(content)
+	writer.Close()
+
+	req := edge.newUploadRequest(t, "abc/text.txt", content)
+	req.Body = io.NopCloser(&compressed)
+	req.ContentLength = int64(compressed.Len())
+	req.Header.Set("Content-Encoding", "gzip")
+	if rr := edge.serveUpload(req); rr.Code != http.StatusCreated {
+		t.Fatalf("forwarded upload: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/text.txt", nil)
+	if rr := central.serveUpload(req); rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Errorf("download from upstream: got %v", rr.Code)
+	}
+}
+
+func TestForwardDownload(t *testing.T) {
+	edge, central, teardown := setupUpstream(t)
+	defer teardown()
+
+	content := []byte("0123456789")
+	central.uploadFile(t, "abc/file.txt", content)
+
+	req, _ := http.NewRequest("GET", "/upload/abc/file.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rr := edge.serveUpload(req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "234" {
+		t.Errorf("forwarded range request: got %v %q", rr.Code, rr.Body.String())
+	}
+	if values := rr.Header().Values("Access-Control-Allow-Origin"); len(values) != 1 {
+		t.Errorf("CORS headers have been duplicated: %v", values)
+	}
+
+	req, _ = http.NewRequest("GET", "/upload/abc/missing.txt", nil)
+	if rr := edge.serveUpload(req); rr.Code != http.StatusNotFound {
+		t.Errorf("forwarded download of missing file: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	teardown()
+	req, _ = http.NewRequest("GET", "/upload/abc/file.txt", nil)
+	if rr := edge.serveUpload(req); rr.Code != http.StatusBadGateway {
+		t.Errorf("download with unreachable upstream: got %v want %v", rr.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Disk usage by user
+ * The first path element of an upload identifies the user with some XMPP
+ * servers (see maxFilesPerPrefix). Every userUsageInterval, the metadata of
+ * all files is summed up by this prefix. The userUsageTopN prefixes using
+ * the most space are exported as metrics, keeping their number bounded;
+ * the admin API lists all of them. With tenants, usage is summed up by
+ * tenant as well.
+ */
+
+package filer
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	userUsageBytesMetric = newGauge("prosody_filer_user_usage_bytes", "Size of the files of the users using the most space, by uploader prefix.")
+	userUsageFilesMetric = newGauge("prosody_filer_user_usage_files", "Files of the users using the most space, by uploader prefix.")
+	storedBytesMetric    = newGauge("prosody_filer_stored_bytes", "Size of all files with metadata.")
+	storedFilesMetric    = newGauge("prosody_filer_stored_files", "Files with metadata.")
+	tenantBytesMetric    = newGauge("prosody_filer_tenant_usage_bytes", "Size of the files of each tenant.")
+	tenantFilesMetric    = newGauge("prosody_filer_tenant_usage_files", "Files of each tenant.")
+)
+
+const usageDefaultLimit = 100
+
+type prefixUsage struct {
+	Prefix string `json:"prefix"`
+	Files  int64  `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type tenantUsage struct {
+	Tenant string `json:"tenant"`
+	Files  int64  `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+/*
+ * Result of the last count, prefixes and tenants sorted by size, largest
+ * first
+ */
+type usageReport struct {
+	sync.RWMutex
+	prefixes []prefixUsage
+	tenants  []tenantUsage
+	files    int64
+	bytes    int64
+	updated  time.Time
+}
+
+/*
+ * Counts usage every userUsageInterval
+ */
+func (s *Server) startUsageCount() {
+	go func() {
+		for {
+			if err := s.countUsage(); err != nil {
+				log.Error("Counting disk usage failed: ", err)
+			}
+			time.Sleep(s.conf.UserUsageInterval)
+		}
+	}()
+}
+
+/*
+ * Sums up the metadata of all files by uploader prefix and tenant and
+ * updates the metrics
+ */
+func (s *Server) countUsage() error {
+	root := s.sharedPath("meta")
+	byPrefix := make(map[string]*prefixUsage)
+	byTenant := make(map[string]*tenantUsage)
+	var files, bytes int64
+	err := filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed while walking
+			if name != root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			return err
+		}
+		meta, err := s.readMetadata(filepath.ToSlash(relative))
+		if err != nil {
+			// Removed while walking
+			return nil
+		}
+
+		prefix := uploaderPrefix(meta.Path)
+		usage, ok := byPrefix[prefix]
+		if !ok {
+			usage = &prefixUsage{Prefix: prefix}
+			byPrefix[prefix] = usage
+		}
+		usage.Files++
+		usage.Bytes += meta.Size
+
+		// Files uploaded before tenants were configured have none in their metadata
+		tenant := meta.Tenant
+		if tenant == "" {
+			tenant = s.tenant("", meta.Path)
+		}
+		if tenant != "" {
+			usage, ok := byTenant[tenant]
+			if !ok {
+				usage = &tenantUsage{Tenant: tenant}
+				byTenant[tenant] = usage
+			}
+			usage.Files++
+			usage.Bytes += meta.Size
+		}
+		files++
+		bytes += meta.Size
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	prefixes := make([]prefixUsage, 0, len(byPrefix))
+	for _, usage := range byPrefix {
+		prefixes = append(prefixes, *usage)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Bytes != prefixes[j].Bytes {
+			return prefixes[i].Bytes > prefixes[j].Bytes
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+
+	tenants := make([]tenantUsage, 0, len(byTenant))
+	for _, usage := range byTenant {
+		tenants = append(tenants, *usage)
+	}
+	sort.Slice(tenants, func(i, j int) bool {
+		if tenants[i].Bytes != tenants[j].Bytes {
+			return tenants[i].Bytes > tenants[j].Bytes
+		}
+		return tenants[i].Tenant < tenants[j].Tenant
+	})
+
+	s.usage.Lock()
+	s.usage.tenants = tenants
+	s.usage.prefixes, s.usage.files, s.usage.bytes, s.usage.updated = prefixes, files, bytes, time.Now()
+	s.usage.Unlock()
+
+	userUsageBytesMetric.reset()
+	userUsageFilesMetric.reset()
+	for i, usage := range prefixes {
+		if i == s.conf.UserUsageTopN {
+			break
+		}
+		labels := `prefix="` + escapeLabelValue(usage.Prefix) + `"`
+		userUsageBytesMetric.set(labels, float64(usage.Bytes))
+		userUsageFilesMetric.set(labels, float64(usage.Files))
+	}
+	// Tenants are configured, so their number is bounded
+	tenantBytesMetric.reset()
+	tenantFilesMetric.reset()
+	for _, usage := range tenants {
+		labels := `tenant="` + escapeLabelValue(usage.Tenant) + `"`
+		tenantBytesMetric.set(labels, float64(usage.Bytes))
+		tenantFilesMetric.set(labels, float64(usage.Files))
+	}
+	storedBytesMetric.set("", float64(bytes))
+	storedFilesMetric.set("", float64(files))
+	return nil
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/*
+ * Escapes a label value for the Prometheus text format
+ */
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+/*
+ * Usage endpoint:
+ *   GET /usage?limit=<n>       Prefixes using the most space (default: 100)
+ *   GET /usage?prefix=<prefix> Usage of one prefix
+ * With tenants, the usage of all tenants is included.
+ */
+func (s *Server) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if s.conf.UserUsageInterval <= 0 {
+		httpError(w, http.StatusNotImplemented, "userUsageInterval is not set")
+		return
+	}
+
+	limit := usageDefaultLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+
+	s.usage.RLock()
+	defer s.usage.RUnlock()
+	if s.usage.updated.IsZero() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "usage has not been counted yet"})
+		return
+	}
+
+	prefixes := []prefixUsage{}
+	if prefix := r.FormValue("prefix"); prefix != "" {
+		for _, usage := range s.usage.prefixes {
+			if usage.Prefix == prefix {
+				prefixes = append(prefixes, usage)
+			}
+		}
+	} else if limit < len(s.usage.prefixes) {
+		prefixes = s.usage.prefixes[:limit]
+	} else {
+		prefixes = append(prefixes, s.usage.prefixes...)
+	}
+
+	response := map[string]interface{}{
+		"updated":  s.usage.updated.UTC(),
+		"files":    s.usage.files,
+		"bytes":    s.usage.bytes,
+		"prefixes": prefixes,
+	}
+	if len(s.conf.Tenants) > 0 {
+		response["tenants"] = append([]tenantUsage{}, s.usage.tenants...)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,67 @@
+package filer
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+/*
+ * Usage is summed up by prefix, only the largest prefixes are exported as
+ * metrics
+ */
+func TestUserUsage(t *testing.T) {
+	s := newTestServer(t)
+
+	// Remove uploaded files after test
+	defer s.cleanup()
+
+	// Set config
+	s.conf.AdminToken = "admintoken"
+	s.conf.UserUsageInterval = 1
+	s.conf.UserUsageTopN = 1
+
+	if rr := s.adminRequest(t, "GET", "/usage"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("before counting: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	s.uploadFile(t, "alice/first.txt", []byte("first file"))
+	s.uploadFile(t, "alice/second.txt", []byte("second file"))
+	s.uploadFile(t, "bob/file.txt", []byte("bob's"))
+	if err := s.countUsage(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := userUsageBytesMetric.get(`prefix="alice"`); value != 21 {
+		t.Errorf("usage metric of alice: got %v want 21", value)
+	}
+	if value := userUsageBytesMetric.get(`prefix="bob"`); value != 0 {
+		t.Errorf("usage metric of bob beyond userUsageTopN: got %v", value)
+	}
+	if value := storedFilesMetric.get(""); value != 3 {
+		t.Errorf("stored files: got %v want 3", value)
+	}
+
+	var response struct {
+		Files    int64         `json:"files"`
+		Bytes    int64         `json:"bytes"`
+		Prefixes []prefixUsage `json:"prefixes"`
+	}
+	rr := s.adminRequest(t, "GET", "/usage")
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Files != 3 || response.Bytes != 26 || len(response.Prefixes) != 2 ||
+		response.Prefixes[0] != (prefixUsage{"alice", 2, 21}) || response.Prefixes[1] != (prefixUsage{"bob", 1, 5}) {
+		t.Errorf("unexpected usage: %+v", response)
+	}
+
+	rr = s.adminRequest(t, "GET", "/usage?prefix=bob")
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if len(response.Prefixes) != 1 || response.Prefixes[0].Prefix != "bob" {
+		t.Errorf("usage of bob: %+v", response.Prefixes)
+	}
+	if rr := s.adminRequest(t, "GET", "/usage?limit=0"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Webhook notifications
+ * Events are POSTed as JSON to webhookURL in the background. With a
+ * webhookSecret, the body is signed with HMAC-SHA256 in the
+ * X-Prosody-Filer-Signature header ("sha256=<hex>").
+ */
+
+package filer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var webhookFailuresMetric = newCounter("prosody_filer_webhook_failures_total", "Webhook notifications which could not be delivered.")
+
+const webhookAttempts = 3
+
+/*
+ * Sends the configured events to webhookURL
+ */
+func (s *Server) startWebhook() {
+	queue := make(chan fileEvent, 100)
+	client := &http.Client{Timeout: s.conf.WebhookTimeout}
+
+	s.subscribeEvents(func(event fileEvent) {
+		if !eventSelected(s.conf.WebhookEvents, event.Type) {
+			return
+		}
+		select {
+		case queue <- event:
+		default:
+			log.Warn("Webhook queue full, dropping ", event.Type, " event of ", event.Path)
+			webhookFailuresMetric.add("", 1)
+		}
+	})
+
+	go func() {
+		for event := range queue {
+			if err := s.sendWebhook(client, event); err != nil {
+				log.Error(err)
+				webhookFailuresMetric.add("", 1)
+			}
+		}
+	}()
+}
+
+/*
+ * Delivers an event, retrying with increasing delays
+ */
+func (s *Server) sendWebhook(client *http.Client, event fileEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = s.postWebhook(client, s.conf.WebhookURL, body)
+		if err == nil || attempt == webhookAttempts {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("webhook for %s event of %s failed: %s", event.Type, event.Path, err)
+	}
+	return nil
+}
+
+func (s *Server) postWebhook(client *http.Client, target string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "prosody-filer/"+Version)
+	if s.conf.WebhookSecret != "" {
+		req.Header.Set("X-Prosody-Filer-Signature", "sha256="+s.webhookSignature(body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Server) webhookSignature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.conf.WebhookSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
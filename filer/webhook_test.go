@@ -0,0 +1,44 @@
+package filer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+ * Events are POSTed as signed JSON
+ */
+func TestWebhook(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+	s.conf.WebhookSecret = "webhooksecret"
+
+	var received fileEvent
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		if r.Header.Get("X-Prosody-Filer-Signature") != "sha256="+s.webhookSignature(body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		signature = r.Header.Get("X-Prosody-Filer-Signature")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	s.conf.WebhookURL = server.URL
+
+	event := fileEvent{Type: "upload", Path: "abc/cat.jpg", Size: 3, Uploader: "abc"}
+	if err := s.sendWebhook(server.Client(), event); err != nil {
+		t.Fatal(err)
+	}
+	if signature == "" {
+		t.Error("webhook has not been signed")
+	}
+	if received.Type != "upload" || received.Path != "abc/cat.jpg" || received.Size != 3 || received.Uploader != "abc" {
+		t.Errorf("unexpected payload %+v", received)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * XMPP notifications
+ * Prosody Filer connects to the XMPP server as external component
+ * (XEP-0114) to send messages to admins. A connection is opened for each
+ * batch of notifications, which are rare.
+ * Also see: https://xmpp.org/extensions/xep-0114.html
+ */
+
+package filer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const xmppTimeout = 10 * time.Second
+
+/*
+ * Sends messages to all notifyJIDs
+ */
+func (s *Server) sendXmppMessages(messages []string) error {
+	conn, err := net.DialTimeout("tcp", s.conf.XmppComponentAddress, xmppTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to XMPP server: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(xmppTimeout))
+
+	if err := s.xmppHandshake(conn); err != nil {
+		return fmt.Errorf("XMPP component handshake failed: %s", err)
+	}
+
+	for _, message := range messages {
+		for _, jid := range s.conf.XmppNotifyJIDs {
+			stanza := struct {
+				XMLName xml.Name `xml:"message"`
+				From    string   `xml:"from,attr"`
+				To      string   `xml:"to,attr"`
+				Type    string   `xml:"type,attr"`
+				Body    string   `xml:"body"`
+			}{From: s.conf.XmppComponentDomain, To: jid, Type: "chat", Body: message}
+			if err := xml.NewEncoder(conn).Encode(stanza); err != nil {
+				return fmt.Errorf("failed to send XMPP message: %s", err)
+			}
+		}
+	}
+
+	_, err = io.WriteString(conn, "</stream:stream>")
+	return err
+}
+
+/*
+ * Opens the component stream and authenticates with the hash of the
+ * stream ID and the shared secret
+ */
+func (s *Server) xmppHandshake(conn net.Conn) error {
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns='jabber:component:accept' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' to='%s'>", xmlEscape(s.conf.XmppComponentDomain))
+	if _, err := io.WriteString(conn, header); err != nil {
+		return err
+	}
+
+	decoder := xml.NewDecoder(conn)
+	stream, err := nextStartElement(decoder)
+	if err != nil {
+		return err
+	} else if stream.Name.Local != "stream" {
+		return fmt.Errorf("unexpected element <%s>", stream.Name.Local)
+	}
+	streamID := ""
+	for _, attr := range stream.Attr {
+		if attr.Name.Local == "id" {
+			streamID = attr.Value
+		}
+	}
+
+	digest := sha1.Sum([]byte(streamID + s.conf.XmppComponentSecret))
+	if _, err := fmt.Fprintf(conn, "<handshake>%s</handshake>", hex.EncodeToString(digest[:])); err != nil {
+		return err
+	}
+
+	response, err := nextStartElement(decoder)
+	if err != nil {
+		return err
+	} else if response.Name.Local == "error" {
+		return errors.New("stream error, check xmppComponentDomain and xmppComponentSecret")
+	} else if response.Name.Local != "handshake" {
+		return fmt.Errorf("unexpected element <%s>", response.Name.Local)
+	}
+	return nil
+}
+
+func nextStartElement(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
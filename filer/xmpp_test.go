@@ -0,0 +1,88 @@
+package filer
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+/*
+ * Send messages through a fake XMPP server accepting components
+ */
+func TestSendXmppMessages(t *testing.T) {
+	// Set config
+	s := newTestServer(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s.conf.XmppComponentAddress = listener.Addr().String()
+	s.conf.XmppComponentDomain = "filer.example.com"
+	s.conf.XmppComponentSecret = "componentsecret"
+	s.conf.XmppNotifyJIDs = []string{"admin@example.com"}
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		header, _ := reader.ReadString('>')
+		header, _ = reader.ReadString('>')
+		if !strings.Contains(header, "to='filer.example.com'") {
+			received <- "unexpected header " + header
+			return
+		}
+		conn.Write([]byte("<?xml version='1.0'?><stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' id='4711' from='filer.example.com'>"))
+
+		digest := sha1.Sum([]byte("4711componentsecret"))
+		handshake, _ := reader.ReadString('>')
+		handshake2, _ := reader.ReadString('>')
+		if handshake+handshake2 != "<handshake>"+hex.EncodeToString(digest[:])+"</handshake>" {
+			conn.Write([]byte("<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>"))
+			received <- "invalid handshake"
+			return
+		}
+		conn.Write([]byte("<handshake/>"))
+
+		message, _ := reader.ReadString('\x00')
+		received <- message
+	}()
+
+	if err := s.sendXmppMessages([]string{"disk <full>"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `<message from="filer.example.com" to="admin@example.com" type="chat"><body>disk &lt;full&gt;</body></message></stream:stream>`
+	if message := <-received; message != expected {
+		t.Errorf("got %q, want %q", message, expected)
+	}
+
+	s.conf.XmppComponentSecret = "wrong"
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reader.ReadString('>')
+		reader.ReadString('>')
+		conn.Write([]byte("<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' id='4712'>"))
+		reader.ReadString('>')
+		reader.ReadString('>')
+		conn.Write([]byte("<stream:error><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>"))
+	}()
+	if err := s.sendXmppMessages([]string{"test"}); err == nil {
+		t.Error("failed handshake has not been reported")
+	}
+}
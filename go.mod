@@ -1,8 +1,12 @@
 module github.com/ThomasLeister/prosody-filer
 
-go 1.16
+go 1.20
 
 require (
 	github.com/BurntSushi/toml v1.3.2
+	github.com/klauspost/compress v1.17.9
 	github.com/sirupsen/logrus v1.9.3
+	github.com/yuin/gopher-lua v1.1.1
 )
+
+require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
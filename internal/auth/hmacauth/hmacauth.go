@@ -0,0 +1,64 @@
+/*
+ * Package hmacauth implements the upload MACs of mod_http_upload_external
+ * (https://modules.prosody.im/mod_http_upload_external.html):
+ *
+ *   v       HMAC-SHA256 over "<path> <size>"
+ *   v2      HMAC-SHA256 over "<path>\0<size>\0<content type>"
+ *   token   same as v2, sent by Metronome
+ *
+ * Uploads with an expiry (the exp parameter) append it to the MAC input,
+ * separated like the other components: "<path> <size> <exp>" for v. A
+ * download limit (the maxdl parameter) is appended after that, tagged so
+ * it can't be mistaken for an expiry: "<path> <size> maxdl=<n>".
+ */
+
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// MAC parameters, in order of preference
+var Versions = []string{"v2", "token", "v"}
+
+/*
+ * Calculates the hex encoded MAC of an upload of size bytes to path, expiring
+ * at the Unix time expires (0 = never) or after maxDownloads downloads (0 =
+ * unlimited). Returns "" for unknown versions.
+ */
+func Sign(secret string, version string, path string, size int64, contentType string, expires int64, maxDownloads int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	var separator string
+	switch version {
+	case "v":
+		// use a space character (0x20) between components of MAC
+		separator = "\x20"
+		mac.Write([]byte(path + separator + strconv.FormatInt(size, 10)))
+	case "v2", "token":
+		// use a null byte character (0x00) between components of MAC
+		separator = "\x00"
+		mac.Write([]byte(path + separator + strconv.FormatInt(size, 10) + separator + contentType))
+	default:
+		return ""
+	}
+	if expires != 0 {
+		mac.Write([]byte(separator + strconv.FormatInt(expires, 10)))
+	}
+	if maxDownloads != 0 {
+		mac.Write([]byte(separator + "maxdl=" + strconv.FormatInt(maxDownloads, 10)))
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Checks a MAC sent by a client, in constant time
+ */
+func Verify(secret string, version string, path string, size int64, contentType string, expires int64, maxDownloads int64, clientMAC string) bool {
+	expected := Sign(secret, version, path, size, contentType, expires, maxDownloads)
+	return expected != "" && hmac.Equal([]byte(expected), []byte(clientMAC))
+}
@@ -0,0 +1,50 @@
+package hmacauth
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	// MACs from the example in prosody-filer_test.go
+	for _, test := range []struct {
+		version     string
+		contentType string
+		expected    string
+	}{
+		{"v", "", "7b8879e2d1c733b423a70cde30cecc3a3c64a03f790d1b5bcbb2a6aca52b477e"},
+		{"v2", "image/jpeg", "7318cd44d4c40731e3b2ff869f553ab2326eae631868e7b8054db20d4aee1c06"},
+		{"token", "image/jpeg", "7318cd44d4c40731e3b2ff869f553ab2326eae631868e7b8054db20d4aee1c06"},
+	} {
+		if mac := Sign("mysecret", test.version, "thomas/abc/catmetal.jpg", 23026, test.contentType, 0, 0); mac != test.expected {
+			t.Errorf("%s: got %s want %s", test.version, mac, test.expected)
+		}
+	}
+
+	if mac := Sign("mysecret", "v3", "thomas/abc/catmetal.jpg", 23026, "", 0, 0); mac != "" {
+		t.Errorf("unknown version: got %s", mac)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	mac := Sign("mysecret", "v", "abc/file.txt", 5, "", 0, 0)
+	if !Verify("mysecret", "v", "abc/file.txt", 5, "", 0, 0, mac) {
+		t.Errorf("valid MAC rejected")
+	}
+	if Verify("mysecret", "v", "abc/file.txt", 6, "", 0, 0, mac) || Verify("other", "v", "abc/file.txt", 5, "", 0, 0, mac) {
+		t.Errorf("invalid MAC accepted")
+	}
+	if Verify("mysecret", "v", "abc/file.txt", 5, "", 1700000000, 0, mac) {
+		t.Errorf("MAC without expiry accepted with expiry")
+	}
+	if !Verify("mysecret", "v", "abc/file.txt", 5, "", 1700000000, 0, Sign("mysecret", "v", "abc/file.txt", 5, "", 1700000000, 0)) {
+		t.Errorf("valid MAC with expiry rejected")
+	}
+	// A MAC with expiry must not be usable as one with download limit
+	if Verify("mysecret", "v", "abc/file.txt", 5, "", 0, 1700000000, Sign("mysecret", "v", "abc/file.txt", 5, "", 1700000000, 0)) {
+		t.Errorf("MAC with expiry accepted with download limit")
+	}
+	if !Verify("mysecret", "v2", "abc/file.txt", 5, "", 1700000000, 3, Sign("mysecret", "v2", "abc/file.txt", 5, "", 1700000000, 3)) {
+		t.Errorf("valid MAC with expiry and download limit rejected")
+	}
+	if Verify("mysecret", "v3", "abc/file.txt", 5, "", 0, 0, "") {
+		t.Errorf("unknown version accepted")
+	}
+}
@@ -0,0 +1,1011 @@
+/*
+ * Package config holds the settings of Prosody Filer: defaults, loading
+ * from TOML files and validation of settings which don't depend on the
+ * rest of the filer.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+ * Configuration of this server
+ */
+type Config struct {
+	ListenPort   string
+	UnixSocket   bool
+	Secret       string
+	StoreDir     string
+	UploadSubDir string
+	LogLevel     string
+
+	// Refuse to start with weak secrets ("refuse"), or only log them ("warn")
+	WeakSecrets     string
+	MinSecretLength int
+
+	// Refuse to start with less bytes available in storeDir (0 = unchecked)
+	MinFreeSpace int64
+
+	// Log ("warn") or refuse to start with ("refuse") insecure permissions in storeDir, or "ignore" them
+	InsecurePermissions string
+
+	// Further subdirectories for uploads and downloads, mapped to a subtree of storeDir ("" = storeDir itself)
+	UploadSubDirs map[string]string
+
+	// Directory receiving uploads, on the same filesystem as storeDir ("" = inside storeDir)
+	TempDir string
+
+	// Read-only directories downloads fall back to if a file is not in the storage backend, e.g. after a migration
+	FallbackStoreDirs []string
+
+	// Reserve disk space for uploads from their Content-Length, where the filesystem supports it
+	PreallocateUploads bool
+
+	// Answer stored uploads with a JSON body containing the URL of the file
+	UploadResponseJSON bool
+
+	// Point the Location header of responses to stored uploads to the file
+	UploadLocation bool
+
+	// Uploads to existing paths: "reject", "overwrite" or "version" (overwrite, keeping up to keepVersions replaced files, 0 = all)
+	ConflictPolicy string
+	KeepVersions   int
+
+	// Serialize concurrent uploads to the same path: "process", "flock" (across instances sharing clusterDir or storeDir) or "off"
+	UploadLocking string
+
+	// Protocol spoken on listenPort: "http", "h2c" (HTTP/2 without TLS) or "fcgi" (FastCGI)
+	ListenProtocol string
+
+	// Maximum upload size in bytes (0 = unlimited), and by extension or content type
+	MaxFileSize int64
+	SizeLimits  map[string]int64
+
+	// Minimum upload size in bytes
+	MinFileSize int64
+
+	// Log the progress of uploads of at least progressLogSize bytes every progressLogInterval (0 = never)
+	ProgressLogSize     int64
+	ProgressLogInterval time.Duration
+
+	// Maximum number of files below the first path element (0 = unlimited)
+	MaxFilesPerPrefix int
+
+	// Explain the service to people visiting "/" or the upload directory
+	LandingPage     bool
+	LandingPageFile string
+
+	// Short aliases for uploads, redirecting to the file
+	ShortURLs      bool
+	ShortURLSubDir string
+
+	// Show browsers a page with a download button instead of the file
+	PreviewPages bool
+
+	// Serve /robots.txt disallowing indexing, and a favicon (optional)
+	RobotsTxt bool
+	Favicon   string
+
+	// HTML pages for error responses to browsers, by status code: template files or inline templates
+	ErrorPages         map[string]string
+	ErrorPageTemplates map[string]string
+
+	// Answer errors with JSON or XEP-0363 XML bodies to clients accepting them
+	StructuredErrors bool
+
+	// Delay responses to requests with missing or invalid MAC
+	MacFailureDelay time.Duration
+
+	// Reverse proxies whose X-Forwarded-For header is trusted
+	TrustedProxies []string
+
+	// Honor X-Forwarded-Prefix of trustedProxies: the path prefix stripped by the proxy,
+	// included in the path covered by MACs and in generated URLs
+	ForwardedPrefix bool
+
+	// Ban clients causing more than notFoundLimit 404 responses within notFoundWindow (0 = never)
+	NotFoundLimit  int
+	NotFoundWindow time.Duration
+	BanDuration    time.Duration
+
+	// Decoy paths or patterns ("/.env", "/upload/*.php") only scanners request, optionally banning them for banDuration
+	HoneypotPaths []string
+	HoneypotBan   bool
+
+	// Keep bans in banDir ("" = clusterDir or the internal directory), re-read every banSyncInterval to pick up bans of other nodes
+	BanDir          string
+	BanSyncInterval time.Duration
+
+	// Requests per second and client, with bursts of up to rateLimitBurst requests (0 = unlimited)
+	RateLimit      float64
+	RateLimitBurst int
+
+	// Request processing applied to all public requests, in this order. See Middlewares.
+	Middleware []string
+
+	// XMPP server preset: "", "prosody", "ejabberd", "metronome" or "auto"
+	ServerType string
+
+	// Accept "v" MACs, which don't cover the content type
+	AllowV1 bool
+
+	// Accepted MAC parameters in order of preference, instead of those of
+	// serverType, for all uploads and by upload subdirectory
+	MacVersions       []string
+	SubDirMacVersions map[string][]string
+
+	// Path the MAC is calculated over: "decoded", "escaped" or "both"
+	MacPathEncoding string
+
+	// Answer missing and invalid MACs and existing files with the status
+	// codes of the serverType preset instead of 403, 403 and 409
+	ProtocolStatusCodes bool
+
+	// Accept JWTs with path and maxSize claims for uploads: HS256 signed with
+	// jwtSecret and/or EdDSA signed with the key in jwtPublicKeyFile (PEM)
+	JwtSecret        string
+	JwtPublicKeyFile string
+
+	// Require HTTP Basic auth for downloads below the prefixes of downloadAuth ("/" = all files),
+	// by the users allowed there ("*" = all users of downloadUsers and downloadHtpasswd)
+	DownloadAuth     map[string][]string
+	DownloadUsers    map[string]string
+	DownloadHtpasswd string
+
+	// Uploads without Content-Length: "reject" or "verify"
+	ChunkedUploads string
+
+	// Accept uploads with "Content-Encoding: gzip", stored decompressed
+	GzipUploads bool
+
+	// Resumable uploads: tus and PUT with Content-Range
+	TusSubDir           string
+	ResumableUploads    bool
+	PartialUploadExpiry time.Duration
+
+	// ClamAV virus scanning
+	ClamdAddress        string
+	ClamdTimeout        time.Duration
+	ClamdFailureMode    string
+	ClamdInfectedAction string
+
+	// Quarantine
+	QuarantineStatus int
+
+	// Content checks
+	BlockExecutables   bool
+	MimeMismatchPolicy string
+
+	// Filters
+	StripImageMetadata     bool
+	RecompressImages       bool
+	RecompressTypes        []string
+	RecompressMaxDimension int
+	RecompressQuality      int
+	RecompressMaxInputSize int64
+	RecompressMaxPixels    int64
+
+	// SHA-256 hash denylist
+	HashDenylist       string
+	HashDenylistAction string
+
+	// Compression at rest
+	CompressFiles    bool
+	CompressionLevel int
+
+	// Store identical uploads only once
+	Deduplicate bool
+
+	// At-rest encryption
+	EncryptionKey         string
+	EncryptionKeyFile     string
+	EncryptionOldKeys     []string
+	EncryptionOldKeyFiles []string
+
+	// "local" or "s3"
+	StorageBackend string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3Prefix       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3PathStyle    bool
+	S3Timeout      time.Duration
+
+	// Count disk usage by uploader prefix periodically, exporting the userUsageTopN largest as metrics
+	UserUsageInterval time.Duration
+	UserUsageTopN     int
+
+	// Tenants by host name ("chat.example.com") or subtree of storeDir ("/team-files"), labelling metrics, logs and usage
+	Tenants map[string]string
+
+	// Probe the storage backend periodically, storing uploads in failoverStoreDir while it fails
+	HealthCheckInterval time.Duration
+	FailoverStoreDir    string
+	// Probes taking longer, e.g. on a hanging network filesystem, fail
+	HealthCheckTimeout time.Duration
+
+	// Cluster mode: metadata in a directory shared by all nodes, clusterNode defaults to the host name
+	ClusterDir  string
+	ClusterNode string
+
+	// Append created and deleted files to a journal, for incremental backups
+	Journal bool
+
+	// Periodic archives of metadata and short URLs, keeping the newest metadataBackupKeep
+	MetadataBackupDir      string
+	MetadataBackupInterval time.Duration
+	MetadataBackupKeep     int
+
+	// Append-only log of uploads and deletions with hashes and client addresses, optionally hash-chained
+	AuditLog      string
+	AuditLogChain bool
+
+	// Copy uploads to a secondary filer ("https://...", signed with mirrorSecret) or directory ("file:///...")
+	MirrorURL     string
+	MirrorSecret  string
+	MirrorTimeout time.Duration
+
+	// Proxy mode: forward uploads (signed with upstreamSecret) and downloads to another filer
+	UpstreamURL     string
+	UpstreamSecret  string
+	UpstreamTimeout time.Duration
+
+	// Local cache for files from remote storage backends
+	DiskCacheSize        int64
+	DiskCacheMaxFileSize int64
+
+	// In-memory cache for files requested repeatedly
+	MemoryCacheSize        int64
+	MemoryCacheMaxFileSize int64
+	MemoryCacheWindow      time.Duration
+
+	// Read buffer in bytes for video and audio downloads which can't use sendfile, 0 = default (32 KiB)
+	MediaReadBuffer int
+
+	// Send files compressed at rest or with a .br/.gz sibling compressed to clients accepting it
+	ServePrecompressed bool
+
+	// "flat" or "sharded"
+	StorageLayout string
+
+	// Send Content-MD5 header on downloads
+	SendContentMD5 bool
+
+	// Cache-Control header for downloads
+	CacheControl string
+
+	// Let the web server deliver downloads: "", "x-accel-redirect" or "x-sendfile"
+	DownloadOffload       string
+	DownloadOffloadPrefix string
+
+	// Redirect downloads: "", "presigned" (S3) or "cdn"
+	DownloadRedirect       string
+	DownloadRedirectPrefix string
+	DownloadRedirectExpiry time.Duration
+
+	// Expire files after maxDownloads downloads (0 = unlimited), by prefix of the stored path
+	// ("public/"), unless the upload URL has a signed maxdl parameter
+	MaxDownloads       int64
+	PrefixMaxDownloads map[string]int64
+
+	// Prefixes of the stored path ("once/") whose files are removed after their first complete download
+	BurnAfterReading []string
+
+	// Require the dl parameter of downloads, naming the saved file, to be signed with secret
+	SignDownloadNames bool
+
+	// Integrity verification
+	ScrubInterval time.Duration
+	ScrubRate     int64
+
+	// Refuse uploads, e.g. during maintenance
+	ReadOnly           bool
+	ReadOnlyRetryAfter time.Duration
+
+	// Planned periods of read-only mode
+	MaintenanceWindows []MaintenanceWindow
+
+	// Admin API
+	AdminListenPort string
+	AdminUnixSocket bool
+	AdminToken      string
+
+	// Log in to the admin API with OpenID Connect. oidcRedirectURL points to
+	// /oidc/callback of the admin API, oidcAdmins lists "sub" or "email" claims.
+	OidcIssuer          string
+	OidcClientID        string
+	OidcClientSecret    string
+	OidcRedirectURL     string
+	OidcAdmins          []string
+	OidcSessionDuration time.Duration
+
+	// Upload slots requested through the admin API
+	SlotToken   string
+	SlotMaxSize int64
+	PublicURL   string
+
+	// Give slots random file names, keeping the requested one in the metadata
+	SlotObfuscateNames bool
+
+	// Notify an external service of events: "upload", "download" and/or "delete"
+	WebhookURL     string
+	WebhookSecret  string
+	WebhookEvents  []string
+	WebhookTimeout time.Duration
+
+	// CrowdSec local API: refuse clients with decisions (crowdsecAPIKey of a bouncer) and
+	// report 404 floods and MAC brute force (crowdsecMachineID and crowdsecPassword of a watcher)
+	CrowdsecURL           string
+	CrowdsecAPIKey        string
+	CrowdsecCacheDuration time.Duration
+	CrowdsecMachineID     string
+	CrowdsecPassword      string
+	CrowdsecMacFailures   int
+
+	// Report server errors and panics to Sentry and/or as JSON to errorWebhookURL, signed with webhookSecret
+	SentryDSN       string
+	ErrorWebhookURL string
+
+	// Run a command for events: "upload", "download" and/or "delete"
+	HookCommand     []string
+	HookEvents      []string
+	HookTimeout     time.Duration
+	HookConcurrency int
+
+	// External plugins, each a command with arguments
+	Plugins           [][]string
+	PluginTimeout     time.Duration
+	PluginFailureMode string
+
+	// Lua script defining hooks, run like plugins
+	LuaScript string
+
+	// Publish events to message brokers: "upload", "download" and/or "delete"
+	NatsURL      string
+	NatsSubject  string
+	MqttURL      string
+	MqttTopic    string
+	BrokerEvents []string
+
+	// Notify admins via XMPP, connecting as external component
+	XmppComponentAddress string
+	XmppComponentDomain  string
+	XmppComponentSecret  string
+	XmppNotifyJIDs       []string
+	NotifyInterval       time.Duration
+	NotifyDiskUsage      int
+	NotifyMacFailures    int
+}
+
+/*
+ * A period during which uploads are refused
+ */
+type MaintenanceWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+/*
+ * Settings selected by serverType
+ */
+type Preset struct {
+	// Accepted MAC parameters, in order of preference
+	MacVersions     []string
+	MacPathEncoding string
+
+	// Used with protocolStatusCodes
+	StatusCodes StatusCodes
+}
+
+/*
+ * Status codes of rejected uploads, as handled by the upload module of an
+ * XMPP server
+ */
+type StatusCodes struct {
+	MissingMAC int
+	InvalidMAC int
+	FileExists int
+}
+
+var DefaultStatusCodes = StatusCodes{MissingMAC: 403, InvalidMAC: 403, FileExists: 409}
+
+/*
+ * Names of the available middleware, in their default order
+ */
+var Middlewares = []string{"log", "metrics", "errorPages", "bans", "crowdsec", "rateLimit", "cors"}
+
+var Presets = map[string]Preset{
+	"prosody": {MacVersions: []string{"v2", "v"}, MacPathEncoding: "decoded",
+		StatusCodes: StatusCodes{MissingMAC: 401, InvalidMAC: 403, FileExists: 409}},
+	"ejabberd": {MacVersions: []string{"v"}, MacPathEncoding: "escaped",
+		StatusCodes: StatusCodes{MissingMAC: 403, InvalidMAC: 403, FileExists: 403}},
+	"metronome": {MacVersions: []string{"token"}, MacPathEncoding: "decoded",
+		StatusCodes: StatusCodes{MissingMAC: 400, InvalidMAC: 403, FileExists: 409}},
+	"auto": {MacVersions: []string{"v2", "token", "v"}, MacPathEncoding: "both",
+		StatusCodes: DefaultStatusCodes},
+}
+
+/*
+ * Default values for settings which are missing in the config file
+ */
+func Default() Config {
+	return Config{
+		ListenProtocol:         "http",
+		MinFileSize:            1,
+		PreallocateUploads:     true,
+		AllowV1:                true,
+		WeakSecrets:            "refuse",
+		MinSecretLength:        16,
+		InsecurePermissions:    "warn",
+		UploadLocation:         true,
+		ConflictPolicy:         "reject",
+		KeepVersions:           10,
+		UploadLocking:          "process",
+		ProgressLogSize:        100 * 1024 * 1024,
+		ProgressLogInterval:    30 * time.Second,
+		RobotsTxt:              true,
+		ShortURLSubDir:         "s/",
+		TrustedProxies:         []string{"127.0.0.1", "::1"},
+		NotFoundWindow:         10 * time.Minute,
+		BanDuration:            time.Hour,
+		BanSyncInterval:        time.Minute,
+		RateLimitBurst:         20,
+		OidcSessionDuration:    8 * time.Hour,
+		Middleware:             append([]string{}, Middlewares...),
+		MacPathEncoding:        "decoded",
+		ChunkedUploads:         "reject",
+		PartialUploadExpiry:    24 * time.Hour,
+		ClamdTimeout:           30 * time.Second,
+		ClamdFailureMode:       "reject",
+		ClamdInfectedAction:    "reject",
+		QuarantineStatus:       http.StatusUnavailableForLegalReasons,
+		HashDenylistAction:     "reject",
+		MimeMismatchPolicy:     "allow",
+		RecompressTypes:        []string{"image/jpeg", "image/png"},
+		RecompressMaxDimension: 2560,
+		RecompressQuality:      85,
+		RecompressMaxInputSize: 32 * 1024 * 1024,
+		RecompressMaxPixels:    50 * 1000 * 1000,
+		CompressionLevel:       3,
+		StorageBackend:         "local",
+		S3Region:               "us-east-1",
+		S3Timeout:              10 * time.Minute,
+		DiskCacheMaxFileSize:   16 * 1024 * 1024,
+		MemoryCacheMaxFileSize: 1024 * 1024,
+		MemoryCacheWindow:      time.Minute,
+		StorageLayout:          "flat",
+		DownloadRedirectExpiry: time.Hour,
+		ScrubRate:              10 * 1024 * 1024,
+		ReadOnlyRetryAfter:     5 * time.Minute,
+		WebhookEvents:          []string{"upload"},
+		WebhookTimeout:         10 * time.Second,
+		MirrorTimeout:          5 * time.Minute,
+		UpstreamTimeout:        time.Minute,
+		HealthCheckInterval:    30 * time.Second,
+		HealthCheckTimeout:     10 * time.Second,
+		UserUsageTopN:          10,
+		CrowdsecCacheDuration:  time.Minute,
+		CrowdsecMacFailures:    10,
+		MetadataBackupInterval: time.Hour,
+		MetadataBackupKeep:     24,
+		HookEvents:             []string{"upload"},
+		HookTimeout:            time.Minute,
+		HookConcurrency:        2,
+		PluginTimeout:          10 * time.Second,
+		PluginFailureMode:      "reject",
+		NatsSubject:            "prosody-filer",
+		MqttTopic:              "prosody-filer",
+		BrokerEvents:           []string{"upload", "delete"},
+		NotifyInterval:         time.Hour,
+		NotifyDiskUsage:        90,
+		NotifyMacFailures:      10,
+	}
+}
+
+/*
+ * Reads a config file, applying defaults for missing settings and the
+ * XMPP server preset
+ */
+func Load(configFilename string) (Config, error) {
+	config := Default()
+
+	configData, err := os.ReadFile(configFilename)
+	if err != nil {
+		return config, fmt.Errorf("configuration file %s cannot be read: %s", configFilename, err)
+	}
+
+	meta, err := toml.Decode(string(configData), &config)
+	if err != nil {
+		return config, fmt.Errorf("configuration file %s is invalid: %s", configFilename, err)
+	}
+
+	// Settings not given explicitly follow the XMPP server preset
+	if preset, ok := Presets[config.ServerType]; ok && !meta.IsDefined("macPathEncoding") {
+		config.MacPathEncoding = preset.MacPathEncoding
+	}
+
+	return config, nil
+}
+
+/*
+ * Checks settings which can not be validated by the TOML decoder, and
+ * normalizes some of them
+ */
+func (conf *Config) Validate() error {
+	switch conf.ListenProtocol {
+	case "http", "h2c", "fcgi":
+	default:
+		return fmt.Errorf("invalid listenProtocol %q: must be \"http\", \"h2c\" or \"fcgi\"", conf.ListenProtocol)
+	}
+
+	if err := checkAbstractSocket("listenPort", conf.ListenPort, &conf.UnixSocket); err != nil {
+		return err
+	}
+	if err := checkAbstractSocket("adminListenPort", conf.AdminListenPort, &conf.AdminUnixSocket); err != nil {
+		return err
+	}
+	if err := checkListenAddress("listenPort", conf.ListenPort, conf.UnixSocket); err != nil {
+		return err
+	}
+	if err := checkListenAddress("adminListenPort", conf.AdminListenPort, conf.AdminUnixSocket); err != nil {
+		return err
+	}
+
+	// Compared and joined with URL paths as "upload/"
+	conf.UploadSubDir = strings.Trim(path.Clean("/"+conf.UploadSubDir), "/")
+	if conf.UploadSubDir != "" {
+		conf.UploadSubDir += "/"
+	}
+	if conf.MinFreeSpace < 0 {
+		return fmt.Errorf("minFreeSpace must not be negative")
+	}
+	for _, dir := range conf.FallbackStoreDirs {
+		if dir == "" || filepath.Clean(dir) == filepath.Clean(conf.StoreDir) {
+			return fmt.Errorf("invalid fallbackStoreDirs entry %q: must be a directory other than storeDir", dir)
+		}
+	}
+
+	if _, ok := Presets[conf.ServerType]; !ok && conf.ServerType != "" {
+		return fmt.Errorf("invalid serverType %q: must be \"prosody\", \"ejabberd\", \"metronome\" or \"auto\"", conf.ServerType)
+	}
+	if preset := Presets[conf.ServerType]; !conf.AllowV1 && len(conf.MacVersions) == 0 && len(preset.MacVersions) == 1 && preset.MacVersions[0] == "v" {
+		return fmt.Errorf("allowV1 = false refuses all uploads signed by %s, which only sends \"v\" MACs", conf.ServerType)
+	}
+	if err := checkMacVersions("macVersions", conf.MacVersions, conf.AllowV1); err != nil {
+		return err
+	}
+
+	switch conf.MacPathEncoding {
+	case "decoded", "escaped", "both":
+	default:
+		return fmt.Errorf("invalid macPathEncoding %q: must be \"decoded\", \"escaped\" or \"both\"", conf.MacPathEncoding)
+	}
+
+	switch conf.WeakSecrets {
+	case "refuse", "warn":
+	default:
+		return fmt.Errorf("invalid weakSecrets %q: must be \"refuse\" or \"warn\"", conf.WeakSecrets)
+	}
+
+	switch conf.InsecurePermissions {
+	case "warn", "refuse", "ignore":
+	default:
+		return fmt.Errorf("invalid insecurePermissions %q: must be \"warn\", \"refuse\" or \"ignore\"", conf.InsecurePermissions)
+	}
+
+	switch conf.ConflictPolicy {
+	case "reject", "overwrite", "version":
+	default:
+		return fmt.Errorf("invalid conflictPolicy %q: must be \"reject\", \"overwrite\" or \"version\"", conf.ConflictPolicy)
+	}
+	if conf.KeepVersions < 0 {
+		return fmt.Errorf("keepVersions must not be negative")
+	}
+
+	switch conf.UploadLocking {
+	case "process", "flock", "off":
+	default:
+		return fmt.Errorf("invalid uploadLocking %q: must be \"process\", \"flock\" or \"off\"", conf.UploadLocking)
+	}
+
+	if (conf.ChunkedUploads == "verify" || conf.GzipUploads) && conf.MaxFileSize <= 0 {
+		return fmt.Errorf("chunkedUploads = \"verify\" and gzipUploads require maxFileSize, as the size of these uploads is only known once they have been received")
+	}
+	switch conf.ChunkedUploads {
+	case "reject", "verify":
+	default:
+		return fmt.Errorf("invalid chunkedUploads %q: must be \"reject\" or \"verify\"", conf.ChunkedUploads)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range conf.Middleware {
+		if !containsString(Middlewares, name) {
+			return fmt.Errorf("invalid middleware %q: must be one of %s", name, strings.Join(Middlewares, ", "))
+		} else if seen[name] {
+			return fmt.Errorf("middleware %q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	if conf.RateLimit < 0 {
+		return fmt.Errorf("rateLimit must not be negative")
+	}
+	if conf.RateLimit > 0 && conf.RateLimitBurst < 1 {
+		return fmt.Errorf("rateLimitBurst must be positive")
+	}
+
+	if len(conf.DownloadAuth) > 0 && len(conf.DownloadUsers) == 0 && conf.DownloadHtpasswd == "" {
+		return fmt.Errorf("downloadUsers or downloadHtpasswd is required for downloadAuth")
+	}
+	for prefix, users := range conf.DownloadAuth {
+		if len(users) == 0 {
+			return fmt.Errorf("downloadAuth entry %q must list users or \"*\"", prefix)
+		}
+	}
+
+	if conf.UserUsageInterval > 0 && conf.UserUsageTopN < 0 {
+		return fmt.Errorf("userUsageTopN must not be negative")
+	}
+
+	if conf.MaxDownloads < 0 {
+		return fmt.Errorf("maxDownloads must not be negative")
+	}
+	for prefix, limit := range conf.PrefixMaxDownloads {
+		if limit < 0 {
+			return fmt.Errorf("prefixMaxDownloads entry %q must not be negative", prefix)
+		}
+	}
+
+	for _, window := range conf.MaintenanceWindows {
+		if !window.End.After(window.Start) {
+			return fmt.Errorf("maintenanceWindows entry starting at %s must end after its start", window.Start.Format(time.RFC3339))
+		}
+	}
+
+	for _, prefix := range conf.BurnAfterReading {
+		if strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("burnAfterReading entry %q must not be empty", prefix)
+		}
+	}
+
+	if conf.BanSyncInterval < 0 {
+		return fmt.Errorf("banSyncInterval must not be negative")
+	}
+	for _, pattern := range conf.HoneypotPaths {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("invalid honeypotPaths entry %q: must be a path or pattern starting with \"/\"", pattern)
+		}
+	}
+
+	tenants := make(map[string]string, len(conf.Tenants))
+	for key, tenant := range conf.Tenants {
+		if tenant == "" {
+			return fmt.Errorf("tenants entry %q must not be empty", key)
+		}
+		if strings.HasPrefix(key, "/") {
+			subtree := strings.Trim(path.Clean(key), "/")
+			if subtree == "" || strings.HasPrefix(subtree, ".") {
+				return fmt.Errorf("invalid tenants entry %q: must be a host name or a subtree of storeDir (\"/team-files\")", key)
+			}
+			tenants["/"+subtree] = tenant
+		} else if key == "" || strings.ContainsAny(key, "/:") {
+			return fmt.Errorf("invalid tenants entry %q: must be a host name or a subtree of storeDir (\"/team-files\")", key)
+		} else {
+			tenants[strings.ToLower(key)] = tenant
+		}
+	}
+	conf.Tenants = tenants
+
+	if conf.FailoverStoreDir != "" && conf.HealthCheckInterval <= 0 {
+		return fmt.Errorf("healthCheckInterval is required for failoverStoreDir")
+	}
+	if conf.HealthCheckInterval > 0 && conf.HealthCheckTimeout <= 0 {
+		return fmt.Errorf("healthCheckTimeout must be positive")
+	}
+
+	if conf.MetadataBackupDir != "" && (conf.MetadataBackupInterval <= 0 || conf.MetadataBackupKeep < 1) {
+		return fmt.Errorf("metadataBackupInterval and metadataBackupKeep must be positive")
+	}
+
+	if conf.AuditLogChain && conf.AuditLog == "" {
+		return fmt.Errorf("auditLog is required for auditLogChain")
+	}
+
+	if conf.CrowdsecURL != "" {
+		crowdsecURL, err := url.Parse(conf.CrowdsecURL)
+		if err != nil || (crowdsecURL.Scheme != "http" && crowdsecURL.Scheme != "https") {
+			return fmt.Errorf("invalid crowdsecURL %q: must be an http or https URL", conf.CrowdsecURL)
+		}
+		if conf.CrowdsecAPIKey == "" && conf.CrowdsecMachineID == "" {
+			return fmt.Errorf("crowdsecAPIKey and/or crowdsecMachineID is required for crowdsecURL")
+		}
+		if conf.CrowdsecMachineID != "" && (conf.CrowdsecPassword == "" || conf.CrowdsecMacFailures < 1) {
+			return fmt.Errorf("crowdsecPassword and a positive crowdsecMacFailures are required for crowdsecMachineID")
+		}
+	}
+
+	if conf.MirrorURL != "" {
+		mirrorURL, err := url.Parse(conf.MirrorURL)
+		if err != nil || (mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https" && mirrorURL.Scheme != "file") {
+			return fmt.Errorf("invalid mirrorURL %q: must be an http, https or file URL", conf.MirrorURL)
+		}
+	}
+
+	if conf.UpstreamURL != "" {
+		upstreamURL, err := url.Parse(conf.UpstreamURL)
+		if err != nil || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") || upstreamURL.Host == "" {
+			return fmt.Errorf("invalid upstreamURL %q: must be an http or https URL", conf.UpstreamURL)
+		}
+		if conf.ResumableUploads || conf.TusSubDir != "" {
+			return fmt.Errorf("resumableUploads and tusSubDir can't be used with upstreamURL")
+		}
+	}
+
+	if conf.XmppComponentAddress != "" && (conf.XmppComponentDomain == "" || conf.XmppComponentSecret == "") {
+		return fmt.Errorf("xmppComponentDomain and xmppComponentSecret are required for XMPP notifications")
+	}
+	if len(conf.HookCommand) > 0 && conf.HookConcurrency < 1 {
+		return fmt.Errorf("hookConcurrency must be positive")
+	}
+
+	for _, command := range conf.Plugins {
+		if len(command) == 0 || command[0] == "" {
+			return fmt.Errorf("plugins must not contain empty commands")
+		}
+	}
+	switch conf.PluginFailureMode {
+	case "reject", "accept":
+	default:
+		return fmt.Errorf("invalid pluginFailureMode %q: must be \"reject\" or \"accept\"", conf.PluginFailureMode)
+	}
+
+	if conf.MinFileSize < 0 {
+		return fmt.Errorf("minFileSize must not be negative")
+	}
+	if conf.ProgressLogSize < 0 {
+		return fmt.Errorf("progressLogSize must not be negative")
+	}
+	if conf.ProgressLogSize > 0 && conf.ProgressLogInterval <= 0 {
+		return fmt.Errorf("progressLogInterval must be positive")
+	}
+
+	sizeLimits := make(map[string]int64, len(conf.SizeLimits))
+	for key, limit := range conf.SizeLimits {
+		if !strings.HasPrefix(key, ".") && !strings.Contains(key, "/") {
+			return fmt.Errorf("invalid sizeLimits entry %q: must be an extension (\".mp4\") or content type (\"video/*\")", key)
+		}
+		sizeLimits[strings.ToLower(key)] = limit
+	}
+	conf.SizeLimits = sizeLimits
+
+	if conf.TusSubDir != "" && path.Join("/", conf.TusSubDir) == path.Join("/", conf.UploadSubDir) {
+		return fmt.Errorf("tusSubDir must differ from uploadSubDir")
+	}
+	subtrees := make(map[string]string, len(conf.UploadSubDirs))
+	for subDir, subtree := range conf.UploadSubDirs {
+		dir := path.Join("/", subDir)
+		if dir == "/" || dir == path.Join("/", conf.UploadSubDir) || (conf.TusSubDir != "" && dir == path.Join("/", conf.TusSubDir)) ||
+			(conf.ShortURLs && dir == path.Join("/", conf.ShortURLSubDir)) {
+			return fmt.Errorf("uploadSubDirs entry %q must differ from \"/\", uploadSubDir, tusSubDir and shortURLSubDir", subDir)
+		}
+		subtree = strings.Trim(path.Clean("/"+subtree), "/")
+		if strings.HasPrefix(subtree, ".") {
+			return fmt.Errorf("invalid uploadSubDirs entry %q: subtree must not start with \".\"", subDir)
+		}
+		subtrees[subDir] = subtree
+	}
+	conf.UploadSubDirs = subtrees
+
+	subDirMacVersions := make(map[string][]string, len(conf.SubDirMacVersions))
+	for subDir, versions := range conf.SubDirMacVersions {
+		dir := path.Join("/", subDir)
+		known := dir == path.Join("/", conf.UploadSubDir) || (conf.TusSubDir != "" && dir == path.Join("/", conf.TusSubDir))
+		for uploadSubDir := range conf.UploadSubDirs {
+			known = known || dir == path.Join("/", uploadSubDir)
+		}
+		if !known {
+			return fmt.Errorf("subDirMacVersions entry %q must be uploadSubDir, tusSubDir or in uploadSubDirs", subDir)
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("subDirMacVersions entry %q must not be empty", subDir)
+		}
+		if err := checkMacVersions("subDirMacVersions entry "+strconv.Quote(subDir), versions, conf.AllowV1); err != nil {
+			return err
+		}
+		subDirMacVersions[dir] = versions
+	}
+	conf.SubDirMacVersions = subDirMacVersions
+	if conf.ShortURLs {
+		shortDir := path.Join("/", conf.ShortURLSubDir)
+		if shortDir == "/" || shortDir == path.Join("/", conf.UploadSubDir) || (conf.TusSubDir != "" && shortDir == path.Join("/", conf.TusSubDir)) {
+			return fmt.Errorf("shortURLSubDir must differ from \"/\", uploadSubDir and tusSubDir")
+		}
+	}
+
+	switch conf.ClamdFailureMode {
+	case "reject", "accept":
+	default:
+		return fmt.Errorf("invalid clamdFailureMode %q: must be \"reject\" or \"accept\"", conf.ClamdFailureMode)
+	}
+
+	switch conf.ClamdInfectedAction {
+	case "reject", "quarantine":
+	default:
+		return fmt.Errorf("invalid clamdInfectedAction %q: must be \"reject\" or \"quarantine\"", conf.ClamdInfectedAction)
+	}
+
+	switch conf.HashDenylistAction {
+	case "reject", "quarantine":
+	default:
+		return fmt.Errorf("invalid hashDenylistAction %q: must be \"reject\" or \"quarantine\"", conf.HashDenylistAction)
+	}
+
+	switch conf.MimeMismatchPolicy {
+	case "allow", "warn", "reject":
+	default:
+		return fmt.Errorf("invalid mimeMismatchPolicy %q: must be \"allow\", \"warn\" or \"reject\"", conf.MimeMismatchPolicy)
+	}
+
+	for _, recompressType := range conf.RecompressTypes {
+		if recompressType != "image/jpeg" && recompressType != "image/png" {
+			return fmt.Errorf("invalid recompressTypes entry %q: only \"image/jpeg\" and \"image/png\" are supported", recompressType)
+		}
+	}
+
+	if conf.RecompressImages && (conf.RecompressMaxDimension < 1 || conf.RecompressQuality < 1 || conf.RecompressQuality > 100) {
+		return fmt.Errorf("recompressMaxDimension must be positive and recompressQuality between 1 and 100")
+	}
+	if conf.RecompressImages && conf.RecompressMaxPixels < 1 {
+		return fmt.Errorf("recompressMaxPixels must be positive")
+	}
+
+	switch conf.StorageLayout {
+	case "flat", "sharded":
+	default:
+		return fmt.Errorf("invalid storageLayout %q: must be \"flat\" or \"sharded\"", conf.StorageLayout)
+	}
+
+	switch conf.StorageBackend {
+	case "local":
+	case "s3":
+		if conf.S3Endpoint == "" || conf.S3Bucket == "" || conf.S3AccessKey == "" || conf.S3SecretKey == "" {
+			return fmt.Errorf("s3Endpoint, s3Bucket, s3AccessKey and s3SecretKey must be set for the S3 storage backend")
+		}
+		if conf.Deduplicate || conf.StorageLayout != "flat" || conf.DownloadOffload != "" {
+			return fmt.Errorf("deduplicate, storageLayout and downloadOffload are only supported by the local storage backend")
+		}
+		if conf.S3Timeout < 0 {
+			return fmt.Errorf("s3Timeout must not be negative")
+		}
+	default:
+		return fmt.Errorf("invalid storageBackend %q: must be \"local\" or \"s3\"", conf.StorageBackend)
+	}
+
+	switch conf.DownloadRedirect {
+	case "":
+	case "presigned":
+		if conf.StorageBackend != "s3" {
+			return fmt.Errorf("downloadRedirect \"presigned\" requires the S3 storage backend")
+		}
+	case "cdn":
+		if conf.DownloadRedirectPrefix == "" {
+			return fmt.Errorf("downloadRedirectPrefix must be set to the CDN URL")
+		}
+	default:
+		return fmt.Errorf("invalid downloadRedirect %q: must be \"presigned\" or \"cdn\"", conf.DownloadRedirect)
+	}
+
+	switch conf.DownloadOffload {
+	case "", "x-sendfile":
+	case "x-accel-redirect":
+		if !strings.HasPrefix(conf.DownloadOffloadPrefix, "/") {
+			return fmt.Errorf("downloadOffloadPrefix must be set to the internal nginx location, e.g. \"/internal-files/\"")
+		}
+	default:
+		return fmt.Errorf("invalid downloadOffload %q: must be \"x-accel-redirect\" or \"x-sendfile\"", conf.DownloadOffload)
+	}
+
+	if conf.CompressFiles && (conf.CompressionLevel < 1 || conf.CompressionLevel > 22) {
+		return fmt.Errorf("compressionLevel must be between 1 and 22")
+	}
+
+	if conf.QuarantineStatus != http.StatusUnavailableForLegalReasons && conf.QuarantineStatus != http.StatusNotFound {
+		return fmt.Errorf("invalid quarantineStatus %d: must be 451 or 404", conf.QuarantineStatus)
+	}
+
+	if conf.AdminListenPort != "" && conf.AdminToken == "" && conf.OidcIssuer == "" {
+		return fmt.Errorf("adminToken or oidcIssuer must be set to enable the admin API")
+	}
+	if conf.OidcIssuer != "" {
+		if conf.OidcClientID == "" || conf.OidcClientSecret == "" || conf.OidcRedirectURL == "" {
+			return fmt.Errorf("oidcClientID, oidcClientSecret and oidcRedirectURL must be set for OpenID Connect")
+		}
+		if len(conf.OidcAdmins) == 0 {
+			return fmt.Errorf("oidcAdmins must list the users allowed to log in")
+		}
+		if conf.OidcSessionDuration <= 0 {
+			return fmt.Errorf("oidcSessionDuration must be positive")
+		}
+	}
+
+	if conf.EncryptionKey != "" && conf.EncryptionKeyFile != "" {
+		return fmt.Errorf("only one of encryptionKey and encryptionKeyFile may be set")
+	}
+
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Addresses starting with "@" are sockets in the abstract namespace of
+ * Linux, which have no file and need no cleanup. They imply unixSocket.
+ */
+func checkAbstractSocket(setting string, address string, unixSocket *bool) error {
+	if !strings.HasPrefix(address, "@") {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("invalid %s %q: abstract unix sockets are only supported on Linux", setting, address)
+	}
+	*unixSocket = true
+	return nil
+}
+
+/*
+ * Checks a TCP address to listen on, e.g. "[::1]:5050". Empty addresses
+ * are checked by their users.
+ */
+func checkListenAddress(setting string, address string, unixSocket bool) error {
+	if address == "" || unixSocket {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %s, expecting e.g. \"[::1]:5050\"", setting, address, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid %s %q: %s", setting, address, err)
+	}
+	return nil
+}
+
+/*
+ * Checks a list of MAC parameters
+ */
+func checkMacVersions(setting string, versions []string, allowV1 bool) error {
+	for _, version := range versions {
+		switch version {
+		case "v2", "token":
+		case "v":
+			if !allowV1 {
+				return fmt.Errorf("%s must not contain \"v\" with allowV1 = false", setting)
+			}
+		default:
+			return fmt.Errorf("invalid %s: unknown MAC parameter %q, must be \"v2\", \"token\" or \"v\"", setting, version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	config, err := Load("../../config.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Secret != "mysecret" || config.UploadSubDir != "upload/" {
+		t.Errorf("settings missing: %+v", config)
+	}
+	if config.ChunkedUploads != "reject" || config.MinFileSize != 1 {
+		t.Errorf("defaults missing: %+v", config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("example config is invalid: %s", err)
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Errorf("missing config file accepted")
+	}
+}
+
+func TestPresets(t *testing.T) {
+	dir := t.TempDir()
+	load := func(content string) Config {
+		filename := filepath.Join(dir, "config.toml")
+		os.WriteFile(filename, []byte(content), 0644)
+		config, err := Load(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	if config := load(`serverType = "ejabberd"`); config.MacPathEncoding != "escaped" {
+		t.Errorf("preset not applied: %s", config.MacPathEncoding)
+	}
+	if config := load("serverType = \"ejabberd\"\nmacPathEncoding = \"both\""); config.MacPathEncoding != "both" {
+		t.Errorf("explicit setting overridden: %s", config.MacPathEncoding)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, modify := range map[string]func(*Config){
+		"serverType":      func(c *Config) { c.ServerType = "openfire" },
+		"chunkedUploads":  func(c *Config) { c.ChunkedUploads = "maybe" },
+		"conflictPolicy":  func(c *Config) { c.ConflictPolicy = "rename" },
+		"allowV1":         func(c *Config) { c.ServerType, c.AllowV1 = "ejabberd", false },
+		"weakSecrets":     func(c *Config) { c.WeakSecrets = "ignore" },
+		"insecurePerms":   func(c *Config) { c.InsecurePermissions = "fix" },
+		"healthTimeout":   func(c *Config) { c.HealthCheckTimeout = 0 },
+		"uploadLocking":   func(c *Config) { c.UploadLocking = "mutex" },
+		"fallbackDirs":    func(c *Config) { c.FallbackStoreDirs = []string{"/srv/old", ""} },
+		"listenPort":      func(c *Config) { c.ListenPort = "5050" },
+		"adminListenPort": func(c *Config) { c.AdminListenPort = "[::1]:http-alt-nonexistent" },
+		"minFreeSpace":    func(c *Config) { c.MinFreeSpace = -1 },
+		"macVersions":     func(c *Config) { c.MacVersions = []string{"v3"} },
+		"macVersions v":   func(c *Config) { c.MacVersions, c.AllowV1 = []string{"v2", "v"}, false },
+		"subDirMacVersions": func(c *Config) {
+			c.SubDirMacVersions = map[string][]string{"other/": {"v2"}}
+		},
+		"sizeLimits":     func(c *Config) { c.SizeLimits = map[string]int64{"mp4": 1} },
+		"tusSubDir":      func(c *Config) { c.UploadSubDir, c.TusSubDir = "upload/", "/upload" },
+		"storageBackend": func(c *Config) { c.StorageBackend = "s3" },
+		"adminToken":     func(c *Config) { c.AdminListenPort = "[::1]:5051" },
+		"oidcClientID":   func(c *Config) { c.OidcIssuer = "https://sso.example.com" },
+		"oidcAdmins": func(c *Config) {
+			c.OidcIssuer, c.OidcClientID, c.OidcClientSecret = "https://sso.example.com", "filer", "secret"
+			c.OidcRedirectURL = "https://admin.example.com/oidc/callback"
+		},
+		"compressionLevel":  func(c *Config) { c.CompressFiles, c.CompressionLevel = true, 23 },
+		"quarantineStatus":  func(c *Config) { c.QuarantineStatus = 403 },
+		"plugins":           func(c *Config) { c.Plugins = [][]string{{}} },
+		"pluginFailureMode": func(c *Config) { c.PluginFailureMode = "ignore" },
+		"middleware":        func(c *Config) { c.Middleware = []string{"log", "gzip"} },
+		"middleware twice":  func(c *Config) { c.Middleware = []string{"cors", "cors"} },
+		"rateLimit":         func(c *Config) { c.RateLimit = -1 },
+		"rateLimitBurst":    func(c *Config) { c.RateLimit, c.RateLimitBurst = 10, 0 },
+		"downloadUsers":     func(c *Config) { c.DownloadAuth = map[string][]string{"/": {"*"}} },
+		"mirrorURL":         func(c *Config) { c.MirrorURL = "ftp://standby.example.com/" },
+		"uploadSubDirs":     func(c *Config) { c.UploadSubDirs = map[string]string{"files/": ".prosody-filer"} },
+		"uploadSubDirs /":   func(c *Config) { c.UploadSubDirs = map[string]string{"/": ""} },
+		"failoverStoreDir":  func(c *Config) { c.FailoverStoreDir, c.HealthCheckInterval = "/mnt/failover", 0 },
+		"progressLog":       func(c *Config) { c.ProgressLogInterval = 0 },
+		"tenants":           func(c *Config) { c.Tenants = map[string]string{"chat.example.com": ""} },
+		"tenants port":      func(c *Config) { c.Tenants = map[string]string{"chat.example.com:443": "example"} },
+		"tenants /":         func(c *Config) { c.Tenants = map[string]string{"/": "example"} },
+		"honeypotPaths":     func(c *Config) { c.HoneypotPaths = []string{".env"} },
+		"maxDownloads":      func(c *Config) { c.PrefixMaxDownloads = map[string]int64{"public/": -1} },
+		"burnAfterReading":  func(c *Config) { c.BurnAfterReading = []string{"/"} },
+		"chunked unlimited": func(c *Config) { c.ChunkedUploads = "verify" },
+		"gzipUploads":       func(c *Config) { c.GzipUploads = true },
+		"recompress pixels": func(c *Config) { c.RecompressImages, c.RecompressMaxPixels = true, 0 },
+		"maintenanceWindows": func(c *Config) {
+			c.MaintenanceWindows = []MaintenanceWindow{{Start: time.Unix(7200, 0), End: time.Unix(3600, 0)}}
+		},
+		"honeypotPaths [": func(c *Config) { c.HoneypotPaths = []string{"/upload/[.php"} },
+		"downloadAuth": func(c *Config) {
+			c.DownloadAuth, c.DownloadUsers = map[string][]string{"team/": {}}, map[string]string{"alice": "secret"}
+		},
+	} {
+		config := Default()
+		modify(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: invalid setting accepted", name)
+		}
+	}
+
+	config := Default()
+	config.ListenPort = "@prosody-filer"
+	err := config.Validate()
+	if runtime.GOOS == "linux" && (err != nil || !config.UnixSocket) {
+		t.Errorf("abstract socket not accepted as unix socket: %v", err)
+	} else if runtime.GOOS != "linux" && err == nil {
+		t.Errorf("abstract socket accepted on %s", runtime.GOOS)
+	}
+
+	for subDir, want := range map[string]string{"upload": "upload/", "/files//upload/": "files/upload/", "/": ""} {
+		config = Default()
+		config.UploadSubDir = subDir
+		if err := config.Validate(); err != nil || config.UploadSubDir != want {
+			t.Errorf("uploadSubDir %q: got %q want %q (%v)", subDir, config.UploadSubDir, want, err)
+		}
+	}
+
+	config = Default()
+	config.SizeLimits = map[string]int64{".MP4": 1, "Video/*": 2}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.SizeLimits[".mp4"] != 1 || config.SizeLimits["video/*"] != 2 {
+		t.Errorf("sizeLimits keys not normalized: %v", config.SizeLimits)
+	}
+
+	config = Default()
+	config.Tenants = map[string]string{"Chat.Example.com": "example", "/team-files/": "team"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Tenants["chat.example.com"] != "example" || config.Tenants["/team-files"] != "team" {
+		t.Errorf("tenants keys not normalized: %v", config.Tenants)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build go1.24
+// +build go1.24
+
+package httpserver
+
+import (
+	"net"
+	"net/http"
+)
+
+/*
+ * Serves HTTP/1.1 and HTTP/2 with prior knowledge over cleartext
+ */
+func serveH2C(listener net.Listener, handler http.Handler) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := &http.Server{Handler: handler, Protocols: protocols}
+	return server.Serve(listener)
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+// +build !go1.24
+
+package httpserver
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+func serveH2C(listener net.Listener, handler http.Handler) error {
+	return errors.New("h2c requires a build with Go 1.24 or later")
+}
@@ -0,0 +1,43 @@
+//go:build go1.24
+// +build go1.24
+
+package httpserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestServeH2C(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), "h2c")
+
+	// HTTP/2 with prior knowledge, like reverse proxies
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s want HTTP/2", resp.Proto)
+	}
+
+	// HTTP/1.1 still works
+	resp, err = http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("got %s want HTTP/1.1", resp.Proto)
+	}
+}
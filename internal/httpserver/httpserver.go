@@ -0,0 +1,75 @@
+/*
+ * Package httpserver contains the plumbing of the standalone server:
+ * listening on TCP ports or unix sockets, speaking HTTP, h2c or FastCGI,
+ * reloading on SIGHUP and dumping stats on SIGUSR1.
+ */
+
+package httpserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+ * Listens on a TCP address like "[::]:5050", or on a unix socket path if
+ * unixSocket is set
+ */
+func Listen(address string, unixSocket bool) (net.Listener, error) {
+	proto := "tcp"
+	if unixSocket {
+		proto = "unix"
+	}
+	return net.Listen(proto, address)
+}
+
+/*
+ * Serves requests on listener with handler, speaking protocol: "http",
+ * "h2c" (HTTP/2 without TLS, for reverse proxies multiplexing requests) or
+ * "fcgi" (FastCGI, for web servers like Apache or lighttpd)
+ */
+func Serve(listener net.Listener, handler http.Handler, protocol string) error {
+	switch protocol {
+	case "fcgi":
+		return fcgi.Serve(listener, handler)
+	case "h2c":
+		return serveH2C(listener, handler)
+	}
+	return http.Serve(listener, handler)
+}
+
+/*
+ * Calls reload for every SIGHUP received, until stop is called
+ */
+func OnReload(reload func()) (stop func()) {
+	return onSignal(syscall.SIGHUP, reload)
+}
+
+/*
+ * Calls handler for every sig received, until stop is called
+ */
+func onSignal(sig os.Signal, handler func()) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				handler()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
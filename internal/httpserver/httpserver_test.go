@@ -0,0 +1,115 @@
+package httpserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListen(t *testing.T) {
+	listener, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener.Addr().Network() != "tcp" {
+		t.Errorf("got %s want tcp", listener.Addr().Network())
+	}
+	listener.Close()
+
+	socket := filepath.Join(t.TempDir(), "filer.sock")
+	listener, err = Listen(socket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listener.Addr().Network() != "unix" || listener.Addr().String() != socket {
+		t.Errorf("got %s %s", listener.Addr().Network(), listener.Addr())
+	}
+	listener.Close()
+
+	// Abstract sockets leave no file behind
+	if runtime.GOOS == "linux" {
+		listener, err = Listen("@prosody-filer-test", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("unix", "@prosody-filer-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+/*
+ * A FastCGI listener answers management records
+ */
+func TestServeFastCGI(t *testing.T) {
+	listener, err := Listen(filepath.Join(t.TempDir(), "filer.sock"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go Serve(listener, http.NotFoundHandler(), "fcgi")
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// FCGI_GET_VALUES asking for FCGI_MPXS_CONNS
+	name := "FCGI_MPXS_CONNS"
+	content := append([]byte{byte(len(name)), 0}, name...)
+	record := append([]byte{1, 9, 0, 0, 0, byte(len(content)), 0, 0}, content...)
+	if _, err := conn.Write(record); err != nil {
+		t.Fatal(err)
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	// FCGI_GET_VALUES_RESULT
+	if header[0] != 1 || header[1] != 10 {
+		t.Errorf("unexpected FastCGI record: %v", header)
+	}
+	body := make([]byte, int(header[4])<<8|int(header[5]))
+	io.ReadFull(conn, body)
+	if !bytes.Contains(body, []byte(name)) {
+		t.Errorf("FCGI_MPXS_CONNS missing in %q", body)
+	}
+}
+
+func TestOnReload(t *testing.T) {
+	reloaded := make(chan bool, 1)
+	stop := OnReload(func() { reloaded <- true })
+	defer stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Errorf("not reloaded on SIGHUP")
+	}
+}
+
+func TestOnStatsRequest(t *testing.T) {
+	dumped := make(chan bool, 1)
+	stop := OnStatsRequest(func() { dumped <- true })
+	defer stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	select {
+	case <-dumped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("stats not dumped on SIGUSR1")
+	}
+}
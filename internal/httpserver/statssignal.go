@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package httpserver
+
+import "syscall"
+
+/*
+ * Calls dump for every SIGUSR1 received, until stop is called
+ */
+func OnStatsRequest(dump func()) (stop func()) {
+	return onSignal(syscall.SIGUSR1, dump)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package httpserver
+
+/*
+ * There is no SIGUSR1 on Windows
+ */
+func OnStatsRequest(dump func()) (stop func()) {
+	return func() {}
+}
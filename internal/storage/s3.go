@@ -0,0 +1,489 @@
+/*
+ * S3 storage backend
+ * Stores files as objects in an S3 compatible object store (AWS S3, MinIO,
+ * Ceph RGW, ...). Requests are signed with AWS Signature Version 4.
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+/*
+ * Settings of an S3 bucket
+ */
+type S3Config struct {
+	// e.g. "https://s3.eu-central-1.amazonaws.com"
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Bucket in the path instead of the host name, required by MinIO and some other S3 compatible stores
+	PathStyle bool
+	// Maximum duration of a request, including the transfer of its body (0 = unlimited)
+	Timeout time.Duration
+}
+
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3Endpoint %q", config.Endpoint)
+	}
+
+	return &S3{
+		endpoint:  endpoint,
+		region:    config.Region,
+		bucket:    config.Bucket,
+		prefix:    config.Prefix,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		pathStyle: config.PathStyle,
+		client:    &http.Client{Timeout: config.Timeout},
+	}, nil
+}
+
+/*
+ * Returns the URL of the object holding a file
+ */
+func (s *S3) objectURL(fileStorePath string) *url.URL {
+	objectURL := *s.endpoint
+	key := s.prefix + fileStorePath
+
+	if s.pathStyle {
+		objectURL.Path = path.Join("/", s.endpoint.Path, s.bucket, key)
+	} else {
+		objectURL.Host = s.bucket + "." + s.endpoint.Host
+		objectURL.Path = path.Join("/", s.endpoint.Path, key)
+	}
+	objectURL.RawPath = s3Escape(objectURL.Path, true)
+
+	return &objectURL
+}
+
+/*
+ * URI encoding as required for signing: everything but unreserved
+ * characters is percent encoded
+ */
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && keepSlash {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+ * Calculates the signature of a canonical request. Returns the credential
+ * scope and the signature.
+ */
+func (s *S3) signature(canonicalRequest string, t time.Time) (string, string) {
+	date := t.UTC().Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.UTC().Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+/*
+ * Signs a request, including all headers set so far
+ */
+func (s *S3) sign(req *http.Request, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope, signature := s.signature(canonicalRequest, t)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+/*
+ * Returns a presigned URL for downloading a file, valid for expiry
+ */
+func (s *S3) Presign(fileStorePath string, expiry time.Duration) (string, error) {
+	return s.presignAt(fileStorePath, expiry, time.Now()), nil
+}
+
+func (s *S3) presignAt(fileStorePath string, expiry time.Duration, t time.Time) string {
+	objectURL := s.objectURL(fileStorePath)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+t.UTC().Format("20060102")+"/"+s.region+"/s3/aws4_request")
+	query.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expiry/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		objectURL.EscapedPath(),
+		s3CanonicalQuery(query),
+		"host:" + objectURL.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	_, signature := s.signature(canonicalRequest, t)
+	objectURL.RawQuery = s3CanonicalQuery(query) + "&X-Amz-Signature=" + signature
+
+	return objectURL.String()
+}
+
+/*
+ * Sends a signed request for an object
+ */
+func (s *S3) request(method string, fileStorePath string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(fileStorePath).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	s.sign(req, s3UnsignedPayload, time.Now())
+	return s.client.Do(req)
+}
+
+/*
+ * Returns an error describing a failed request
+ */
+func s3Error(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request failed: %s %s", resp.Status, strings.TrimSpace(string(message)))
+}
+
+func (s *S3) Commit(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	file, err := os.Open(tmpFilename)
+	if err != nil {
+		return false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	// Never replace existing objects
+	resp, err := s.request(http.MethodPut, fileStorePath, file, info.Size(), http.Header{"If-None-Match": {"*"}})
+	if err != nil {
+		return false, fmt.Errorf("failed to upload %s to S3: %s", fileStorePath, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return false, ErrExists
+	default:
+		return false, s3Error(resp)
+	}
+}
+
+/*
+ * Uploads to S3 replace existing objects atomically
+ */
+func (s *S3) Replace(tmpFilename string, fileStorePath string, hash string) (bool, error) {
+	file, err := os.Open(tmpFilename)
+	if err != nil {
+		return false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	resp, err := s.request(http.MethodPut, fileStorePath, file, info.Size(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to upload %s to S3: %s", fileStorePath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, s3Error(resp)
+	}
+	return false, nil
+}
+
+/*
+ * Returns size and modification time of an object
+ */
+func (s *S3) Stat(fileStorePath string) (int64, time.Time, error) {
+	resp, err := s.request(http.MethodHead, fileStorePath, nil, 0, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, time.Time{}, os.ErrNotExist
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, s3Error(resp)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (s *S3) Exists(fileStorePath string) (bool, error) {
+	_, _, err := s.Stat(fileStorePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/*
+ * Checks that the bucket is reachable with the configured credentials
+ */
+func (s *S3) CheckHealth() error {
+	bucketURL := *s.endpoint
+	if s.pathStyle {
+		bucketURL.Path = path.Join("/", s.endpoint.Path, s.bucket)
+	} else {
+		bucketURL.Host = s.bucket + "." + s.endpoint.Host
+		bucketURL.Path = path.Join("/", s.endpoint.Path)
+	}
+	bucketURL.RawPath = s3Escape(bucketURL.Path, true)
+
+	req, err := http.NewRequest(http.MethodHead, bucketURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, s3UnsignedPayload, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) Delete(fileStorePath string) error {
+	// S3 doesn't tell whether the object existed
+	if _, _, err := s.Stat(fileStorePath); err != nil {
+		return err
+	}
+
+	resp, err := s.request(http.MethodDelete, fileStorePath, nil, 0, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %s", fileStorePath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) Open(fileStorePath string) (File, error) {
+	size, modTime, err := s.Stat(fileStorePath)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{backend: s, fileStorePath: fileStorePath, size: size, modTime: modTime}, nil
+}
+
+/*
+ * An object opened for reading. Content is streamed with ranged GET
+ * requests; a new request is only needed when reading does not continue
+ * where the previous read ended. Not safe for concurrent use.
+ */
+type s3Object struct {
+	backend       *S3
+	fileStorePath string
+	size          int64
+	modTime       time.Time
+	pos           int64
+
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+func (o *s3Object) ModTime() time.Time {
+	return o.modTime
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	n, err := o.ReadAt(p, o.pos)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil || o.bodyPos != off {
+		o.closeBody()
+
+		resp, err := o.backend.request(http.MethodGet, o.fileStorePath, nil, 0, http.Header{"Range": {"bytes=" + strconv.FormatInt(off, 10) + "-"}})
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && off == 0) {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body, o.bodyPos = resp.Body, off
+	}
+
+	atEnd := false
+	if remaining := o.size - off; int64(len(p)) >= remaining {
+		p = p[:remaining]
+		atEnd = true
+	}
+
+	n, err := io.ReadFull(o.body, p)
+	o.bodyPos += int64(n)
+	if err != nil {
+		o.closeBody()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	} else if atEnd {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *s3Object) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
+
+func (o *s3Object) Close() error {
+	o.closeBody()
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Package s3test provides a minimal S3 server for tests, keeping objects
+ * in memory
+ */
+
+package s3test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	mutex   sync.Mutex
+	Objects map[string][]byte
+
+	// Number of GET requests
+	Gets int
+
+	// Fail all requests, like an unreachable store
+	Down bool
+}
+
+func NewServer() *Server {
+	return &Server{Objects: make(map[string][]byte)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") && r.URL.Query().Get("X-Amz-Signature") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Down {
+		http.Error(w, "ServiceUnavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	// HEAD bucket
+	if r.Method == http.MethodHead && !strings.Contains(strings.Trim(r.URL.Path, "/"), "/") {
+		return
+	}
+	object, exists := s.Objects[r.URL.Path]
+
+	switch r.Method {
+	case http.MethodPut:
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			http.Error(w, "PreconditionFailed", http.StatusPreconditionFailed)
+			return
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		s.Objects[r.URL.Path] = body.Bytes()
+	case http.MethodGet, http.MethodHead:
+		if r.Method == http.MethodGet {
+			s.Gets++
+		}
+		if !exists {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(object))
+	case http.MethodDelete:
+		delete(s.Objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
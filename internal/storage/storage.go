@@ -0,0 +1,102 @@
+/*
+ * Package storage defines the interface of storage backends, which keep
+ * the stored files: files in StoreDir (implemented by the filer, as it
+ * depends on the storage layout) or objects in an S3 compatible object
+ * store.
+ */
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrExists      = errors.New("file exists")
+	ErrIsDirectory = errors.New("is a directory")
+)
+
+/*
+ * A stored file opened for reading its raw (possibly encoded) contents
+ */
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Size() int64
+	ModTime() time.Time
+}
+
+type Backend interface {
+	// Stores a completely received upload. Fails with ErrExists if
+	// fileStorePath exists already. Returns true if the upload has been
+	// deduplicated.
+	Commit(tmpFilename string, fileStorePath string, hash string) (bool, error)
+
+	// Stores a completely received upload like Commit, but atomically
+	// replaces the file at fileStorePath if there is one: it can be read
+	// until the new one takes its place, and is kept if storing fails.
+	Replace(tmpFilename string, fileStorePath string, hash string) (bool, error)
+
+	// Opens a stored file. Fails with an error satisfying os.IsNotExist if
+	// it does not exist.
+	Open(fileStorePath string) (File, error)
+
+	Exists(fileStorePath string) (bool, error)
+
+	// Removes a stored file. Fails with an error satisfying os.IsNotExist if
+	// it does not exist.
+	Delete(fileStorePath string) error
+}
+
+/*
+ * Backends which can hand out time-limited URLs for downloading files directly
+ */
+type Presigner interface {
+	Presign(fileStorePath string, expiry time.Duration) (string, error)
+}
+
+/*
+ * Backends which can tell whether they are working, e.g. by sending a
+ * request to a remote store
+ */
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+/*
+ * A file on the local filesystem
+ */
+type LocalFile struct {
+	*os.File
+	info os.FileInfo
+}
+
+func OpenLocalFile(absFilename string) (*LocalFile, error) {
+	file, err := os.Open(absFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	} else if info.IsDir() {
+		file.Close()
+		return nil, ErrIsDirectory
+	}
+
+	return &LocalFile{File: file, info: info}, nil
+}
+
+func (f *LocalFile) Size() int64 {
+	return f.info.Size()
+}
+
+func (f *LocalFile) ModTime() time.Time {
+	return f.info.ModTime()
+}
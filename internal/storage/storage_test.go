@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLocalFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file.txt")
+	os.WriteFile(filename, []byte("hello"), 0644)
+
+	file, err := OpenLocalFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if file.Size() != 5 {
+		t.Errorf("got size %d want 5", file.Size())
+	}
+
+	if _, err := OpenLocalFile(dir); err != ErrIsDirectory {
+		t.Errorf("got %v want %v", err, ErrIsDirectory)
+	}
+	if _, err := OpenLocalFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("got %v want not exist", err)
+	}
+}